@@ -0,0 +1,129 @@
+package api
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"jwt_refresher/database"
+	"jwt_refresher/models"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// API Key格式: jrk_<随机串>，前缀用于在列表中识别
+const apiKeyPrefix = "jrk_"
+
+type APIKeyHandler struct {
+	db *database.DB
+}
+
+func NewAPIKeyHandler(db *database.DB) *APIKeyHandler {
+	return &APIKeyHandler{db: db}
+}
+
+type createAPIKeyRequest struct {
+	Name          string   `json:"name" binding:"required"`
+	AllProjects   bool     `json:"all_projects"`
+	ProjectIDs    []int64  `json:"project_ids"`
+	Scopes        []string `json:"scopes" binding:"required"`
+	ExpiresInDays int      `json:"expires_in_days"`
+}
+
+// GetAllAPIKeys 获取所有API Key（不包含密钥本身）
+func (h *APIKeyHandler) GetAllAPIKeys(c *gin.Context) {
+	keys, err := h.db.GetAllAPIKeys(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, keys)
+}
+
+// CreateAPIKey 创建API Key，明文密钥只在此响应中返回一次
+func (h *APIKeyHandler) CreateAPIKey(c *gin.Context) {
+	var req createAPIKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if len(req.Scopes) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "At least one scope is required"})
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !slices.Contains(models.ValidScopes, scope) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown scope: " + scope})
+			return
+		}
+	}
+	if !req.AllProjects && len(req.ProjectIDs) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "project_ids is required unless all_projects is set"})
+		return
+	}
+
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate key"})
+		return
+	}
+	secret := apiKeyPrefix + base64.RawURLEncoding.EncodeToString(random)
+
+	key := &models.APIKey{
+		Name:        req.Name,
+		Prefix:      secret[:len(apiKeyPrefix)+8],
+		KeyHash:     hashAPIKey(secret),
+		AllProjects: req.AllProjects,
+		ProjectIDs:  req.ProjectIDs,
+		Scopes:      req.Scopes,
+	}
+	if req.ExpiresInDays > 0 {
+		key.ExpiresAt = sql.NullTime{Time: time.Now().AddDate(0, 0, req.ExpiresInDays), Valid: true}
+	}
+
+	if err := h.db.CreateAPIKey(c.Request.Context(), key); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"key":     secret,
+		"api_key": key,
+	})
+}
+
+// RevokeAPIKey 撤销API Key
+func (h *APIKeyHandler) RevokeAPIKey(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid API key ID"})
+		return
+	}
+
+	if err := h.db.RevokeAPIKey(c.Request.Context(), id); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "API key revoked successfully"})
+}
+
+// DeleteAPIKey 删除API Key
+func (h *APIKeyHandler) DeleteAPIKey(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid API key ID"})
+		return
+	}
+
+	if err := h.db.DeleteAPIKey(c.Request.Context(), id); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "API key deleted successfully"})
+}
@@ -1,15 +1,47 @@
 package api
 
 import (
+	"crypto/sha256"
 	"crypto/subtle"
+	"encoding/hex"
+	"jwt_refresher/database"
+	"jwt_refresher/models"
+	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
+const apiKeyContextKey = "api_key"
+
+// apiKeyTouchInterval 距上次记录不到这个时间时不更新API Key的最后使用时间，避免每个请求都写数据库
+const apiKeyTouchInterval = time.Minute
+
 // BasicAuthMiddleware creates a middleware that requires Basic Auth
-func BasicAuthMiddleware(username, password string) gin.HandlerFunc {
+// or a bearer API key. Requests authenticated with an API key are only
+// allowed through routes guarded by RequireScope.
+func BasicAuthMiddleware(db *database.DB, username, password string) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		if token, ok := bearerToken(c.GetHeader("Authorization")); ok {
+			key, err := db.GetAPIKeyByHash(c.Request.Context(), hashAPIKey(token))
+			if err != nil || !key.Active(time.Now()) {
+				c.Header("WWW-Authenticate", `Bearer realm="JWT Refresher"`)
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired API key"})
+				return
+			}
+			if !key.LastUsedAt.Valid || time.Since(key.LastUsedAt.Time) >= apiKeyTouchInterval {
+				if err := db.TouchAPIKey(c.Request.Context(), key.ID); err != nil {
+					log.Printf("Warning: %v", err)
+				}
+			}
+			c.Set(apiKeyContextKey, key)
+			c.Next()
+			return
+		}
+
 		user, pass, hasAuth := c.Request.BasicAuth()
 
 		if !hasAuth {
@@ -31,3 +63,70 @@ func BasicAuthMiddleware(username, password string) gin.HandlerFunc {
 		c.Next()
 	}
 }
+
+// RequireAdmin rejects requests authenticated with an API key
+func RequireAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if apiKeyFromContext(c) != nil {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "API keys cannot access this endpoint"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// RequireScope lets API keys through when they hold the scope and are
+// allowed to access the project in the :id route parameter.
+// Admin (Basic Auth) requests always pass.
+func RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := apiKeyFromContext(c)
+		if key == nil {
+			c.Next()
+			return
+		}
+
+		if !key.HasScope(scope) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "API key lacks scope " + scope})
+			return
+		}
+		if idParam := c.Param("id"); idParam != "" {
+			id, err := strconv.ParseInt(idParam, 10, 64)
+			if err != nil || !key.AllowsProject(id) {
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "API key is not allowed to access this project"})
+				return
+			}
+		}
+		c.Next()
+	}
+}
+
+// canReadRefreshToken reports whether the caller may see refresh tokens:
+// admins always can, API keys need the token:read_refresh scope
+func canReadRefreshToken(c *gin.Context) bool {
+	key := apiKeyFromContext(c)
+	return key == nil || key.HasScope(models.ScopeTokenReadRefresh)
+}
+
+// apiKeyFromContext returns the API key that authenticated the request, if any
+func apiKeyFromContext(c *gin.Context) *models.APIKey {
+	if v, ok := c.Get(apiKeyContextKey); ok {
+		if key, ok := v.(*models.APIKey); ok {
+			return key
+		}
+	}
+	return nil
+}
+
+func bearerToken(header string) (string, bool) {
+	const prefix = "Bearer "
+	if len(header) <= len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", false
+	}
+	return strings.TrimSpace(header[len(prefix):]), true
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
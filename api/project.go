@@ -1,31 +1,43 @@
 package api
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"jwt_refresher/database"
 	"jwt_refresher/models"
 	"jwt_refresher/refresher"
+	"jwt_refresher/scheduler"
+	"log"
 	"net/http"
+	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 )
 
 type ProjectHandler struct {
-	db     *database.DB
-	engine *refresher.Engine
+	db        *database.DB
+	engine    *refresher.Engine
+	scheduler *scheduler.Scheduler
 }
 
-func NewProjectHandler(db *database.DB, engine *refresher.Engine) *ProjectHandler {
-	return &ProjectHandler{db: db, engine: engine}
+func NewProjectHandler(db *database.DB, engine *refresher.Engine, sched *scheduler.Scheduler) *ProjectHandler {
+	return &ProjectHandler{db: db, engine: engine, scheduler: sched}
 }
 
 // GetAllProjects 获取所有项目
 func (h *ProjectHandler) GetAllProjects(c *gin.Context) {
-	projects, err := h.db.GetAllProjects()
+	projects, err := h.db.GetAllProjects(c.Request.Context())
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	for _, project := range projects {
+		project.Refreshing = h.engine.IsRefreshing(project.ID)
+	}
 	c.JSON(http.StatusOK, projects)
 }
 
@@ -37,12 +49,14 @@ func (h *ProjectHandler) GetProject(c *gin.Context) {
 		return
 	}
 
-	project, err := h.db.GetProject(id)
+	project, err := h.db.GetProject(c.Request.Context(), id)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
 		return
 	}
+	project.Refreshing = h.engine.IsRefreshing(id)
 
+	c.Header("ETag", projectETag(project))
 	c.JSON(http.StatusOK, project)
 }
 
@@ -54,19 +68,19 @@ func (h *ProjectHandler) CreateProject(c *gin.Context) {
 		return
 	}
 
-	// 设置默认值
-	if project.RefreshMethod == "" {
-		project.RefreshMethod = "POST"
-	}
-	if project.RefreshBeforeSeconds == 0 {
-		project.RefreshBeforeSeconds = 300
-	}
+	applyProjectDefaults(&project)
 	project.Enabled = true
 
-	if err := h.db.CreateProject(&project); err != nil {
+	if errs := validateProject(&project); len(errs) > 0 {
+		respondValidationErrors(c, "project", errs)
+		return
+	}
+
+	if err := h.db.CreateProject(c.Request.Context(), &project); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	h.scheduler.Reschedule(project.ID)
 
 	c.JSON(http.StatusCreated, project)
 }
@@ -85,12 +99,237 @@ func (h *ProjectHandler) UpdateProject(c *gin.Context) {
 		return
 	}
 
+	existing, err := h.db.GetProject(c.Request.Context(), id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
+		return
+	}
+	expectedVersion, ok := checkIfMatch(c, existing)
+	if !ok {
+		return
+	}
+
+	applyProjectDefaults(&project)
+	if errs := validateProject(&project); len(errs) > 0 {
+		respondValidationErrors(c, "project", errs)
+		return
+	}
+
+	// 请求中的refresh token为空或未提供时保留原值，access token等运行状态不随配置替换
 	project.ID = id
-	if err := h.db.UpdateProject(&project); err != nil {
+	if err := h.db.UpdateProject(c.Request.Context(), &project, expectedVersion); err != nil {
+		respondUpdateError(c, err)
+		return
+	}
+	h.engine.EvictTransport(id)
+
+	// 提供了新的refresh token时解除needs_reauth状态
+	if existing.LastRefreshStatus == models.StatusNeedsReauth &&
+		project.CurrentRefreshToken != "" && project.CurrentRefreshToken != existing.CurrentRefreshToken {
+		if err := h.db.Reauthorize(c.Request.Context(), id, project.CurrentRefreshToken); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		h.publishStatus(c, id)
+	}
+	h.scheduler.Reschedule(id)
+
+	h.respondUpdated(c, id)
+}
+
+// PatchProject 按JSON merge-patch (RFC 7386) 部分更新项目，只修改请求中出现的字段，
+// 未出现的字段（包括refresh token）保持不变，null表示清空该字段
+func (h *ProjectHandler) PatchProject(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid project ID"})
+		return
+	}
+
+	var patch map[string]json.RawMessage
+	if err := c.ShouldBindJSON(&patch); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	existing, err := h.db.GetProject(c.Request.Context(), id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
+		return
+	}
+	expectedVersion, ok := checkIfMatch(c, existing)
+	if !ok {
+		return
+	}
+
+	errs := FieldErrors{}
+	columns := make([]string, 0, len(patch))
+	for field := range patch {
+		if !database.IsPatchableColumn(field) {
+			errs.add(field, "field cannot be modified")
+			continue
+		}
+		columns = append(columns, field)
+	}
+	if len(errs) > 0 {
+		respondValidationErrors(c, "project", errs)
+		return
+	}
+	sort.Strings(columns)
+
+	project, err := mergePatch(existing, patch)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if errs := validateProject(project); len(errs) > 0 {
+		respondValidationErrors(c, "project", errs)
+		return
+	}
+
+	if len(columns) > 0 {
+		if err := h.db.PatchProject(c.Request.Context(), project, columns, expectedVersion); err != nil {
+			respondUpdateError(c, err)
+			return
+		}
+		h.engine.EvictTransport(id)
+	}
+
+	// 提供了新的refresh token时解除needs_reauth状态
+	if existing.LastRefreshStatus == models.StatusNeedsReauth &&
+		project.CurrentRefreshToken != "" && project.CurrentRefreshToken != existing.CurrentRefreshToken {
+		if err := h.db.Reauthorize(c.Request.Context(), id, project.CurrentRefreshToken); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		h.publishStatus(c, id)
+	}
+	h.scheduler.Reschedule(id)
+
+	h.respondUpdated(c, id)
+}
+
+// mergePatch 把merge-patch应用到项目的JSON表示上，返回修改后的项目
+func mergePatch(project *models.Project, patch map[string]json.RawMessage) (*models.Project, error) {
+	data, err := json.Marshal(project)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	for field, value := range patch {
+		if string(value) == "null" {
+			delete(doc, field)
+		} else {
+			doc[field] = mergeField(doc[field], value)
+		}
+	}
+
+	if data, err = json.Marshal(doc); err != nil {
+		return nil, err
+	}
+	merged := &models.Project{}
+	if err := json.Unmarshal(data, merged); err != nil {
+		return nil, fmt.Errorf("invalid patch: %w", err)
+	}
+	return merged, nil
+}
+
+// mergeField 合并单个字段。custom_variables、refresh_headers等以JSON字符串保存的对象
+// 也可以直接用对象打补丁，按RFC 7386递归合并到原有的对象中
+func mergeField(current, value json.RawMessage) json.RawMessage {
+	if !isJSONObject(value) {
+		return value
+	}
+	var s string
+	if err := json.Unmarshal(current, &s); err != nil {
+		return mergeJSON(current, value)
+	}
+	if strings.TrimSpace(s) == "" {
+		s = "{}"
+	}
+	if !isJSONObject(json.RawMessage(s)) {
+		// 原值不是JSON对象，按普通字段替换（类型不符时由Unmarshal报错）
+		return value
+	}
+	merged, _ := json.Marshal(string(mergeJSON(json.RawMessage(s), value)))
+	return merged
+}
+
+// mergeJSON 按RFC 7386把patch合并到target：对象递归合并，null删除键，其他值直接替换
+func mergeJSON(target, patch json.RawMessage) json.RawMessage {
+	var patchObj map[string]json.RawMessage
+	if err := json.Unmarshal(patch, &patchObj); err != nil || patchObj == nil {
+		return patch
+	}
+	var targetObj map[string]json.RawMessage
+	if err := json.Unmarshal(target, &targetObj); err != nil || targetObj == nil {
+		targetObj = make(map[string]json.RawMessage)
+	}
+	for name, value := range patchObj {
+		if string(value) == "null" {
+			delete(targetObj, name)
+		} else {
+			targetObj[name] = mergeJSON(targetObj[name], value)
+		}
+	}
+	data, _ := json.Marshal(targetObj)
+	return data
+}
+
+func isJSONObject(data json.RawMessage) bool {
+	var obj map[string]json.RawMessage
+	return json.Unmarshal(data, &obj) == nil && obj != nil
+}
+
+// projectETag 根据config_version生成项目的ETag，后台刷新不会改变ETag
+func projectETag(p *models.Project) string {
+	return fmt.Sprintf(`"%d"`, p.ConfigVersion)
+}
+
+// checkIfMatch 检查If-Match请求头。没有请求头或为 * 时不做并发检查（返回0）；
+// 与当前ETag一致时返回读取到的config_version，供数据库在更新时再次确认；
+// 不一致时返回412，ok为false
+func checkIfMatch(c *gin.Context, existing *models.Project) (expectedVersion int64, ok bool) {
+	header := strings.TrimSpace(c.GetHeader("If-Match"))
+	if header == "" || header == "*" {
+		return 0, true
+	}
+
+	etag := projectETag(existing)
+	for _, candidate := range strings.Split(header, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == etag {
+			return existing.ConfigVersion, true
+		}
+	}
+
+	c.Header("ETag", etag)
+	c.JSON(http.StatusPreconditionFailed, gin.H{"error": "Project has been modified, reload and try again"})
+	return 0, false
+}
+
+// respondUpdateError 更新失败时的响应，并发修改返回412
+func respondUpdateError(c *gin.Context, err error) {
+	if errors.Is(err, database.ErrProjectModified) {
+		c.JSON(http.StatusPreconditionFailed, gin.H{"error": "Project has been modified, reload and try again"})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+}
+
+// respondUpdated 返回更新后的项目和新的ETag
+func (h *ProjectHandler) respondUpdated(c *gin.Context, id int64) {
+	project, err := h.db.GetProject(c.Request.Context(), id)
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	project.Refreshing = h.engine.IsRefreshing(id)
 
+	c.Header("ETag", projectETag(project))
 	c.JSON(http.StatusOK, project)
 }
 
@@ -102,10 +341,12 @@ func (h *ProjectHandler) DeleteProject(c *gin.Context) {
 		return
 	}
 
-	if err := h.db.DeleteProject(id); err != nil {
+	if err := h.db.DeleteProject(c.Request.Context(), id); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	h.scheduler.Remove(id)
+	h.engine.ForgetProject(id)
 
 	c.JSON(http.StatusOK, gin.H{"message": "Project deleted successfully"})
 }
@@ -118,10 +359,12 @@ func (h *ProjectHandler) ToggleProject(c *gin.Context) {
 		return
 	}
 
-	if err := h.db.ToggleProject(id); err != nil {
+	if err := h.db.ToggleProject(c.Request.Context(), id); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	h.scheduler.Reschedule(id)
+	h.publishStatus(c, id)
 
 	c.JSON(http.StatusOK, gin.H{"message": "Project toggled successfully"})
 }
@@ -134,21 +377,181 @@ func (h *ProjectHandler) RefreshProject(c *gin.Context) {
 		return
 	}
 
-	project, err := h.db.GetProject(id)
+	project, err := h.db.GetProject(c.Request.Context(), id)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
 		return
 	}
 
-	if err := h.engine.Refresh(project); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	err = h.engine.Refresh(c.Request.Context(), project)
+	h.scheduler.Reschedule(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":       err.Error(),
+			"error_class": refresher.ClassOf(err),
+		})
 		return
 	}
 
 	// 重新获取更新后的项目信息
-	project, _ = h.db.GetProject(id)
+	project, _ = h.db.GetProject(c.Request.Context(), id)
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Refresh successful",
 		"project": project,
 	})
 }
+
+// ReauthorizeProject 提供新的refresh token，解除needs_reauth状态
+func (h *ProjectHandler) ReauthorizeProject(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid project ID"})
+		return
+	}
+
+	var req struct {
+		RefreshToken string `json:"refresh_token" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if _, err := h.db.GetProject(c.Request.Context(), id); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
+		return
+	}
+
+	if err := h.db.Reauthorize(c.Request.Context(), id, req.RefreshToken); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.scheduler.Reschedule(id)
+	h.publishStatus(c, id)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Project reauthorized successfully"})
+}
+
+// publishStatus 向SSE订阅者发布项目当前的状态（重新授权、启用/禁用之后）
+func (h *ProjectHandler) publishStatus(c *gin.Context, id int64) {
+	project, err := h.db.GetProject(c.Request.Context(), id)
+	if err != nil {
+		log.Printf("Warning: Failed to publish status of project %d: %v", id, err)
+		return
+	}
+	h.engine.PublishProjectStatus(project)
+}
+
+// dryRunRequest 试运行的请求体。project为要试运行的项目配置，
+// 对已有项目可以省略（使用已保存的配置）
+type dryRunRequest struct {
+	Project *models.Project `json:"project"`
+	refresher.DryRunOptions
+}
+
+// DryRunProject 试运行已有项目：渲染将要发送的请求并对示例响应执行提取规则，不修改项目。
+// 提供project时使用其配置（如编辑中未保存的修改），token等运行状态仍使用已保存的值
+func (h *ProjectHandler) DryRunProject(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid project ID"})
+		return
+	}
+
+	var req dryRunRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	existing, err := h.db.GetProject(c.Request.Context(), id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
+		return
+	}
+
+	project := existing
+	if req.Project != nil {
+		project = req.Project
+		applyProjectDefaults(project)
+		project.ID = existing.ID
+		project.CurrentAccessToken = existing.CurrentAccessToken
+		project.TokenExpiresAt = existing.TokenExpiresAt
+		project.Outputs = existing.Outputs
+		if project.CurrentRefreshToken == "" {
+			project.CurrentRefreshToken = existing.CurrentRefreshToken
+		}
+	}
+
+	h.dryRun(c, project, req.DryRunOptions)
+}
+
+// DryRunNewProject 创建项目前试运行，检查模板、请求头和提取规则
+func (h *ProjectHandler) DryRunNewProject(c *gin.Context) {
+	var req dryRunRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Project == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "project is required"})
+		return
+	}
+	applyProjectDefaults(req.Project)
+
+	h.dryRun(c, req.Project, req.DryRunOptions)
+}
+
+func (h *ProjectHandler) dryRun(c *gin.Context, project *models.Project, opts refresher.DryRunOptions) {
+	if errs := validateProject(project); len(errs) > 0 {
+		respondValidationErrors(c, "project", errs)
+		return
+	}
+
+	result, err := refresher.DryRun(project, opts)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// applyProjectDefaults 为未设置的字段填充默认值
+func applyProjectDefaults(p *models.Project) {
+	if p.ProjectType == "" {
+		p.ProjectType = models.ProjectTypeCustom
+	}
+	if p.OAuth2ClientAuth == "" {
+		p.OAuth2ClientAuth = models.OAuth2ClientAuthBasic
+	}
+	if p.OAuth2BodyFormat == "" {
+		p.OAuth2BodyFormat = models.OAuth2BodyFormatForm
+	}
+	if p.ResponseFormat == "" {
+		p.ResponseFormat = models.ResponseFormatAuto
+	}
+	if p.ExpiresFormat == "" {
+		p.ExpiresFormat = models.ExpiresFormatSeconds
+	}
+	if p.RefreshMethod == "" {
+		p.RefreshMethod = "POST"
+	}
+	if p.RefreshBeforeSeconds == 0 {
+		p.RefreshBeforeSeconds = 300
+	}
+	if p.RequestTimeoutSeconds == 0 {
+		p.RequestTimeoutSeconds = 30
+	}
+	if p.RetryMaxAttempts == 0 {
+		p.RetryMaxAttempts = 3
+	}
+	if p.RetryBaseDelayMs == 0 {
+		p.RetryBaseDelayMs = 1000
+	}
+	if p.CircuitBreakerThreshold == 0 {
+		p.CircuitBreakerThreshold = 5
+	}
+	if p.CircuitBreakerCooldownSeconds == 0 {
+		p.CircuitBreakerCooldownSeconds = 600
+	}
+}
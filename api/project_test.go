@@ -0,0 +1,318 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"jwt_refresher/database"
+	"jwt_refresher/models"
+	"jwt_refresher/notifier"
+	"jwt_refresher/pubsub"
+	"jwt_refresher/refresher"
+	"jwt_refresher/scheduler"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestMergePatch(t *testing.T) {
+	existing := &models.Project{
+		ID:                  1,
+		Name:                "demo",
+		Description:         "old",
+		Enabled:             true,
+		RefreshURL:          "https://auth.example.com/token",
+		RefreshHeaders:      `{"Accept":"application/json","X-Tenant":"a"}`,
+		CustomVariables:     `{"client_id":"abc","nested":{"a":1,"b":2}}`,
+		CurrentRefreshToken: "rt-1",
+		RetryJitter:         0.2,
+		ConfigVersion:       3,
+	}
+
+	tests := []struct {
+		name    string
+		patch   string
+		check   func(t *testing.T, p *models.Project)
+		wantErr bool
+	}{
+		{
+			name:  "absent fields are kept",
+			patch: `{"description":"new"}`,
+			check: func(t *testing.T, p *models.Project) {
+				if p.Description != "new" || p.Name != "demo" || p.CurrentRefreshToken != "rt-1" || !p.Enabled || p.ConfigVersion != 3 {
+					t.Errorf("mergePatch() = %+v", p)
+				}
+			},
+		},
+		{
+			name:  "null clears the field",
+			patch: `{"description":null,"retry_jitter":null,"enabled":null}`,
+			check: func(t *testing.T, p *models.Project) {
+				if p.Description != "" || p.RetryJitter != 0 || p.Enabled {
+					t.Errorf("mergePatch() description = %q, retry_jitter = %v, enabled = %v", p.Description, p.RetryJitter, p.Enabled)
+				}
+			},
+		},
+		{
+			name:  "string replaces json field",
+			patch: `{"custom_variables":"{\"client_id\":\"xyz\"}"}`,
+			check: func(t *testing.T, p *models.Project) {
+				assertJSON(t, p.CustomVariables, `{"client_id":"xyz"}`)
+			},
+		},
+		{
+			name:  "object merges into json field",
+			patch: `{"custom_variables":{"client_secret":"s","nested":{"b":null,"c":3}}}`,
+			check: func(t *testing.T, p *models.Project) {
+				assertJSON(t, p.CustomVariables, `{"client_id":"abc","client_secret":"s","nested":{"a":1,"c":3}}`)
+			},
+		},
+		{
+			name:  "null in object removes the key",
+			patch: `{"refresh_headers":{"X-Tenant":null}}`,
+			check: func(t *testing.T, p *models.Project) {
+				assertJSON(t, p.RefreshHeaders, `{"Accept":"application/json"}`)
+			},
+		},
+		{
+			name:  "object merges into empty json field",
+			patch: `{"output_rules":{"id_token":"id_token"}}`,
+			check: func(t *testing.T, p *models.Project) {
+				assertJSON(t, p.OutputRules, `{"id_token":"id_token"}`)
+			},
+		},
+		{
+			name:  "object replaces nested non-object value",
+			patch: `{"custom_variables":{"client_id":{"value":"abc"}}}`,
+			check: func(t *testing.T, p *models.Project) {
+				assertJSON(t, p.CustomVariables, `{"client_id":{"value":"abc"},"nested":{"a":1,"b":2}}`)
+			},
+		},
+		{name: "object for plain string field", patch: `{"refresh_url":{"host":"x"}}`, wantErr: true},
+		{name: "wrong type", patch: `{"enabled":"yes"}`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var patch map[string]json.RawMessage
+			if err := json.Unmarshal([]byte(tt.patch), &patch); err != nil {
+				t.Fatal(err)
+			}
+
+			before := *existing
+			got, err := mergePatch(existing, patch)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("mergePatch() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if *existing != before {
+				t.Error("mergePatch() modified the existing project")
+			}
+			if !tt.wantErr {
+				tt.check(t, got)
+			}
+		})
+	}
+}
+
+func assertJSON(t *testing.T, got, want string) {
+	t.Helper()
+	var g, w any
+	if err := json.Unmarshal([]byte(got), &g); err != nil {
+		t.Fatalf("invalid json %q: %v", got, err)
+	}
+	if err := json.Unmarshal([]byte(want), &w); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(g) != fmt.Sprint(w) {
+		t.Errorf("json = %s, want %s", got, want)
+	}
+}
+
+func TestCheckIfMatch(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	existing := &models.Project{ID: 1, ConfigVersion: 5}
+
+	tests := []struct {
+		name        string
+		ifMatch     string
+		wantOK      bool
+		wantVersion int64
+	}{
+		{name: "no header skips the check", ifMatch: "", wantOK: true, wantVersion: 0},
+		{name: "wildcard skips the check", ifMatch: "*", wantOK: true, wantVersion: 0},
+		{name: "matching etag", ifMatch: `"5"`, wantOK: true, wantVersion: 5},
+		{name: "weak etag", ifMatch: `W/"5"`, wantOK: true, wantVersion: 5},
+		{name: "one of several", ifMatch: `"4", "5"`, wantOK: true, wantVersion: 5},
+		{name: "stale etag", ifMatch: `"4"`, wantOK: false},
+		{name: "unquoted etag", ifMatch: "5", wantOK: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodPatch, "/api/projects/1", nil)
+			if tt.ifMatch != "" {
+				c.Request.Header.Set("If-Match", tt.ifMatch)
+			}
+
+			version, ok := checkIfMatch(c, existing)
+			if ok != tt.wantOK || version != tt.wantVersion {
+				t.Fatalf("checkIfMatch() = %d, %v, want %d, %v", version, ok, tt.wantVersion, tt.wantOK)
+			}
+			if ok {
+				if c.Writer.Written() {
+					t.Errorf("checkIfMatch() wrote a response with status %d", w.Code)
+				}
+				return
+			}
+			if w.Code != http.StatusPreconditionFailed {
+				t.Errorf("status = %d, want %d", w.Code, http.StatusPreconditionFailed)
+			}
+			if etag := w.Header().Get("ETag"); etag != `"5"` {
+				t.Errorf("ETag = %q, want %q", etag, `"5"`)
+			}
+		})
+	}
+}
+
+func TestRespondUpdateError(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{name: "concurrent modification", err: fmt.Errorf("update: %w", database.ErrProjectModified), want: http.StatusPreconditionFailed},
+		{name: "other error", err: errors.New("disk full"), want: http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			respondUpdateError(c, tt.err)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+// newTestServer 使用临时数据库创建只注册项目接口的路由，调度器不启动
+func newTestServer(t *testing.T) (*database.DB, *gin.Engine) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	db, err := database.InitDB(filepath.Join(t.TempDir(), "test.db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine := refresher.NewEngine(db, "", notifier.New(db), pubsub.New())
+	sched := scheduler.NewScheduler(db, engine, 1, 0)
+	t.Cleanup(func() {
+		engine.Stop(context.Background())
+		db.Close()
+	})
+
+	h := NewProjectHandler(db, engine, sched)
+	r := gin.New()
+	r.POST("/api/projects", h.CreateProject)
+	r.PUT("/api/projects/:id", h.UpdateProject)
+	r.PATCH("/api/projects/:id", h.PatchProject)
+	return db, r
+}
+
+func createTestProject(t *testing.T, db *database.DB, status string) *models.Project {
+	t.Helper()
+	project := &models.Project{
+		Name:                "demo",
+		Enabled:             true,
+		RefreshURL:          "https://auth.example.com/token",
+		RefreshMethod:       "POST",
+		AccessTokenPath:     "access_token",
+		CurrentRefreshToken: "rt-stored",
+	}
+	ctx := context.Background()
+	if err := db.CreateProject(ctx, project); err != nil {
+		t.Fatal(err)
+	}
+	if status == models.StatusNeedsReauth {
+		if _, err := db.RecordRefreshFailure(ctx, project.ID, status); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return project
+}
+
+func TestUpdateProjectRefreshToken(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     string
+		body       string
+		wantToken  string
+		wantStatus string
+	}{
+		{
+			name:      "missing token keeps the stored one",
+			body:      `{"name":"demo","refresh_url":"https://auth.example.com/token","access_token_path":"access_token"}`,
+			wantToken: "rt-stored",
+		},
+		{
+			name:      "empty token keeps the stored one",
+			body:      `{"name":"demo","refresh_url":"https://auth.example.com/token","access_token_path":"access_token","current_refresh_token":""}`,
+			wantToken: "rt-stored",
+		},
+		{
+			name:      "new token is written",
+			body:      `{"name":"demo","refresh_url":"https://auth.example.com/token","access_token_path":"access_token","current_refresh_token":"rt-new"}`,
+			wantToken: "rt-new",
+		},
+		{
+			name:       "new token clears needs_reauth",
+			status:     models.StatusNeedsReauth,
+			body:       `{"name":"demo","refresh_url":"https://auth.example.com/token","access_token_path":"access_token","current_refresh_token":"rt-new"}`,
+			wantToken:  "rt-new",
+			wantStatus: models.StatusReauthorized,
+		},
+		{
+			name:       "same token keeps needs_reauth",
+			status:     models.StatusNeedsReauth,
+			body:       `{"name":"demo","refresh_url":"https://auth.example.com/token","access_token_path":"access_token","current_refresh_token":"rt-stored"}`,
+			wantToken:  "rt-stored",
+			wantStatus: models.StatusNeedsReauth,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, r := newTestServer(t)
+			project := createTestProject(t, db, tt.status)
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPut, fmt.Sprintf("/api/projects/%d", project.ID), strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			r.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+			}
+
+			got, err := db.GetProject(context.Background(), project.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.CurrentRefreshToken != tt.wantToken {
+				t.Errorf("refresh token = %q, want %q", got.CurrentRefreshToken, tt.wantToken)
+			}
+			if tt.wantStatus != "" && got.LastRefreshStatus != tt.wantStatus {
+				t.Errorf("status = %q, want %q", got.LastRefreshStatus, tt.wantStatus)
+			}
+		})
+	}
+}
@@ -4,21 +4,26 @@ import (
 	"embed"
 	"io/fs"
 	"jwt_refresher/database"
+	"jwt_refresher/models"
+	"jwt_refresher/notifier"
+	"jwt_refresher/pubsub"
 	"jwt_refresher/refresher"
+	"jwt_refresher/scheduler"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
 )
 
-func SetupRouter(db *database.DB, engine *refresher.Engine, staticFiles embed.FS, username, password string) *gin.Engine {
+func SetupRouter(db *database.DB, engine *refresher.Engine, sched *scheduler.Scheduler, n *notifier.Notifier, broker *pubsub.Broker, staticFiles embed.FS, username, password string) *gin.Engine {
 	gin.SetMode(gin.ReleaseMode)
 	r := gin.Default()
 
 	// CORS middleware
 	r.Use(func(c *gin.Context) {
 		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, If-Match")
+		c.Writer.Header().Set("Access-Control-Expose-Headers", "ETag")
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(http.StatusNoContent)
 			return
@@ -27,35 +32,70 @@ func SetupRouter(db *database.DB, engine *refresher.Engine, staticFiles embed.FS
 	})
 
 	// Create auth middleware
-	authMiddleware := BasicAuthMiddleware(username, password)
+	authMiddleware := BasicAuthMiddleware(db, username, password)
+	adminOnly := RequireAdmin()
 
 	// API handlers
-	projectHandler := NewProjectHandler(db, engine)
-	tokenHandler := NewTokenHandler(db)
+	projectHandler := NewProjectHandler(db, engine, sched)
+	tokenHandler := NewTokenHandler(db, engine, sched, broker)
+	apiKeyHandler := NewAPIKeyHandler(db)
+	webhookHandler := NewWebhookHandler(db, n)
+	sinkHandler := NewSinkHandler(db)
 
 	// Protected API routes
 	api := r.Group("/api")
 	api.Use(authMiddleware) // Apply auth to all API routes
 	{
+		// API Key可访问的路由（按权限范围和项目限制）
+		api.GET("/projects/:id/token", RequireScope(models.ScopeTokenRead), tokenHandler.GetToken)
+		api.GET("/projects/:id/token/claims", RequireScope(models.ScopeTokenRead), tokenHandler.GetTokenClaims)
+		api.GET("/projects/:id/token/stream", RequireScope(models.ScopeTokenRead), tokenHandler.StreamToken)
+		api.GET("/tokens/stream", RequireScope(models.ScopeTokenRead), tokenHandler.StreamTokens)
+		api.GET("/projects/:id/logs", RequireScope(models.ScopeLogsRead), tokenHandler.GetLogs)
+		api.POST("/projects/:id/refresh", RequireScope(models.ScopeProjectRefresh), projectHandler.RefreshProject)
+
+		// 以下路由仅限管理员
+		admin := api.Group("", adminOnly)
+
 		// 项目管理
-		api.GET("/projects", projectHandler.GetAllProjects)
-		api.GET("/projects/:id", projectHandler.GetProject)
-		api.POST("/projects", projectHandler.CreateProject)
-		api.PUT("/projects/:id", projectHandler.UpdateProject)
-		api.DELETE("/projects/:id", projectHandler.DeleteProject)
-		api.POST("/projects/:id/toggle", projectHandler.ToggleProject)
-		api.POST("/projects/:id/refresh", projectHandler.RefreshProject)
+		admin.GET("/projects", projectHandler.GetAllProjects)
+		admin.GET("/projects/:id", projectHandler.GetProject)
+		admin.POST("/projects", projectHandler.CreateProject)
+		admin.POST("/projects/dry-run", projectHandler.DryRunNewProject)
+		admin.PUT("/projects/:id", projectHandler.UpdateProject)
+		admin.PATCH("/projects/:id", projectHandler.PatchProject)
+		admin.DELETE("/projects/:id", projectHandler.DeleteProject)
+		admin.POST("/projects/:id/toggle", projectHandler.ToggleProject)
+		admin.POST("/projects/:id/reauthorize", projectHandler.ReauthorizeProject)
+		admin.POST("/projects/:id/dry-run", projectHandler.DryRunProject)
+
+		// 刷新成功后推送token的sink
+		admin.GET("/projects/:id/sinks", sinkHandler.GetSinks)
+		admin.POST("/projects/:id/sinks", sinkHandler.CreateSink)
+		admin.PUT("/projects/:id/sinks/:sink_id", sinkHandler.UpdateSink)
+		admin.DELETE("/projects/:id/sinks/:sink_id", sinkHandler.DeleteSink)
+
+		// API Key管理
+		admin.GET("/keys", apiKeyHandler.GetAllAPIKeys)
+		admin.POST("/keys", apiKeyHandler.CreateAPIKey)
+		admin.POST("/keys/:id/revoke", apiKeyHandler.RevokeAPIKey)
+		admin.DELETE("/keys/:id", apiKeyHandler.DeleteAPIKey)
 
-		// Token查询
-		api.GET("/projects/:id/token", tokenHandler.GetToken)
-		api.GET("/projects/:id/logs", tokenHandler.GetLogs)
+		// Webhook通知
+		admin.GET("/webhooks", webhookHandler.GetAllWebhooks)
+		admin.POST("/webhooks", webhookHandler.CreateWebhook)
+		admin.GET("/webhooks/:id", webhookHandler.GetWebhook)
+		admin.PUT("/webhooks/:id", webhookHandler.UpdateWebhook)
+		admin.DELETE("/webhooks/:id", webhookHandler.DeleteWebhook)
+		admin.GET("/webhooks/:id/deliveries", webhookHandler.GetDeliveries)
+		admin.POST("/webhooks/:id/test", webhookHandler.TestWebhook)
 	}
 
 	// Protected static files and web interface
 	staticFS, err := fs.Sub(staticFiles, "web/static")
 	if err == nil {
 		protected := r.Group("/")
-		protected.Use(authMiddleware)
+		protected.Use(authMiddleware, adminOnly)
 		{
 			protected.StaticFS("/static", http.FS(staticFS))
 			protected.GET("/", func(c *gin.Context) {
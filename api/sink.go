@@ -0,0 +1,141 @@
+package api
+
+import (
+	"jwt_refresher/database"
+	"jwt_refresher/models"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+type SinkHandler struct {
+	db *database.DB
+}
+
+func NewSinkHandler(db *database.DB) *SinkHandler {
+	return &SinkHandler{db: db}
+}
+
+// GetSinks 获取项目的所有sink
+func (h *SinkHandler) GetSinks(c *gin.Context) {
+	projectID, ok := h.projectID(c)
+	if !ok {
+		return
+	}
+
+	sinks, err := h.db.GetProjectSinks(c.Request.Context(), projectID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, sinks)
+}
+
+// CreateSink 为项目创建sink，默认启用
+func (h *SinkHandler) CreateSink(c *gin.Context) {
+	projectID, ok := h.projectID(c)
+	if !ok {
+		return
+	}
+
+	sink := models.Sink{Enabled: true}
+	if err := c.ShouldBindJSON(&sink); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	sink.ProjectID = projectID
+
+	if errs := validateSink(&sink); len(errs) > 0 {
+		respondValidationErrors(c, "sink", errs)
+		return
+	}
+
+	if err := h.db.CreateSink(c.Request.Context(), &sink); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.respondSink(c, http.StatusCreated, projectID, sink.ID)
+}
+
+// UpdateSink 更新sink，请求中没有的字段保留原值
+func (h *SinkHandler) UpdateSink(c *gin.Context) {
+	sink, ok := h.loadSink(c)
+	if !ok {
+		return
+	}
+	id, projectID := sink.ID, sink.ProjectID
+	if err := c.ShouldBindJSON(sink); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	sink.ID, sink.ProjectID = id, projectID
+
+	if errs := validateSink(sink); len(errs) > 0 {
+		respondValidationErrors(c, "sink", errs)
+		return
+	}
+
+	if err := h.db.UpdateSink(c.Request.Context(), sink); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.respondSink(c, http.StatusOK, projectID, id)
+}
+
+// DeleteSink 删除sink，已有的推送记录保留在刷新日志中
+func (h *SinkHandler) DeleteSink(c *gin.Context) {
+	sink, ok := h.loadSink(c)
+	if !ok {
+		return
+	}
+
+	if err := h.db.DeleteSink(c.Request.Context(), sink.ProjectID, sink.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Sink deleted successfully"})
+}
+
+// respondSink 返回保存后的sink（包含数据库生成的时间）
+func (h *SinkHandler) respondSink(c *gin.Context, status int, projectID, id int64) {
+	sink, err := h.db.GetSink(c.Request.Context(), projectID, id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(status, sink)
+}
+
+// projectID 解析路径中的项目ID并确认项目存在
+func (h *SinkHandler) projectID(c *gin.Context) (int64, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid project ID"})
+		return 0, false
+	}
+	if _, err := h.db.GetProject(c.Request.Context(), id); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
+		return 0, false
+	}
+	return id, true
+}
+
+func (h *SinkHandler) loadSink(c *gin.Context) (*models.Sink, bool) {
+	projectID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid project ID"})
+		return nil, false
+	}
+	id, err := strconv.ParseInt(c.Param("sink_id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid sink ID"})
+		return nil, false
+	}
+	sink, err := h.db.GetSink(c.Request.Context(), projectID, id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Sink not found"})
+		return nil, false
+	}
+	return sink, true
+}
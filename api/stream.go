@@ -0,0 +1,125 @@
+package api
+
+import (
+	"io"
+	"jwt_refresher/pubsub"
+	"jwt_refresher/refresher"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// streamHeartbeat SSE心跳间隔，避免代理因连接空闲而断开
+const streamHeartbeat = 15 * time.Second
+
+// StreamToken 以SSE推送项目的token变化。连接后先发送当前的token
+func (h *TokenHandler) StreamToken(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid project ID"})
+		return
+	}
+
+	// 先订阅再读取当前token，两者之间的刷新不会丢失
+	sub := h.broker.Subscribe(func(projectID int64) bool { return projectID == id })
+	defer sub.Close()
+
+	project, err := h.db.GetProject(c.Request.Context(), id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
+		return
+	}
+
+	var snapshot []pubsub.Message
+	if project.CurrentAccessToken != "" {
+		token, err := refresher.TokenOf(project)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		snapshot = append(snapshot, pubsub.Message{Event: pubsub.EventToken, ProjectID: id, Data: token})
+	}
+	h.stream(c, sub, snapshot)
+}
+
+// StreamTokens 以SSE推送所有可访问项目的token和状态变化。
+// API Key只能收到其允许访问的项目。连接后先发送各项目当前的token
+func (h *TokenHandler) StreamTokens(c *gin.Context) {
+	allowed := func(int64) bool { return true }
+	if key := apiKeyFromContext(c); key != nil {
+		allowed = key.AllowsProject
+	}
+
+	sub := h.broker.Subscribe(allowed)
+	defer sub.Close()
+
+	projects, err := h.db.GetAllProjects(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	var snapshot []pubsub.Message
+	for _, project := range projects {
+		if !allowed(project.ID) || project.CurrentAccessToken == "" {
+			continue
+		}
+		token, err := refresher.TokenOf(project)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		snapshot = append(snapshot, pubsub.Message{Event: pubsub.EventToken, ProjectID: project.ID, Data: token})
+	}
+	h.stream(c, sub, snapshot)
+}
+
+// stream 发送snapshot后持续推送订阅的消息，直到客户端断开或订阅被关闭
+// （读取太慢或服务停止，客户端应重连）
+func (h *TokenHandler) stream(c *gin.Context, sub *pubsub.Subscription, snapshot []pubsub.Message) {
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	// 禁止nginx缓冲响应
+	c.Header("X-Accel-Buffering", "no")
+
+	withRefresh := canReadRefreshToken(c)
+	for _, msg := range snapshot {
+		c.SSEvent(msg.Event, streamData(msg, withRefresh))
+	}
+	c.Writer.Flush()
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case msg, ok := <-sub.C:
+			if !ok {
+				return false
+			}
+			c.SSEvent(msg.Event, streamData(msg, withRefresh))
+			return true
+		case <-heartbeat.C:
+			// SSE注释行，客户端会忽略
+			_, err := io.WriteString(w, ": ping\n\n")
+			return err == nil
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
+
+// streamData 返回要发送的消息数据，调用者不能读取refresh token时去掉token事件中的refresh token。
+// 消息由所有订阅者共享，不能直接修改
+func streamData(msg pubsub.Message, withRefresh bool) any {
+	token, ok := msg.Data.(*refresher.Token)
+	if !ok || withRefresh || token.RefreshToken == "" {
+		return msg.Data
+	}
+	redacted := *token
+	redacted.RefreshToken = ""
+	return &redacted
+}
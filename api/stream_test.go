@@ -0,0 +1,172 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"jwt_refresher/database"
+	"jwt_refresher/models"
+	"jwt_refresher/pubsub"
+	"jwt_refresher/refresher"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// sseEvent 从流中读取的一个SSE事件
+type sseEvent struct {
+	event string
+	token refresher.Token
+}
+
+// readEvent 读取下一个事件，跳过心跳注释
+func readEvent(t *testing.T, r *bufio.Reader) (sseEvent, bool) {
+	t.Helper()
+	var ev sseEvent
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return ev, false
+		}
+		line = strings.TrimRight(line, "\n")
+		switch {
+		case strings.HasPrefix(line, "event:"):
+			ev.event = strings.TrimPrefix(line, "event:")
+		case strings.HasPrefix(line, "data:"):
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data:")), &ev.token); err != nil {
+				t.Fatalf("invalid data %q: %v", line, err)
+			}
+		case line == "" && ev.event != "":
+			return ev, true
+		}
+	}
+}
+
+func TestStreamTokens(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db, err := database.InitDB(filepath.Join(t.TempDir(), "test.db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	var ids []int64
+	for _, name := range []string{"a", "b", "no token"} {
+		project := &models.Project{Name: name, Enabled: true, RefreshURL: "https://auth.example.com/token", RefreshMethod: "POST", AccessTokenPath: "access_token"}
+		if err := db.CreateProject(ctx, project); err != nil {
+			t.Fatal(err)
+		}
+		if name != "no token" {
+			if err := db.UpdateProjectTokens(ctx, project.ID, "at-"+name, "rt-"+name, time.Now().Add(time.Hour), "", models.StatusSuccess); err != nil {
+				t.Fatal(err)
+			}
+		}
+		ids = append(ids, project.ID)
+	}
+	a, b := ids[0], ids[1]
+
+	tests := []struct {
+		name string
+		path string
+		key  *models.APIKey
+		// 连接后收到的当前token
+		wantSnapshot []int64
+		// 依次发布到这些项目后，期望只收到最后一个
+		publish     []int64
+		wantRefresh bool
+	}{
+		{name: "all projects", path: "/api/tokens/stream", wantSnapshot: []int64{a, b}, publish: []int64{b}, wantRefresh: true},
+		{
+			name:         "api key sees allowed projects",
+			path:         "/api/tokens/stream",
+			key:          &models.APIKey{ProjectIDs: []int64{a}, Scopes: []string{models.ScopeTokenRead, models.ScopeTokenReadRefresh}},
+			wantSnapshot: []int64{a},
+			publish:      []int64{b, a},
+			wantRefresh:  true,
+		},
+		{
+			name:         "refresh token needs its scope",
+			path:         "/api/tokens/stream",
+			key:          &models.APIKey{AllProjects: true, Scopes: []string{models.ScopeTokenRead}},
+			wantSnapshot: []int64{a, b},
+			publish:      []int64{a},
+		},
+		{name: "single project", path: "/api/projects/" + itoa(b) + "/token/stream", wantSnapshot: []int64{b}, publish: []int64{a, b}, wantRefresh: true},
+		{name: "project without token", path: "/api/projects/" + itoa(ids[2]) + "/token/stream", publish: []int64{a, ids[2]}, wantRefresh: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broker := pubsub.New()
+			h := NewTokenHandler(db, nil, nil, broker)
+			r := gin.New()
+			r.Use(func(c *gin.Context) {
+				if tt.key != nil {
+					c.Set(apiKeyContextKey, tt.key)
+				}
+			})
+			r.GET("/api/projects/:id/token/stream", h.StreamToken)
+			r.GET("/api/tokens/stream", h.StreamTokens)
+			server := httptest.NewServer(r)
+			defer server.Close()
+
+			client := &http.Client{Timeout: 5 * time.Second}
+			resp, err := client.Get(server.URL + tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/event-stream") {
+				t.Errorf("Content-Type = %q", ct)
+			}
+			reader := bufio.NewReader(resp.Body)
+
+			checkRefresh := func(ev sseEvent) {
+				if (ev.token.RefreshToken != "") != tt.wantRefresh {
+					t.Errorf("project %d refresh token = %q, want present %v", ev.token.ProjectID, ev.token.RefreshToken, tt.wantRefresh)
+				}
+			}
+			snapshot := map[int64]bool{}
+			for range tt.wantSnapshot {
+				ev, ok := readEvent(t, reader)
+				if !ok || ev.event != pubsub.EventToken {
+					t.Fatalf("snapshot event = %+v, %v", ev, ok)
+				}
+				snapshot[ev.token.ProjectID] = true
+				checkRefresh(ev)
+			}
+			for _, id := range tt.wantSnapshot {
+				if !snapshot[id] {
+					t.Errorf("snapshot is missing project %d: %v", id, snapshot)
+				}
+			}
+
+			for _, id := range tt.publish {
+				broker.Publish(pubsub.Message{Event: pubsub.EventToken, ProjectID: id, Data: &refresher.Token{ProjectID: id, AccessToken: "at-new", RefreshToken: "rt-new"}})
+			}
+			ev, ok := readEvent(t, reader)
+			want := tt.publish[len(tt.publish)-1]
+			if !ok || ev.token.ProjectID != want || ev.token.AccessToken != "at-new" {
+				t.Fatalf("event = %+v, %v; want the token of project %d", ev, ok, want)
+			}
+			checkRefresh(ev)
+
+			// 停止服务时结束流
+			broker.Close()
+			if ev, ok := readEvent(t, reader); ok {
+				t.Errorf("unexpected event after Close: %+v", ev)
+			}
+		})
+	}
+}
+
+func itoa(id int64) string {
+	return strconv.FormatInt(id, 10)
+}
@@ -1,22 +1,62 @@
 package api
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"jwt_refresher/database"
+	"jwt_refresher/models"
+	"jwt_refresher/pubsub"
+	"jwt_refresher/refresher"
+	"jwt_refresher/scheduler"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
+const (
+	// defaultTokenWait、maxTokenWait 等待满足条件的token的默认和最长时间
+	defaultTokenWait = 30 * time.Second
+	maxTokenWait     = 2 * time.Minute
+)
+
 type TokenHandler struct {
-	db *database.DB
+	db        *database.DB
+	engine    *refresher.Engine
+	scheduler *scheduler.Scheduler
+	broker    *pubsub.Broker
+}
+
+func NewTokenHandler(db *database.DB, engine *refresher.Engine, sched *scheduler.Scheduler, broker *pubsub.Broker) *TokenHandler {
+	return &TokenHandler{db: db, engine: engine, scheduler: sched, broker: broker}
 }
 
-func NewTokenHandler(db *database.DB) *TokenHandler {
-	return &TokenHandler{db: db}
+// tokenCondition GetToken的min_valid和not参数：调用者需要的token
+type tokenCondition struct {
+	minValid time.Duration // token至少还要有效这么久（过期时间未知时视为满足）
+	notHash  string        // token的SHA-256不能是这个值（调用者持有的已失效token）
+	wait     time.Duration
 }
 
-// GetToken 获取当前有效token
+// satisfiedBy 判断项目当前的token是否满足条件
+func (cond *tokenCondition) satisfiedBy(project *models.Project, now time.Time) bool {
+	if project.CurrentAccessToken == "" {
+		return false
+	}
+	if cond.notHash != "" && tokenHash(project.CurrentAccessToken) == cond.notHash {
+		return false
+	}
+	if cond.minValid > 0 && project.TokenExpiresAt.Valid && project.TokenExpiresAt.Time.Before(now.Add(cond.minValid)) {
+		return false
+	}
+	return true
+}
+
+// GetToken 获取当前有效token。带min_valid或not参数时，如果当前token不满足条件，
+// 会触发（或加入进行中的）刷新，最多等待wait后返回新token
 func (h *TokenHandler) GetToken(c *gin.Context) {
 	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
 	if err != nil {
@@ -24,17 +64,222 @@ func (h *TokenHandler) GetToken(c *gin.Context) {
 		return
 	}
 
-	project, err := h.db.GetProject(id)
+	cond, err := parseTokenCondition(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	project, err := h.db.GetProject(c.Request.Context(), id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
+		return
+	}
+
+	if cond != nil && cond.minValid > 0 {
+		// 上游签发的token有效期不够时，刷新也无法满足，不能让调用者反复触发刷新
+		if lifetime := tokenLifetime(project); lifetime > 0 && cond.minValid > lifetime {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": fmt.Sprintf("min_valid %s exceeds the token lifetime %s", cond.minValid, lifetime.Round(time.Second)),
+			})
+			return
+		}
+	}
+
+	if cond != nil && !cond.satisfiedBy(project, time.Now()) {
+		if key := apiKeyFromContext(c); key != nil && !key.HasScope(models.ScopeProjectRefresh) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "API key lacks scope " + models.ScopeProjectRefresh + " required to wait for a fresh token"})
+			return
+		}
+		var ok bool
+		if project, ok = h.waitForToken(c, project, cond); !ok {
+			return
+		}
+	}
+
+	outputs, err := refresher.ParseOutputs(project.Outputs)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	resp := gin.H{
+		"access_token":        project.CurrentAccessToken,
+		"access_token_sha256": tokenHash(project.CurrentAccessToken),
+		"expires_at":          project.TokenExpiresAt,
+		"outputs":             outputs,
+	}
+	if canReadRefreshToken(c) {
+		resp["refresh_token"] = project.CurrentRefreshToken
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// waitForToken 刷新项目并等待结果，返回满足条件的项目。失败时已写入响应
+func (h *TokenHandler) waitForToken(c *gin.Context, project *models.Project, cond *tokenCondition) (*models.Project, bool) {
+	ctx := c.Request.Context()
+
+	// 与调度器一样，不刷新需要重新授权或熔断中的项目
+	if project.LastRefreshStatus == models.StatusNeedsReauth {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":       "Project needs re-authorization",
+			"error_class": refresher.ErrorClassTerminal,
+		})
+		return nil, false
+	}
+	if now := time.Now(); project.CircuitOpen(now) {
+		retryAfter := project.CircuitOpenUntil.Time.Sub(now)
+		c.Header("Retry-After", strconv.Itoa(int(retryAfter.Round(time.Second)/time.Second)))
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"error": fmt.Sprintf("Circuit breaker is open until %s", project.CircuitOpenUntil.Time.Format(time.RFC3339)),
+		})
+		return nil, false
+	}
+
+	// 等待超时或客户端断开时不取消刷新，否则上游已轮换的refresh token可能丢失；
+	// 刷新在引擎的context下执行，程序退出时才会被取消
+	done := make(chan error, 1)
+	go func() {
+		err := h.engine.Refresh(h.engine.Context(), project)
+		h.scheduler.Reschedule(project.ID)
+		done <- err
+	}()
+
+	timer := time.NewTimer(cond.wait)
+	defer timer.Stop()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error":       err.Error(),
+				"error_class": refresher.ClassOf(err),
+			})
+			return nil, false
+		}
+	case <-timer.C:
+		c.JSON(http.StatusGatewayTimeout, gin.H{
+			"error": fmt.Sprintf("Timed out after %s waiting for a fresh token", cond.wait),
+		})
+		return nil, false
+	case <-ctx.Done():
+		return nil, false
+	}
+
+	project, err := h.db.GetProject(ctx, project.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	if !cond.satisfiedBy(project, time.Now()) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"error": "Refreshed token still does not satisfy min_valid or not",
+		})
+		return nil, false
+	}
+	return project, true
+}
+
+// tokenLifetime 返回上一次成功刷新得到的token的有效期，未知时返回0
+func tokenLifetime(project *models.Project) time.Duration {
+	if project.LastRefreshStatus != models.StatusSuccess || !project.LastRefreshAt.Valid || !project.TokenExpiresAt.Valid {
+		return 0
+	}
+	return project.TokenExpiresAt.Time.Sub(project.LastRefreshAt.Time)
+}
+
+// parseTokenCondition 解析min_valid、not和wait参数，没有min_valid和not时返回nil
+func parseTokenCondition(c *gin.Context) (*tokenCondition, error) {
+	minValid, notHash := c.Query("min_valid"), c.Query("not")
+	if minValid == "" && notHash == "" {
+		return nil, nil
+	}
+
+	cond := &tokenCondition{wait: defaultTokenWait}
+	var err error
+	if minValid != "" {
+		if cond.minValid, err = parseDurationParam("min_valid", minValid); err != nil {
+			return nil, err
+		}
+	}
+	if notHash != "" {
+		cond.notHash = strings.ToLower(notHash)
+		if b, err := hex.DecodeString(cond.notHash); err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("not must be the hex SHA-256 of the access token")
+		}
+	}
+	if wait := c.Query("wait"); wait != "" {
+		if cond.wait, err = parseDurationParam("wait", wait); err != nil {
+			return nil, err
+		}
+		cond.wait = min(cond.wait, maxTokenWait)
+	}
+	return cond, nil
+}
+
+// parseDurationParam 解析时长参数，支持Go的时长格式（如 120s、2m）或秒数
+func parseDurationParam(name, value string) (time.Duration, error) {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		seconds, convErr := strconv.Atoi(value)
+		if convErr != nil {
+			return 0, fmt.Errorf("%s must be a duration such as 120s: %v", name, err)
+		}
+		d = time.Duration(seconds) * time.Second
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("%s must not be negative", name)
+	}
+	return d, nil
+}
+
+// tokenHash 返回access token的SHA-256（十六进制），用于not参数
+func tokenHash(token string) string {
+	if token == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// GetTokenClaims 解码当前access token（JWT）的header和claims，不校验签名
+func (h *TokenHandler) GetTokenClaims(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid project ID"})
+		return
+	}
+
+	project, err := h.db.GetProject(c.Request.Context(), id)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
 		return
 	}
+	if project.CurrentAccessToken == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Project has no access token"})
+		return
+	}
+
+	jwt, err := refresher.DecodeJWT(project.CurrentAccessToken)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"access_token":  project.CurrentAccessToken,
-		"refresh_token": project.CurrentRefreshToken,
-		"expires_at":    project.TokenExpiresAt,
-	})
+	resp := gin.H{
+		"header": jwt.Header,
+		"claims": jwt.Claims,
+	}
+	for name, claim := range map[string]func() (time.Time, bool){
+		"expires_at": jwt.ExpiresAt,
+		"issued_at":  jwt.IssuedAt,
+		"not_before": jwt.NotBefore,
+	} {
+		if t, ok := claim(); ok {
+			resp[name] = t
+		}
+	}
+	c.JSON(http.StatusOK, resp)
 }
 
 // GetLogs 获取刷新日志
@@ -52,7 +297,7 @@ func (h *TokenHandler) GetLogs(c *gin.Context) {
 		}
 	}
 
-	logs, err := h.db.GetProjectLogs(id, limit)
+	logs, err := h.db.GetProjectLogs(c.Request.Context(), id, limit)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -0,0 +1,183 @@
+package api
+
+import (
+	"database/sql"
+	"jwt_refresher/models"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestParseTokenCondition(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	hash := tokenHash("at-1")
+
+	tests := []struct {
+		name    string
+		query   string
+		want    *tokenCondition
+		wantErr bool
+	}{
+		{name: "no condition", query: "", want: nil},
+		{name: "wait alone is not a condition", query: "wait=10s", want: nil},
+		{name: "min_valid duration", query: "min_valid=5m", want: &tokenCondition{minValid: 5 * time.Minute, wait: defaultTokenWait}},
+		{name: "min_valid seconds", query: "min_valid=300", want: &tokenCondition{minValid: 5 * time.Minute, wait: defaultTokenWait}},
+		{name: "not hash", query: "not=" + hash, want: &tokenCondition{notHash: hash, wait: defaultTokenWait}},
+		{name: "not hash is case insensitive", query: "not=" + strings.ToUpper(hash), want: &tokenCondition{notHash: hash, wait: defaultTokenWait}},
+		{name: "both with wait", query: "min_valid=1m&not=" + hash + "&wait=5", want: &tokenCondition{minValid: time.Minute, notHash: hash, wait: 5 * time.Second}},
+		{name: "wait is capped", query: "min_valid=1m&wait=1h", want: &tokenCondition{minValid: time.Minute, wait: maxTokenWait}},
+		{name: "zero wait", query: "min_valid=1m&wait=0", want: &tokenCondition{minValid: time.Minute}},
+
+		{name: "invalid min_valid", query: "min_valid=soon", wantErr: true},
+		{name: "negative min_valid", query: "min_valid=-1m", wantErr: true},
+		{name: "invalid wait", query: "min_valid=1m&wait=later", wantErr: true},
+		{name: "not is the raw token", query: "not=at-1", wantErr: true},
+		{name: "not is too short", query: "not=" + hash[:32], wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest(http.MethodGet, "/api/projects/1/token?"+tt.query, nil)
+
+			got, err := parseTokenCondition(c)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseTokenCondition() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+				t.Errorf("parseTokenCondition() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTokenConditionSatisfiedBy(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	expiresIn := func(d time.Duration) sql.NullTime { return sql.NullTime{Time: now.Add(d), Valid: true} }
+
+	tests := []struct {
+		name    string
+		cond    tokenCondition
+		project models.Project
+		want    bool
+	}{
+		{
+			name:    "no token",
+			cond:    tokenCondition{minValid: time.Minute},
+			project: models.Project{TokenExpiresAt: expiresIn(time.Hour)},
+			want:    false,
+		},
+		{
+			name:    "valid long enough",
+			cond:    tokenCondition{minValid: 5 * time.Minute},
+			project: models.Project{CurrentAccessToken: "at-1", TokenExpiresAt: expiresIn(10 * time.Minute)},
+			want:    true,
+		},
+		{
+			name:    "expires exactly at min_valid",
+			cond:    tokenCondition{minValid: 5 * time.Minute},
+			project: models.Project{CurrentAccessToken: "at-1", TokenExpiresAt: expiresIn(5 * time.Minute)},
+			want:    true,
+		},
+		{
+			name:    "expires too soon",
+			cond:    tokenCondition{minValid: 5 * time.Minute},
+			project: models.Project{CurrentAccessToken: "at-1", TokenExpiresAt: expiresIn(4 * time.Minute)},
+			want:    false,
+		},
+		{
+			name:    "expiry is not checked without min_valid",
+			cond:    tokenCondition{},
+			project: models.Project{CurrentAccessToken: "at-1", TokenExpiresAt: expiresIn(-time.Minute)},
+			want:    true,
+		},
+		{
+			name:    "unknown expiry satisfies min_valid",
+			cond:    tokenCondition{minValid: time.Hour},
+			project: models.Project{CurrentAccessToken: "at-1"},
+			want:    true,
+		},
+		{
+			name:    "token is the rejected one",
+			cond:    tokenCondition{notHash: tokenHash("at-1")},
+			project: models.Project{CurrentAccessToken: "at-1", TokenExpiresAt: expiresIn(time.Hour)},
+			want:    false,
+		},
+		{
+			name:    "token was refreshed",
+			cond:    tokenCondition{notHash: tokenHash("at-1")},
+			project: models.Project{CurrentAccessToken: "at-2", TokenExpiresAt: expiresIn(time.Hour)},
+			want:    true,
+		},
+		{
+			name:    "new token but too short",
+			cond:    tokenCondition{minValid: 5 * time.Minute, notHash: tokenHash("at-1")},
+			project: models.Project{CurrentAccessToken: "at-2", TokenExpiresAt: expiresIn(time.Minute)},
+			want:    false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.cond.satisfiedBy(&tt.project, now); got != tt.want {
+				t.Errorf("satisfiedBy() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTokenLifetime(t *testing.T) {
+	refreshed := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	valid := func(t time.Time) sql.NullTime { return sql.NullTime{Time: t, Valid: true} }
+
+	tests := []struct {
+		name    string
+		project models.Project
+		want    time.Duration
+	}{
+		{
+			name: "last successful refresh",
+			project: models.Project{
+				LastRefreshStatus: models.StatusSuccess,
+				LastRefreshAt:     valid(refreshed),
+				TokenExpiresAt:    valid(refreshed.Add(15 * time.Minute)),
+			},
+			want: 15 * time.Minute,
+		},
+		{
+			name: "unknown expiry",
+			project: models.Project{
+				LastRefreshStatus: models.StatusSuccess,
+				LastRefreshAt:     valid(refreshed),
+			},
+		},
+		{
+			name:    "never refreshed",
+			project: models.Project{TokenExpiresAt: valid(refreshed)},
+		},
+		{
+			// 失败后last_refresh_at是失败的时间，不能用来计算有效期
+			name: "last refresh failed",
+			project: models.Project{
+				LastRefreshStatus: models.StatusFailed,
+				LastRefreshAt:     valid(refreshed.Add(10 * time.Minute)),
+				TokenExpiresAt:    valid(refreshed.Add(15 * time.Minute)),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tokenLifetime(&tt.project); got != tt.want {
+				t.Errorf("tokenLifetime() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
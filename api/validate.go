@@ -0,0 +1,305 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"jwt_refresher/models"
+	"jwt_refresher/notifier"
+	"jwt_refresher/refresher"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// FieldErrors 校验失败的字段，字段名 -> 错误信息
+type FieldErrors map[string]string
+
+func (e FieldErrors) add(field, format string, args ...any) {
+	if _, ok := e[field]; !ok {
+		e[field] = fmt.Sprintf(format, args...)
+	}
+}
+
+// respondValidationErrors 返回422和各字段的错误，kind为校验的对象（project、webhook、sink）
+func respondValidationErrors(c *gin.Context, kind string, errs FieldErrors) {
+	c.JSON(http.StatusUnprocessableEntity, gin.H{
+		"error":  "Invalid " + kind + " configuration",
+		"fields": errs,
+	})
+}
+
+var httpMethods = map[string]bool{
+	http.MethodGet: true, http.MethodPost: true, http.MethodPut: true,
+	http.MethodPatch: true, http.MethodDelete: true,
+}
+
+// validateProject 校验项目配置，空值按刷新引擎的默认值处理。
+// HTTP方法不区分大小写，校验前统一转为大写后保存
+func validateProject(p *models.Project) FieldErrors {
+	errs := FieldErrors{}
+
+	if strings.TrimSpace(p.Name) == "" {
+		errs.add("name", "name is required")
+	}
+
+	custom := false
+	switch p.ProjectType {
+	case "", models.ProjectTypeCustom:
+		custom = true
+	case models.ProjectTypeOAuth2RefreshToken, models.ProjectTypeOAuth2ClientCredentials:
+	default:
+		errs.add("project_type", "unknown project type %q", p.ProjectType)
+	}
+
+	// 刷新配置
+	validateURL(errs, "refresh_url", p.RefreshURL)
+	p.RefreshMethod = strings.ToUpper(strings.TrimSpace(p.RefreshMethod))
+	if custom && p.RefreshMethod != "" && !httpMethods[p.RefreshMethod] {
+		errs.add("refresh_method", "unsupported HTTP method %q", p.RefreshMethod)
+	}
+	if p.RefreshHeaders != "" {
+		var headers map[string]string
+		if err := json.Unmarshal([]byte(p.RefreshHeaders), &headers); err != nil {
+			errs.add("refresh_headers", "must be a JSON object of strings: %v", err)
+		}
+		for key, value := range headers {
+			if err := refresher.ValidateTemplate(value); err != nil {
+				errs.add("refresh_headers", "header %s: %v", key, err)
+			}
+		}
+	}
+	if custom {
+		if err := refresher.ValidateTemplate(p.RefreshBodyTemplate); err != nil {
+			errs.add("refresh_body_template", "%v", err)
+		}
+	}
+	if err := refresher.ValidateRefreshSteps(p.RefreshSteps); err != nil {
+		errs.add("refresh_steps", "%v", err)
+	} else {
+		steps, _ := refresher.ParseRefreshSteps(p.RefreshSteps)
+		for _, step := range steps {
+			if step.Method != "" && !httpMethods[strings.ToUpper(strings.TrimSpace(step.Method))] {
+				errs.add("refresh_steps", "step %s: unsupported HTTP method %q", step.Name, step.Method)
+			}
+		}
+	}
+
+	// OAuth2配置
+	switch p.OAuth2ClientAuth {
+	case "", models.OAuth2ClientAuthBasic, models.OAuth2ClientAuthBody:
+	default:
+		errs.add("oauth2_client_auth", "unknown client auth %q", p.OAuth2ClientAuth)
+	}
+	switch p.OAuth2BodyFormat {
+	case "", models.OAuth2BodyFormatForm, models.OAuth2BodyFormatJSON:
+	default:
+		errs.add("oauth2_body_format", "unknown body format %q", p.OAuth2BodyFormat)
+	}
+
+	// Token提取规则
+	switch p.ResponseFormat {
+	case "", models.ResponseFormatAuto, models.ResponseFormatJSON, models.ResponseFormatForm, models.ResponseFormatXML:
+	default:
+		errs.add("response_format", "unknown response format %q", p.ResponseFormat)
+	}
+	if custom && p.AccessTokenPath == "" {
+		errs.add("access_token_path", "access_token_path is required")
+	}
+	for field, path := range map[string]string{
+		"access_token_path":  p.AccessTokenPath,
+		"refresh_token_path": p.RefreshTokenPath,
+		"expires_in_path":    p.ExpiresInPath,
+	} {
+		if path == "" {
+			continue
+		}
+		if err := refresher.ValidatePath(p.ResponseFormat, path); err != nil {
+			errs.add(field, "%v", err)
+		}
+	}
+	if err := refresher.ValidateExpiresFormat(p.ExpiresFormat, p.ExpiresLayout); err != nil {
+		if p.ExpiresFormat == models.ExpiresFormatLayout {
+			errs.add("expires_layout", "%v", err)
+		} else {
+			errs.add("expires_format", "%v", err)
+		}
+	}
+	if rules, err := refresher.ParseOutputRules(p.OutputRules); err != nil {
+		errs.add("output_rules", "must be a JSON object of name to path: %v", err)
+	} else {
+		for name, path := range rules {
+			if err := refresher.ValidatePath(p.ResponseFormat, path); err != nil {
+				errs.add("output_rules", "output %s: %v", name, err)
+			}
+		}
+	}
+
+	if p.CustomVariables != "" {
+		var vars map[string]interface{}
+		if err := json.Unmarshal([]byte(p.CustomVariables), &vars); err != nil {
+			errs.add("custom_variables", "must be a JSON object: %v", err)
+		}
+	}
+
+	// 刷新策略、重试与熔断
+	if p.RefreshBeforeSeconds < 0 {
+		errs.add("refresh_before_seconds", "must not be negative")
+	}
+	if p.RequestTimeoutSeconds < 0 {
+		errs.add("request_timeout_seconds", "must not be negative")
+	}
+	if p.RetryMaxAttempts < 0 {
+		errs.add("retry_max_attempts", "must not be negative")
+	}
+	if p.RetryBaseDelayMs < 0 {
+		errs.add("retry_base_delay_ms", "must not be negative")
+	}
+	if p.RetryJitter < 0 || p.RetryJitter > 1 {
+		errs.add("retry_jitter", "must be between 0 and 1")
+	}
+	if err := refresher.ValidateRetryOn(p.RetryOn); err != nil {
+		errs.add("retry_on", "%v", err)
+	}
+	if p.CircuitBreakerThreshold < -1 {
+		errs.add("circuit_breaker_threshold", "must be -1 (disabled) or a positive number")
+	}
+	if p.CircuitBreakerCooldownSeconds < 0 {
+		errs.add("circuit_breaker_cooldown_seconds", "must not be negative")
+	}
+	if _, err := refresher.ParseErrorMatchers(p.ErrorMatchers); err != nil {
+		errs.add("error_matchers", "%v", err)
+	}
+
+	// TLS
+	if p.TLSClientCert != "" || p.TLSClientKey != "" {
+		if err := refresher.ValidateTLSClientCert(p.TLSClientCert, p.TLSClientKey); err != nil {
+			if p.TLSClientCert == "" {
+				errs.add("tls_client_cert", "%v", err)
+			} else {
+				errs.add("tls_client_key", "%v", err)
+			}
+		}
+	}
+	if p.TLSCABundle != "" {
+		if err := refresher.ValidateTLSCABundle(p.TLSCABundle); err != nil {
+			errs.add("tls_ca_bundle", "%v", err)
+		}
+	}
+	if err := refresher.ValidateTLSMinVersion(p.TLSMinVersion); err != nil {
+		errs.add("tls_min_version", "%v", err)
+	}
+	if err := refresher.ValidateProxy(p.Proxy); err != nil {
+		errs.add("proxy", "%v", err)
+	}
+
+	return errs
+}
+
+// validateWebhook 校验Webhook配置
+func validateWebhook(w *models.Webhook) FieldErrors {
+	errs := FieldErrors{}
+
+	if strings.TrimSpace(w.Name) == "" {
+		errs.add("name", "name is required")
+	}
+	if u, err := url.Parse(w.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs.add("url", "must be an absolute http or https url")
+	}
+	if len(w.Events) == 0 {
+		errs.add("events", "at least one event is required")
+	}
+	for _, event := range w.Events {
+		if !slices.Contains(models.ValidEvents, event) {
+			errs.add("events", "unknown event %q", event)
+		}
+	}
+	if !w.AllProjects && len(w.ProjectIDs) == 0 {
+		errs.add("project_ids", "project_ids is required unless all_projects is set")
+	}
+	if w.Headers != "" {
+		var headers map[string]string
+		if err := json.Unmarshal([]byte(w.Headers), &headers); err != nil {
+			errs.add("headers", "must be a JSON object of strings: %v", err)
+		}
+	}
+	if err := notifier.ValidatePayloadTemplate(w.PayloadTemplate); err != nil {
+		errs.add("payload_template", "%v", err)
+	}
+	if w.FailureThreshold < 0 {
+		errs.add("failure_threshold", "must not be negative")
+	}
+	if w.ExpiryWarningSeconds < 0 {
+		errs.add("expiry_warning_seconds", "must not be negative")
+	}
+
+	return errs
+}
+
+// validateSink 校验sink配置，只检查其类型用到的字段
+func validateSink(s *models.Sink) FieldErrors {
+	errs := FieldErrors{}
+
+	if strings.TrimSpace(s.Name) == "" {
+		errs.add("name", "name is required")
+	}
+	if s.Format != "" && !slices.Contains(models.ValidSinkFormats, s.Format) {
+		errs.add("format", "unknown sink format %q", s.Format)
+	}
+	if s.TimeoutSeconds < 0 {
+		errs.add("timeout_seconds", "must not be negative")
+	}
+
+	switch s.Type {
+	case models.SinkFile:
+		if !filepath.IsAbs(s.Path) {
+			errs.add("path", "must be an absolute file path")
+		}
+		if _, err := refresher.ParseSinkFileMode(s.FileMode); err != nil {
+			errs.add("file_mode", "%v", err)
+		}
+	case models.SinkWebhook:
+		if u, err := url.Parse(s.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs.add("url", "must be an absolute http or https url")
+		}
+		if s.Headers != "" {
+			var headers map[string]string
+			if err := json.Unmarshal([]byte(s.Headers), &headers); err != nil {
+				errs.add("headers", "must be a JSON object of strings: %v", err)
+			}
+		}
+	case models.SinkCommand:
+		if strings.TrimSpace(s.Command) == "" {
+			errs.add("command", "command is required")
+		}
+	default:
+		errs.add("type", "unknown sink type %q", s.Type)
+	}
+
+	return errs
+}
+
+// validateURL 校验刷新URL。包含模板时只能检查模板语法，渲染后的URL在刷新时才能确定
+func validateURL(errs FieldErrors, field, raw string) {
+	if strings.TrimSpace(raw) == "" {
+		errs.add(field, "%s is required", field)
+		return
+	}
+	if strings.Contains(raw, "{{") {
+		if err := refresher.ValidateTemplate(raw); err != nil {
+			errs.add(field, "%v", err)
+		}
+		return
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		errs.add(field, "invalid url: %v", err)
+		return
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs.add(field, "must be an absolute http or https url")
+	}
+}
@@ -0,0 +1,339 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"jwt_refresher/models"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func validProject() models.Project {
+	return models.Project{
+		Name:            "demo",
+		RefreshURL:      "https://auth.example.com/token",
+		RefreshMethod:   "POST",
+		AccessTokenPath: "access_token",
+	}
+}
+
+func TestValidateProject(t *testing.T) {
+	tests := []struct {
+		name       string
+		modify     func(p *models.Project)
+		wantFields []string
+		wantMethod string
+	}{
+		{name: "valid", modify: func(*models.Project) {}, wantMethod: "POST"},
+		{name: "lowercase method", modify: func(p *models.Project) { p.RefreshMethod = "put" }, wantMethod: "PUT"},
+		{name: "mixed case method", modify: func(p *models.Project) { p.RefreshMethod = " Patch " }, wantMethod: "PATCH"},
+		{name: "empty method", modify: func(p *models.Project) { p.RefreshMethod = "" }, wantMethod: ""},
+		{name: "unknown method", modify: func(p *models.Project) { p.RefreshMethod = "fetch" }, wantFields: []string{"refresh_method"}},
+		{
+			name: "step methods are case insensitive",
+			modify: func(p *models.Project) {
+				p.RefreshSteps = `[{"name":"nonce","url":"https://auth.example.com/nonce","method":"get"},` +
+					`{"name":"login","url":"https://auth.example.com/login","method":"Post"},` +
+					`{"name":"default","url":"https://auth.example.com/x"}]`
+			},
+			wantMethod: "POST",
+		},
+		{
+			name: "unknown step method",
+			modify: func(p *models.Project) {
+				p.RefreshSteps = `[{"name":"nonce","url":"https://auth.example.com/nonce","method":"CONNECT"}]`
+			},
+			wantFields: []string{"refresh_steps"},
+		},
+		{
+			name:       "missing required fields",
+			modify:     func(p *models.Project) { p.Name = " "; p.RefreshURL = ""; p.AccessTokenPath = "" },
+			wantFields: []string{"name", "refresh_url", "access_token_path"},
+		},
+		{
+			name:       "relative url",
+			modify:     func(p *models.Project) { p.RefreshURL = "/oauth/token" },
+			wantFields: []string{"refresh_url"},
+		},
+		{
+			name:       "templated url",
+			modify:     func(p *models.Project) { p.RefreshURL = "https://{{.host}}/token" },
+			wantMethod: "POST",
+		},
+		{
+			name: "invalid templates and json",
+			modify: func(p *models.Project) {
+				p.RefreshHeaders = `["Accept"]`
+				p.RefreshBodyTemplate = "{{.RefreshToken"
+				p.CustomVariables = `"abc"`
+				p.OutputRules = `{"id_token":"regex:("}`
+			},
+			wantFields: []string{"refresh_headers", "refresh_body_template", "custom_variables", "output_rules"},
+		},
+		{
+			name:       "invalid header template",
+			modify:     func(p *models.Project) { p.RefreshHeaders = `{"X-Token":"{{.AccessToken"}` },
+			wantFields: []string{"refresh_headers"},
+		},
+		{
+			name: "invalid paths",
+			modify: func(p *models.Project) {
+				p.ResponseFormat = models.ResponseFormatJSON
+				p.AccessTokenPath = "data."
+				p.ExpiresInPath = "regex:("
+			},
+			wantFields: []string{"access_token_path", "expires_in_path"},
+		},
+		{
+			name: "oauth2 uses the standard paths",
+			modify: func(p *models.Project) {
+				p.ProjectType = models.ProjectTypeOAuth2ClientCredentials
+				p.AccessTokenPath = ""
+				p.RefreshMethod = "fetch"
+			},
+			wantMethod: "FETCH",
+		},
+		{
+			name: "unknown enums",
+			modify: func(p *models.Project) {
+				p.ProjectType = "saml"
+				p.OAuth2ClientAuth = "jwt"
+				p.OAuth2BodyFormat = "xml"
+				p.ResponseFormat = "yaml"
+				p.ExpiresFormat = "weeks"
+			},
+			// 提取路径按响应格式校验，格式未知时同样报错
+			wantFields: []string{"project_type", "oauth2_client_auth", "oauth2_body_format", "response_format", "expires_format", "access_token_path"},
+		},
+		{
+			name: "invalid retry and circuit breaker settings",
+			modify: func(p *models.Project) {
+				p.RefreshBeforeSeconds = -1
+				p.RequestTimeoutSeconds = -1
+				p.RetryMaxAttempts = -1
+				p.RetryBaseDelayMs = -1
+				p.RetryJitter = 1.5
+				p.RetryOn = "network,5xx"
+				p.CircuitBreakerThreshold = -2
+				p.CircuitBreakerCooldownSeconds = -1
+				p.ErrorMatchers = `[{"class":"fatal","status":400}]`
+			},
+			wantFields: []string{
+				"refresh_before_seconds", "request_timeout_seconds", "retry_max_attempts", "retry_base_delay_ms",
+				"retry_jitter", "retry_on", "circuit_breaker_threshold", "circuit_breaker_cooldown_seconds", "error_matchers",
+			},
+		},
+		{
+			name:       "disabled circuit breaker",
+			modify:     func(p *models.Project) { p.CircuitBreakerThreshold = -1 },
+			wantMethod: "POST",
+		},
+		{
+			name: "invalid tls and proxy settings",
+			modify: func(p *models.Project) {
+				p.TLSClientCert = "not a certificate"
+				p.TLSCABundle = "not a bundle"
+				p.TLSMinVersion = "1.4"
+				p.Proxy = "ftp://proxy.example.com"
+			},
+			wantFields: []string{"tls_client_key", "tls_ca_bundle", "tls_min_version", "proxy"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := validProject()
+			tt.modify(&p)
+
+			assertFieldErrors(t, validateProject(&p), tt.wantFields)
+			if len(tt.wantFields) == 0 && p.RefreshMethod != tt.wantMethod {
+				t.Errorf("refresh_method = %q, want %q", p.RefreshMethod, tt.wantMethod)
+			}
+		})
+	}
+}
+
+func TestValidateWebhook(t *testing.T) {
+	valid := func() models.Webhook {
+		return models.Webhook{
+			Name:        "alerts",
+			URL:         "https://hooks.example.com/jwt",
+			Events:      []string{models.EventFailure},
+			AllProjects: true,
+		}
+	}
+
+	tests := []struct {
+		name       string
+		modify     func(w *models.Webhook)
+		wantFields []string
+	}{
+		{name: "valid", modify: func(*models.Webhook) {}},
+		{
+			name: "missing fields",
+			modify: func(w *models.Webhook) {
+				w.Name = ""
+				w.URL = "hooks.example.com"
+				w.Events = nil
+				w.AllProjects = false
+			},
+			wantFields: []string{"name", "url", "events", "project_ids"},
+		},
+		{
+			name: "invalid values",
+			modify: func(w *models.Webhook) {
+				w.Events = []string{"deleted"}
+				w.Headers = "Bearer x"
+				w.PayloadTemplate = "{{.Message"
+				w.FailureThreshold = -1
+				w.ExpiryWarningSeconds = -1
+			},
+			wantFields: []string{"events", "headers", "payload_template", "failure_threshold", "expiry_warning_seconds"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := valid()
+			tt.modify(&w)
+			assertFieldErrors(t, validateWebhook(&w), tt.wantFields)
+		})
+	}
+}
+
+func TestValidateSink(t *testing.T) {
+	tests := []struct {
+		name       string
+		sink       models.Sink
+		wantFields []string
+	}{
+		{name: "file", sink: models.Sink{Name: "f", Type: models.SinkFile, Path: "/run/token", FileMode: "0640", Format: models.SinkFormatEnv}},
+		{name: "webhook", sink: models.Sink{Name: "w", Type: models.SinkWebhook, URL: "https://consumer.example.com/token"}},
+		{name: "command", sink: models.Sink{Name: "c", Type: models.SinkCommand, Command: "systemctl reload app"}},
+		{
+			name:       "relative file path and bad mode",
+			sink:       models.Sink{Name: "f", Type: models.SinkFile, Path: "token.txt", FileMode: "rw-r"},
+			wantFields: []string{"path", "file_mode"},
+		},
+		{
+			name:       "invalid webhook",
+			sink:       models.Sink{Name: "w", Type: models.SinkWebhook, URL: "ftp://x", Headers: "{", Format: "yaml", TimeoutSeconds: -1},
+			wantFields: []string{"url", "headers", "format", "timeout_seconds"},
+		},
+		{name: "empty command", sink: models.Sink{Name: "c", Type: models.SinkCommand, Command: " "}, wantFields: []string{"command"}},
+		{name: "unknown type", sink: models.Sink{Type: "s3"}, wantFields: []string{"name", "type"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assertFieldErrors(t, validateSink(&tt.sink), tt.wantFields)
+		})
+	}
+}
+
+func assertFieldErrors(t *testing.T, errs FieldErrors, wantFields []string) {
+	t.Helper()
+	if len(errs) != len(wantFields) {
+		t.Fatalf("errors = %v, want errors for %v", errs, wantFields)
+	}
+	for _, field := range wantFields {
+		if _, ok := errs[field]; !ok {
+			t.Errorf("errors = %v, want an error for %s", errs, field)
+		}
+	}
+}
+
+func TestProjectValidationResponse(t *testing.T) {
+	db, r := newTestServer(t)
+	project, err := db.GetProject(context.Background(), createTestProject(t, db, "").ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		wantStatus int
+		wantFields []string
+	}{
+		{
+			name:       "create",
+			method:     http.MethodPost,
+			path:       "/api/projects",
+			body:       `{"name":"","refresh_url":"not a url","refresh_method":"fetch","access_token_path":"access_token"}`,
+			wantStatus: http.StatusUnprocessableEntity,
+			wantFields: []string{"name", "refresh_url", "refresh_method"},
+		},
+		{
+			name:       "create with lowercase method",
+			method:     http.MethodPost,
+			path:       "/api/projects",
+			body:       `{"name":"new","refresh_url":"https://auth.example.com/token","refresh_method":"get","access_token_path":"access_token"}`,
+			wantStatus: http.StatusCreated,
+		},
+		{
+			name:       "replace",
+			method:     http.MethodPut,
+			path:       fmt.Sprintf("/api/projects/%d", project.ID),
+			body:       `{"name":"demo","refresh_url":"https://auth.example.com/token","access_token_path":"access_token","retry_jitter":2}`,
+			wantStatus: http.StatusUnprocessableEntity,
+			wantFields: []string{"retry_jitter"},
+		},
+		{
+			name:       "patch validates the merged project",
+			method:     http.MethodPatch,
+			path:       fmt.Sprintf("/api/projects/%d", project.ID),
+			body:       `{"access_token_path":null,"custom_variables":"[1]"}`,
+			wantStatus: http.StatusUnprocessableEntity,
+			wantFields: []string{"access_token_path", "custom_variables"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			r.ServeHTTP(w, req)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if tt.wantStatus != http.StatusUnprocessableEntity {
+				var created models.Project
+				if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+					t.Fatal(err)
+				}
+				if created.RefreshMethod != "GET" {
+					t.Errorf("refresh_method = %q, want %q", created.RefreshMethod, "GET")
+				}
+				return
+			}
+
+			var resp struct {
+				Error  string      `json:"error"`
+				Fields FieldErrors `json:"fields"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Error != "Invalid project configuration" {
+				t.Errorf("error = %q", resp.Error)
+			}
+			assertFieldErrors(t, resp.Fields, tt.wantFields)
+		})
+	}
+
+	// 被拒绝的修改不会写入
+	got, err := db.GetProject(context.Background(), project.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.RetryJitter != 0 || got.AccessTokenPath != "access_token" || got.ConfigVersion != project.ConfigVersion {
+		t.Errorf("project was modified by a rejected update: %+v", got)
+	}
+}
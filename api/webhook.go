@@ -0,0 +1,156 @@
+package api
+
+import (
+	"jwt_refresher/database"
+	"jwt_refresher/models"
+	"jwt_refresher/notifier"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+type WebhookHandler struct {
+	db       *database.DB
+	notifier *notifier.Notifier
+}
+
+func NewWebhookHandler(db *database.DB, n *notifier.Notifier) *WebhookHandler {
+	return &WebhookHandler{db: db, notifier: n}
+}
+
+// GetAllWebhooks 获取所有Webhook
+func (h *WebhookHandler) GetAllWebhooks(c *gin.Context) {
+	webhooks, err := h.db.GetAllWebhooks(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, webhooks)
+}
+
+// GetWebhook 获取单个Webhook
+func (h *WebhookHandler) GetWebhook(c *gin.Context) {
+	webhook, ok := h.loadWebhook(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, webhook)
+}
+
+// CreateWebhook 创建Webhook，默认启用并接收所有项目的事件
+func (h *WebhookHandler) CreateWebhook(c *gin.Context) {
+	webhook := models.Webhook{Enabled: true, AllProjects: true}
+	if err := c.ShouldBindJSON(&webhook); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if errs := validateWebhook(&webhook); len(errs) > 0 {
+		respondValidationErrors(c, "webhook", errs)
+		return
+	}
+
+	if err := h.db.CreateWebhook(c.Request.Context(), &webhook); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.respondWebhook(c, http.StatusCreated, webhook.ID)
+}
+
+// UpdateWebhook 更新Webhook，请求中没有的字段保留原值
+func (h *WebhookHandler) UpdateWebhook(c *gin.Context) {
+	webhook, ok := h.loadWebhook(c)
+	if !ok {
+		return
+	}
+	id := webhook.ID
+	if err := c.ShouldBindJSON(webhook); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	webhook.ID = id
+
+	if errs := validateWebhook(webhook); len(errs) > 0 {
+		respondValidationErrors(c, "webhook", errs)
+		return
+	}
+
+	if err := h.db.UpdateWebhook(c.Request.Context(), webhook); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.respondWebhook(c, http.StatusOK, webhook.ID)
+}
+
+// DeleteWebhook 删除Webhook及其投递记录
+func (h *WebhookHandler) DeleteWebhook(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook ID"})
+		return
+	}
+
+	if err := h.db.DeleteWebhook(c.Request.Context(), id); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.notifier.ForgetWebhook(id)
+	c.JSON(http.StatusOK, gin.H{"message": "Webhook deleted successfully"})
+}
+
+// GetDeliveries 获取Webhook最近的投递记录
+func (h *WebhookHandler) GetDeliveries(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook ID"})
+		return
+	}
+
+	limit := 50
+	if limitStr := c.Query("limit"); limitStr != "" {
+		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 {
+			limit = l
+		}
+	}
+
+	deliveries, err := h.db.GetWebhookDeliveries(c.Request.Context(), id, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, deliveries)
+}
+
+// TestWebhook 发送一次测试通知并返回投递结果
+func (h *WebhookHandler) TestWebhook(c *gin.Context) {
+	webhook, ok := h.loadWebhook(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, h.notifier.Test(c.Request.Context(), webhook))
+}
+
+// respondWebhook 返回保存后的Webhook（包含数据库生成的时间）
+func (h *WebhookHandler) respondWebhook(c *gin.Context, status int, id int64) {
+	webhook, err := h.db.GetWebhook(c.Request.Context(), id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(status, webhook)
+}
+
+func (h *WebhookHandler) loadWebhook(c *gin.Context) (*models.Webhook, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook ID"})
+		return nil, false
+	}
+	webhook, err := h.db.GetWebhook(c.Request.Context(), id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+		return nil, false
+	}
+	return webhook, true
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"jwt_refresher/config"
+	"jwt_refresher/database"
+	"log"
+)
+
+// runCommand dispatches maintenance subcommands such as key rotation
+func runCommand(name string, args []string) error {
+	switch name {
+	case "generate-key":
+		key, err := database.GenerateMasterKey()
+		if err != nil {
+			return err
+		}
+		fmt.Println(key)
+		return nil
+	case "rotate-key":
+		return rotateKey(args)
+	default:
+		return fmt.Errorf("unknown command %q (available: generate-key, rotate-key)", name)
+	}
+}
+
+// rotateKey re-encrypts every sensitive field with a new master key.
+// The current key is taken from the normal configuration.
+func rotateKey(args []string) error {
+	fs := flag.NewFlagSet("rotate-key", flag.ContinueOnError)
+	newKey := fs.String("new-key", "", "new master key (base64 or hex encoded 32 bytes)")
+	newKeyFile := fs.String("new-key-file", "", "file containing the new master key")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	newCipher, err := database.LoadCipher(*newKey, *newKeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load new key: %w", err)
+	}
+	if newCipher == nil {
+		return fmt.Errorf("-new-key or -new-key-file is required")
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+	oldCipher, err := database.LoadCipher(cfg.EncryptionKey, cfg.EncryptionKeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load current key: %w", err)
+	}
+
+	db, err := database.InitDB(cfg.DBPath, oldCipher)
+	if err != nil {
+		return fmt.Errorf("failed to open database: %w", err)
+	}
+	defer db.Close()
+
+	n, err := db.RotateKey(newCipher)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Re-encrypted %d rows with key %s", n, newCipher.KeyID())
+	log.Println("Update encryption_key / ENCRYPTION_KEY to the new key before restarting the service")
+	return nil
+}
@@ -17,6 +17,21 @@ type Config struct {
 	Password string `yaml:"password"`
 	LogFile  string `yaml:"log_file"`
 
+	// Master key for encrypting tokens and custom variables at rest
+	// (base64 or hex encoded 32 bytes), or a file containing it
+	EncryptionKey     string `yaml:"encryption_key"`
+	EncryptionKeyFile string `yaml:"encryption_key_file"`
+
+	// Refresh concurrency limits and graceful shutdown
+	MaxConcurrentRefreshes int `yaml:"max_concurrent_refreshes"`
+	MaxConcurrentPerHost   int `yaml:"max_concurrent_per_host"`
+	ShutdownTimeoutSeconds int `yaml:"shutdown_timeout_seconds"`
+
+	// Outbound proxy for refresh requests: empty uses HTTP_PROXY/HTTPS_PROXY,
+	// "direct" disables proxying, otherwise an http(s):// or socks5:// URL.
+	// Projects can override it
+	Proxy string `yaml:"proxy"`
+
 	// Computed fields (not in YAML)
 	DBPath string `yaml:"-"`
 }
@@ -27,6 +42,10 @@ func Load() (*Config, error) {
 		Port:    3007,
 		DataDir: "./data",
 		LogFile: "app.log",
+
+		MaxConcurrentRefreshes: 4,
+		MaxConcurrentPerHost:   2,
+		ShutdownTimeoutSeconds: 30,
 	}
 
 	// Try to load from config.yaml
@@ -57,6 +76,31 @@ func Load() (*Config, error) {
 	if logFile := os.Getenv("LOG_FILE"); logFile != "" {
 		cfg.LogFile = logFile
 	}
+	if key := os.Getenv("ENCRYPTION_KEY"); key != "" {
+		cfg.EncryptionKey = key
+	}
+	if keyFile := os.Getenv("ENCRYPTION_KEY_FILE"); keyFile != "" {
+		cfg.EncryptionKeyFile = keyFile
+	}
+	if n := os.Getenv("MAX_CONCURRENT_REFRESHES"); n != "" {
+		if v, err := strconv.Atoi(n); err == nil {
+			cfg.MaxConcurrentRefreshes = v
+		}
+	}
+	if n := os.Getenv("MAX_CONCURRENT_PER_HOST"); n != "" {
+		if v, err := strconv.Atoi(n); err == nil {
+			cfg.MaxConcurrentPerHost = v
+		}
+	}
+	if n := os.Getenv("SHUTDOWN_TIMEOUT_SECONDS"); n != "" {
+		if v, err := strconv.Atoi(n); err == nil {
+			cfg.ShutdownTimeoutSeconds = v
+		}
+	}
+
+	if proxy := os.Getenv("PROXY"); proxy != "" {
+		cfg.Proxy = proxy
+	}
 
 	// Compute derived paths
 	cfg.DBPath = filepath.Join(cfg.DataDir, "jwt_refresher.db")
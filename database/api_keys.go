@@ -0,0 +1,116 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"jwt_refresher/models"
+	"strings"
+)
+
+// API Key operations
+
+const apiKeyColumns = `id, name, prefix, key_hash, all_projects, project_ids, scopes,
+			expires_at, last_used_at, revoked_at, created_at`
+
+func scanAPIKey(row rowScanner) (*models.APIKey, error) {
+	k := &models.APIKey{}
+	var projectIDs, scopes sql.NullString
+	err := row.Scan(
+		&k.ID, &k.Name, &k.Prefix, &k.KeyHash, &k.AllProjects, &projectIDs, &scopes,
+		&k.ExpiresAt, &k.LastUsedAt, &k.RevokedAt, &k.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if projectIDs.String != "" {
+		if err := json.Unmarshal([]byte(projectIDs.String), &k.ProjectIDs); err != nil {
+			return nil, fmt.Errorf("invalid project_ids for api key %d: %w", k.ID, err)
+		}
+	}
+	if scopes.String != "" {
+		k.Scopes = strings.Split(scopes.String, ",")
+	}
+	return k, nil
+}
+
+func (db *DB) CreateAPIKey(ctx context.Context, k *models.APIKey) error {
+	projectIDs, err := json.Marshal(k.ProjectIDs)
+	if err != nil {
+		return fmt.Errorf("failed to encode project ids: %w", err)
+	}
+
+	query := `
+		INSERT INTO api_keys (
+			name, prefix, key_hash, all_projects, project_ids, scopes, expires_at
+		) VALUES (?, ?, ?, ?, ?, ?, ?)
+	`
+	result, err := db.ExecContext(ctx, query,
+		k.Name, k.Prefix, k.KeyHash, k.AllProjects, string(projectIDs),
+		strings.Join(k.Scopes, ","), k.ExpiresAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create api key: %w", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("failed to get last insert id: %w", err)
+	}
+	k.ID = id
+	return nil
+}
+
+func (db *DB) GetAllAPIKeys(ctx context.Context) ([]*models.APIKey, error) {
+	query := `SELECT ` + apiKeyColumns + ` FROM api_keys ORDER BY created_at DESC`
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get api keys: %w", err)
+	}
+	defer rows.Close()
+
+	var keys []*models.APIKey
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan api key: %w", err)
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+func (db *DB) GetAPIKeyByHash(ctx context.Context, hash string) (*models.APIKey, error) {
+	query := `SELECT ` + apiKeyColumns + ` FROM api_keys WHERE key_hash = ?`
+	k, err := scanAPIKey(db.QueryRowContext(ctx, query, hash))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get api key: %w", err)
+	}
+	return k, nil
+}
+
+func (db *DB) TouchAPIKey(ctx context.Context, id int64) error {
+	query := `UPDATE api_keys SET last_used_at = CURRENT_TIMESTAMP WHERE id = ?`
+	if _, err := db.ExecContext(ctx, query, id); err != nil {
+		return fmt.Errorf("failed to update api key last used: %w", err)
+	}
+	return nil
+}
+
+func (db *DB) RevokeAPIKey(ctx context.Context, id int64) error {
+	query := `UPDATE api_keys SET revoked_at = CURRENT_TIMESTAMP WHERE id = ? AND revoked_at IS NULL`
+	if _, err := db.ExecContext(ctx, query, id); err != nil {
+		return fmt.Errorf("failed to revoke api key: %w", err)
+	}
+	return nil
+}
+
+func (db *DB) DeleteAPIKey(ctx context.Context, id int64) error {
+	query := `DELETE FROM api_keys WHERE id = ?`
+	if _, err := db.ExecContext(ctx, query, id); err != nil {
+		return fmt.Errorf("failed to delete api key: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package database
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// 加密值格式: enc:v1:<密钥ID>:<被主密钥包裹的数据密钥>:<密文>
+const encryptedPrefix = "enc:v1:"
+
+const masterKeySize = 32
+
+// Cipher 使用AES-GCM对敏感字段做信封加密：
+// 每个值使用随机数据密钥加密，数据密钥再由主密钥加密后与密文一起保存
+type Cipher struct {
+	masterKey []byte
+	keyID     string
+}
+
+// NewCipher 使用32字节主密钥创建Cipher
+func NewCipher(masterKey []byte) (*Cipher, error) {
+	if len(masterKey) != masterKeySize {
+		return nil, fmt.Errorf("master key must be %d bytes, got %d", masterKeySize, len(masterKey))
+	}
+	sum := sha256.Sum256(masterKey)
+	return &Cipher{
+		masterKey: append([]byte(nil), masterKey...),
+		keyID:     hex.EncodeToString(sum[:4]),
+	}, nil
+}
+
+// KeyID 返回主密钥指纹，用于识别数据由哪个密钥加密
+func (c *Cipher) KeyID() string {
+	return c.keyID
+}
+
+// GenerateMasterKey 生成随机主密钥（base64编码）
+func GenerateMasterKey() (string, error) {
+	key := make([]byte, masterKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", fmt.Errorf("failed to generate master key: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// ParseMasterKey 解析base64或hex编码的主密钥
+func ParseMasterKey(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if key, err := base64.StdEncoding.DecodeString(s); err == nil && len(key) == masterKeySize {
+		return key, nil
+	}
+	if key, err := hex.DecodeString(s); err == nil && len(key) == masterKeySize {
+		return key, nil
+	}
+	return nil, fmt.Errorf("master key must be %d bytes encoded as base64 or hex", masterKeySize)
+}
+
+// LoadCipher 根据配置的密钥或密钥文件创建Cipher，两者都为空时返回nil（不加密）
+func LoadCipher(key, keyFile string) (*Cipher, error) {
+	if key == "" && keyFile != "" {
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key file: %w", err)
+		}
+		key = string(data)
+	}
+	if key == "" {
+		return nil, nil
+	}
+
+	masterKey, err := ParseMasterKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return NewCipher(masterKey)
+}
+
+// IsEncrypted 判断值是否为加密格式
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, encryptedPrefix)
+}
+
+// Encrypt 加密明文，空值和nil Cipher原样返回。以enc:v1:开头的值也会被加密，
+// 调用者需要自行跳过已加密的值（见EncryptPlaintextRows）
+func (c *Cipher) Encrypt(plaintext string) (string, error) {
+	if c == nil || plaintext == "" {
+		return plaintext, nil
+	}
+
+	dataKey := make([]byte, masterKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", fmt.Errorf("failed to generate data key: %w", err)
+	}
+
+	wrappedKey, err := seal(c.masterKey, dataKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to wrap data key: %w", err)
+	}
+	ciphertext, err := seal(dataKey, []byte(plaintext))
+	if err != nil {
+		return "", fmt.Errorf("failed to encrypt value: %w", err)
+	}
+
+	return encryptedPrefix + c.keyID + ":" +
+		base64.RawStdEncoding.EncodeToString(wrappedKey) + ":" +
+		base64.RawStdEncoding.EncodeToString(ciphertext), nil
+}
+
+// Decrypt 解密值，未加密的旧数据原样返回
+func (c *Cipher) Decrypt(value string) (string, error) {
+	if !IsEncrypted(value) {
+		return value, nil
+	}
+	if c == nil {
+		return "", errors.New("value is encrypted but no encryption key is configured")
+	}
+
+	parts := strings.Split(strings.TrimPrefix(value, encryptedPrefix), ":")
+	if len(parts) != 3 {
+		return "", errors.New("malformed encrypted value")
+	}
+	if parts[0] != c.keyID {
+		return "", fmt.Errorf("value was encrypted with key %s, current key is %s", parts[0], c.keyID)
+	}
+
+	wrappedKey, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("malformed wrapped key: %w", err)
+	}
+	ciphertext, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("malformed ciphertext: %w", err)
+	}
+
+	dataKey, err := open(c.masterKey, wrappedKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+	plaintext, err := open(dataKey, ciphertext)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt value: %w", err)
+	}
+	return string(plaintext), nil
+}
+
+func seal(key, plaintext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func open(key, data []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
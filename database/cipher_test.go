@@ -0,0 +1,272 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"jwt_refresher/models"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testCipher(t *testing.T, seed byte) *Cipher {
+	t.Helper()
+	c, err := NewCipher(bytes.Repeat([]byte{seed}, masterKeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestCipherRoundTrip(t *testing.T) {
+	c := testCipher(t, 1)
+
+	tests := []struct {
+		name      string
+		plaintext string
+		encrypted bool
+	}{
+		{name: "empty value is kept", plaintext: "", encrypted: false},
+		{name: "ascii", plaintext: "rt-0123456789", encrypted: true},
+		{name: "json", plaintext: `{"client_id":"abc","secret":"s3cr3t"}`, encrypted: true},
+		{name: "unicode", plaintext: "令牌🔑", encrypted: true},
+		{name: "looks encrypted", plaintext: "enc:v1:abcd1234:not:encrypted", encrypted: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			enc, err := c.Encrypt(tt.plaintext)
+			if err != nil {
+				t.Fatalf("Encrypt() error = %v", err)
+			}
+			if IsEncrypted(enc) != tt.encrypted {
+				t.Fatalf("Encrypt() = %q, encrypted = %v, want %v", enc, IsEncrypted(enc), tt.encrypted)
+			}
+			if tt.encrypted && strings.Contains(enc, tt.plaintext) {
+				t.Errorf("Encrypt() = %q contains the plaintext", enc)
+			}
+
+			got, err := c.Decrypt(enc)
+			if err != nil {
+				t.Fatalf("Decrypt() error = %v", err)
+			}
+			if got != tt.plaintext {
+				t.Errorf("Decrypt() = %q, want %q", got, tt.plaintext)
+			}
+
+			// 调用者传入的值总是被加密，即使看起来已经是加密格式
+			if !tt.encrypted {
+				return
+			}
+			again, err := c.Encrypt(enc)
+			if err != nil || again == enc {
+				t.Fatalf("Encrypt(encrypted) = %q, %v, want a new ciphertext", again, err)
+			}
+			if got, err := c.Decrypt(again); err != nil || got != enc {
+				t.Errorf("Decrypt(Encrypt(encrypted)) = %q, %v, want %q", got, err, enc)
+			}
+		})
+	}
+}
+
+func TestCipherEncryptIsRandomized(t *testing.T) {
+	c := testCipher(t, 1)
+	a, _ := c.Encrypt("same value")
+	b, _ := c.Encrypt("same value")
+	if a == b {
+		t.Errorf("Encrypt() returned the same ciphertext twice: %q", a)
+	}
+}
+
+func TestCipherDecryptErrors(t *testing.T) {
+	c1 := testCipher(t, 1)
+	c2 := testCipher(t, 2)
+	enc, err := c1.Encrypt("secret value")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(strings.TrimPrefix(enc, encryptedPrefix), ":")
+	ciphertext, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext[len(ciphertext)-1] ^= 0xff
+	tampered := base64.RawStdEncoding.EncodeToString(ciphertext)
+
+	tests := []struct {
+		name    string
+		cipher  *Cipher
+		value   string
+		want    string
+		wantErr string
+	}{
+		{name: "plaintext passes through", cipher: c1, value: "legacy", want: "legacy"},
+		{name: "plaintext without key", cipher: nil, value: "legacy", want: "legacy"},
+		{name: "encrypted without key", cipher: nil, value: enc, wantErr: "no encryption key"},
+		{name: "wrong key", cipher: c2, value: enc, wantErr: "encrypted with key " + c1.KeyID()},
+		{name: "missing parts", cipher: c1, value: encryptedPrefix + c1.KeyID() + ":abc", wantErr: "malformed encrypted value"},
+		{name: "bad base64", cipher: c1, value: encryptedPrefix + c1.KeyID() + ":!!:" + parts[2], wantErr: "malformed wrapped key"},
+		{name: "tampered ciphertext", cipher: c1, value: encryptedPrefix + parts[0] + ":" + parts[1] + ":" + tampered, wantErr: "failed to decrypt value"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.cipher.Decrypt(tt.value)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Decrypt() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Decrypt() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Decrypt() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseMasterKey(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, masterKeySize)
+
+	tests := []struct {
+		name    string
+		input   string
+		wantErr bool
+	}{
+		{name: "base64", input: base64.StdEncoding.EncodeToString(key)},
+		{name: "hex", input: hex.EncodeToString(key)},
+		{name: "surrounding whitespace", input: " " + base64.StdEncoding.EncodeToString(key) + "\n"},
+		{name: "too short", input: base64.StdEncoding.EncodeToString(key[:16]), wantErr: true},
+		{name: "not encoded", input: "not a key", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseMasterKey(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseMasterKey() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !bytes.Equal(got, key) {
+				t.Errorf("ParseMasterKey() = %x, want %x", got, key)
+			}
+		})
+	}
+}
+
+func TestRotateKey(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "test.db")
+	oldCipher := testCipher(t, 1)
+	newCipher := testCipher(t, 2)
+
+	db, err := InitDB(path, oldCipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	project := &models.Project{
+		Name:                "rotate",
+		Enabled:             true,
+		RefreshURL:          "https://auth.example.com/token",
+		RefreshHeaders:      `{"Authorization":"Bearer static"}`,
+		AccessTokenPath:     "access_token",
+		CurrentRefreshToken: "rt-before-rotation",
+		CustomVariables:     `{"client_secret":"abc"}`,
+	}
+	if err := db.CreateProject(ctx, project); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := db.RotateKey(newCipher)
+	if err != nil {
+		t.Fatalf("RotateKey() error = %v", err)
+	}
+	if n != 1 {
+		t.Errorf("RotateKey() rotated %d rows, want 1", n)
+	}
+
+	var stored string
+	if err := db.QueryRow(`SELECT current_refresh_token FROM projects WHERE id = ?`, project.ID).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(stored, encryptedPrefix+newCipher.KeyID()+":") {
+		t.Errorf("stored refresh token = %q, want encrypted with key %s", stored, newCipher.KeyID())
+	}
+
+	got, err := db.GetProject(ctx, project.ID)
+	if err != nil {
+		t.Fatalf("GetProject() after rotation error = %v", err)
+	}
+	if got.CurrentRefreshToken != project.CurrentRefreshToken || got.RefreshHeaders != project.RefreshHeaders ||
+		got.CustomVariables != project.CustomVariables {
+		t.Errorf("GetProject() after rotation = %q, %q, %q", got.CurrentRefreshToken, got.RefreshHeaders, got.CustomVariables)
+	}
+	db.Close()
+
+	// 旧密钥不能再解密
+	db, err = InitDB(path, oldCipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.GetProject(ctx, project.ID); err == nil {
+		t.Error("GetProject() with the old key succeeded, want an error")
+	}
+}
+
+func TestEncryptedLookingValues(t *testing.T) {
+	ctx := context.Background()
+	c := testCipher(t, 1)
+	db, err := InitDB(filepath.Join(t.TempDir(), "test.db"), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// 管理员输入和上游返回的值都可能以enc:v1:开头，必须加密保存，否则读取时被当作密文
+	other, _ := testCipher(t, 2).Encrypt("x")
+	project := &models.Project{
+		Name:                "prefixed",
+		Enabled:             true,
+		RefreshURL:          "https://auth.example.com/token",
+		AccessTokenPath:     "access_token",
+		OAuth2ClientSecret:  "enc:v1:secret",
+		CustomVariables:     `enc:v1:{"a":1}`,
+		Proxy:               other,
+		CurrentRefreshToken: "enc:v1:::",
+	}
+	if err := db.CreateProject(ctx, project); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.UpdateProjectTokens(ctx, project.ID, "enc:v1:access", "enc:v1:refresh", time.Now().Add(time.Hour), "", models.StatusSuccess); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := db.GetProject(ctx, project.ID)
+	if err != nil {
+		t.Fatalf("GetProject() error = %v", err)
+	}
+	tests := []struct {
+		name string
+		got  string
+		want string
+	}{
+		{name: "client secret", got: got.OAuth2ClientSecret, want: project.OAuth2ClientSecret},
+		{name: "custom variables", got: got.CustomVariables, want: project.CustomVariables},
+		{name: "ciphertext of another key", got: got.Proxy, want: other},
+		{name: "access token", got: got.CurrentAccessToken, want: "enc:v1:access"},
+		{name: "refresh token", got: got.CurrentRefreshToken, want: "enc:v1:refresh"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.got != tt.want {
+				t.Errorf("got %q, want %q", tt.got, tt.want)
+			}
+		})
+	}
+}
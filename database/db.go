@@ -1,9 +1,13 @@
 package database
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"jwt_refresher/models"
+	"log"
+	"strings"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -11,9 +15,11 @@ import (
 
 type DB struct {
 	*sql.DB
+	cipher *Cipher
 }
 
-func InitDB(dbPath string) (*DB, error) {
+// InitDB 打开数据库并建表，cipher为nil时敏感字段以明文存储
+func InitDB(dbPath string, cipher *Cipher) (*DB, error) {
 	db, err := sql.Open("sqlite3", dbPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
@@ -27,7 +33,24 @@ func InitDB(dbPath string) (*DB, error) {
 		return nil, fmt.Errorf("failed to create tables: %w", err)
 	}
 
-	return &DB{db}, nil
+	if err := migrateColumns(db); err != nil {
+		return nil, fmt.Errorf("failed to migrate tables: %w", err)
+	}
+
+	d := &DB{DB: db, cipher: cipher}
+
+	// 一次性迁移：加密旧数据库中的明文字段
+	if cipher != nil {
+		n, err := d.EncryptPlaintextRows()
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt existing data: %w", err)
+		}
+		if n > 0 {
+			log.Printf("Encrypted sensitive fields of %d existing rows", n)
+		}
+	}
+
+	return d, nil
 }
 
 func createTables(db *sql.DB) error {
@@ -44,7 +67,7 @@ func createTables(db *sql.DB) error {
 		refresh_body_template TEXT,
 
 		access_token_path TEXT NOT NULL,
-		refresh_token_path TEXT NOT NULL,
+		refresh_token_path TEXT,
 		expires_in_path TEXT,
 
 		custom_variables TEXT,
@@ -59,7 +82,7 @@ func createTables(db *sql.DB) error {
 		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
 		last_refresh_at DATETIME,
 		last_refresh_status TEXT
-	);`
+	);` // 之后新增的列见 columnMigrations
 
 	logsTable := `
 	CREATE TABLE IF NOT EXISTS refresh_logs (
@@ -76,6 +99,91 @@ func createTables(db *sql.DB) error {
 		FOREIGN KEY (project_id) REFERENCES projects(id) ON DELETE CASCADE
 	);`
 
+	apiKeysTable := `
+	CREATE TABLE IF NOT EXISTS api_keys (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		prefix TEXT NOT NULL,
+		key_hash TEXT NOT NULL UNIQUE,
+		all_projects BOOLEAN DEFAULT 0,
+		project_ids TEXT,
+		scopes TEXT,
+		expires_at DATETIME,
+		last_used_at DATETIME,
+		revoked_at DATETIME,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);`
+
+	webhooksTable := `
+	CREATE TABLE IF NOT EXISTS webhooks (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		url TEXT NOT NULL,
+		secret TEXT,
+		events TEXT,
+		all_projects BOOLEAN DEFAULT 1,
+		project_ids TEXT,
+		enabled BOOLEAN DEFAULT 1,
+		payload_template TEXT,
+		headers TEXT,
+		failure_threshold INTEGER DEFAULT 3,
+		expiry_warning_seconds INTEGER DEFAULT 600,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);`
+
+	webhookDeliveriesTable := `
+	CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		webhook_id INTEGER NOT NULL,
+		project_id INTEGER,
+		event TEXT NOT NULL,
+		status TEXT NOT NULL,
+		attempts INTEGER DEFAULT 0,
+		response_status INTEGER DEFAULT 0,
+		response_body TEXT,
+		error TEXT,
+		payload TEXT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		delivered_at DATETIME,
+		FOREIGN KEY (webhook_id) REFERENCES webhooks(id) ON DELETE CASCADE
+	);`
+
+	sinksTable := `
+	CREATE TABLE IF NOT EXISTS sinks (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		project_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		type TEXT NOT NULL,
+		enabled BOOLEAN DEFAULT 1,
+		format TEXT,
+		path TEXT,
+		file_mode TEXT,
+		url TEXT,
+		headers TEXT,
+		secret TEXT,
+		command TEXT,
+		timeout_seconds INTEGER DEFAULT 0,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (project_id) REFERENCES projects(id) ON DELETE CASCADE
+	);`
+
+	sinkDeliveriesTable := `
+	CREATE TABLE IF NOT EXISTS sink_deliveries (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		refresh_log_id INTEGER NOT NULL,
+		sink_id INTEGER NOT NULL,
+		sink_name TEXT,
+		sink_type TEXT,
+		status TEXT NOT NULL,
+		error TEXT,
+		output TEXT,
+		duration_ms INTEGER DEFAULT 0,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (refresh_log_id) REFERENCES refresh_logs(id) ON DELETE CASCADE
+	);`
+
 	if _, err := db.Exec(projectsTable); err != nil {
 		return fmt.Errorf("failed to create projects table: %w", err)
 	}
@@ -84,27 +192,132 @@ func createTables(db *sql.DB) error {
 		return fmt.Errorf("failed to create refresh_logs table: %w", err)
 	}
 
+	if _, err := db.Exec(apiKeysTable); err != nil {
+		return fmt.Errorf("failed to create api_keys table: %w", err)
+	}
+
+	if _, err := db.Exec(webhooksTable); err != nil {
+		return fmt.Errorf("failed to create webhooks table: %w", err)
+	}
+
+	if _, err := db.Exec(webhookDeliveriesTable); err != nil {
+		return fmt.Errorf("failed to create webhook_deliveries table: %w", err)
+	}
+
+	if _, err := db.Exec(sinksTable); err != nil {
+		return fmt.Errorf("failed to create sinks table: %w", err)
+	}
+
+	if _, err := db.Exec(sinkDeliveriesTable); err != nil {
+		return fmt.Errorf("failed to create sink_deliveries table: %w", err)
+	}
+
 	return nil
 }
 
 // Project CRUD operations
 
-func (db *DB) CreateProject(p *models.Project) error {
+const projectColumns = `id, name, description, enabled, project_type,
+			refresh_url, refresh_method, refresh_headers, refresh_body_template, refresh_steps,
+			oauth2_client_id, oauth2_client_secret, oauth2_scope, oauth2_audience,
+			oauth2_client_auth, oauth2_body_format,
+			tls_client_cert, tls_client_key, tls_ca_bundle, tls_server_name, tls_min_version, tls_insecure_skip_verify,
+			proxy,
+			response_format, access_token_path, refresh_token_path, expires_in_path, expires_format, expires_layout,
+			output_rules,
+			custom_variables, current_access_token, current_refresh_token, token_expires_at, outputs,
+			refresh_before_seconds, request_timeout_seconds,
+			retry_max_attempts, retry_base_delay_ms, retry_jitter, retry_on,
+			circuit_breaker_threshold, circuit_breaker_cooldown_seconds,
+			consecutive_failures, circuit_open_until,
+			error_matchers,
+			config_version, created_at, updated_at, last_refresh_at, last_refresh_status`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanProject 按projectColumns的顺序扫描一行并解密敏感字段
+func (db *DB) scanProject(row rowScanner) (*models.Project, error) {
+	pdb := &models.ProjectDB{}
+	err := row.Scan(
+		&pdb.ID, &pdb.Name, &pdb.Description, &pdb.Enabled, &pdb.ProjectType,
+		&pdb.RefreshURL, &pdb.RefreshMethod, &pdb.RefreshHeaders, &pdb.RefreshBodyTemplate, &pdb.RefreshSteps,
+		&pdb.OAuth2ClientID, &pdb.OAuth2ClientSecret, &pdb.OAuth2Scope, &pdb.OAuth2Audience,
+		&pdb.OAuth2ClientAuth, &pdb.OAuth2BodyFormat,
+		&pdb.TLSClientCert, &pdb.TLSClientKey, &pdb.TLSCABundle, &pdb.TLSServerName, &pdb.TLSMinVersion, &pdb.TLSInsecureSkipVerify,
+		&pdb.Proxy,
+		&pdb.ResponseFormat, &pdb.AccessTokenPath, &pdb.RefreshTokenPath, &pdb.ExpiresInPath, &pdb.ExpiresFormat, &pdb.ExpiresLayout,
+		&pdb.OutputRules,
+		&pdb.CustomVariables, &pdb.CurrentAccessToken, &pdb.CurrentRefreshToken, &pdb.TokenExpiresAt, &pdb.Outputs,
+		&pdb.RefreshBeforeSeconds, &pdb.RequestTimeoutSeconds,
+		&pdb.RetryMaxAttempts, &pdb.RetryBaseDelayMs, &pdb.RetryJitter, &pdb.RetryOn,
+		&pdb.CircuitBreakerThreshold, &pdb.CircuitBreakerCooldownSeconds,
+		&pdb.ConsecutiveFailures, &pdb.CircuitOpenUntil,
+		&pdb.ErrorMatchers,
+		&pdb.ConfigVersion, &pdb.CreatedAt, &pdb.UpdatedAt, &pdb.LastRefreshAt, &pdb.LastRefreshStatus,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, field := range []*sql.NullString{&pdb.CustomVariables, &pdb.CurrentAccessToken, &pdb.CurrentRefreshToken, &pdb.OAuth2ClientSecret, &pdb.Outputs, &pdb.TLSClientKey, &pdb.Proxy, &pdb.RefreshHeaders} {
+		if field.String, err = db.cipher.Decrypt(field.String); err != nil {
+			return nil, fmt.Errorf("failed to decrypt project %d: %w", pdb.ID, err)
+		}
+	}
+	return pdb.ToProject(), nil
+}
+
+// encryptAll 依次加密多个值
+func (db *DB) encryptAll(values ...string) ([]string, error) {
+	out := make([]string, len(values))
+	for i, v := range values {
+		enc, err := db.cipher.Encrypt(v)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = enc
+	}
+	return out, nil
+}
+
+func (db *DB) CreateProject(ctx context.Context, p *models.Project) error {
 	query := `
 		INSERT INTO projects (
-			name, description, enabled,
-			refresh_url, refresh_method, refresh_headers, refresh_body_template,
-			access_token_path, refresh_token_path, expires_in_path,
+			name, description, enabled, project_type,
+			refresh_url, refresh_method, refresh_headers, refresh_body_template, refresh_steps,
+			oauth2_client_id, oauth2_client_secret, oauth2_scope, oauth2_audience,
+			oauth2_client_auth, oauth2_body_format,
+			tls_client_cert, tls_client_key, tls_ca_bundle, tls_server_name, tls_min_version, tls_insecure_skip_verify,
+			proxy,
+			response_format, access_token_path, refresh_token_path, expires_in_path, expires_format, expires_layout,
+			output_rules,
 			custom_variables, current_refresh_token,
-			refresh_before_seconds
-		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			refresh_before_seconds, request_timeout_seconds,
+			retry_max_attempts, retry_base_delay_ms, retry_jitter, retry_on,
+			circuit_breaker_threshold, circuit_breaker_cooldown_seconds,
+			error_matchers
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
-	result, err := db.Exec(query,
-		p.Name, p.Description, p.Enabled,
-		p.RefreshURL, p.RefreshMethod, p.RefreshHeaders, p.RefreshBodyTemplate,
-		p.AccessTokenPath, p.RefreshTokenPath, p.ExpiresInPath,
-		p.CustomVariables, p.CurrentRefreshToken,
-		p.RefreshBeforeSeconds,
+	secrets, err := db.encryptAll(p.CustomVariables, p.CurrentRefreshToken, p.OAuth2ClientSecret, p.TLSClientKey, p.Proxy, p.RefreshHeaders)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt project: %w", err)
+	}
+	result, err := db.ExecContext(ctx, query,
+		p.Name, p.Description, p.Enabled, p.ProjectType,
+		p.RefreshURL, p.RefreshMethod, secrets[5], p.RefreshBodyTemplate, p.RefreshSteps,
+		p.OAuth2ClientID, secrets[2], p.OAuth2Scope, p.OAuth2Audience,
+		p.OAuth2ClientAuth, p.OAuth2BodyFormat,
+		p.TLSClientCert, secrets[3], p.TLSCABundle, p.TLSServerName, p.TLSMinVersion, p.TLSInsecureSkipVerify,
+		secrets[4],
+		p.ResponseFormat, p.AccessTokenPath, p.RefreshTokenPath, p.ExpiresInPath, p.ExpiresFormat, p.ExpiresLayout,
+		p.OutputRules,
+		secrets[0], secrets[1],
+		p.RefreshBeforeSeconds, p.RequestTimeoutSeconds,
+		p.RetryMaxAttempts, p.RetryBaseDelayMs, p.RetryJitter, p.RetryOn,
+		p.CircuitBreakerThreshold, p.CircuitBreakerCooldownSeconds,
+		p.ErrorMatchers,
 	)
 	if err != nil {
 		return fmt.Errorf("failed to create project: %w", err)
@@ -118,42 +331,24 @@ func (db *DB) CreateProject(p *models.Project) error {
 	return nil
 }
 
-func (db *DB) GetProject(id int64) (*models.Project, error) {
+func (db *DB) GetProject(ctx context.Context, id int64) (*models.Project, error) {
 	query := `
-		SELECT id, name, description, enabled,
-			refresh_url, refresh_method, refresh_headers, refresh_body_template,
-			access_token_path, refresh_token_path, expires_in_path,
-			custom_variables, current_access_token, current_refresh_token, token_expires_at,
-			refresh_before_seconds,
-			created_at, updated_at, last_refresh_at, last_refresh_status
+		SELECT ` + projectColumns + `
 		FROM projects WHERE id = ?
 	`
-	pdb := &models.ProjectDB{}
-	err := db.QueryRow(query, id).Scan(
-		&pdb.ID, &pdb.Name, &pdb.Description, &pdb.Enabled,
-		&pdb.RefreshURL, &pdb.RefreshMethod, &pdb.RefreshHeaders, &pdb.RefreshBodyTemplate,
-		&pdb.AccessTokenPath, &pdb.RefreshTokenPath, &pdb.ExpiresInPath,
-		&pdb.CustomVariables, &pdb.CurrentAccessToken, &pdb.CurrentRefreshToken, &pdb.TokenExpiresAt,
-		&pdb.RefreshBeforeSeconds,
-		&pdb.CreatedAt, &pdb.UpdatedAt, &pdb.LastRefreshAt, &pdb.LastRefreshStatus,
-	)
+	project, err := db.scanProject(db.QueryRowContext(ctx, query, id))
 	if err != nil {
 		return nil, fmt.Errorf("failed to get project: %w", err)
 	}
-	return pdb.ToProject(), nil
+	return project, nil
 }
 
-func (db *DB) GetAllProjects() ([]*models.Project, error) {
+func (db *DB) GetAllProjects(ctx context.Context) ([]*models.Project, error) {
 	query := `
-		SELECT id, name, description, enabled,
-			refresh_url, refresh_method, refresh_headers, refresh_body_template,
-			access_token_path, refresh_token_path, expires_in_path,
-			custom_variables, current_access_token, current_refresh_token, token_expires_at,
-			refresh_before_seconds,
-			created_at, updated_at, last_refresh_at, last_refresh_status
+		SELECT ` + projectColumns + `
 		FROM projects ORDER BY created_at DESC
 	`
-	rows, err := db.Query(query)
+	rows, err := db.QueryContext(ctx, query)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get projects: %w", err)
 	}
@@ -161,34 +356,21 @@ func (db *DB) GetAllProjects() ([]*models.Project, error) {
 
 	var projects []*models.Project
 	for rows.Next() {
-		pdb := &models.ProjectDB{}
-		err := rows.Scan(
-			&pdb.ID, &pdb.Name, &pdb.Description, &pdb.Enabled,
-			&pdb.RefreshURL, &pdb.RefreshMethod, &pdb.RefreshHeaders, &pdb.RefreshBodyTemplate,
-			&pdb.AccessTokenPath, &pdb.RefreshTokenPath, &pdb.ExpiresInPath,
-			&pdb.CustomVariables, &pdb.CurrentAccessToken, &pdb.CurrentRefreshToken, &pdb.TokenExpiresAt,
-			&pdb.RefreshBeforeSeconds,
-			&pdb.CreatedAt, &pdb.UpdatedAt, &pdb.LastRefreshAt, &pdb.LastRefreshStatus,
-		)
+		project, err := db.scanProject(rows)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan project: %w", err)
 		}
-		projects = append(projects, pdb.ToProject())
+		projects = append(projects, project)
 	}
 	return projects, nil
 }
 
-func (db *DB) GetEnabledProjects() ([]*models.Project, error) {
+func (db *DB) GetEnabledProjects(ctx context.Context) ([]*models.Project, error) {
 	query := `
-		SELECT id, name, description, enabled,
-			refresh_url, refresh_method, refresh_headers, refresh_body_template,
-			access_token_path, refresh_token_path, expires_in_path,
-			custom_variables, current_access_token, current_refresh_token, token_expires_at,
-			refresh_before_seconds,
-			created_at, updated_at, last_refresh_at, last_refresh_status
+		SELECT ` + projectColumns + `
 		FROM projects WHERE enabled = 1
 	`
-	rows, err := db.Query(query)
+	rows, err := db.QueryContext(ctx, query)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get enabled projects: %w", err)
 	}
@@ -196,93 +378,289 @@ func (db *DB) GetEnabledProjects() ([]*models.Project, error) {
 
 	var projects []*models.Project
 	for rows.Next() {
-		pdb := &models.ProjectDB{}
-		err := rows.Scan(
-			&pdb.ID, &pdb.Name, &pdb.Description, &pdb.Enabled,
-			&pdb.RefreshURL, &pdb.RefreshMethod, &pdb.RefreshHeaders, &pdb.RefreshBodyTemplate,
-			&pdb.AccessTokenPath, &pdb.RefreshTokenPath, &pdb.ExpiresInPath,
-			&pdb.CustomVariables, &pdb.CurrentAccessToken, &pdb.CurrentRefreshToken, &pdb.TokenExpiresAt,
-			&pdb.RefreshBeforeSeconds,
-			&pdb.CreatedAt, &pdb.UpdatedAt, &pdb.LastRefreshAt, &pdb.LastRefreshStatus,
-		)
+		project, err := db.scanProject(rows)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan project: %w", err)
 		}
-		projects = append(projects, pdb.ToProject())
+		projects = append(projects, project)
 	}
 	return projects, nil
 }
 
-func (db *DB) UpdateProject(p *models.Project) error {
+// ErrProjectModified 项目在读取之后已被其他请求修改
+var ErrProjectModified = errors.New("project has been modified")
+
+// bumpConfigVersion 修改配置的语句都递增config_version，刷新等运行状态的更新不递增
+const bumpConfigVersion = `config_version = config_version + 1, updated_at = strftime('%Y-%m-%d %H:%M:%f', 'now')`
+
+// UpdateProject 更新项目的所有配置列。refresh token为空时保留原值，access token等运行状态不变。
+// expectedVersion不为0时，只有项目的config_version与之相同时才更新，否则返回ErrProjectModified
+func (db *DB) UpdateProject(ctx context.Context, p *models.Project, expectedVersion int64) error {
 	query := `
 		UPDATE projects SET
-			name = ?, description = ?, enabled = ?,
-			refresh_url = ?, refresh_method = ?, refresh_headers = ?, refresh_body_template = ?,
-			access_token_path = ?, refresh_token_path = ?, expires_in_path = ?,
-			custom_variables = ?, current_refresh_token = ?,
-			refresh_before_seconds = ?,
-			updated_at = CURRENT_TIMESTAMP
+			name = ?, description = ?, enabled = ?, project_type = ?,
+			refresh_url = ?, refresh_method = ?, refresh_headers = ?, refresh_body_template = ?, refresh_steps = ?,
+			oauth2_client_id = ?, oauth2_client_secret = ?, oauth2_scope = ?, oauth2_audience = ?,
+			oauth2_client_auth = ?, oauth2_body_format = ?,
+			tls_client_cert = ?, tls_client_key = ?, tls_ca_bundle = ?, tls_server_name = ?, tls_min_version = ?, tls_insecure_skip_verify = ?,
+			proxy = ?,
+			response_format = ?, access_token_path = ?, refresh_token_path = ?, expires_in_path = ?, expires_format = ?, expires_layout = ?,
+			output_rules = ?,
+			custom_variables = ?, current_refresh_token = COALESCE(NULLIF(?, ''), current_refresh_token),
+			refresh_before_seconds = ?, request_timeout_seconds = ?,
+			retry_max_attempts = ?, retry_base_delay_ms = ?, retry_jitter = ?, retry_on = ?,
+			circuit_breaker_threshold = ?, circuit_breaker_cooldown_seconds = ?,
+			error_matchers = ?,
+			` + bumpConfigVersion + `
 		WHERE id = ?
 	`
-	_, err := db.Exec(query,
-		p.Name, p.Description, p.Enabled,
-		p.RefreshURL, p.RefreshMethod, p.RefreshHeaders, p.RefreshBodyTemplate,
-		p.AccessTokenPath, p.RefreshTokenPath, p.ExpiresInPath,
-		p.CustomVariables, p.CurrentRefreshToken,
-		p.RefreshBeforeSeconds,
+	secrets, err := db.encryptAll(p.CustomVariables, p.CurrentRefreshToken, p.OAuth2ClientSecret, p.TLSClientKey, p.Proxy, p.RefreshHeaders)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt project: %w", err)
+	}
+	args := []any{
+		p.Name, p.Description, p.Enabled, p.ProjectType,
+		p.RefreshURL, p.RefreshMethod, secrets[5], p.RefreshBodyTemplate, p.RefreshSteps,
+		p.OAuth2ClientID, secrets[2], p.OAuth2Scope, p.OAuth2Audience,
+		p.OAuth2ClientAuth, p.OAuth2BodyFormat,
+		p.TLSClientCert, secrets[3], p.TLSCABundle, p.TLSServerName, p.TLSMinVersion, p.TLSInsecureSkipVerify,
+		secrets[4],
+		p.ResponseFormat, p.AccessTokenPath, p.RefreshTokenPath, p.ExpiresInPath, p.ExpiresFormat, p.ExpiresLayout,
+		p.OutputRules,
+		secrets[0], secrets[1],
+		p.RefreshBeforeSeconds, p.RequestTimeoutSeconds,
+		p.RetryMaxAttempts, p.RetryBaseDelayMs, p.RetryJitter, p.RetryOn,
+		p.CircuitBreakerThreshold, p.CircuitBreakerCooldownSeconds,
+		p.ErrorMatchers,
 		p.ID,
-	)
+	}
+	return db.execVersioned(ctx, query, args, expectedVersion)
+}
+
+// patchableColumns 可以通过PatchProject修改的列及其在项目中的值，列名与JSON字段名相同
+func patchableColumns(p *models.Project) map[string]any {
+	return map[string]any{
+		"name":                             p.Name,
+		"description":                      p.Description,
+		"enabled":                          p.Enabled,
+		"project_type":                     p.ProjectType,
+		"refresh_url":                      p.RefreshURL,
+		"refresh_method":                   p.RefreshMethod,
+		"refresh_headers":                  p.RefreshHeaders,
+		"refresh_body_template":            p.RefreshBodyTemplate,
+		"refresh_steps":                    p.RefreshSteps,
+		"oauth2_client_id":                 p.OAuth2ClientID,
+		"oauth2_client_secret":             p.OAuth2ClientSecret,
+		"oauth2_scope":                     p.OAuth2Scope,
+		"oauth2_audience":                  p.OAuth2Audience,
+		"oauth2_client_auth":               p.OAuth2ClientAuth,
+		"oauth2_body_format":               p.OAuth2BodyFormat,
+		"tls_client_cert":                  p.TLSClientCert,
+		"tls_client_key":                   p.TLSClientKey,
+		"tls_ca_bundle":                    p.TLSCABundle,
+		"tls_server_name":                  p.TLSServerName,
+		"tls_min_version":                  p.TLSMinVersion,
+		"tls_insecure_skip_verify":         p.TLSInsecureSkipVerify,
+		"proxy":                            p.Proxy,
+		"response_format":                  p.ResponseFormat,
+		"access_token_path":                p.AccessTokenPath,
+		"refresh_token_path":               p.RefreshTokenPath,
+		"expires_in_path":                  p.ExpiresInPath,
+		"expires_format":                   p.ExpiresFormat,
+		"expires_layout":                   p.ExpiresLayout,
+		"output_rules":                     p.OutputRules,
+		"custom_variables":                 p.CustomVariables,
+		"current_refresh_token":            p.CurrentRefreshToken,
+		"refresh_before_seconds":           p.RefreshBeforeSeconds,
+		"request_timeout_seconds":          p.RequestTimeoutSeconds,
+		"retry_max_attempts":               p.RetryMaxAttempts,
+		"retry_base_delay_ms":              p.RetryBaseDelayMs,
+		"retry_jitter":                     p.RetryJitter,
+		"retry_on":                         p.RetryOn,
+		"circuit_breaker_threshold":        p.CircuitBreakerThreshold,
+		"circuit_breaker_cooldown_seconds": p.CircuitBreakerCooldownSeconds,
+		"error_matchers":                   p.ErrorMatchers,
+	}
+}
+
+// IsPatchableColumn 判断字段能否通过PatchProject修改
+func IsPatchableColumn(column string) bool {
+	_, ok := patchableColumns(&models.Project{})[column]
+	return ok
+}
+
+// PatchProject 只更新columns中列出的列，值取自p，其他列（包括token）保持不变。
+// expectedVersion的含义与UpdateProject相同
+func (db *DB) PatchProject(ctx context.Context, p *models.Project, columns []string, expectedVersion int64) error {
+	values := patchableColumns(p)
+	encrypted := make(map[string]bool)
+	for _, column := range encryptedColumns["projects"] {
+		encrypted[column] = true
+	}
+
+	var sets []string
+	var args []any
+	for _, column := range columns {
+		value, ok := values[column]
+		if !ok {
+			return fmt.Errorf("column %s cannot be patched", column)
+		}
+		if encrypted[column] {
+			enc, err := db.cipher.Encrypt(value.(string))
+			if err != nil {
+				return fmt.Errorf("failed to encrypt project: %w", err)
+			}
+			value = enc
+		}
+		sets = append(sets, column+" = ?")
+		args = append(args, value)
+	}
+	sets = append(sets, bumpConfigVersion)
+	args = append(args, p.ID)
+
+	query := `UPDATE projects SET ` + strings.Join(sets, ", ") + ` WHERE id = ?`
+	return db.execVersioned(ctx, query, args, expectedVersion)
+}
+
+// execVersioned 执行以 "WHERE id = ?" 结尾的更新语句，expectedVersion不为0时追加乐观锁条件
+func (db *DB) execVersioned(ctx context.Context, query string, args []any, expectedVersion int64) error {
+	if expectedVersion != 0 {
+		query += ` AND config_version = ?`
+		args = append(args, expectedVersion)
+	}
+
+	result, err := db.ExecContext(ctx, query, args...)
 	if err != nil {
 		return fmt.Errorf("failed to update project: %w", err)
 	}
+	if expectedVersion != 0 {
+		n, err := result.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("failed to update project: %w", err)
+		}
+		if n == 0 {
+			return ErrProjectModified
+		}
+	}
 	return nil
 }
 
-func (db *DB) UpdateProjectTokens(id int64, accessToken, refreshToken string, expiresAt time.Time, status string) error {
+// UpdateProjectTokens 保存刷新结果，refreshToken为空时保留原有的refresh token，
+// expiresAt为零值表示过期时间未知，outputs为额外提取的值 (JSON对象)
+func (db *DB) UpdateProjectTokens(ctx context.Context, id int64, accessToken, refreshToken string, expiresAt time.Time, outputs, status string) error {
 	query := `
 		UPDATE projects SET
 			current_access_token = ?,
-			current_refresh_token = ?,
+			current_refresh_token = COALESCE(NULLIF(?, ''), current_refresh_token),
 			token_expires_at = ?,
+			outputs = ?,
 			last_refresh_at = CURRENT_TIMESTAMP,
 			last_refresh_status = ?,
-			updated_at = CURRENT_TIMESTAMP
+			consecutive_failures = 0,
+			circuit_open_until = NULL,
+			updated_at = strftime('%Y-%m-%d %H:%M:%f', 'now')
 		WHERE id = ?
 	`
-	_, err := db.Exec(query, accessToken, refreshToken, expiresAt, status, id)
+	secrets, err := db.encryptAll(accessToken, refreshToken, outputs)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt tokens: %w", err)
+	}
+	// 过期时间未知时写入NULL
+	expires := sql.NullTime{Time: expiresAt, Valid: !expiresAt.IsZero()}
+	_, err = db.ExecContext(ctx, query, secrets[0], secrets[1], expires, secrets[2], status, id)
 	if err != nil {
 		return fmt.Errorf("failed to update project tokens: %w", err)
 	}
 	return nil
 }
 
-func (db *DB) UpdateProjectRefreshStatus(id int64, status string) error {
+func (db *DB) UpdateProjectRefreshStatus(ctx context.Context, id int64, status string) error {
 	query := `
 		UPDATE projects SET
 			last_refresh_at = CURRENT_TIMESTAMP,
 			last_refresh_status = ?,
-			updated_at = CURRENT_TIMESTAMP
+			updated_at = strftime('%Y-%m-%d %H:%M:%f', 'now')
 		WHERE id = ?
 	`
-	_, err := db.Exec(query, status, id)
+	_, err := db.ExecContext(ctx, query, status, id)
 	if err != nil {
 		return fmt.Errorf("failed to update project refresh status: %w", err)
 	}
 	return nil
 }
 
-func (db *DB) DeleteProject(id int64) error {
+// RecordRefreshFailure 记录一次刷新失败并返回连续失败次数
+func (db *DB) RecordRefreshFailure(ctx context.Context, id int64, status string) (int, error) {
+	query := `
+		UPDATE projects SET
+			last_refresh_at = CURRENT_TIMESTAMP,
+			last_refresh_status = ?,
+			consecutive_failures = consecutive_failures + 1,
+			updated_at = strftime('%Y-%m-%d %H:%M:%f', 'now')
+		WHERE id = ?
+		RETURNING consecutive_failures
+	`
+	var failures int
+	if err := db.QueryRowContext(ctx, query, status, id).Scan(&failures); err != nil {
+		return 0, fmt.Errorf("failed to record refresh failure: %w", err)
+	}
+	return failures, nil
+}
+
+// OpenCircuit 打开熔断器，在until之前调度器不再刷新该项目
+func (db *DB) OpenCircuit(ctx context.Context, id int64, until time.Time) error {
+	query := `
+		UPDATE projects SET
+			circuit_open_until = ?,
+			last_refresh_status = ?,
+			updated_at = strftime('%Y-%m-%d %H:%M:%f', 'now')
+		WHERE id = ?
+	`
+	_, err := db.ExecContext(ctx, query, until, models.StatusCircuitOpen, id)
+	if err != nil {
+		return fmt.Errorf("failed to open circuit: %w", err)
+	}
+	return nil
+}
+
+// Reauthorize 保存新的refresh token并清除needs_reauth、失败计数和熔断状态
+func (db *DB) Reauthorize(ctx context.Context, id int64, refreshToken string) error {
+	query := `
+		UPDATE projects SET
+			current_refresh_token = ?,
+			last_refresh_status = ?,
+			consecutive_failures = 0,
+			circuit_open_until = NULL,
+			updated_at = strftime('%Y-%m-%d %H:%M:%f', 'now')
+		WHERE id = ?
+	`
+	secrets, err := db.encryptAll(refreshToken)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt refresh token: %w", err)
+	}
+	_, err = db.ExecContext(ctx, query, secrets[0], models.StatusReauthorized, id)
+	if err != nil {
+		return fmt.Errorf("failed to reauthorize project: %w", err)
+	}
+	return nil
+}
+
+func (db *DB) DeleteProject(ctx context.Context, id int64) error {
+	if _, err := db.ExecContext(ctx, `DELETE FROM sinks WHERE project_id = ?`, id); err != nil {
+		return fmt.Errorf("failed to delete project sinks: %w", err)
+	}
+
 	query := `DELETE FROM projects WHERE id = ?`
-	_, err := db.Exec(query, id)
+	_, err := db.ExecContext(ctx, query, id)
 	if err != nil {
 		return fmt.Errorf("failed to delete project: %w", err)
 	}
 	return nil
 }
 
-func (db *DB) ToggleProject(id int64) error {
-	query := `UPDATE projects SET enabled = NOT enabled, updated_at = CURRENT_TIMESTAMP WHERE id = ?`
-	_, err := db.Exec(query, id)
+func (db *DB) ToggleProject(ctx context.Context, id int64) error {
+	query := `UPDATE projects SET enabled = NOT enabled, ` + bumpConfigVersion + ` WHERE id = ?`
+	_, err := db.ExecContext(ctx, query, id)
 	if err != nil {
 		return fmt.Errorf("failed to toggle project: %w", err)
 	}
@@ -291,20 +669,20 @@ func (db *DB) ToggleProject(id int64) error {
 
 // RefreshLog operations
 
-func (db *DB) CreateRefreshLog(log *models.RefreshLog) error {
+func (db *DB) CreateRefreshLog(ctx context.Context, log *models.RefreshLog) error {
 	query := `
 		INSERT INTO refresh_logs (
 			project_id, status, error_message,
 			old_token_preview, new_token_preview,
 			old_refresh_token_preview, new_refresh_token_preview,
-			response_body
-		) VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+			response_body, failed_step, proxy
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
-	result, err := db.Exec(query,
+	result, err := db.ExecContext(ctx, query,
 		log.ProjectID, log.Status, log.ErrorMessage,
 		log.OldTokenPreview, log.NewTokenPreview,
 		log.OldRefreshTokenPreview, log.NewRefreshTokenPreview,
-		log.ResponseBody,
+		log.ResponseBody, log.FailedStep, log.Proxy,
 	)
 	if err != nil {
 		return fmt.Errorf("failed to create refresh log: %w", err)
@@ -318,18 +696,18 @@ func (db *DB) CreateRefreshLog(log *models.RefreshLog) error {
 	return nil
 }
 
-func (db *DB) GetProjectLogs(projectID int64, limit int) ([]*models.RefreshLog, error) {
+func (db *DB) GetProjectLogs(ctx context.Context, projectID int64, limit int) ([]*models.RefreshLog, error) {
 	query := `
 		SELECT id, project_id, refresh_at, status, error_message,
 			old_token_preview, new_token_preview,
 			old_refresh_token_preview, new_refresh_token_preview,
-			response_body
+			response_body, COALESCE(failed_step, ''), COALESCE(proxy, '')
 		FROM refresh_logs
 		WHERE project_id = ?
 		ORDER BY refresh_at DESC
 		LIMIT ?
 	`
-	rows, err := db.Query(query, projectID, limit)
+	rows, err := db.QueryContext(ctx, query, projectID, limit)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get project logs: %w", err)
 	}
@@ -342,12 +720,15 @@ func (db *DB) GetProjectLogs(projectID int64, limit int) ([]*models.RefreshLog,
 			&log.ID, &log.ProjectID, &log.RefreshAt, &log.Status, &log.ErrorMessage,
 			&log.OldTokenPreview, &log.NewTokenPreview,
 			&log.OldRefreshTokenPreview, &log.NewRefreshTokenPreview,
-			&log.ResponseBody,
+			&log.ResponseBody, &log.FailedStep, &log.Proxy,
 		)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan refresh log: %w", err)
 		}
 		logs = append(logs, log)
 	}
+	if err := db.attachSinkDeliveries(ctx, logs); err != nil {
+		return nil, err
+	}
 	return logs, nil
 }
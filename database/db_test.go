@@ -0,0 +1,115 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"jwt_refresher/models"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestProjectConfigVersion(t *testing.T) {
+	ctx := context.Background()
+	db, err := InitDB(filepath.Join(t.TempDir(), "test.db"), testCipher(t, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	project := &models.Project{
+		Name:                "versioned",
+		Enabled:             true,
+		RefreshURL:          "https://auth.example.com/token",
+		AccessTokenPath:     "access_token",
+		CurrentRefreshToken: "rt-1",
+	}
+	if err := db.CreateProject(ctx, project); err != nil {
+		t.Fatal(err)
+	}
+
+	// 依次执行，每一步之后检查config_version和refresh token
+	tests := []struct {
+		name        string
+		update      func(version int64) error
+		expected    int64
+		wantErr     error
+		wantVersion int64
+	}{
+		{
+			name: "patch with current version",
+			update: func(version int64) error {
+				return db.PatchProject(ctx, &models.Project{ID: project.ID, Description: "patched"}, []string{"description"}, version)
+			},
+			expected:    1,
+			wantVersion: 2,
+		},
+		{
+			name: "patch with stale version",
+			update: func(version int64) error {
+				return db.PatchProject(ctx, &models.Project{ID: project.ID, Description: "lost"}, []string{"description"}, version)
+			},
+			expected:    1,
+			wantErr:     ErrProjectModified,
+			wantVersion: 2,
+		},
+		{
+			name: "refresh does not change the version",
+			update: func(int64) error {
+				return db.UpdateProjectTokens(ctx, project.ID, "at-1", "rt-2", time.Now().Add(time.Hour), "", models.StatusSuccess)
+			},
+			wantVersion: 2,
+		},
+		{
+			name: "put with stale version",
+			update: func(version int64) error {
+				p := *project
+				p.Description = "lost"
+				return db.UpdateProject(ctx, &p, version)
+			},
+			expected:    1,
+			wantErr:     ErrProjectModified,
+			wantVersion: 2,
+		},
+		{
+			name: "put without version check",
+			update: func(version int64) error {
+				p := *project
+				p.Description = "replaced"
+				p.CurrentRefreshToken = ""
+				return db.UpdateProject(ctx, &p, version)
+			},
+			expected:    0,
+			wantVersion: 3,
+		},
+		{
+			name:        "toggle bumps the version",
+			update:      func(int64) error { return db.ToggleProject(ctx, project.ID) },
+			wantVersion: 4,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.update(tt.expected)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("update error = %v, want %v", err, tt.wantErr)
+			}
+
+			got, err := db.GetProject(ctx, project.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.ConfigVersion != tt.wantVersion {
+				t.Errorf("config_version = %d, want %d", got.ConfigVersion, tt.wantVersion)
+			}
+			if got.Description == "lost" {
+				t.Error("rejected update was applied")
+			}
+			// 不带refresh token的配置更新不会覆盖刷新轮换后的refresh token
+			if got.CurrentAccessToken != "" && got.CurrentRefreshToken != "rt-2" {
+				t.Errorf("refresh token = %q, want %q", got.CurrentRefreshToken, "rt-2")
+			}
+		})
+	}
+}
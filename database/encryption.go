@@ -0,0 +1,124 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// encryptedColumns 列出各表中需要加密存储的字段
+var encryptedColumns = map[string][]string{
+	"projects": {"custom_variables", "current_access_token", "current_refresh_token", "oauth2_client_secret", "outputs", "tls_client_key", "proxy", "refresh_headers"},
+	"webhooks": {"secret", "headers"},
+	"sinks":    {"secret", "headers"},
+}
+
+// EncryptPlaintextRows 加密所有仍为明文的敏感字段，返回被修改的行数
+func (db *DB) EncryptPlaintextRows() (int, error) {
+	return db.reencrypt(db.cipher, func(value string) bool {
+		return !IsEncrypted(value)
+	})
+}
+
+// RotateKey 使用新主密钥重新加密所有敏感字段，成功后切换为新密钥
+func (db *DB) RotateKey(newCipher *Cipher) (int, error) {
+	if newCipher == nil {
+		return 0, fmt.Errorf("new encryption key is required")
+	}
+	n, err := db.reencrypt(newCipher, func(string) bool { return true })
+	if err != nil {
+		return 0, err
+	}
+	db.cipher = newCipher
+	return n, nil
+}
+
+// reencrypt 在一个事务内用当前密钥解密、用target重新加密所有满足条件的字段
+func (db *DB) reencrypt(target *Cipher, needs func(value string) bool) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	total := 0
+	for table, columns := range encryptedColumns {
+		n, err := db.reencryptTable(tx, table, columns, target, needs)
+		if err != nil {
+			return 0, err
+		}
+		total += n
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return total, nil
+}
+
+func (db *DB) reencryptTable(tx *sql.Tx, table string, columns []string, target *Cipher, needs func(string) bool) (int, error) {
+	rows, err := tx.Query(fmt.Sprintf("SELECT id, %s FROM %s", strings.Join(columns, ", "), table))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read %s: %w", table, err)
+	}
+
+	type pending struct {
+		id     int64
+		values []any
+	}
+	var updates []pending
+
+	for rows.Next() {
+		var id int64
+		values := make([]sql.NullString, len(columns))
+		dest := []any{&id}
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan %s: %w", table, err)
+		}
+
+		changed := false
+		out := make([]any, len(columns))
+		for i, v := range values {
+			out[i] = v
+			if !v.Valid || v.String == "" || !needs(v.String) {
+				continue
+			}
+			plain, err := db.cipher.Decrypt(v.String)
+			if err != nil {
+				rows.Close()
+				return 0, fmt.Errorf("failed to decrypt %s.%s (id %d): %w", table, columns[i], id, err)
+			}
+			enc, err := target.Encrypt(plain)
+			if err != nil {
+				rows.Close()
+				return 0, fmt.Errorf("failed to encrypt %s.%s (id %d): %w", table, columns[i], id, err)
+			}
+			out[i] = enc
+			changed = true
+		}
+		if changed {
+			updates = append(updates, pending{id: id, values: out})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return 0, fmt.Errorf("failed to read %s: %w", table, err)
+	}
+	rows.Close()
+
+	sets := make([]string, len(columns))
+	for i, col := range columns {
+		sets[i] = col + " = ?"
+	}
+	query := fmt.Sprintf("UPDATE %s SET %s WHERE id = ?", table, strings.Join(sets, ", "))
+	for _, u := range updates {
+		if _, err := tx.Exec(query, append(u.values, u.id)...); err != nil {
+			return 0, fmt.Errorf("failed to update %s (id %d): %w", table, u.id, err)
+		}
+	}
+	return len(updates), nil
+}
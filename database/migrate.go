@@ -0,0 +1,110 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// columnMigration 描述在建表之后新增的列，新旧数据库都通过ALTER TABLE补齐
+type columnMigration struct {
+	table      string
+	column     string
+	definition string
+}
+
+var columnMigrations = []columnMigration{
+	// 重试策略与熔断
+	{"projects", "retry_max_attempts", "INTEGER DEFAULT 3"},
+	{"projects", "retry_base_delay_ms", "INTEGER DEFAULT 1000"},
+	{"projects", "retry_jitter", "REAL DEFAULT 0.2"},
+	{"projects", "retry_on", "TEXT DEFAULT 'network,timeout,429,500-599'"},
+	{"projects", "circuit_breaker_threshold", "INTEGER DEFAULT 5"},
+	{"projects", "circuit_breaker_cooldown_seconds", "INTEGER DEFAULT 600"},
+	{"projects", "consecutive_failures", "INTEGER DEFAULT 0"},
+	{"projects", "circuit_open_until", "DATETIME"},
+
+	// 错误分类
+	{"projects", "error_matchers", "TEXT"},
+	{"projects", "request_timeout_seconds", "INTEGER DEFAULT 30"},
+	{"projects", "project_type", "TEXT DEFAULT 'custom'"},
+	{"projects", "oauth2_client_id", "TEXT"},
+	{"projects", "oauth2_client_secret", "TEXT"},
+	{"projects", "oauth2_scope", "TEXT"},
+	{"projects", "oauth2_audience", "TEXT"},
+	{"projects", "oauth2_client_auth", "TEXT DEFAULT 'basic'"},
+	{"projects", "oauth2_body_format", "TEXT DEFAULT 'form'"},
+	{"projects", "expires_format", "TEXT DEFAULT 'seconds'"},
+	{"projects", "expires_layout", "TEXT"},
+	{"projects", "response_format", "TEXT DEFAULT 'auto'"},
+	{"projects", "output_rules", "TEXT"},
+	{"projects", "outputs", "TEXT"},
+
+	// 多步骤刷新
+	{"projects", "refresh_steps", "TEXT"},
+	{"refresh_logs", "failed_step", "TEXT"},
+
+	// TLS
+	{"projects", "tls_client_cert", "TEXT"},
+	{"projects", "tls_client_key", "TEXT"},
+	{"projects", "tls_ca_bundle", "TEXT"},
+	{"projects", "tls_server_name", "TEXT"},
+	{"projects", "tls_min_version", "TEXT"},
+	{"projects", "tls_insecure_skip_verify", "BOOLEAN DEFAULT 0"},
+
+	// 出站代理
+	{"projects", "proxy", "TEXT"},
+	{"refresh_logs", "proxy", "TEXT"},
+
+	// 配置版本，用于ETag
+	{"projects", "config_version", "INTEGER DEFAULT 1"},
+}
+
+// migrateColumns 为缺少新列的表执行ALTER TABLE
+func migrateColumns(db *sql.DB) error {
+	existing := make(map[string]map[string]bool)
+
+	for _, m := range columnMigrations {
+		cols, ok := existing[m.table]
+		if !ok {
+			var err error
+			if cols, err = tableColumns(db, m.table); err != nil {
+				return err
+			}
+			existing[m.table] = cols
+		}
+		if cols[m.column] {
+			continue
+		}
+
+		query := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", m.table, m.column, m.definition)
+		if _, err := db.Exec(query); err != nil {
+			return fmt.Errorf("failed to add column %s.%s: %w", m.table, m.column, err)
+		}
+		cols[m.column] = true
+	}
+	return nil
+}
+
+func tableColumns(db *sql.DB, table string) (map[string]bool, error) {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read columns of %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	cols := make(map[string]bool)
+	for rows.Next() {
+		var (
+			cid        int
+			name, typ  string
+			notNull    bool
+			defaultVal sql.NullString
+			pk         int
+		)
+		if err := rows.Scan(&cid, &name, &typ, &notNull, &defaultVal, &pk); err != nil {
+			return nil, fmt.Errorf("failed to scan columns of %s: %w", table, err)
+		}
+		cols[name] = true
+	}
+	return cols, rows.Err()
+}
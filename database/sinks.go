@@ -0,0 +1,200 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"jwt_refresher/models"
+	"strings"
+)
+
+// Sink operations
+
+const sinkColumns = `id, project_id, name, type, enabled, format,
+			path, file_mode, url, headers, secret, command, timeout_seconds,
+			created_at, updated_at`
+
+func (db *DB) scanSink(row rowScanner) (*models.Sink, error) {
+	s := &models.Sink{}
+	var format, path, fileMode, url, headers, secret, command sql.NullString
+	err := row.Scan(
+		&s.ID, &s.ProjectID, &s.Name, &s.Type, &s.Enabled, &format,
+		&path, &fileMode, &url, &headers, &secret, &command, &s.TimeoutSeconds,
+		&s.CreatedAt, &s.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.Secret, err = db.cipher.Decrypt(secret.String); err != nil {
+		return nil, fmt.Errorf("failed to decrypt sink %d: %w", s.ID, err)
+	}
+	if s.Headers, err = db.cipher.Decrypt(headers.String); err != nil {
+		return nil, fmt.Errorf("failed to decrypt sink %d: %w", s.ID, err)
+	}
+	s.Format = format.String
+	s.Path = path.String
+	s.FileMode = fileMode.String
+	s.URL = url.String
+	s.Command = command.String
+	return s, nil
+}
+
+// sinkArgs 按CreateSink/UpdateSink的列顺序返回参数
+func (db *DB) sinkArgs(s *models.Sink) ([]any, error) {
+	secrets, err := db.encryptAll(s.Headers, s.Secret)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt sink: %w", err)
+	}
+	return []any{
+		s.Name, s.Type, s.Enabled, s.Format,
+		s.Path, s.FileMode, s.URL, secrets[0], secrets[1], s.Command, s.TimeoutSeconds,
+	}, nil
+}
+
+func (db *DB) CreateSink(ctx context.Context, s *models.Sink) error {
+	args, err := db.sinkArgs(s)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO sinks (
+			project_id, name, type, enabled, format,
+			path, file_mode, url, headers, secret, command, timeout_seconds
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	result, err := db.ExecContext(ctx, query, append([]any{s.ProjectID}, args...)...)
+	if err != nil {
+		return fmt.Errorf("failed to create sink: %w", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("failed to get last insert id: %w", err)
+	}
+	s.ID = id
+	return nil
+}
+
+func (db *DB) UpdateSink(ctx context.Context, s *models.Sink) error {
+	args, err := db.sinkArgs(s)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		UPDATE sinks SET
+			name = ?, type = ?, enabled = ?, format = ?,
+			path = ?, file_mode = ?, url = ?, headers = ?, secret = ?, command = ?, timeout_seconds = ?,
+			updated_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND project_id = ?
+	`
+	result, err := db.ExecContext(ctx, query, append(args, s.ID, s.ProjectID)...)
+	if err != nil {
+		return fmt.Errorf("failed to update sink: %w", err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// GetSink 获取项目的sink，sink不属于该项目时返回sql.ErrNoRows
+func (db *DB) GetSink(ctx context.Context, projectID, id int64) (*models.Sink, error) {
+	query := `SELECT ` + sinkColumns + ` FROM sinks WHERE id = ? AND project_id = ?`
+	return db.scanSink(db.QueryRowContext(ctx, query, id, projectID))
+}
+
+func (db *DB) GetProjectSinks(ctx context.Context, projectID int64) ([]*models.Sink, error) {
+	return db.querySinks(ctx, `SELECT `+sinkColumns+` FROM sinks WHERE project_id = ? ORDER BY id`, projectID)
+}
+
+// GetEnabledSinks 获取项目所有启用的sink，刷新成功后依次推送
+func (db *DB) GetEnabledSinks(ctx context.Context, projectID int64) ([]*models.Sink, error) {
+	return db.querySinks(ctx, `SELECT `+sinkColumns+` FROM sinks WHERE project_id = ? AND enabled = 1 ORDER BY id`, projectID)
+}
+
+func (db *DB) querySinks(ctx context.Context, query string, args ...any) ([]*models.Sink, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get sinks: %w", err)
+	}
+	defer rows.Close()
+
+	var sinks []*models.Sink
+	for rows.Next() {
+		s, err := db.scanSink(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan sink: %w", err)
+		}
+		sinks = append(sinks, s)
+	}
+	return sinks, nil
+}
+
+func (db *DB) DeleteSink(ctx context.Context, projectID, id int64) error {
+	if _, err := db.ExecContext(ctx, `DELETE FROM sinks WHERE id = ? AND project_id = ?`, id, projectID); err != nil {
+		return fmt.Errorf("failed to delete sink: %w", err)
+	}
+	return nil
+}
+
+// Sink delivery operations
+
+func (db *DB) CreateSinkDelivery(ctx context.Context, d *models.SinkDelivery) error {
+	query := `
+		INSERT INTO sink_deliveries (refresh_log_id, sink_id, sink_name, sink_type, status, error, output, duration_ms)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		RETURNING id, created_at
+	`
+	err := db.QueryRowContext(ctx, query,
+		d.RefreshLogID, d.SinkID, d.SinkName, d.SinkType, d.Status, d.Error, d.Output, d.DurationMs,
+	).Scan(&d.ID, &d.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to create sink delivery: %w", err)
+	}
+	return nil
+}
+
+// attachSinkDeliveries 为刷新日志填充各sink的推送结果
+func (db *DB) attachSinkDeliveries(ctx context.Context, logs []*models.RefreshLog) error {
+	if len(logs) == 0 {
+		return nil
+	}
+
+	byID := make(map[int64]*models.RefreshLog, len(logs))
+	args := make([]any, 0, len(logs))
+	for _, log := range logs {
+		byID[log.ID] = log
+		args = append(args, log.ID)
+	}
+
+	query := `
+		SELECT id, refresh_log_id, sink_id, COALESCE(sink_name, ''), COALESCE(sink_type, ''), status,
+			COALESCE(error, ''), COALESCE(output, ''), duration_ms, created_at
+		FROM sink_deliveries
+		WHERE refresh_log_id IN (?` + strings.Repeat(", ?", len(args)-1) + `)
+		ORDER BY id
+	`
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to get sink deliveries: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		d := &models.SinkDelivery{}
+		err := rows.Scan(
+			&d.ID, &d.RefreshLogID, &d.SinkID, &d.SinkName, &d.SinkType, &d.Status,
+			&d.Error, &d.Output, &d.DurationMs, &d.CreatedAt,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to scan sink delivery: %w", err)
+		}
+		if log, ok := byID[d.RefreshLogID]; ok {
+			log.Sinks = append(log.Sinks, d)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"jwt_refresher/models"
+	"strings"
+)
+
+// Webhook operations
+
+const webhookColumns = `id, name, url, secret, events, all_projects, project_ids, enabled,
+			payload_template, headers, failure_threshold, expiry_warning_seconds,
+			created_at, updated_at`
+
+func (db *DB) scanWebhook(row rowScanner) (*models.Webhook, error) {
+	w := &models.Webhook{}
+	var secret, events, projectIDs, payloadTemplate, headers sql.NullString
+	err := row.Scan(
+		&w.ID, &w.Name, &w.URL, &secret, &events, &w.AllProjects, &projectIDs, &w.Enabled,
+		&payloadTemplate, &headers, &w.FailureThreshold, &w.ExpiryWarningSeconds,
+		&w.CreatedAt, &w.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if w.Secret, err = db.cipher.Decrypt(secret.String); err != nil {
+		return nil, fmt.Errorf("failed to decrypt webhook %d: %w", w.ID, err)
+	}
+	if events.String != "" {
+		w.Events = strings.Split(events.String, ",")
+	}
+	if projectIDs.String != "" {
+		if err := json.Unmarshal([]byte(projectIDs.String), &w.ProjectIDs); err != nil {
+			return nil, fmt.Errorf("invalid project_ids for webhook %d: %w", w.ID, err)
+		}
+	}
+	if w.Headers, err = db.cipher.Decrypt(headers.String); err != nil {
+		return nil, fmt.Errorf("failed to decrypt webhook %d: %w", w.ID, err)
+	}
+	w.PayloadTemplate = payloadTemplate.String
+	return w, nil
+}
+
+// webhookArgs 按CreateWebhook/UpdateWebhook的列顺序返回参数
+func (db *DB) webhookArgs(w *models.Webhook) ([]any, error) {
+	projectIDs, err := json.Marshal(w.ProjectIDs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode project ids: %w", err)
+	}
+	secrets, err := db.encryptAll(w.Secret, w.Headers)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt webhook: %w", err)
+	}
+	return []any{
+		w.Name, w.URL, secrets[0], strings.Join(w.Events, ","), w.AllProjects, string(projectIDs), w.Enabled,
+		w.PayloadTemplate, secrets[1], w.FailureThreshold, w.ExpiryWarningSeconds,
+	}, nil
+}
+
+func (db *DB) CreateWebhook(ctx context.Context, w *models.Webhook) error {
+	args, err := db.webhookArgs(w)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO webhooks (
+			name, url, secret, events, all_projects, project_ids, enabled,
+			payload_template, headers, failure_threshold, expiry_warning_seconds
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	result, err := db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to create webhook: %w", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("failed to get last insert id: %w", err)
+	}
+	w.ID = id
+	return nil
+}
+
+func (db *DB) UpdateWebhook(ctx context.Context, w *models.Webhook) error {
+	args, err := db.webhookArgs(w)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		UPDATE webhooks SET
+			name = ?, url = ?, secret = ?, events = ?, all_projects = ?, project_ids = ?, enabled = ?,
+			payload_template = ?, headers = ?, failure_threshold = ?, expiry_warning_seconds = ?,
+			updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`
+	result, err := db.ExecContext(ctx, query, append(args, w.ID)...)
+	if err != nil {
+		return fmt.Errorf("failed to update webhook: %w", err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (db *DB) GetWebhook(ctx context.Context, id int64) (*models.Webhook, error) {
+	query := `SELECT ` + webhookColumns + ` FROM webhooks WHERE id = ?`
+	return db.scanWebhook(db.QueryRowContext(ctx, query, id))
+}
+
+func (db *DB) GetAllWebhooks(ctx context.Context) ([]*models.Webhook, error) {
+	return db.queryWebhooks(ctx, `SELECT `+webhookColumns+` FROM webhooks ORDER BY created_at DESC`)
+}
+
+// GetEnabledWebhooks 获取所有启用的Webhook，用于分发事件
+func (db *DB) GetEnabledWebhooks(ctx context.Context) ([]*models.Webhook, error) {
+	return db.queryWebhooks(ctx, `SELECT `+webhookColumns+` FROM webhooks WHERE enabled = 1`)
+}
+
+func (db *DB) queryWebhooks(ctx context.Context, query string) ([]*models.Webhook, error) {
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get webhooks: %w", err)
+	}
+	defer rows.Close()
+
+	var webhooks []*models.Webhook
+	for rows.Next() {
+		w, err := db.scanWebhook(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan webhook: %w", err)
+		}
+		webhooks = append(webhooks, w)
+	}
+	return webhooks, nil
+}
+
+// DeleteWebhook 删除Webhook及其投递记录
+func (db *DB) DeleteWebhook(ctx context.Context, id int64) error {
+	if _, err := db.ExecContext(ctx, `DELETE FROM webhook_deliveries WHERE webhook_id = ?`, id); err != nil {
+		return fmt.Errorf("failed to delete webhook deliveries: %w", err)
+	}
+	if _, err := db.ExecContext(ctx, `DELETE FROM webhooks WHERE id = ?`, id); err != nil {
+		return fmt.Errorf("failed to delete webhook: %w", err)
+	}
+	return nil
+}
+
+// Webhook delivery operations
+
+func (db *DB) CreateWebhookDelivery(ctx context.Context, d *models.WebhookDelivery) error {
+	query := `
+		INSERT INTO webhook_deliveries (webhook_id, project_id, event, status, payload)
+		VALUES (?, ?, ?, ?, ?)
+		RETURNING id, created_at
+	`
+	err := db.QueryRowContext(ctx, query, d.WebhookID, d.ProjectID, d.Event, d.Status, d.Payload).Scan(&d.ID, &d.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to create webhook delivery: %w", err)
+	}
+	return nil
+}
+
+// UpdateWebhookDelivery 记录投递的最新一次尝试
+func (db *DB) UpdateWebhookDelivery(ctx context.Context, d *models.WebhookDelivery) error {
+	query := `
+		UPDATE webhook_deliveries SET
+			status = ?, attempts = ?, response_status = ?, response_body = ?, error = ?, delivered_at = ?
+		WHERE id = ?
+	`
+	_, err := db.ExecContext(ctx, query,
+		d.Status, d.Attempts, d.ResponseStatus, d.ResponseBody, d.Error, d.DeliveredAt, d.ID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update webhook delivery: %w", err)
+	}
+	return nil
+}
+
+func (db *DB) GetWebhookDeliveries(ctx context.Context, webhookID int64, limit int) ([]*models.WebhookDelivery, error) {
+	query := `
+		SELECT id, webhook_id, project_id, event, status, attempts,
+			response_status, COALESCE(response_body, ''), COALESCE(error, ''), payload,
+			created_at, delivered_at
+		FROM webhook_deliveries
+		WHERE webhook_id = ?
+		ORDER BY id DESC
+		LIMIT ?
+	`
+	rows, err := db.QueryContext(ctx, query, webhookID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get webhook deliveries: %w", err)
+	}
+	defer rows.Close()
+
+	var deliveries []*models.WebhookDelivery
+	for rows.Next() {
+		d := &models.WebhookDelivery{}
+		err := rows.Scan(
+			&d.ID, &d.WebhookID, &d.ProjectID, &d.Event, &d.Status, &d.Attempts,
+			&d.ResponseStatus, &d.ResponseBody, &d.Error, &d.Payload,
+			&d.CreatedAt, &d.DeliveredAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan webhook delivery: %w", err)
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, nil
+}
@@ -1,26 +1,40 @@
 package main
 
 import (
+	"context"
 	"embed"
+	"errors"
 	"fmt"
 	"io"
 	"jwt_refresher/api"
 	"jwt_refresher/config"
 	"jwt_refresher/database"
 	"jwt_refresher/logger"
+	"jwt_refresher/notifier"
+	"jwt_refresher/pubsub"
 	"jwt_refresher/refresher"
 	"jwt_refresher/scheduler"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"syscall"
+	"time"
 )
 
 //go:embed web/static/*
 var staticFiles embed.FS
 
 func main() {
+	// Maintenance subcommands
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1], os.Args[2:]); err != nil {
+			log.Fatalf("%s failed: %v", os.Args[1], err)
+		}
+		return
+	}
+
 	log.Println("Starting JWT Token Refresher...")
 
 	// Load configuration
@@ -49,35 +63,61 @@ func main() {
 		log.Fatalf("Failed to migrate database: %v", err)
 	}
 
+	// 加载加密密钥
+	cipher, err := database.LoadCipher(cfg.EncryptionKey, cfg.EncryptionKeyFile)
+	if err != nil {
+		log.Fatalf("Failed to load encryption key: %v", err)
+	}
+	if cipher == nil {
+		log.Println("WARNING: No encryption key configured, tokens and custom variables are stored in plaintext")
+	} else {
+		log.Printf("Encryption at rest enabled (key id: %s)", cipher.KeyID())
+	}
+
 	// 初始化数据库
-	db, err := database.InitDB(cfg.DBPath)
+	db, err := database.InitDB(cfg.DBPath, cipher)
 	if err != nil {
 		log.Fatalf("Failed to initialize database: %v", err)
 	}
 	defer db.Close()
 	log.Printf("Database initialized: %s", cfg.DBPath)
 
+	shutdownTimeout := time.Duration(cfg.ShutdownTimeoutSeconds) * time.Second
+
+	// 创建Webhook通知，刷新引擎产生的事件由它异步投递
+	notify := notifier.New(db)
+	notify.Start()
+
+	// token和状态变化的发布/订阅，供SSE流使用
+	broker := pubsub.New()
+
 	// 创建刷新引擎
-	engine := refresher.NewEngine(db)
+	if err := refresher.ValidateProxy(cfg.Proxy); err != nil {
+		log.Fatalf("Invalid proxy configuration: %v", err)
+	}
+	engine := refresher.NewEngine(db, cfg.Proxy, notify, broker)
 	log.Println("Refresh engine created")
 
 	// 创建并启动调度器
-	sched := scheduler.NewScheduler(db, engine)
+	sched := scheduler.NewScheduler(db, engine, cfg.MaxConcurrentRefreshes, cfg.MaxConcurrentPerHost)
 	sched.Start()
-	defer sched.Stop()
 
 	// 设置Web服务
-	router := api.SetupRouter(db, engine, staticFiles, cfg.Username, cfg.Password)
+	router := api.SetupRouter(db, engine, sched, notify, broker, staticFiles, cfg.Username, cfg.Password)
 
 	// 启动Web服务
 	log.Printf("Starting web server on port %d...", cfg.Port)
 	log.Printf("Access the web interface at: http://localhost:%d", cfg.Port)
 	log.Printf("Authentication required: username=%s", cfg.Username)
 
-	// 优雅关闭
+	srv := &http.Server{
+		Addr:    fmt.Sprintf(":%d", cfg.Port),
+		Handler: router,
+	}
+	// SSE流不会自己结束，关闭时先断开所有订阅，否则Shutdown会一直等到超时
+	srv.RegisterOnShutdown(broker.Close)
 	go func() {
-		addr := fmt.Sprintf(":%d", cfg.Port)
-		if err := router.Run(addr); err != nil {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			log.Fatalf("Failed to start web server: %v", err)
 		}
 	}()
@@ -87,8 +127,18 @@ func main() {
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 
+	// 优雅关闭：先停止接收请求并等待进行中的请求，再停止调度器，等待手动或长轮询触发的
+	// 刷新写完数据库，最后投递剩余的通知
+	// 各步骤共享同一个期限，整个关闭过程最多等待shutdownTimeout
 	log.Println("Shutting down server...")
-	sched.Stop()
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Web server shutdown: %v", err)
+	}
+	sched.Stop(ctx)
+	engine.Stop(ctx)
+	notify.Stop(ctx)
 	log.Println("Server stopped")
 }
 
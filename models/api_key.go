@@ -0,0 +1,62 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+)
+
+// API Key权限范围
+const (
+	ScopeTokenRead        = "token:read"
+	ScopeTokenReadRefresh = "token:read_refresh" // 读取token时同时返回refresh token
+	ScopeProjectRefresh   = "project:refresh"
+	ScopeLogsRead         = "logs:read"
+)
+
+// ValidScopes 所有可分配的权限范围
+var ValidScopes = []string{ScopeTokenRead, ScopeTokenReadRefresh, ScopeProjectRefresh, ScopeLogsRead}
+
+type APIKey struct {
+	ID          int64        `json:"id"`
+	Name        string       `json:"name"`
+	Prefix      string       `json:"prefix"`
+	KeyHash     string       `json:"-"`
+	AllProjects bool         `json:"all_projects"`
+	ProjectIDs  []int64      `json:"project_ids"`
+	Scopes      []string     `json:"scopes"`
+	ExpiresAt   sql.NullTime `json:"expires_at"`
+	LastUsedAt  sql.NullTime `json:"last_used_at"`
+	RevokedAt   sql.NullTime `json:"revoked_at"`
+	CreatedAt   time.Time    `json:"created_at"`
+}
+
+// Active 判断Key是否未撤销且未过期
+func (k *APIKey) Active(now time.Time) bool {
+	if k.RevokedAt.Valid {
+		return false
+	}
+	return !k.ExpiresAt.Valid || now.Before(k.ExpiresAt.Time)
+}
+
+// HasScope 判断Key是否拥有指定权限
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsProject 判断Key是否可以访问指定项目
+func (k *APIKey) AllowsProject(projectID int64) bool {
+	if k.AllProjects {
+		return true
+	}
+	for _, id := range k.ProjectIDs {
+		if id == projectID {
+			return true
+		}
+	}
+	return false
+}
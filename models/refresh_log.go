@@ -15,4 +15,7 @@ type RefreshLog struct {
 	OldRefreshTokenPreview string   `json:"old_refresh_token_preview"`
 	NewRefreshTokenPreview string   `json:"new_refresh_token_preview"`
 	ResponseBody          string    `json:"response_body"`
+	FailedStep            string    `json:"failed_step"` // 失败的刷新步骤，为空表示最终的token请求
+	Proxy                 string    `json:"proxy"`       // 每次尝试使用的代理（不含密码，逗号分隔），direct表示直连
+	Sinks                 []*SinkDelivery `json:"sinks,omitempty"` // 刷新成功后各sink的推送结果
 }
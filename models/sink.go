@@ -0,0 +1,63 @@
+package models
+
+import (
+	"time"
+)
+
+// Sink类型
+const (
+	SinkFile    = "file"    // 原子写入文件
+	SinkWebhook = "webhook" // POST到URL
+	SinkCommand = "command" // 执行本地命令，token通过stdin传入
+)
+
+// Sink写入内容的格式
+const (
+	SinkFormatRaw  = "raw"  // 只有access token
+	SinkFormatJSON = "json" // 项目ID、名称以及GET /api/projects/:id/token返回的字段
+	SinkFormatEnv  = "env"  // .env格式的KEY=value
+)
+
+// ValidSinkFormats 支持的写入格式
+var ValidSinkFormats = []string{SinkFormatRaw, SinkFormatJSON, SinkFormatEnv}
+
+// Sink 刷新成功后将新token推送到下游
+type Sink struct {
+	ID        int64  `json:"id"`
+	ProjectID int64  `json:"project_id"`
+	Name      string `json:"name"`
+	Type      string `json:"type"` // file, webhook, command
+	Enabled   bool   `json:"enabled"`
+	Format    string `json:"format"` // raw, json, env；为空时file和command使用raw，webhook使用json
+
+	// file
+	Path     string `json:"path"`
+	FileMode string `json:"file_mode"` // 八进制权限，如 0600，为空时使用0600
+
+	// webhook
+	URL     string `json:"url"`
+	Headers string `json:"headers"` // 请求头 (JSON格式: {"Authorization": "Bearer xxx"})
+	Secret  string `json:"secret"`  // HMAC签名密钥，加密存储
+
+	// command（通过 /bin/sh -c 执行）
+	Command string `json:"command"`
+
+	TimeoutSeconds int `json:"timeout_seconds"` // 单次推送的超时，为0时使用30秒
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// SinkDelivery 一次刷新中某个sink的推送结果
+type SinkDelivery struct {
+	ID           int64     `json:"id"`
+	RefreshLogID int64     `json:"refresh_log_id"`
+	SinkID       int64     `json:"sink_id"`
+	SinkName     string    `json:"sink_name"`
+	SinkType     string    `json:"sink_type"`
+	Status       string    `json:"status"` // success, failed
+	Error        string    `json:"error"`
+	Output       string    `json:"output"` // webhook的响应或命令的输出（截断）
+	DurationMs   int64     `json:"duration_ms"`
+	CreatedAt    time.Time `json:"created_at"`
+}
@@ -0,0 +1,90 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+)
+
+// 通知事件
+const (
+	EventSuccess             = "success"              // 刷新成功
+	EventFailure             = "failure"              // 刷新失败
+	EventConsecutiveFailures = "consecutive_failures" // 连续失败达到Webhook的阈值
+	EventRecovery            = "recovery"             // 失败后恢复成功
+	EventNeedsReauth         = "needs_reauth"         // refresh token已失效，需要重新授权
+	EventExpiring            = "expiring"             // token即将过期且最近一次刷新没有成功
+	EventTest                = "test"                 // 手动发送的测试通知
+)
+
+// ValidEvents 可订阅的事件
+var ValidEvents = []string{
+	EventSuccess, EventFailure, EventConsecutiveFailures, EventRecovery, EventNeedsReauth, EventExpiring,
+}
+
+// Webhook投递状态
+const (
+	DeliveryPending = "pending"
+	DeliverySuccess = "success"
+	DeliveryFailed  = "failed"
+)
+
+type Webhook struct {
+	ID          int64    `json:"id"`
+	Name        string   `json:"name"`
+	URL         string   `json:"url"`
+	Secret      string   `json:"secret"` // HMAC签名密钥，加密存储
+	Events      []string `json:"events"`
+	AllProjects bool     `json:"all_projects"`
+	ProjectIDs  []int64  `json:"project_ids"`
+	Enabled     bool     `json:"enabled"`
+
+	// 请求体模板（Go模板，渲染结果须为JSON），为空时发送默认格式的事件
+	PayloadTemplate string `json:"payload_template"`
+	// 请求头 (JSON格式: {"Authorization": "Bearer xxx"})
+	Headers string `json:"headers"`
+
+	FailureThreshold     int `json:"failure_threshold"`      // consecutive_failures事件的连续失败次数
+	ExpiryWarningSeconds int `json:"expiry_warning_seconds"` // expiring事件：距过期多少秒内通知
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Subscribes 判断Webhook是否订阅了事件
+func (w *Webhook) Subscribes(event string) bool {
+	for _, e := range w.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsProject 判断Webhook是否接收指定项目的事件
+func (w *Webhook) AllowsProject(projectID int64) bool {
+	if w.AllProjects {
+		return true
+	}
+	for _, id := range w.ProjectIDs {
+		if id == projectID {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookDelivery 一次Webhook投递（包括所有重试）
+type WebhookDelivery struct {
+	ID             int64        `json:"id"`
+	WebhookID      int64        `json:"webhook_id"`
+	ProjectID      int64        `json:"project_id"`
+	Event          string       `json:"event"`
+	Status         string       `json:"status"` // pending, success, failed
+	Attempts       int          `json:"attempts"`
+	ResponseStatus int          `json:"response_status"`
+	ResponseBody   string       `json:"response_body"`
+	Error          string       `json:"error"`
+	Payload        string       `json:"payload"`
+	CreatedAt      time.Time    `json:"created_at"`
+	DeliveredAt    sql.NullTime `json:"delivered_at"`
+}
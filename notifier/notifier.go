@@ -0,0 +1,228 @@
+package notifier
+
+import (
+	"context"
+	"jwt_refresher/database"
+	"jwt_refresher/models"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// eventQueueSize 待分发事件的缓冲，队列满时丢弃事件，避免阻塞刷新
+	eventQueueSize = 256
+
+	defaultFailureThreshold     = 3
+	defaultExpiryWarningSeconds = 600
+)
+
+// Event 通知事件，未配置请求体模板时按此格式发送JSON
+type Event struct {
+	Type                string     `json:"event"`
+	ProjectID           int64      `json:"project_id"`
+	ProjectName         string     `json:"project_name"`
+	Time                time.Time  `json:"time"`
+	Message             string     `json:"message,omitempty"`
+	ErrorClass          string     `json:"error_class,omitempty"`
+	ConsecutiveFailures int        `json:"consecutive_failures,omitempty"`
+	ExpiresAt           *time.Time `json:"expires_at,omitempty"`
+}
+
+// notifiedKey 每个Webhook、项目只通知一次的事件的去重键
+type notifiedKey struct {
+	webhookID int64
+	projectID int64
+}
+
+// Notifier 将刷新事件异步投递到订阅的Webhook
+type Notifier struct {
+	db     *database.DB
+	client *http.Client
+	events chan Event
+
+	// expiring事件按token过期时间去重
+	mu       sync.Mutex
+	notified map[notifiedKey]time.Time
+
+	// 投递在独立的goroutine中执行（包括重试），停止时最多等到关闭期限
+	ctx        context.Context
+	cancel     context.CancelFunc
+	deliveries sync.WaitGroup
+
+	// 停止后events已关闭，之后的Notify直接丢弃事件
+	closeMu sync.RWMutex
+	closed  bool
+
+	wg       sync.WaitGroup
+	stopOnce sync.Once
+}
+
+// New 创建Notifier
+func New(db *database.DB) *Notifier {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Notifier{
+		db:       db,
+		client:   &http.Client{},
+		events:   make(chan Event, eventQueueSize),
+		notified: make(map[notifiedKey]time.Time),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+func (n *Notifier) Start() {
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		for event := range n.events {
+			n.dispatch(event)
+		}
+	}()
+}
+
+// Stop 分发完已排队的事件，等待进行中的投递完成，ctx结束后取消剩余的重试
+func (n *Notifier) Stop(ctx context.Context) {
+	n.stopOnce.Do(func() {
+		n.closeMu.Lock()
+		n.closed = true
+		close(n.events)
+		n.closeMu.Unlock()
+		n.wg.Wait()
+
+		drained := make(chan struct{})
+		go func() {
+			n.deliveries.Wait()
+			close(drained)
+		}()
+		select {
+		case <-drained:
+		case <-ctx.Done():
+			log.Println("Timed out waiting for webhook deliveries, cancelling them")
+			n.cancel()
+			<-drained
+		}
+		n.cancel()
+	})
+}
+
+// Notify 异步发送事件，不会阻塞。n为nil或已停止时忽略
+func (n *Notifier) Notify(event Event) {
+	if n == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	// 停止后仍可能有刷新完成（如API触发的刷新），此时丢弃事件
+	n.closeMu.RLock()
+	defer n.closeMu.RUnlock()
+	if n.closed {
+		return
+	}
+	select {
+	case n.events <- event:
+	default:
+		log.Printf("Warning: Notification queue full, dropping %s event for project %d", event.Type, event.ProjectID)
+	}
+}
+
+// ForgetWebhook 清除已删除的Webhook的去重记录
+func (n *Notifier) ForgetWebhook(webhookID int64) {
+	n.forget(func(key notifiedKey) bool { return key.webhookID == webhookID })
+}
+
+// ForgetProject 清除已删除的项目的去重记录
+func (n *Notifier) ForgetProject(projectID int64) {
+	n.forget(func(key notifiedKey) bool { return key.projectID == projectID })
+}
+
+func (n *Notifier) forget(match func(notifiedKey) bool) {
+	if n == nil {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for key := range n.notified {
+		if match(key) {
+			delete(n.notified, key)
+		}
+	}
+}
+
+// Test 向Webhook发送一次测试通知（不重试），返回投递记录
+func (n *Notifier) Test(ctx context.Context, w *models.Webhook) *models.WebhookDelivery {
+	event := Event{Type: models.EventTest, Time: time.Now(), Message: "Test notification"}
+	return n.deliver(ctx, w, event, 1)
+}
+
+// dispatch 将事件投递到所有匹配的Webhook
+func (n *Notifier) dispatch(event Event) {
+	webhooks, err := n.db.GetEnabledWebhooks(n.ctx)
+	if err != nil {
+		log.Printf("Warning: Failed to load webhooks: %v", err)
+		return
+	}
+
+	for _, w := range webhooks {
+		if !w.AllowsProject(event.ProjectID) {
+			continue
+		}
+		for _, e := range n.match(w, event) {
+			n.deliveries.Add(1)
+			go func(w *models.Webhook, e Event) {
+				defer n.deliveries.Done()
+				n.deliver(n.ctx, w, e, maxDeliveryAttempts)
+			}(w, e)
+		}
+	}
+}
+
+// match 返回事件需要向Webhook发送的通知。failure事件在连续失败次数
+// 恰好达到阈值时额外产生consecutive_failures通知（每次连续失败只通知一次）；
+// expiring事件在过期时间进入Webhook的提醒窗口后，对同一个过期时间只通知一次
+func (n *Notifier) match(w *models.Webhook, event Event) []Event {
+	var events []Event
+	switch event.Type {
+	case models.EventFailure:
+		if w.Subscribes(models.EventFailure) {
+			events = append(events, event)
+		}
+		threshold := w.FailureThreshold
+		if threshold <= 0 {
+			threshold = defaultFailureThreshold
+		}
+		if w.Subscribes(models.EventConsecutiveFailures) && event.ConsecutiveFailures == threshold {
+			e := event
+			e.Type = models.EventConsecutiveFailures
+			events = append(events, e)
+		}
+
+	case models.EventExpiring:
+		if !w.Subscribes(models.EventExpiring) || event.ExpiresAt == nil {
+			break
+		}
+		window := time.Duration(w.ExpiryWarningSeconds) * time.Second
+		if window <= 0 {
+			window = defaultExpiryWarningSeconds * time.Second
+		}
+		if time.Until(*event.ExpiresAt) > window {
+			break
+		}
+		key := notifiedKey{webhookID: w.ID, projectID: event.ProjectID}
+		n.mu.Lock()
+		if !n.notified[key].Equal(*event.ExpiresAt) {
+			n.notified[key] = *event.ExpiresAt
+			events = append(events, event)
+		}
+		n.mu.Unlock()
+
+	default:
+		if w.Subscribes(event.Type) {
+			events = append(events, event)
+		}
+	}
+	return events
+}
@@ -0,0 +1,113 @@
+package notifier
+
+import (
+	"fmt"
+	"jwt_refresher/models"
+	"testing"
+	"time"
+)
+
+func TestForgetExpiring(t *testing.T) {
+	expiresAt := time.Now().Add(time.Minute)
+	expiring := func(projectID int64) Event {
+		return Event{Type: models.EventExpiring, ProjectID: projectID, ExpiresAt: &expiresAt}
+	}
+	webhook := func(id int64) *models.Webhook {
+		return &models.Webhook{ID: id, Events: []string{models.EventExpiring}}
+	}
+
+	tests := []struct {
+		name   string
+		forget func(n *Notifier)
+		// 清除后再次匹配时是否重新通知，依次为(1,1)、(1,2)、(2,1)
+		want [3]bool
+	}{
+		{name: "nothing forgotten", forget: func(*Notifier) {}, want: [3]bool{false, false, false}},
+		{name: "forget webhook", forget: func(n *Notifier) { n.ForgetWebhook(1) }, want: [3]bool{true, true, false}},
+		{name: "forget project", forget: func(n *Notifier) { n.ForgetProject(1) }, want: [3]bool{true, false, true}},
+		{name: "forget unknown ids", forget: func(n *Notifier) { n.ForgetWebhook(9); n.ForgetProject(9) }, want: [3]bool{false, false, false}},
+	}
+
+	pairs := [3][2]int64{{1, 1}, {1, 2}, {2, 1}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := New(nil)
+			for _, p := range pairs {
+				if got := n.match(webhook(p[0]), expiring(p[1])); len(got) != 1 {
+					t.Fatalf("first match(webhook %d, project %d) = %d events, want 1", p[0], p[1], len(got))
+				}
+			}
+
+			tt.forget(n)
+			for i, p := range pairs {
+				got := len(n.match(webhook(p[0]), expiring(p[1]))) == 1
+				if got != tt.want[i] {
+					t.Errorf("match(webhook %d, project %d) notified = %v, want %v", p[0], p[1], got, tt.want[i])
+				}
+			}
+		})
+	}
+
+	var n *Notifier
+	n.ForgetProject(1) // 未配置notifier时忽略
+}
+
+func TestMatch(t *testing.T) {
+	soon := time.Now().Add(5 * time.Minute)
+	later := time.Now().Add(time.Hour)
+	webhook := &models.Webhook{
+		ID:                   1,
+		Events:               []string{models.EventFailure, models.EventConsecutiveFailures, models.EventExpiring},
+		FailureThreshold:     3,
+		ExpiryWarningSeconds: 600,
+	}
+
+	// 依次匹配，expiring的去重记录在步骤之间保留
+	tests := []struct {
+		name    string
+		webhook *models.Webhook
+		event   Event
+		want    []string
+	}{
+		{name: "failure below threshold", event: Event{Type: models.EventFailure, ConsecutiveFailures: 2}, want: []string{models.EventFailure}},
+		{
+			name:  "failure at threshold",
+			event: Event{Type: models.EventFailure, ConsecutiveFailures: 3},
+			want:  []string{models.EventFailure, models.EventConsecutiveFailures},
+		},
+		{name: "failure above threshold", event: Event{Type: models.EventFailure, ConsecutiveFailures: 4}, want: []string{models.EventFailure}},
+		{
+			name:    "default threshold",
+			webhook: &models.Webhook{ID: 2, Events: []string{models.EventConsecutiveFailures}},
+			event:   Event{Type: models.EventFailure, ConsecutiveFailures: defaultFailureThreshold},
+			want:    []string{models.EventConsecutiveFailures},
+		},
+		{name: "not subscribed", event: Event{Type: models.EventRecovery}},
+		{name: "expiry outside the window", event: Event{Type: models.EventExpiring, ProjectID: 1, ExpiresAt: &later}},
+		{name: "expiry inside the window", event: Event{Type: models.EventExpiring, ProjectID: 1, ExpiresAt: &soon}, want: []string{models.EventExpiring}},
+		{name: "same expiry is notified once", event: Event{Type: models.EventExpiring, ProjectID: 1, ExpiresAt: &soon}},
+		{name: "other project", event: Event{Type: models.EventExpiring, ProjectID: 2, ExpiresAt: &soon}, want: []string{models.EventExpiring}},
+		{
+			name:  "new expiry is notified again",
+			event: Event{Type: models.EventExpiring, ProjectID: 1, ExpiresAt: func() *time.Time { t := soon.Add(time.Minute); return &t }()},
+			want:  []string{models.EventExpiring},
+		},
+	}
+
+	n := New(nil)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := webhook
+			if tt.webhook != nil {
+				w = tt.webhook
+			}
+			var got []string
+			for _, e := range n.match(w, tt.event) {
+				got = append(got, e.Type)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package notifier
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"jwt_refresher/models"
+	"log"
+	"net/http"
+	"strconv"
+	"text/template"
+	"time"
+)
+
+const (
+	maxDeliveryAttempts = 5
+	deliveryBaseDelay   = 2 * time.Second
+	maxDeliveryDelay    = time.Minute
+	deliveryTimeout     = 10 * time.Second
+
+	// maxDeliveryResponse 投递记录中保存的响应体长度
+	maxDeliveryResponse = 1024
+)
+
+// payloadFuncs 请求体模板可用的函数
+var payloadFuncs = template.FuncMap{
+	// json 将值编码为JSON，如 {"text": {{json .Message}}}
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// sampleEvent 校验请求体模板时使用的示例事件
+var sampleEvent = Event{
+	Type:                models.EventFailure,
+	ProjectID:           1,
+	ProjectName:         "example",
+	Time:                time.Unix(0, 0).UTC(),
+	Message:             "HTTP 500 (transient): internal error",
+	ErrorClass:          "transient",
+	ConsecutiveFailures: 1,
+}
+
+// Sign 计算Webhook签名：HMAC-SHA256(secret, timestamp + "." + body)的十六进制
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ValidatePayloadTemplate 用示例事件渲染请求体模板，检查语法以及结果是否为JSON
+func ValidatePayloadTemplate(tmpl string) error {
+	_, err := renderPayload(tmpl, sampleEvent)
+	return err
+}
+
+// renderPayload 渲染请求体，模板为空时发送事件本身
+func renderPayload(tmpl string, event Event) ([]byte, error) {
+	if tmpl == "" {
+		return json.Marshal(event)
+	}
+
+	t, err := template.New("payload").Funcs(payloadFuncs).Parse(tmpl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid payload template: %w", err)
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, event); err != nil {
+		return nil, fmt.Errorf("failed to render payload template: %w", err)
+	}
+	if !json.Valid(buf.Bytes()) {
+		return nil, fmt.Errorf("payload template must render valid JSON")
+	}
+	return buf.Bytes(), nil
+}
+
+// deliver 投递一个事件，网络错误、429和5xx按指数退避重试，最多maxAttempts次。
+// 每次尝试后更新投递记录
+func (n *Notifier) deliver(ctx context.Context, w *models.Webhook, event Event, maxAttempts int) *models.WebhookDelivery {
+	// 投递记录在取消后也要写入
+	storeCtx := context.WithoutCancel(ctx)
+
+	payload, renderErr := renderPayload(w.PayloadTemplate, event)
+	d := &models.WebhookDelivery{
+		WebhookID: w.ID,
+		ProjectID: event.ProjectID,
+		Event:     event.Type,
+		Status:    models.DeliveryPending,
+		Payload:   string(payload),
+	}
+	if err := n.db.CreateWebhookDelivery(storeCtx, d); err != nil {
+		log.Printf("Warning: Failed to create webhook delivery: %v", err)
+	}
+	if renderErr != nil {
+		n.finish(storeCtx, w, d, models.DeliveryFailed, renderErr.Error())
+		return d
+	}
+
+	for attempt := 1; ; attempt++ {
+		d.Attempts = attempt
+		status, body, err := n.send(ctx, w, event, d.ID, payload)
+		d.ResponseStatus = status
+		d.ResponseBody = body
+
+		var reason string
+		switch {
+		case err != nil:
+			reason = err.Error()
+		case status < 200 || status > 299:
+			reason = fmt.Sprintf("HTTP %d", status)
+		default:
+			n.finish(storeCtx, w, d, models.DeliverySuccess, "")
+			return d
+		}
+
+		retryable := err != nil || status == http.StatusTooManyRequests || status >= 500
+		if !retryable || attempt >= maxAttempts || ctx.Err() != nil {
+			n.finish(storeCtx, w, d, models.DeliveryFailed, reason)
+			return d
+		}
+
+		d.Error = reason
+		if err := n.db.UpdateWebhookDelivery(storeCtx, d); err != nil {
+			log.Printf("Warning: Failed to update webhook delivery: %v", err)
+		}
+
+		delay := min(deliveryBaseDelay<<(attempt-1), maxDeliveryDelay)
+		log.Printf("Webhook %s (ID: %d) delivery %d attempt %d/%d failed (%s), retrying in %v",
+			w.Name, w.ID, d.ID, attempt, maxAttempts, reason, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			n.finish(storeCtx, w, d, models.DeliveryFailed, reason)
+			return d
+		}
+	}
+}
+
+// finish 记录投递的最终结果
+func (n *Notifier) finish(ctx context.Context, w *models.Webhook, d *models.WebhookDelivery, status, errorMsg string) {
+	d.Status = status
+	d.Error = errorMsg
+	if status == models.DeliverySuccess {
+		d.DeliveredAt = sql.NullTime{Time: time.Now(), Valid: true}
+	} else {
+		log.Printf("Warning: Webhook %s (ID: %d) failed to deliver %s event: %s", w.Name, w.ID, d.Event, errorMsg)
+	}
+	if err := n.db.UpdateWebhookDelivery(ctx, d); err != nil {
+		log.Printf("Warning: Failed to update webhook delivery: %v", err)
+	}
+}
+
+// send 发送一次请求，返回状态码和（截断的）响应体
+func (n *Notifier) send(ctx context.Context, w *models.Webhook, event Event, deliveryID int64, payload []byte) (int, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, deliveryTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, "", err
+	}
+	if w.Headers != "" {
+		var headers map[string]string
+		if err := json.Unmarshal([]byte(w.Headers), &headers); err != nil {
+			return 0, "", fmt.Errorf("invalid headers: %w", err)
+		}
+		for key, value := range headers {
+			req.Header.Set(key, value)
+		}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "jwt-refresher")
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("X-Webhook-Event", event.Type)
+	req.Header.Set("X-Webhook-Delivery", strconv.FormatInt(deliveryID, 10))
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	if w.Secret != "" {
+		req.Header.Set("X-Webhook-Signature", "sha256="+Sign(w.Secret, timestamp, payload))
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxDeliveryResponse))
+	return resp.StatusCode, string(body), nil
+}
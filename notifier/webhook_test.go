@@ -0,0 +1,224 @@
+package notifier
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"jwt_refresher/database"
+	"jwt_refresher/models"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSign(t *testing.T) {
+	body := []byte(`{"event":"failure"}`)
+	tests := []struct {
+		name      string
+		secret    string
+		timestamp string
+		body      []byte
+		want      string
+	}{
+		// printf '1700000000.{"event":"failure"}' | openssl dgst -sha256 -hmac secret
+		{name: "known value", secret: "secret", timestamp: "1700000000", body: body, want: "13b0be176bab28d24c4cd7df91eb18dd42a64dbaaea82834642a4d4e49071f21"},
+		{name: "secret", secret: "other", timestamp: "1700000000", body: body},
+		{name: "timestamp", secret: "secret", timestamp: "1700000001", body: body},
+		{name: "body", secret: "secret", timestamp: "1700000000", body: []byte(`{"event":"recovery"}`)},
+	}
+
+	known := tests[0].want
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Sign(tt.secret, tt.timestamp, tt.body)
+			if tt.want != "" && got != tt.want {
+				t.Errorf("Sign() = %s, want %s", got, tt.want)
+			}
+			if tt.want == "" && got == known {
+				t.Errorf("Sign() does not depend on the %s", tt.name)
+			}
+		})
+	}
+}
+
+func TestRenderPayload(t *testing.T) {
+	tests := []struct {
+		name    string
+		tmpl    string
+		want    string
+		wantErr bool
+	}{
+		{name: "default payload", tmpl: "", want: `"event":"failure"`},
+		{name: "template", tmpl: `{"text":{{json .Message}},"project":{{.ProjectID}}}`, want: `{"text":"HTTP 500 (transient): internal error","project":1}`},
+		{name: "syntax error", tmpl: `{"text":{{.Message}`, wantErr: true},
+		{name: "not json", tmpl: `text={{.Message}}`, wantErr: true},
+		{name: "unknown field", tmpl: `{"x":{{.Nope}}}`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := renderPayload(tt.tmpl, sampleEvent)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("renderPayload() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if (ValidatePayloadTemplate(tt.tmpl) != nil) != tt.wantErr {
+				t.Errorf("ValidatePayloadTemplate() disagrees with renderPayload()")
+			}
+			if !tt.wantErr && !json.Valid(got) {
+				t.Errorf("renderPayload() = %s, want JSON", got)
+			}
+			if !tt.wantErr && !strings.Contains(string(got), tt.want) {
+				t.Errorf("renderPayload() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func newTestDB(t *testing.T) *database.DB {
+	t.Helper()
+	db, err := database.InitDB(filepath.Join(t.TempDir(), "test.db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// received 接收端收到的一次投递
+type received struct {
+	header http.Header
+	body   []byte
+}
+
+func TestDeliver(t *testing.T) {
+	tests := []struct {
+		name         string
+		statuses     []int
+		maxAttempts  int
+		wantStatus   string
+		wantAttempts int
+	}{
+		{name: "delivered", statuses: []int{http.StatusNoContent}, maxAttempts: 3, wantStatus: models.DeliverySuccess, wantAttempts: 1},
+		{name: "client error is not retried", statuses: []int{http.StatusBadRequest}, maxAttempts: 3, wantStatus: models.DeliveryFailed, wantAttempts: 1},
+		{name: "server error is retried", statuses: []int{http.StatusBadGateway, http.StatusOK}, maxAttempts: 3, wantStatus: models.DeliverySuccess, wantAttempts: 2},
+		{name: "gives up after max attempts", statuses: []int{http.StatusServiceUnavailable}, maxAttempts: 1, wantStatus: models.DeliveryFailed, wantAttempts: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var hits atomic.Int32
+			requests := make(chan received, 10)
+			receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				i := int(hits.Add(1)) - 1
+				body, _ := io.ReadAll(r.Body)
+				requests <- received{header: r.Header.Clone(), body: body}
+				w.WriteHeader(tt.statuses[min(i, len(tt.statuses)-1)])
+			}))
+			defer receiver.Close()
+
+			db := newTestDB(t)
+			webhook := &models.Webhook{
+				Name:        "hook",
+				URL:         receiver.URL,
+				Secret:      "whsec",
+				Events:      []string{models.EventFailure},
+				AllProjects: true,
+				Enabled:     true,
+				Headers:     `{"Authorization":"Bearer hook-token"}`,
+			}
+			if err := db.CreateWebhook(context.Background(), webhook); err != nil {
+				t.Fatal(err)
+			}
+
+			n := New(db)
+			d := n.deliver(context.Background(), webhook, sampleEvent, tt.maxAttempts)
+			if d.Status != tt.wantStatus || d.Attempts != tt.wantAttempts {
+				t.Errorf("delivery = %s after %d attempts, want %s after %d", d.Status, d.Attempts, tt.wantStatus, tt.wantAttempts)
+			}
+
+			stored, err := db.GetWebhookDeliveries(context.Background(), webhook.ID, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(stored) != 1 || stored[0].Status != tt.wantStatus || stored[0].Attempts != tt.wantAttempts {
+				t.Errorf("stored deliveries = %+v", stored)
+			}
+
+			// 每次尝试都带签名，签名覆盖时间戳和请求体
+			for i := 0; i < tt.wantAttempts; i++ {
+				req := <-requests
+				ts := req.header.Get("X-Webhook-Timestamp")
+				if _, err := strconv.ParseInt(ts, 10, 64); err != nil {
+					t.Errorf("X-Webhook-Timestamp = %q", ts)
+				}
+				if got, want := req.header.Get("X-Webhook-Signature"), "sha256="+Sign("whsec", ts, req.body); got != want {
+					t.Errorf("X-Webhook-Signature = %q, want %q", got, want)
+				}
+				if req.header.Get("X-Webhook-Event") != models.EventFailure ||
+					req.header.Get("X-Webhook-Delivery") != strconv.FormatInt(d.ID, 10) ||
+					req.header.Get("Authorization") != "Bearer hook-token" ||
+					req.header.Get("Content-Type") != "application/json" {
+					t.Errorf("headers = %v", req.header)
+				}
+				var event Event
+				if err := json.Unmarshal(req.body, &event); err != nil || event.Type != models.EventFailure || event.ProjectID != 1 {
+					t.Errorf("body = %s", req.body)
+				}
+			}
+		})
+	}
+}
+
+func TestNotifyDispatch(t *testing.T) {
+	requests := make(chan received, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- received{header: r.Header.Clone(), body: body}
+	}))
+	defer receiver.Close()
+
+	db := newTestDB(t)
+	for _, w := range []*models.Webhook{
+		{Name: "project 1 failures", Events: []string{models.EventFailure, models.EventConsecutiveFailures}, ProjectIDs: []int64{1}, FailureThreshold: 2},
+		{Name: "all recoveries", Events: []string{models.EventRecovery}, AllProjects: true},
+		{Name: "disabled", Events: []string{models.EventFailure}, AllProjects: true},
+	} {
+		w.URL = receiver.URL
+		w.Enabled = w.Name != "disabled"
+		if err := db.CreateWebhook(context.Background(), w); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n := New(db)
+	n.Start()
+	n.Notify(Event{Type: models.EventFailure, ProjectID: 2, ConsecutiveFailures: 2})
+	n.Notify(Event{Type: models.EventFailure, ProjectID: 1, ConsecutiveFailures: 2})
+	n.Notify(Event{Type: models.EventRecovery, ProjectID: 2})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	n.Stop(ctx)
+	close(requests)
+
+	got := map[string]int{}
+	for req := range requests {
+		got[req.header.Get("X-Webhook-Event")]++
+	}
+	want := map[string]int{models.EventFailure: 1, models.EventConsecutiveFailures: 1, models.EventRecovery: 1}
+	if len(got) != len(want) {
+		t.Errorf("delivered %v, want %v", got, want)
+	}
+	for event, count := range want {
+		if got[event] != count {
+			t.Errorf("delivered %d %s events, want %d", got[event], event, count)
+		}
+	}
+
+	// 停止后的事件直接丢弃
+	n.Notify(Event{Type: models.EventRecovery, ProjectID: 1})
+}
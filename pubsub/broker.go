@@ -0,0 +1,104 @@
+package pubsub
+
+import (
+	"log"
+	"sync"
+)
+
+// 消息类型，作为SSE的event字段
+const (
+	EventToken  = "token"  // 刷新成功，写入了新token
+	EventStatus = "status" // 刷新失败、熔断、需要重新授权、重新授权或启用/禁用
+)
+
+// subscriberBuffer 每个订阅者缓冲的消息数。缓冲满说明订阅者读取太慢，
+// 此时断开订阅而不是丢弃消息，客户端重连后会重新收到当前的token
+const subscriberBuffer = 32
+
+// Message 发布给订阅者的消息，Data编码为JSON后发送
+type Message struct {
+	Event     string
+	ProjectID int64
+	Data      any
+}
+
+// Broker 进程内的发布/订阅，刷新引擎发布token和状态的变化
+type Broker struct {
+	mu     sync.Mutex
+	subs   map[*Subscription]struct{}
+	closed bool
+}
+
+// Subscription 一个订阅。C在订阅关闭（主动关闭、读取太慢或Broker关闭）后被关闭
+type Subscription struct {
+	C <-chan Message
+
+	ch     chan Message
+	filter func(projectID int64) bool
+	broker *Broker
+}
+
+func New() *Broker {
+	return &Broker{subs: make(map[*Subscription]struct{})}
+}
+
+// Subscribe 订阅filter返回true的项目的消息，filter为nil时订阅所有项目
+func (b *Broker) Subscribe(filter func(projectID int64) bool) *Subscription {
+	ch := make(chan Message, subscriberBuffer)
+	sub := &Subscription{C: ch, ch: ch, filter: filter, broker: b}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(ch)
+		return sub
+	}
+	b.subs[sub] = struct{}{}
+	return sub
+}
+
+// Publish 将消息发给所有订阅了该项目的订阅者，不会阻塞。b为nil时忽略
+func (b *Broker) Publish(msg Message) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for sub := range b.subs {
+		if sub.filter != nil && !sub.filter(msg.ProjectID) {
+			continue
+		}
+		select {
+		case sub.ch <- msg:
+		default:
+			log.Printf("Warning: Stream subscriber is too slow, disconnecting it")
+			b.remove(sub)
+		}
+	}
+}
+
+// Close 关闭订阅，可重复调用
+func (s *Subscription) Close() {
+	s.broker.mu.Lock()
+	defer s.broker.mu.Unlock()
+	s.broker.remove(s)
+}
+
+// Close 关闭所有订阅并拒绝新的订阅，用于停止服务时结束进行中的流
+func (b *Broker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for sub := range b.subs {
+		b.remove(sub)
+	}
+}
+
+// remove 移除并关闭订阅，调用者须持有b.mu
+func (b *Broker) remove(sub *Subscription) {
+	if _, ok := b.subs[sub]; ok {
+		delete(b.subs, sub)
+		close(sub.ch)
+	}
+}
@@ -0,0 +1,84 @@
+package pubsub
+
+import "testing"
+
+// drain 读取订阅中已缓冲的消息，返回消息的项目ID以及C是否已关闭
+func drain(sub *Subscription) (ids []int64, closed bool) {
+	for {
+		select {
+		case msg, ok := <-sub.C:
+			if !ok {
+				return ids, true
+			}
+			ids = append(ids, msg.ProjectID)
+		default:
+			return ids, false
+		}
+	}
+}
+
+func TestPublishFilter(t *testing.T) {
+	b := New()
+	all := b.Subscribe(nil)
+	even := b.Subscribe(func(projectID int64) bool { return projectID%2 == 0 })
+
+	for id := int64(1); id <= 4; id++ {
+		b.Publish(Message{Event: EventToken, ProjectID: id})
+	}
+
+	if ids, closed := drain(all); len(ids) != 4 || closed {
+		t.Errorf("all received %v (closed %v), want [1 2 3 4]", ids, closed)
+	}
+	if ids, closed := drain(even); len(ids) != 2 || ids[0] != 2 || ids[1] != 4 || closed {
+		t.Errorf("even received %v (closed %v), want [2 4]", ids, closed)
+	}
+
+	var nilBroker *Broker
+	nilBroker.Publish(Message{Event: EventToken, ProjectID: 1}) // 未配置broker时忽略
+}
+
+func TestSlowSubscriberIsDisconnected(t *testing.T) {
+	b := New()
+	slow := b.Subscribe(nil)
+	other := b.Subscribe(func(projectID int64) bool { return projectID == 0 })
+
+	// 缓冲满后的下一条消息断开订阅，而不是丢弃消息或阻塞发布
+	for i := 0; i <= subscriberBuffer; i++ {
+		b.Publish(Message{Event: EventStatus, ProjectID: 1})
+	}
+
+	if ids, closed := drain(slow); len(ids) != subscriberBuffer || !closed {
+		t.Errorf("slow subscriber received %d messages (closed %v), want %d then closed", len(ids), closed, subscriberBuffer)
+	}
+	if _, closed := drain(other); closed {
+		t.Error("unrelated subscriber was closed")
+	}
+	slow.Close() // 已断开的订阅可以再次关闭
+}
+
+func TestClose(t *testing.T) {
+	b := New()
+	sub := b.Subscribe(nil)
+	closedSub := b.Subscribe(nil)
+	closedSub.Close()
+	closedSub.Close()
+
+	b.Publish(Message{Event: EventToken, ProjectID: 1})
+	if ids, closed := drain(closedSub); len(ids) != 0 || !closed {
+		t.Errorf("closed subscription received %v (closed %v)", ids, closed)
+	}
+
+	b.Close()
+	if ids, closed := drain(sub); len(ids) != 1 || !closed {
+		t.Errorf("subscription received %v (closed %v), want the buffered message then closed", ids, closed)
+	}
+
+	// 关闭后的订阅立即结束，发布被忽略
+	late := b.Subscribe(nil)
+	b.Publish(Message{Event: EventToken, ProjectID: 1})
+	if ids, closed := drain(late); len(ids) != 0 || !closed {
+		t.Errorf("subscription after Close received %v (closed %v)", ids, closed)
+	}
+	late.Close()
+	b.Close()
+}
@@ -0,0 +1,243 @@
+package refresher
+
+import (
+	"encoding/json"
+	"fmt"
+	"jwt_refresher/models"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DryRunOptions 试运行的可选输入
+type DryRunOptions struct {
+	// 前置步骤提取值的示例，用于渲染之后的步骤和刷新请求
+	StepValues StepValues `json:"step_values"`
+	// 对示例响应执行提取规则
+	SampleResponse *SampleResponse `json:"sample_response"`
+}
+
+// SampleResponse 粘贴的示例响应
+type SampleResponse struct {
+	StatusCode int               `json:"status_code"` // 为空时为200
+	Headers    map[string]string `json:"headers"`
+	Body       string            `json:"body"`
+}
+
+// DryRunRequest 将要发送的请求，敏感信息已遮盖
+type DryRunRequest struct {
+	Step    string            `json:"step,omitempty"` // 前置步骤名，为空表示刷新请求
+	Method  string            `json:"method"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body"`
+}
+
+// DryRunExtraction 对示例响应的提取结果
+type DryRunExtraction struct {
+	ErrorClass   ErrorClass        `json:"error_class,omitempty"` // 状态码不是200时按错误分类规则得到的分类
+	AccessToken  string            `json:"access_token,omitempty"`
+	RefreshToken string            `json:"refresh_token,omitempty"`
+	ExpiresAt    *time.Time        `json:"expires_at,omitempty"`
+	Outputs      map[string]string `json:"outputs,omitempty"`
+	Errors       map[string]string `json:"errors,omitempty"` // 字段 -> 提取错误
+}
+
+type DryRunResult struct {
+	Requests   []DryRunRequest   `json:"requests"`
+	Extraction *DryRunExtraction `json:"extraction,omitempty"`
+}
+
+// DryRun 渲染项目的请求并对示例响应执行提取规则，不发送请求也不修改项目
+func DryRun(project *models.Project, opts DryRunOptions) (*DryRunResult, error) {
+	steps, err := ParseRefreshSteps(project.RefreshSteps)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse refresh steps: %w", err)
+	}
+	matchers, err := ParseErrorMatchers(project.ErrorMatchers)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse error matchers: %w", err)
+	}
+	outputRules, err := ParseOutputRules(project.OutputRules)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse output rules: %w", err)
+	}
+
+	mask := newSecretMasker(project)
+	result := &DryRunResult{}
+
+	for i := range steps {
+		spec, err := steps[i].buildSpec(project, opts.StepValues)
+		if err != nil {
+			return nil, fmt.Errorf("step %s: %w", steps[i].Name, err)
+		}
+		result.Requests = append(result.Requests, mask.request(steps[i].Name, spec))
+	}
+
+	spec, err := buildRequestSpec(project, opts.StepValues)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build request: %w", err)
+	}
+	result.Requests = append(result.Requests, mask.request("", spec))
+
+	if opts.SampleResponse != nil {
+		result.Extraction = dryRunExtract(project, matchers, outputRules, opts.SampleResponse)
+	}
+	return result, nil
+}
+
+// dryRunExtract 按项目的提取规则处理示例响应，单个字段的错误记录在Errors中
+func dryRunExtract(project *models.Project, matchers []ErrorMatcher, outputRules map[string]string, sample *SampleResponse) *DryRunExtraction {
+	statusCode := sample.StatusCode
+	if statusCode == 0 {
+		statusCode = http.StatusOK
+	}
+	header := make(http.Header)
+	for key, value := range sample.Headers {
+		header.Add(key, value)
+	}
+	response := &Response{StatusCode: statusCode, Header: header, Body: []byte(sample.Body)}
+
+	extraction := &DryRunExtraction{Errors: make(map[string]string)}
+	if statusCode != http.StatusOK {
+		extraction.ErrorClass = classifyResponse(matchers, statusCode, sample.Body)
+		return extraction
+	}
+
+	var err error
+	accessTokenPath, refreshTokenPath, expiresInPath := tokenPaths(project)
+	if extraction.AccessToken, err = ExtractValue(response, project.ResponseFormat, accessTokenPath); err != nil {
+		extraction.Errors["access_token"] = err.Error()
+	}
+	if refreshTokenPath != "" {
+		if extraction.RefreshToken, err = ExtractValue(response, project.ResponseFormat, refreshTokenPath); err != nil {
+			extraction.Errors["refresh_token"] = err.Error()
+		}
+	}
+
+	expiresAt, err := responseExpiry(project, response, expiresInPath, extraction.AccessToken, time.Now())
+	if err != nil {
+		extraction.Errors["expires_at"] = err.Error()
+	}
+	if !expiresAt.IsZero() {
+		extraction.ExpiresAt = &expiresAt
+	}
+
+	if len(outputRules) > 0 {
+		extraction.Outputs = make(map[string]string, len(outputRules))
+		for name, path := range outputRules {
+			value, err := ExtractValue(response, project.ResponseFormat, path)
+			if err != nil {
+				extraction.Errors["outputs."+name] = err.Error()
+				continue
+			}
+			extraction.Outputs[name] = value
+		}
+	}
+	return extraction
+}
+
+// minMaskedSecretLength 短于此长度的敏感值不遮盖
+const minMaskedSecretLength = 4
+
+// secretMasker 遮盖请求中出现的敏感值（包括URL编码和JSON转义后的形式）
+type secretMasker struct {
+	replacer *strings.Replacer
+}
+
+// newSecretMasker 遮盖当前token、client secret、额外输出、所有自定义变量的值，
+// 以及模板可以通过env读取的所有环境变量的值
+func newSecretMasker(project *models.Project) *secretMasker {
+	secrets := []string{project.CurrentAccessToken, project.CurrentRefreshToken, project.OAuth2ClientSecret}
+
+	var customVars interface{}
+	if json.Unmarshal([]byte(project.CustomVariables), &customVars) == nil {
+		secrets = appendStrings(secrets, customVars)
+	}
+	if outputs, err := ParseOutputs(project.Outputs); err == nil {
+		for _, value := range outputs {
+			secrets = append(secrets, value)
+		}
+	}
+	for _, env := range os.Environ() {
+		if name, value, ok := strings.Cut(env, "="); ok && strings.HasPrefix(name, templateEnvPrefix) {
+			secrets = append(secrets, value)
+		}
+	}
+
+	// 先替换较长的值，避免短的值把长的值替换了一部分
+	variants := make(map[string]string)
+	for _, secret := range secrets {
+		// 太短的值替换后会遮盖请求中无关的内容
+		if len(secret) < minMaskedSecretLength {
+			continue
+		}
+		for _, v := range []string{secret, url.QueryEscape(secret), jsonEscape(secret)} {
+			variants[v] = maskSecret(secret)
+		}
+	}
+	keys := make([]string, 0, len(variants))
+	for v := range variants {
+		keys = append(keys, v)
+	}
+	sort.Slice(keys, func(i, j int) bool { return len(keys[i]) > len(keys[j]) })
+
+	pairs := make([]string, 0, len(keys)*2)
+	for _, v := range keys {
+		pairs = append(pairs, v, variants[v])
+	}
+	return &secretMasker{replacer: strings.NewReplacer(pairs...)}
+}
+
+func (m *secretMasker) request(step string, spec *requestSpec) DryRunRequest {
+	headers := make(map[string]string, len(spec.Headers))
+	for key, value := range spec.Headers {
+		// 认证头可能包含编码后的凭证，只保留认证方式
+		if strings.EqualFold(key, "Authorization") {
+			if scheme, _, ok := strings.Cut(value, " "); ok {
+				value = scheme + " ****"
+			} else {
+				value = "****"
+			}
+		}
+		headers[key] = m.replacer.Replace(value)
+	}
+	return DryRunRequest{
+		Step:    step,
+		Method:  spec.Method,
+		URL:     m.replacer.Replace(spec.URL),
+		Headers: headers,
+		Body:    m.replacer.Replace(spec.Body),
+	}
+}
+
+// appendStrings 收集JSON值（包括嵌套的对象和数组）中的所有字符串和数字
+func appendStrings(out []string, value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		out = append(out, v)
+	case float64:
+		out = append(out, strconv.FormatFloat(v, 'f', -1, 64))
+	case map[string]interface{}:
+		for _, item := range v {
+			out = appendStrings(out, item)
+		}
+	case []interface{}:
+		for _, item := range v {
+			out = appendStrings(out, item)
+		}
+	}
+	return out
+}
+
+// maskSecret 只保留较长的值的前4个字符
+func maskSecret(s string) string {
+	if len(s) > 8 {
+		return s[:4] + "****"
+	}
+	return "****"
+}
@@ -0,0 +1,193 @@
+package refresher
+
+import (
+	"encoding/json"
+	"jwt_refresher/models"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDryRunMasksSecrets(t *testing.T) {
+	t.Setenv("REFRESHER_VAR_SIGNING_SALT", "salt-from-environment")
+
+	secrets := []string{
+		"at-current-access",
+		"rt-current-refresh",
+		"client-secret-value",
+		"plain-variable-value",
+		"nested variable/value",
+		"salt-from-environment",
+		"output-session-id",
+		"123456789",
+	}
+
+	tests := []struct {
+		name    string
+		project models.Project
+	}{
+		{
+			name: "custom request with steps",
+			project: models.Project{
+				RefreshURL:    "https://auth.example.com/token?tenant={{urlencode .tenant}}",
+				RefreshMethod: "POST",
+				RefreshHeaders: `{"X-Salt":"{{env \"SIGNING_SALT\"}}","X-Session":"{{.Outputs.session}}",` +
+					`"Authorization":"Bearer {{.AccessToken}}"}`,
+				RefreshBodyTemplate: `{"refresh_token":"{{jsonEscape .RefreshToken}}","pin":{{.pin}},` +
+					`"nested":{{json .nested}},"tenant":"{{.tenant}}"}`,
+				RefreshSteps: `[{"name":"login","url":"https://auth.example.com/login",` +
+					`"body":"user={{.tenant}}&salt={{env \"SIGNING_SALT\"}}&nested={{urlencode .nested.path}}",` +
+					`"extract":{"code":"code"}}]`,
+				AccessTokenPath:     "access_token",
+				CurrentAccessToken:  "at-current-access",
+				CurrentRefreshToken: "rt-current-refresh",
+				CustomVariables:     `{"tenant":"plain-variable-value","pin":123456789,"nested":{"path":"nested variable/value"}}`,
+				Outputs:             `{"session":"output-session-id"}`,
+			},
+		},
+		{
+			name: "oauth2 secret in body",
+			project: models.Project{
+				ProjectType:         models.ProjectTypeOAuth2RefreshToken,
+				RefreshURL:          "https://auth.example.com/oauth/token",
+				OAuth2ClientID:      "client",
+				OAuth2ClientSecret:  "client-secret-value",
+				OAuth2ClientAuth:    models.OAuth2ClientAuthBody,
+				OAuth2BodyFormat:    models.OAuth2BodyFormatJSON,
+				CurrentRefreshToken: "rt-current-refresh",
+			},
+		},
+		{
+			name: "oauth2 secret in basic auth",
+			project: models.Project{
+				ProjectType:         models.ProjectTypeOAuth2RefreshToken,
+				RefreshURL:          "https://auth.example.com/oauth/token",
+				OAuth2ClientID:      "client",
+				OAuth2ClientSecret:  "client-secret-value",
+				CurrentRefreshToken: "rt-current-refresh",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := DryRun(&tt.project, DryRunOptions{})
+			if err != nil {
+				t.Fatalf("DryRun() error = %v", err)
+			}
+			data, err := json.Marshal(result)
+			if err != nil {
+				t.Fatal(err)
+			}
+			response := string(data)
+
+			for _, secret := range secrets {
+				for _, form := range []string{secret, url.QueryEscape(secret), url.PathEscape(secret)} {
+					if strings.Contains(response, form) {
+						t.Errorf("dry run response contains secret %q: %s", form, response)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestDryRunKeepsRequestShape(t *testing.T) {
+	project := &models.Project{
+		RefreshURL:          "https://auth.example.com/token",
+		RefreshMethod:       "POST",
+		RefreshBodyTemplate: `grant_type=refresh_token&refresh_token={{urlencode .RefreshToken}}&client_id={{.client_id}}`,
+		CurrentRefreshToken: "rt-0123456789",
+		CustomVariables:     `{"client_id":"my-client-id","n":"ab"}`,
+	}
+
+	result, err := DryRun(project, DryRunOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Requests) != 1 {
+		t.Fatalf("DryRun() returned %d requests, want 1", len(result.Requests))
+	}
+	req := result.Requests[0]
+	want := "grant_type=refresh_token&refresh_token=rt-0****&client_id=my-c****"
+	if req.Method != "POST" || req.URL != project.RefreshURL || req.Body != want {
+		t.Errorf("DryRun() request = %+v, want body %q", req, want)
+	}
+}
+
+func TestDryRunExtraction(t *testing.T) {
+	project := &models.Project{
+		RefreshURL:          "https://auth.example.com/token",
+		RefreshMethod:       "POST",
+		RefreshBodyTemplate: `code={{.Steps.login.code}}`,
+		RefreshSteps:        `[{"name":"login","url":"https://auth.example.com/login","extract":{"code":"code"}}]`,
+		AccessTokenPath:     "access_token",
+		RefreshTokenPath:    "refresh_token",
+		ExpiresInPath:       "expires_in",
+		OutputRules:         `{"id_token":"id_token","tenant":"tenant"}`,
+	}
+
+	tests := []struct {
+		name   string
+		sample SampleResponse
+		check  func(t *testing.T, e *DryRunExtraction)
+	}{
+		{
+			name:   "all fields",
+			sample: SampleResponse{Body: `{"access_token":"at-1","refresh_token":"rt-1","expires_in":60,"id_token":"id-1","tenant":"acme"}`},
+			check: func(t *testing.T, e *DryRunExtraction) {
+				if e.AccessToken != "at-1" || e.RefreshToken != "rt-1" || e.Outputs["id_token"] != "id-1" || len(e.Errors) != 0 {
+					t.Errorf("extraction = %+v", e)
+				}
+				if e.ExpiresAt == nil || time.Until(*e.ExpiresAt) > time.Minute || time.Until(*e.ExpiresAt) < 50*time.Second {
+					t.Errorf("expires_at = %v, want about a minute from now", e.ExpiresAt)
+				}
+			},
+		},
+		{
+			name:   "missing fields are reported per field",
+			sample: SampleResponse{Body: `{"access_token":"at-1","id_token":"id-1"}`},
+			check: func(t *testing.T, e *DryRunExtraction) {
+				for _, field := range []string{"refresh_token", "expires_at", "outputs.tenant"} {
+					if _, ok := e.Errors[field]; !ok {
+						t.Errorf("errors = %v, want an error for %s", e.Errors, field)
+					}
+				}
+				if e.AccessToken != "at-1" || e.Outputs["id_token"] != "id-1" {
+					t.Errorf("extraction = %+v", e)
+				}
+			},
+		},
+		{
+			name:   "error response is classified",
+			sample: SampleResponse{StatusCode: 400, Body: `{"error":"invalid_grant"}`},
+			check: func(t *testing.T, e *DryRunExtraction) {
+				if e.ErrorClass != ErrorClassTerminal || e.AccessToken != "" {
+					t.Errorf("extraction = %+v, want error class %s", e, ErrorClassTerminal)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := *project
+			sample := tt.sample
+			result, err := DryRun(project, DryRunOptions{
+				StepValues:     StepValues{"login": {"code": "c0de-from-sample"}},
+				SampleResponse: &sample,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *project != before {
+				t.Error("DryRun() modified the project")
+			}
+			if len(result.Requests) != 2 || result.Requests[0].Step != "login" || result.Requests[1].Body != "code=c0de-from-sample" {
+				t.Errorf("requests = %+v", result.Requests)
+			}
+			tt.check(t, result.Extraction)
+		})
+	}
+}
@@ -1,29 +1,204 @@
 package refresher
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"jwt_refresher/database"
 	"jwt_refresher/models"
+	"jwt_refresher/notifier"
+	"jwt_refresher/pubsub"
 	"log"
 	"net/http"
+	"net/http/cookiejar"
 	"strings"
+	"sync"
 	"time"
 )
 
 type Engine struct {
 	db *database.DB
+
+	// 全局代理配置，项目未配置代理时使用
+	proxy string
+
+	// 刷新事件（失败、恢复、需要重新授权等）的通知，为nil时不发送
+	notifier *notifier.Notifier
+
+	// token和状态变化的发布，供SSE订阅，为nil时不发布
+	broker *pubsub.Broker
+
+	// 需要重新授权的项目上一次发送提醒的时间
+	remindMu       sync.Mutex
+	reauthReminded map[int64]time.Time
+
+	// 推送到webhook类型sink的HTTP客户端
+	sinkClient *http.Client
+
+	// 正在推送sink的项目，值为推送期间又刷新得到的、等待推送的最新token
+	sinkMu      sync.Mutex
+	sinkPending map[int64]*sinkPush
+
+	// 每个项目同一时间只有一个刷新在执行，并发调用者共享其结果
+	mu       sync.Mutex
+	inflight map[int64]*flight
+	stopped  bool
+
+	// 所有刷新（调度器、手动和长轮询触发的）都在ctx下执行并计入flights，
+	// 关闭时等待它们写完数据库，超过关闭期限后取消
+	ctx      context.Context
+	cancel   context.CancelFunc
+	flights  sync.WaitGroup
+	stopOnce sync.Once
+
+	// 有自定义TLS或代理配置的项目使用各自的Transport
+	transportsMu sync.Mutex
+	transports   map[int64]*projectTransport
+}
+
+// flight 一次正在执行的刷新。刷新使用引擎的context，
+// 只有所有等待者都放弃（context取消）或引擎关闭时才会被取消
+type flight struct {
+	done    chan struct{}
+	err     error
+	cancel  context.CancelFunc
+	waiters int
+}
+
+// ErrStopped 引擎已关闭，不再开始新的刷新
+var ErrStopped = errors.New("refresh engine stopped")
+
+func NewEngine(db *database.DB, proxy string, n *notifier.Notifier, b *pubsub.Broker) *Engine {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Engine{
+		db:          db,
+		proxy:       proxy,
+		notifier:    n,
+		broker:      b,
+		sinkClient:  &http.Client{},
+		sinkPending: make(map[int64]*sinkPush),
+		inflight:    make(map[int64]*flight),
+		transports:  make(map[int64]*projectTransport),
+		ctx:         ctx,
+		cancel:      cancel,
+
+		reauthReminded: make(map[int64]time.Time),
+	}
+}
+
+// Stop 不再开始新的刷新，等待进行中的刷新完成，ctx结束后取消它们。
+// 应在调度器停止之后、数据库关闭之前调用
+func (e *Engine) Stop(ctx context.Context) {
+	e.stopOnce.Do(func() {
+		e.mu.Lock()
+		e.stopped = true
+		e.mu.Unlock()
+
+		drained := make(chan struct{})
+		go func() {
+			e.flights.Wait()
+			close(drained)
+		}()
+		select {
+		case <-drained:
+		case <-ctx.Done():
+			log.Println("Timed out waiting for in-flight refreshes, cancelling them")
+			e.cancel()
+			<-drained
+		}
+		e.cancel()
+	})
+}
+
+// Context 返回引擎的context，引擎关闭时取消。
+// 用于调用者不等待结果（如长轮询超时后仍在后台进行）的刷新
+func (e *Engine) Context() context.Context {
+	return e.ctx
 }
 
-func NewEngine(db *database.DB) *Engine {
-	return &Engine{db: db}
+// Refresh 刷新项目token。如果该项目已有刷新在执行，则等待并返回其结果，
+// 避免轮换式refresh token被并发请求重复使用。ctx取消时立即返回，
+// 没有其他调用者在等待时同时取消进行中的刷新
+func (e *Engine) Refresh(ctx context.Context, project *models.Project) error {
+	e.mu.Lock()
+	f, ok := e.inflight[project.ID]
+	if ok {
+		log.Printf("Refresh already in progress for project: %s (ID: %d), waiting for its result", project.Name, project.ID)
+	} else {
+		if e.stopped {
+			e.mu.Unlock()
+			return &RefreshError{Class: ErrorClassTransient, Err: ErrStopped}
+		}
+		flightCtx, cancel := context.WithCancel(e.ctx)
+		f = &flight{done: make(chan struct{}), cancel: cancel}
+		e.inflight[project.ID] = f
+		e.flights.Add(1)
+		go func() {
+			defer e.flights.Done()
+			e.run(flightCtx, f, project.ID)
+		}()
+	}
+	f.waiters++
+	e.mu.Unlock()
+
+	select {
+	case <-f.done:
+		return f.err
+	case <-ctx.Done():
+		e.mu.Lock()
+		f.waiters--
+		if f.waiters == 0 {
+			f.cancel()
+		}
+		e.mu.Unlock()
+		return ctx.Err()
+	}
 }
 
-func (e *Engine) Refresh(project *models.Project) error {
+// run 执行一次刷新并通知所有等待者
+func (e *Engine) run(ctx context.Context, f *flight, projectID int64) {
+	defer func() {
+		e.mu.Lock()
+		delete(e.inflight, projectID)
+		e.mu.Unlock()
+		f.cancel()
+		close(f.done)
+	}()
+
+	// 调用者持有的项目可能已过期（refresh token已被上一次刷新轮换），以数据库为准
+	latest, err := e.db.GetProject(ctx, projectID)
+	if err != nil {
+		f.err = fmt.Errorf("failed to load project: %w", err)
+		return
+	}
+
+	// 熔断冷却结束后的第一次刷新是试探：成功则关闭熔断器，失败则重新打开
+	if latest.LastRefreshStatus == models.StatusCircuitOpen && latest.CircuitOpenUntil.Valid && !latest.CircuitOpen(time.Now()) {
+		e.publishStatus(latest, StatusChange{
+			Status:              StatusCircuitHalfOpen,
+			ConsecutiveFailures: latest.ConsecutiveFailures,
+		})
+	}
+
+	f.err = e.refresh(ctx, latest)
+}
+
+// IsRefreshing 判断项目是否有刷新正在执行
+func (e *Engine) IsRefreshing(projectID int64) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, ok := e.inflight[projectID]
+	return ok
+}
+
+func (e *Engine) refresh(ctx context.Context, project *models.Project) error {
 	log.Printf("Starting refresh for project: %s (ID: %d)", project.Name, project.ID)
 
+	// 刷新结果和失败记录在调用者取消后也要写入数据库，
+	// 否则上游已轮换的refresh token会丢失
+	storeCtx := context.WithoutCancel(ctx)
+
 	oldTokenPreview := ""
 	if len(project.CurrentAccessToken) > 10 {
 		oldTokenPreview = project.CurrentAccessToken[:10]
@@ -31,85 +206,133 @@ func (e *Engine) Refresh(project *models.Project) error {
 		oldTokenPreview = project.CurrentAccessToken
 	}
 
-	// 1. 构建HTTP请求体（替换模板变量）
-	body, err := RenderTemplate(project.RefreshBodyTemplate, project)
+	// 1. 解析重试策略、错误匹配、额外输出和刷新步骤的配置
+	policy, err := retryPolicyFor(project)
 	if err != nil {
-		e.logRefreshError(project.ID, oldTokenPreview, "", fmt.Sprintf("Failed to render template: %v", err), "")
-		return fmt.Errorf("failed to render template: %w", err)
+		e.logRefreshError(storeCtx, project, ErrorClassConfig, "", oldTokenPreview, "", fmt.Sprintf("Invalid retry policy: %v", err), "")
+		return &RefreshError{Class: ErrorClassConfig, Err: fmt.Errorf("invalid retry policy: %w", err)}
 	}
 
-	// 2. 创建HTTP请求
-	req, err := http.NewRequest(project.RefreshMethod, project.RefreshURL, bytes.NewBufferString(body))
+	matchers, err := ParseErrorMatchers(project.ErrorMatchers)
 	if err != nil {
-		e.logRefreshError(project.ID, oldTokenPreview, "", fmt.Sprintf("Failed to create request: %v", err), "")
-		return fmt.Errorf("failed to create request: %w", err)
+		e.logRefreshError(storeCtx, project, ErrorClassConfig, "", oldTokenPreview, "", fmt.Sprintf("Failed to parse error matchers: %v", err), "")
+		return &RefreshError{Class: ErrorClassConfig, Err: fmt.Errorf("failed to parse error matchers: %w", err)}
 	}
 
-	// 3. 设置请求头
-	if project.RefreshHeaders != "" {
-		var headers map[string]string
-		if err := json.Unmarshal([]byte(project.RefreshHeaders), &headers); err != nil {
-			e.logRefreshError(project.ID, oldTokenPreview, "", fmt.Sprintf("Failed to parse headers: %v", err), "")
-			return fmt.Errorf("failed to parse headers: %w", err)
-		}
-		for key, value := range headers {
-			req.Header.Set(key, value)
-		}
+	outputRules, err := ParseOutputRules(project.OutputRules)
+	if err != nil {
+		e.logRefreshError(storeCtx, project, ErrorClassConfig, "", oldTokenPreview, "", fmt.Sprintf("Failed to parse output rules: %v", err), "")
+		return &RefreshError{Class: ErrorClassConfig, Err: fmt.Errorf("failed to parse output rules: %w", err)}
 	}
 
-	// 4. 发送请求
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
+	steps, err := ParseRefreshSteps(project.RefreshSteps)
 	if err != nil {
-		e.logRefreshError(project.ID, oldTokenPreview, "", fmt.Sprintf("Failed to send request: %v", err), "")
-		return fmt.Errorf("failed to send request: %w", err)
+		e.logRefreshError(storeCtx, project, ErrorClassConfig, "", oldTokenPreview, "", fmt.Sprintf("Failed to parse refresh steps: %v", err), "")
+		return &RefreshError{Class: ErrorClassConfig, Err: fmt.Errorf("failed to parse refresh steps: %w", err)}
 	}
-	defer resp.Body.Close()
 
-	// 5. 读取响应
-	respBody, err := io.ReadAll(resp.Body)
+	client, err := e.newHTTPClient(project, len(steps) > 0)
+	if err != nil {
+		e.logRefreshError(storeCtx, project, ErrorClassConfig, "", oldTokenPreview, "", fmt.Sprintf("Invalid transport configuration: %v", err), "")
+		return &RefreshError{Class: ErrorClassConfig, Err: fmt.Errorf("invalid transport configuration: %w", err)}
+	}
+
+	// 2. 依次执行刷新步骤，提取的值供之后的步骤和刷新请求的模板使用
+	values, err := e.runSteps(ctx, client, project, steps, policy, matchers, oldTokenPreview)
 	if err != nil {
-		e.logRefreshError(project.ID, oldTokenPreview, "", fmt.Sprintf("Failed to read response: %v", err), "")
-		return fmt.Errorf("failed to read response: %w", err)
+		return err
 	}
 
+	// 3. 按项目类型构建请求（模板或OAuth2）
+	spec, err := buildRequestSpec(project, values)
+	if err != nil {
+		e.logRefreshError(storeCtx, project, ErrorClassConfig, "", oldTokenPreview, "", fmt.Sprintf("Failed to build request: %v", err), "")
+		return &RefreshError{Class: ErrorClassConfig, Err: fmt.Errorf("failed to build request: %w", err)}
+	}
+
+	req, err := newHTTPRequest(ctx, spec)
+	if err != nil {
+		e.logRefreshError(storeCtx, project, ErrorClassConfig, "", oldTokenPreview, "", fmt.Sprintf("Failed to create request: %v", err), "")
+		return &RefreshError{Class: ErrorClassConfig, Err: fmt.Errorf("failed to create request: %w", err)}
+	}
+	// 4. 发送请求（按项目的重试策略重试），刷新日志记录每次尝试实际使用的代理
+	resp, respBody, proxy, err := e.sendWithRetry(ctx, client, project, policy, matchers, req)
+	if err != nil {
+		// 被取消（客户端断开或程序退出）不计入失败
+		if ctx.Err() != nil {
+			log.Printf("Refresh cancelled for project: %s (ID: %d)", project.Name, project.ID)
+			return &RefreshError{Class: ErrorClassTransient, Err: fmt.Errorf("refresh cancelled: %w", ctx.Err())}
+		}
+		class := classifyRequestError(err)
+		e.logRefreshError(storeCtx, project, class, proxy, oldTokenPreview, "", fmt.Sprintf("Failed to send request: %v", err), "")
+		return &RefreshError{Class: class, Err: fmt.Errorf("failed to send request: %w", err)}
+	}
+
+	// 5. 读取响应
 	respBodyStr := string(respBody)
+	response := &Response{StatusCode: resp.StatusCode, Header: resp.Header, Body: respBody}
 
 	// 6. 检查HTTP状态码
 	if resp.StatusCode != http.StatusOK {
-		e.logRefreshError(project.ID, oldTokenPreview, "", fmt.Sprintf("HTTP %d: %s", resp.StatusCode, respBodyStr), respBodyStr)
-		return fmt.Errorf("refresh failed with status %d: %s", resp.StatusCode, respBodyStr)
+		class := classifyResponse(matchers, resp.StatusCode, respBodyStr)
+		e.logRefreshError(storeCtx, project, class, proxy, oldTokenPreview, "", fmt.Sprintf("HTTP %d (%s): %s", resp.StatusCode, class, respBodyStr), respBodyStr)
+		return &RefreshError{
+			Class:      class,
+			StatusCode: resp.StatusCode,
+			Err:        fmt.Errorf("refresh failed with status %d: %s", resp.StatusCode, respBodyStr),
+		}
 	}
 
-	// 7. 使用JSONPath提取token
-	accessToken, err := ExtractToken(respBodyStr, project.AccessTokenPath)
+	// 7. 按响应格式提取token
+	accessTokenPath, refreshTokenPath, expiresInPath := tokenPaths(project)
+	accessToken, err := ExtractValue(response, project.ResponseFormat, accessTokenPath)
 	if err != nil {
-		e.logRefreshError(project.ID, oldTokenPreview, "", fmt.Sprintf("Failed to extract access token: %v", err), respBodyStr)
-		return fmt.Errorf("failed to extract access token: %w", err)
+		e.logRefreshError(storeCtx, project, ErrorClassConfig, proxy, oldTokenPreview, "", fmt.Sprintf("Failed to extract access token: %v", err), respBodyStr)
+		return &RefreshError{Class: ErrorClassConfig, Err: fmt.Errorf("failed to extract access token: %w", err)}
 	}
 
-	refreshToken, err := ExtractToken(respBodyStr, project.RefreshTokenPath)
-	if err != nil {
-		e.logRefreshError(project.ID, oldTokenPreview, "", fmt.Sprintf("Failed to extract refresh token: %v", err), respBodyStr)
-		return fmt.Errorf("failed to extract refresh token: %w", err)
+	// refresh token是可选的：没有提取规则（如client_credentials）或响应中没有返回
+	// （不轮换refresh token的服务）时保留原值，refreshToken为空表示不更新
+	var refreshToken string
+	if refreshTokenPath != "" {
+		if token, err := ExtractValue(response, project.ResponseFormat, refreshTokenPath); err == nil && token != "" {
+			refreshToken = token
+		} else if project.CurrentRefreshToken != "" {
+			log.Printf("No new refresh token returned for project: %s (ID: %d), keeping the previous one", project.Name, project.ID)
+		}
 	}
 
+	// 响应体会保存到刷新日志（logs:read的API Key可读），不能包含新token
+	respBodyStr = redactSecrets(respBodyStr, accessToken, refreshToken)
+
 	// 8. 提取过期时间（如果有）
-	var expiresAt time.Time
-	if project.ExpiresInPath != "" {
-		expiresIn, err := ExtractExpiresIn(respBodyStr, project.ExpiresInPath)
-		if err != nil {
-			log.Printf("Warning: Failed to extract expires_in: %v", err)
-			// 不是致命错误，继续执行
-		} else {
-			expiresAt = time.Now().Add(time.Duration(expiresIn) * time.Second)
+	expiresAt, err := responseExpiry(project, response, expiresInPath, accessToken, time.Now())
+	if err != nil {
+		log.Printf("Warning: Failed to extract expiry: %v", err)
+		// 不是致命错误，继续执行
+	}
+
+	if lifetime := time.Until(expiresAt); !expiresAt.IsZero() && time.Duration(project.RefreshBeforeSeconds)*time.Second >= lifetime {
+		log.Printf("Warning: refresh_before_seconds (%d) of project %s (ID: %d) is not less than the token lifetime (%s), refreshing at half the lifetime instead",
+			project.RefreshBeforeSeconds, project.Name, project.ID, lifetime.Round(time.Second))
+	}
+
+	// 提取额外的输出值，供API返回和下一次请求模板使用
+	outputs, err := extractOutputs(project, outputRules, response)
+	if err != nil {
+		e.logRefreshError(storeCtx, project, ErrorClassConfig, proxy, oldTokenPreview, "", fmt.Sprintf("Failed to encode outputs: %v", err), respBodyStr)
+		return &RefreshError{Class: ErrorClassConfig, Err: fmt.Errorf("failed to encode outputs: %w", err)}
+	}
+	if values, err := ParseOutputs(outputs); err == nil {
+		for _, value := range values {
+			respBodyStr = redactSecrets(respBodyStr, value)
 		}
 	}
 
 	// 9. 更新数据库
-	if err := e.db.UpdateProjectTokens(project.ID, accessToken, refreshToken, expiresAt, "success"); err != nil {
-		e.logRefreshError(project.ID, oldTokenPreview, "", fmt.Sprintf("Failed to update database: %v", err), respBodyStr)
-		return fmt.Errorf("failed to update database: %w", err)
+	if err := e.db.UpdateProjectTokens(storeCtx, project.ID, accessToken, refreshToken, expiresAt, outputs, models.StatusSuccess); err != nil {
+		e.logRefreshError(storeCtx, project, ErrorClassTransient, proxy, oldTokenPreview, "", fmt.Sprintf("Failed to update database: %v", err), respBodyStr)
+		return &RefreshError{Class: ErrorClassTransient, Err: fmt.Errorf("failed to update database: %w", err)}
 	}
 
 	// 10. 记录成功日志
@@ -127,67 +350,396 @@ func (e *Engine) Refresh(project *models.Project) error {
 		oldRefreshTokenPreview = project.CurrentRefreshToken
 	}
 
+	currentRefreshToken := refreshToken
+	if currentRefreshToken == "" {
+		currentRefreshToken = project.CurrentRefreshToken
+	}
 	newRefreshTokenPreview := ""
-	if len(refreshToken) > 10 {
-		newRefreshTokenPreview = refreshToken[:10]
+	if len(currentRefreshToken) > 10 {
+		newRefreshTokenPreview = currentRefreshToken[:10]
 	} else {
-		newRefreshTokenPreview = refreshToken
+		newRefreshTokenPreview = currentRefreshToken
 	}
 
 	logEntry := &models.RefreshLog{
 		ProjectID:              project.ID,
-		Status:                 "success",
+		Status:                 models.StatusSuccess,
 		OldTokenPreview:        oldTokenPreview,
 		NewTokenPreview:        newTokenPreview,
 		OldRefreshTokenPreview: oldRefreshTokenPreview,
 		NewRefreshTokenPreview: newRefreshTokenPreview,
 		ResponseBody:           respBodyStr,
+		Proxy:                  proxy,
 	}
-	if err := e.db.CreateRefreshLog(logEntry); err != nil {
+	if err := e.db.CreateRefreshLog(storeCtx, logEntry); err != nil {
 		log.Printf("Warning: Failed to create refresh log: %v", err)
 	}
 
 	log.Printf("Successfully refreshed tokens for project: %s (ID: %d)", project.Name, project.ID)
+
+	// 11. 发布新token并推送到下游sink
+	token := &Token{
+		ProjectID:    project.ID,
+		ProjectName:  project.Name,
+		AccessToken:  accessToken,
+		RefreshToken: currentRefreshToken,
+	}
+	if !expiresAt.IsZero() {
+		token.ExpiresAt = &expiresAt
+	}
+	if token.Outputs, err = ParseOutputs(outputs); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	e.publishToken(token)
+	e.pushSinks(project, logEntry.ID, token)
+
+	event := notifier.Event{Type: models.EventSuccess}
+	if !expiresAt.IsZero() {
+		event.ExpiresAt = &expiresAt
+	}
+	e.notify(project, event)
+	// 之前处于失败或需要重新授权的状态
+	if project.ConsecutiveFailures > 0 || project.LastRefreshStatus == models.StatusNeedsReauth ||
+		project.LastRefreshStatus == models.StatusReauthorized {
+		event.Type = models.EventRecovery
+		e.notify(project, event)
+	}
 	return nil
 }
 
-func (e *Engine) logRefreshError(projectID int64, oldTokenPreview, newTokenPreview, errorMsg, responseBody string) {
-	// 更新项目状态
-	if err := e.db.UpdateProjectRefreshStatus(projectID, "failed"); err != nil {
-		log.Printf("Warning: Failed to update project refresh status: %v", err)
+// runSteps 依次执行刷新步骤，返回各步骤提取的值。失败时记录失败的步骤
+func (e *Engine) runSteps(ctx context.Context, client *http.Client, project *models.Project, steps []RefreshStep, policy *RetryPolicy, matchers []ErrorMatcher, oldTokenPreview string) (StepValues, error) {
+	storeCtx := context.WithoutCancel(ctx)
+	values := make(StepValues, len(steps))
+
+	for i := range steps {
+		step := &steps[i]
+		log.Printf("Running refresh step %s for project: %s (ID: %d)", step.Name, project.Name, project.ID)
+
+		spec, err := step.buildSpec(project, values)
+		if err != nil {
+			e.logStepError(storeCtx, project, ErrorClassConfig, step.Name, "", oldTokenPreview, "", fmt.Sprintf("Step %s: failed to build request: %v", step.Name, err), "")
+			return nil, &RefreshError{Class: ErrorClassConfig, Err: fmt.Errorf("step %s: failed to build request: %w", step.Name, err)}
+		}
+
+		req, err := newHTTPRequest(ctx, spec)
+		if err != nil {
+			e.logStepError(storeCtx, project, ErrorClassConfig, step.Name, "", oldTokenPreview, "", fmt.Sprintf("Step %s: failed to create request: %v", step.Name, err), "")
+			return nil, &RefreshError{Class: ErrorClassConfig, Err: fmt.Errorf("step %s: failed to create request: %w", step.Name, err)}
+		}
+		resp, respBody, proxy, err := e.sendWithRetry(ctx, client, project, policy, matchers, req)
+		if err != nil {
+			if ctx.Err() != nil {
+				log.Printf("Refresh cancelled for project: %s (ID: %d)", project.Name, project.ID)
+				return nil, &RefreshError{Class: ErrorClassTransient, Err: fmt.Errorf("refresh cancelled: %w", ctx.Err())}
+			}
+			class := classifyRequestError(err)
+			e.logStepError(storeCtx, project, class, step.Name, proxy, oldTokenPreview, "", fmt.Sprintf("Step %s: failed to send request: %v", step.Name, err), "")
+			return nil, &RefreshError{Class: class, Err: fmt.Errorf("step %s: failed to send request: %w", step.Name, err)}
+		}
+
+		respBodyStr := string(respBody)
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			class := classifyResponse(matchers, resp.StatusCode, respBodyStr)
+			e.logStepError(storeCtx, project, class, step.Name, proxy, oldTokenPreview, "", fmt.Sprintf("Step %s: HTTP %d (%s): %s", step.Name, resp.StatusCode, class, respBodyStr), respBodyStr)
+			return nil, &RefreshError{
+				Class:      class,
+				StatusCode: resp.StatusCode,
+				Err:        fmt.Errorf("step %s failed with status %d: %s", step.Name, resp.StatusCode, respBodyStr),
+			}
+		}
+
+		extracted, err := step.extract(&Response{StatusCode: resp.StatusCode, Header: resp.Header, Body: respBody})
+		if err != nil {
+			e.logStepError(storeCtx, project, ErrorClassConfig, step.Name, proxy, oldTokenPreview, "", fmt.Sprintf("Step %s: %v", step.Name, err), respBodyStr)
+			return nil, &RefreshError{Class: ErrorClassConfig, Err: fmt.Errorf("step %s: %w", step.Name, err)}
+		}
+		values[step.Name] = extracted
+	}
+	return values, nil
+}
+
+// newHTTPClient 创建一次刷新使用的HTTP客户端。多步骤刷新时各步骤共享cookie
+func (e *Engine) newHTTPClient(project *models.Project, withCookies bool) (*http.Client, error) {
+	transport, err := e.transportFor(project)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := time.Duration(project.RequestTimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = defaultRequestTimeout
+	}
+	client := &http.Client{Transport: transport, Timeout: timeout}
+	if withCookies {
+		// cookiejar.New在没有PublicSuffixList时不会返回错误
+		client.Jar, _ = cookiejar.New(nil)
+	}
+	return client, nil
+}
+
+// sendWithRetry 发送请求，遇到可重试的错误或状态码时按策略退避重试。
+// 返回最后一次的响应（Body已读取并关闭），以及每次尝试使用的代理（逗号分隔）
+func (e *Engine) sendWithRetry(ctx context.Context, client *http.Client, project *models.Project, policy *RetryPolicy, matchers []ErrorMatcher, req *http.Request) (*http.Response, []byte, string, error) {
+	var proxies []string
+	for attempt := 1; ; attempt++ {
+		attemptReq := req.Clone(ctx)
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, nil, strings.Join(proxies, ", "), err
+			}
+			attemptReq.Body = body
+		}
+		proxy := e.describeProxy(project, attemptReq)
+		proxies = append(proxies, proxy)
+
+		var respBody []byte
+		resp, err := client.Do(attemptReq)
+		if err == nil {
+			respBody, err = io.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+
+		var retryable bool
+		var reason string
+		if err != nil {
+			retryable = policy.RetryableError(err)
+			reason = err.Error()
+		} else {
+			// 终止性错误和配置错误重试也不会成功
+			retryable = resp.StatusCode != http.StatusOK && policy.RetryableStatus(resp.StatusCode) &&
+				classifyResponse(matchers, resp.StatusCode, string(respBody)) == ErrorClassTransient
+			reason = fmt.Sprintf("HTTP %d", resp.StatusCode)
+		}
+
+		if !retryable || attempt >= policy.MaxAttempts || ctx.Err() != nil {
+			if err != nil {
+				return nil, nil, strings.Join(proxies, ", "), err
+			}
+			return resp, respBody, strings.Join(proxies, ", "), nil
+		}
+
+		delay := policy.Backoff(attempt, resp)
+		log.Printf("Refresh attempt %d/%d for project %s (ID: %d) via %s failed (%s), retrying in %v",
+			attempt, policy.MaxAttempts, project.Name, project.ID, proxy, reason, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, nil, strings.Join(proxies, ", "), ctx.Err()
+		}
+	}
+}
+
+func (e *Engine) logRefreshError(ctx context.Context, project *models.Project, class ErrorClass, proxy, oldTokenPreview, newTokenPreview, errorMsg, responseBody string) {
+	e.logStepError(ctx, project, class, "", proxy, oldTokenPreview, newTokenPreview, errorMsg, responseBody)
+}
+
+// logStepError 记录一次失败的刷新，step为失败的刷新步骤，为空表示最终的token请求；
+// proxy为每次尝试使用的代理，请求发送之前的失败为空
+func (e *Engine) logStepError(ctx context.Context, project *models.Project, class ErrorClass, step, proxy, oldTokenPreview, newTokenPreview, errorMsg, responseBody string) {
+	// 上游可能在错误响应中回显请求中的token
+	errorMsg = redactSecrets(errorMsg, project.CurrentAccessToken, project.CurrentRefreshToken)
+	responseBody = redactSecrets(responseBody, project.CurrentAccessToken, project.CurrentRefreshToken)
+
+	event := notifier.Event{
+		Type:       models.EventFailure,
+		Message:    truncateString(errorMsg, maxEventMessage),
+		ErrorClass: string(class),
+	}
+	if class == ErrorClassTerminal {
+		// refresh token已失效：暂停调度，等待重新授权
+		if err := e.db.UpdateProjectRefreshStatus(ctx, project.ID, models.StatusNeedsReauth); err != nil {
+			log.Printf("Warning: Failed to update project refresh status: %v", err)
+		}
+		log.Printf("WARNING: Project %s (ID: %d) needs re-authorization: %s", project.Name, project.ID, sanitizeForLog(errorMsg))
+		e.notify(project, event)
+		// 已处于needs_reauth时（如手动触发的刷新再次失败）不重复发送，
+		// 之后由CheckReauth定期提醒
+		if project.LastRefreshStatus != models.StatusNeedsReauth {
+			event.Type = models.EventNeedsReauth
+			e.notify(project, event)
+			e.remindMu.Lock()
+			e.reauthReminded[project.ID] = time.Now()
+			e.remindMu.Unlock()
+		}
+		e.publishStatus(project, StatusChange{
+			Status:              models.StatusNeedsReauth,
+			ConsecutiveFailures: project.ConsecutiveFailures,
+			ErrorClass:          event.ErrorClass,
+			Error:               event.Message,
+		})
+	} else {
+		var circuitOpened bool
+		event.ConsecutiveFailures, circuitOpened = e.recordFailure(ctx, project)
+		e.notify(project, event)
+		status := models.StatusFailed
+		if circuitOpened {
+			status = models.StatusCircuitOpen
+		}
+		e.publishStatus(project, StatusChange{
+			Status:              status,
+			ConsecutiveFailures: event.ConsecutiveFailures,
+			ErrorClass:          event.ErrorClass,
+			Error:               event.Message,
+		})
 	}
 
 	// 记录错误日志
 	logEntry := &models.RefreshLog{
-		ProjectID:       projectID,
-		Status:          "failed",
+		ProjectID:       project.ID,
+		Status:          models.StatusFailed,
 		ErrorMessage:    errorMsg,
 		OldTokenPreview: oldTokenPreview,
 		NewTokenPreview: newTokenPreview,
 		ResponseBody:    responseBody,
+		FailedStep:      step,
+		Proxy:           proxy,
 	}
-	if err := e.db.CreateRefreshLog(logEntry); err != nil {
+	if err := e.db.CreateRefreshLog(ctx, logEntry); err != nil {
 		log.Printf("Warning: Failed to create refresh log: %v", err)
 	}
 }
 
+// recordFailure 更新失败状态，连续失败达到阈值时打开熔断器。返回连续失败次数
+func (e *Engine) recordFailure(ctx context.Context, project *models.Project) (failures int, circuitOpened bool) {
+	failures, err := e.db.RecordRefreshFailure(ctx, project.ID, models.StatusFailed)
+	if err != nil {
+		log.Printf("Warning: Failed to update project refresh status: %v", err)
+		return 0, false
+	}
+	if project.CircuitBreakerThreshold <= 0 || failures < project.CircuitBreakerThreshold {
+		return failures, false
+	}
+
+	cooldown := time.Duration(project.CircuitBreakerCooldownSeconds) * time.Second
+	if cooldown <= 0 {
+		cooldown = defaultCircuitCooldown
+	}
+	until := time.Now().Add(cooldown)
+	if err := e.db.OpenCircuit(ctx, project.ID, until); err != nil {
+		log.Printf("Warning: Failed to open circuit: %v", err)
+		return failures, false
+	}
+	log.Printf("Circuit opened for project %s (ID: %d) after %d consecutive failures, paused until %s",
+		project.Name, project.ID, failures, until.Format(time.RFC3339))
+	return failures, true
+}
+
+// maxEventMessage 通知中错误信息的最大长度
+const maxEventMessage = 500
+
+// notify 发送项目的刷新事件通知
+func (e *Engine) notify(project *models.Project, event notifier.Event) {
+	event.ProjectID = project.ID
+	event.ProjectName = project.Name
+	e.notifier.Notify(event)
+}
+
+// CheckExpiry 项目的token有过期时间而最近一次刷新没有成功时发送expiring事件，
+// 由调度器定期调用。是否进入Webhook的提醒窗口以及去重由notifier判断
+func (e *Engine) CheckExpiry(project *models.Project) {
+	if !project.Enabled || !project.TokenExpiresAt.Valid || project.LastRefreshStatus == models.StatusSuccess {
+		return
+	}
+	expiresAt := project.TokenExpiresAt.Time
+	e.notify(project, notifier.Event{
+		Type:      models.EventExpiring,
+		Message:   fmt.Sprintf("Token expires at %s, last refresh status: %s", expiresAt.Format(time.RFC3339), project.LastRefreshStatus),
+		ExpiresAt: &expiresAt,
+	})
+}
+
+// CheckReauth 项目处于needs_reauth状态时每reauthReminderInterval重复发送一次
+// needs_reauth事件，直到重新授权。由调度器定期调用
+func (e *Engine) CheckReauth(project *models.Project) {
+	e.remindMu.Lock()
+	if project.LastRefreshStatus != models.StatusNeedsReauth {
+		delete(e.reauthReminded, project.ID)
+		e.remindMu.Unlock()
+		return
+	}
+	now := time.Now()
+	if last, ok := e.reauthReminded[project.ID]; ok && now.Sub(last) < reauthReminderInterval {
+		e.remindMu.Unlock()
+		return
+	}
+	e.reauthReminded[project.ID] = now
+	e.remindMu.Unlock()
+
+	msg := "Project still needs re-authorization"
+	if project.LastRefreshAt.Valid {
+		msg = fmt.Sprintf("Project still needs re-authorization since %s", project.LastRefreshAt.Time.Format(time.RFC3339))
+	}
+	e.notify(project, notifier.Event{Type: models.EventNeedsReauth, Message: msg})
+}
+
+// ForgetProject 项目删除后清除引擎和notifier中为它保留的状态：缓存的Transport、
+// needs_reauth提醒时间和即将过期提醒的去重记录
+func (e *Engine) ForgetProject(projectID int64) {
+	e.EvictTransport(projectID)
+	e.remindMu.Lock()
+	delete(e.reauthReminded, projectID)
+	e.remindMu.Unlock()
+	e.notifier.ForgetProject(projectID)
+}
+
 func (e *Engine) ShouldRefresh(project *models.Project) bool {
-	// 如果没有access token，需要刷新
+	next, ok := e.NextRefreshAt(project)
+	return ok && !time.Now().Before(next)
+}
+
+// NextRefreshAt 计算项目下一次应当刷新的时间，ok为false表示无需自动刷新
+func (e *Engine) NextRefreshAt(project *models.Project) (next time.Time, ok bool) {
+	now := time.Now()
+
+	// 需要重新授权的项目不再自动刷新
+	if project.LastRefreshStatus == models.StatusNeedsReauth {
+		return time.Time{}, false
+	}
+
+	// 熔断器打开期间不刷新，冷却结束后允许一次试探请求
+	if project.CircuitOpen(now) {
+		return project.CircuitOpenUntil.Time, true
+	}
+
 	if project.CurrentAccessToken == "" {
-		return true
+		// 如果没有access token，需要刷新
+		next = now
+	} else if !project.TokenExpiresAt.Valid || project.TokenExpiresAt.Time.IsZero() {
+		// 如果没有设置过期时间，不刷新
+		return time.Time{}, false
+	} else {
+		// 在过期前refresh_before_seconds秒刷新
+		next = project.TokenExpiresAt.Time.Add(-refreshBeforeFor(project))
 	}
 
-	// 如果没有设置过期时间，不刷新
-	if !project.TokenExpiresAt.Valid {
-		return false
+	// 上次刷新成功后至少间隔minRefreshInterval，即使token已经（或即将）过期
+	if project.LastRefreshStatus == models.StatusSuccess && project.LastRefreshAt.Valid {
+		if earliest := project.LastRefreshAt.Time.Add(minRefreshInterval); earliest.After(next) {
+			next = earliest
+		}
 	}
 
-	// 计算距离过期还有多久
-	timeUntilExpiry := time.Until(project.TokenExpiresAt.Time)
+	// 上次刷新失败时至少间隔failureRetryDelay再试
+	if project.LastRefreshStatus == models.StatusFailed && project.LastRefreshAt.Valid {
+		if retryAt := project.LastRefreshAt.Time.Add(failureRetryDelay); retryAt.After(next) {
+			next = retryAt
+		}
+	}
+	return next, true
+}
 
-	// 如果已经过期或即将过期（在refresh_before_seconds秒内），需要刷新
+// refreshBeforeFor 返回过期前多久刷新。refresh_before_seconds不小于上次刷新得到的
+// token有效期时（如默认300秒而token只有60秒），改为在有效期过半时刷新
+func refreshBeforeFor(project *models.Project) time.Duration {
 	refreshBefore := time.Duration(project.RefreshBeforeSeconds) * time.Second
-	return timeUntilExpiry <= refreshBefore
+	if project.LastRefreshAt.Valid && project.TokenExpiresAt.Valid {
+		if lifetime := project.TokenExpiresAt.Time.Sub(project.LastRefreshAt.Time); lifetime > 0 && refreshBefore >= lifetime {
+			return lifetime / 2
+		}
+	}
+	return refreshBefore
 }
 
 func getTokenPreview(token string) string {
@@ -204,6 +756,19 @@ func truncateString(s string, maxLen int) string {
 	return s[:maxLen] + "..."
 }
 
+// minRedactLength 短于此长度的值不做替换，避免误替换响应中的普通字段
+const minRedactLength = 8
+
+// redactSecrets 将s中出现的token等敏感值替换为[REDACTED]
+func redactSecrets(s string, secrets ...string) string {
+	for _, secret := range secrets {
+		if len(secret) >= minRedactLength {
+			s = strings.ReplaceAll(s, secret, "[REDACTED]")
+		}
+	}
+	return s
+}
+
 func sanitizeForLog(s string) string {
 	// 移除敏感信息
 	s = strings.ReplaceAll(s, "\n", " ")
@@ -0,0 +1,490 @@
+package refresher
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"jwt_refresher/database"
+	"jwt_refresher/models"
+	"jwt_refresher/pubsub"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestEngine 使用临时数据库创建引擎，测试结束时停止
+func newTestEngine(t *testing.T) (*database.DB, *Engine) {
+	t.Helper()
+	db, err := database.InitDB(filepath.Join(t.TempDir(), "test.db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := NewEngine(db, "", nil, pubsub.New())
+	t.Cleanup(func() {
+		e.Stop(context.Background())
+		db.Close()
+	})
+	return db, e
+}
+
+// createTestProject 保存项目，未设置的字段使用适合测试的默认值
+func createTestProject(t *testing.T, db *database.DB, project *models.Project) *models.Project {
+	t.Helper()
+	if project.Name == "" {
+		project.Name = "test"
+	}
+	if project.RefreshMethod == "" {
+		project.RefreshMethod = "POST"
+	}
+	if project.AccessTokenPath == "" && project.ProjectType == "" {
+		project.AccessTokenPath = "access_token"
+	}
+	project.Enabled = true
+	if err := db.CreateProject(context.Background(), project); err != nil {
+		t.Fatal(err)
+	}
+	return project
+}
+
+func TestNextRefreshAt(t *testing.T) {
+	now := time.Now()
+	valid := func(t time.Time) sql.NullTime { return sql.NullTime{Time: t, Valid: true} }
+
+	tests := []struct {
+		name    string
+		project models.Project
+		ok      bool
+		// 期望的下次刷新时间（相对now），允许1秒误差
+		after time.Duration
+	}{
+		{
+			name: "refresh before expiry",
+			project: models.Project{
+				CurrentAccessToken:   "tok",
+				TokenExpiresAt:       valid(now.Add(time.Hour)),
+				RefreshBeforeSeconds: 300,
+				LastRefreshAt:        valid(now),
+				LastRefreshStatus:    models.StatusSuccess,
+			},
+			ok:    true,
+			after: 55 * time.Minute,
+		},
+		{
+			// 默认的300秒大于60秒的token有效期，不能立即再次刷新
+			name: "short lived token refreshes at half lifetime",
+			project: models.Project{
+				CurrentAccessToken:   "tok",
+				TokenExpiresAt:       valid(now.Add(90 * time.Second)),
+				RefreshBeforeSeconds: 300,
+				LastRefreshAt:        valid(now),
+				LastRefreshStatus:    models.StatusSuccess,
+			},
+			ok:    true,
+			after: 45 * time.Second,
+		},
+		{
+			name: "very short token is clamped to the minimum interval",
+			project: models.Project{
+				CurrentAccessToken:   "tok",
+				TokenExpiresAt:       valid(now.Add(10 * time.Second)),
+				RefreshBeforeSeconds: 300,
+				LastRefreshAt:        valid(now),
+				LastRefreshStatus:    models.StatusSuccess,
+			},
+			ok:    true,
+			after: minRefreshInterval,
+		},
+		{
+			name: "missing access token after success waits the minimum interval",
+			project: models.Project{
+				LastRefreshAt:     valid(now),
+				LastRefreshStatus: models.StatusSuccess,
+			},
+			ok:    true,
+			after: minRefreshInterval,
+		},
+		{
+			name:    "never refreshed project is due now",
+			project: models.Project{},
+			ok:      true,
+			after:   0,
+		},
+		{
+			name: "failure waits the retry delay",
+			project: models.Project{
+				LastRefreshAt:     valid(now),
+				LastRefreshStatus: models.StatusFailed,
+			},
+			ok:    true,
+			after: failureRetryDelay,
+		},
+		{
+			name: "unknown expiry is not scheduled",
+			project: models.Project{
+				CurrentAccessToken: "tok",
+				LastRefreshAt:      valid(now),
+				LastRefreshStatus:  models.StatusSuccess,
+			},
+			ok: false,
+		},
+		{
+			name: "needs reauth is not scheduled",
+			project: models.Project{
+				LastRefreshStatus: models.StatusNeedsReauth,
+			},
+			ok: false,
+		},
+		{
+			name: "open circuit waits for cooldown",
+			project: models.Project{
+				CircuitOpenUntil: valid(now.Add(5 * time.Minute)),
+			},
+			ok:    true,
+			after: 5 * time.Minute,
+		},
+	}
+
+	e := &Engine{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next, ok := e.NextRefreshAt(&tt.project)
+			if ok != tt.ok {
+				t.Fatalf("ok = %v, want %v", ok, tt.ok)
+			}
+			if !ok {
+				return
+			}
+			if diff := next.Sub(now.Add(tt.after)); diff < -time.Second || diff > time.Second {
+				t.Errorf("next = now + %s, want now + %s", next.Sub(now), tt.after)
+			}
+		})
+	}
+}
+
+func TestRedactSecrets(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		secrets []string
+		want    string
+	}{
+		{
+			name:    "json body",
+			s:       `{"access_token":"eyJhbGciOi.abc","refresh_token":"rt-12345678"}`,
+			secrets: []string{"eyJhbGciOi.abc", "rt-12345678"},
+			want:    `{"access_token":"[REDACTED]","refresh_token":"[REDACTED]"}`,
+		},
+		{
+			name:    "form body",
+			s:       "access_token=secret-token-1&token_type=bearer",
+			secrets: []string{"secret-token-1", ""},
+			want:    "access_token=[REDACTED]&token_type=bearer",
+		},
+		{
+			name:    "short values are kept",
+			s:       `{"token_type":"bearer"}`,
+			secrets: []string{"bearer"},
+			want:    `{"token_type":"bearer"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := redactSecrets(tt.s, tt.secrets...); got != tt.want {
+				t.Errorf("redactSecrets() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEngineStopHonorsDeadline(t *testing.T) {
+	// 上游一直不响应，直到请求被取消
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer upstream.Close()
+
+	db, e := newTestEngine(t)
+	project := createTestProject(t, db, &models.Project{RefreshURL: upstream.URL, RetryMaxAttempts: 1})
+
+	result := make(chan error, 1)
+	go func() { result <- e.Refresh(context.Background(), project) }()
+	for i := 0; !e.IsRefreshing(project.ID); i++ {
+		if i > 200 {
+			t.Fatal("refresh did not start")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	e.Stop(ctx)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Stop() took %s, want about the 100ms deadline", elapsed)
+	}
+
+	select {
+	case err := <-result:
+		if err == nil {
+			t.Error("Refresh() = nil after the engine was stopped, want an error")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Refresh() did not return after Stop()")
+	}
+
+	if err := e.Refresh(context.Background(), project); !errors.Is(err, ErrStopped) {
+		t.Errorf("Refresh() after Stop() error = %v, want ErrStopped", err)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var failing atomic.Bool
+	failing.Store(true)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"access_token":"at-new","expires_in":3600}`))
+	}))
+	defer upstream.Close()
+
+	db, e := newTestEngine(t)
+	project := createTestProject(t, db, &models.Project{
+		RefreshURL:                    upstream.URL,
+		RetryMaxAttempts:              1,
+		CircuitBreakerThreshold:       2,
+		CircuitBreakerCooldownSeconds: 60,
+	})
+	sub := e.broker.Subscribe(nil)
+	defer sub.Close()
+
+	ctx := context.Background()
+	// expireCooldown 把熔断的截止时间移到过去，模拟冷却时间已过
+	expireCooldown := func() {
+		if err := db.OpenCircuit(ctx, project.ID, time.Now().Add(-time.Second)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 依次执行，每一步之后检查项目状态和发布的status事件
+	tests := []struct {
+		name         string
+		before       func()
+		fail         bool
+		wantStatus   string
+		wantFailures int
+		wantOpen     bool
+		wantEvents   []string
+	}{
+		{name: "first failure", fail: true, wantStatus: models.StatusFailed, wantFailures: 1, wantEvents: []string{models.StatusFailed}},
+		{name: "threshold opens the circuit", fail: true, wantStatus: models.StatusCircuitOpen, wantFailures: 2, wantOpen: true, wantEvents: []string{models.StatusCircuitOpen}},
+		{
+			name:         "failed probe reopens the circuit",
+			before:       expireCooldown,
+			fail:         true,
+			wantStatus:   models.StatusCircuitOpen,
+			wantFailures: 3,
+			wantOpen:     true,
+			wantEvents:   []string{StatusCircuitHalfOpen, models.StatusCircuitOpen},
+		},
+		{
+			name:       "successful probe closes the circuit",
+			before:     expireCooldown,
+			wantStatus: models.StatusSuccess,
+			wantEvents: []string{StatusCircuitHalfOpen, pubsub.EventToken},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.before != nil {
+				tt.before()
+			}
+			failing.Store(tt.fail)
+
+			start := time.Now()
+			if err := e.Refresh(ctx, project); (err != nil) != tt.fail {
+				t.Fatalf("Refresh() error = %v, want failure %v", err, tt.fail)
+			}
+
+			got, err := db.GetProject(ctx, project.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.LastRefreshStatus != tt.wantStatus || got.ConsecutiveFailures != tt.wantFailures {
+				t.Errorf("status = %s (%d failures), want %s (%d failures)",
+					got.LastRefreshStatus, got.ConsecutiveFailures, tt.wantStatus, tt.wantFailures)
+			}
+			if open := got.CircuitOpen(time.Now()); open != tt.wantOpen {
+				t.Errorf("circuit open = %v, want %v", open, tt.wantOpen)
+			}
+			if tt.wantOpen {
+				// 冷却期间不调度，冷却结束时再试
+				until := got.CircuitOpenUntil.Time
+				if until.Before(start.Add(59*time.Second)) || until.After(time.Now().Add(61*time.Second)) {
+					t.Errorf("circuit open until now + %s, want now + 60s", time.Until(until))
+				}
+				if next, ok := e.NextRefreshAt(got); !ok || !next.Equal(until) {
+					t.Errorf("NextRefreshAt() = %v, %v, want %v", next, ok, until)
+				}
+			}
+
+			var events []string
+			for len(sub.C) > 0 {
+				msg := <-sub.C
+				if change, ok := msg.Data.(StatusChange); ok {
+					events = append(events, change.Status)
+				} else {
+					events = append(events, msg.Event)
+				}
+			}
+			if fmt.Sprint(events) != fmt.Sprint(tt.wantEvents) {
+				t.Errorf("published %v, want %v", events, tt.wantEvents)
+			}
+		})
+	}
+}
+
+// waitForWaiters 等待项目进行中的刷新有n个等待者
+func waitForWaiters(t *testing.T, e *Engine, projectID int64, n int) {
+	t.Helper()
+	for i := 0; ; i++ {
+		e.mu.Lock()
+		f, ok := e.inflight[projectID]
+		waiters := 0
+		if ok {
+			waiters = f.waiters
+		}
+		e.mu.Unlock()
+		if waiters == n {
+			return
+		}
+		if i > 400 {
+			t.Fatalf("refresh has %d waiters, want %d", waiters, n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRefreshSingleFlight(t *testing.T) {
+	var hits atomic.Int32
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := hits.Add(1)
+		select {
+		case <-release:
+		case <-r.Context().Done():
+			return
+		}
+		fmt.Fprintf(w, `{"access_token":"at-%d","refresh_token":"rt-%d","expires_in":3600}`, n, n)
+	}))
+	defer upstream.Close()
+
+	db, e := newTestEngine(t)
+	project := createTestProject(t, db, &models.Project{
+		RefreshURL:          upstream.URL,
+		RefreshBodyTemplate: `{"refresh_token":"{{.RefreshToken}}"}`,
+		RefreshTokenPath:    "refresh_token",
+		CurrentRefreshToken: "rt-0",
+		RetryMaxAttempts:    1,
+	})
+
+	const callers = 5
+	errs := make(chan error, callers)
+	for i := 0; i < callers; i++ {
+		go func() { errs <- e.Refresh(context.Background(), project) }()
+	}
+	waitForWaiters(t, e, project.ID, callers)
+	close(release)
+
+	for i := 0; i < callers; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("Refresh() error = %v", err)
+		}
+	}
+	if got := hits.Load(); got != 1 {
+		t.Errorf("upstream hits = %d, want 1", got)
+	}
+	if e.IsRefreshing(project.ID) {
+		t.Error("IsRefreshing() = true after the refresh finished")
+	}
+
+	// 调用者持有的是刷新前的项目，下一次刷新仍应使用轮换后的refresh token
+	if err := e.Refresh(context.Background(), project); err != nil {
+		t.Fatal(err)
+	}
+	got, err := db.GetProject(context.Background(), project.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.CurrentAccessToken != "at-2" || got.CurrentRefreshToken != "rt-2" {
+		t.Errorf("tokens = %s, %s, want at-2, rt-2", got.CurrentAccessToken, got.CurrentRefreshToken)
+	}
+}
+
+func TestRefreshWaiterCancellation(t *testing.T) {
+	var hits atomic.Int32
+	cancelled := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		<-r.Context().Done()
+		close(cancelled)
+	}))
+	defer upstream.Close()
+
+	db, e := newTestEngine(t)
+	project := createTestProject(t, db, &models.Project{RefreshURL: upstream.URL, RetryMaxAttempts: 1})
+
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	errs := make(chan error, 2)
+	go func() { errs <- e.Refresh(ctx1, project) }()
+	waitForWaiters(t, e, project.ID, 1)
+	go func() { errs <- e.Refresh(ctx2, project) }()
+	waitForWaiters(t, e, project.ID, 2)
+
+	// 还有其他等待者时，放弃的调用者不会取消刷新
+	cancel1()
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled Refresh() error = %v, want context.Canceled", err)
+	}
+	waitForWaiters(t, e, project.ID, 1)
+	select {
+	case <-cancelled:
+		t.Fatal("refresh was cancelled while another caller was waiting")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// 最后一个等待者放弃时取消刷新，取消不计入失败
+	cancel2()
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled Refresh() error = %v, want context.Canceled", err)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("refresh was not cancelled after every caller gave up")
+	}
+	for i := 0; e.IsRefreshing(project.ID); i++ {
+		if i > 400 {
+			t.Fatal("refresh did not finish after it was cancelled")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	got, err := db.GetProject(context.Background(), project.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ConsecutiveFailures != 0 || got.LastRefreshStatus == models.StatusFailed {
+		t.Errorf("status = %s (%d failures), want the cancelled refresh not to count", got.LastRefreshStatus, got.ConsecutiveFailures)
+	}
+	if got := hits.Load(); got != 1 {
+		t.Errorf("upstream hits = %d, want 1", got)
+	}
+}
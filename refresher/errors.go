@@ -0,0 +1,138 @@
+package refresher
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/tidwall/gjson"
+)
+
+// ErrorClass 刷新失败的类别
+type ErrorClass string
+
+const (
+	// ErrorClassTerminal refresh token已失效，需要重新授权，重试无意义
+	ErrorClassTerminal ErrorClass = "terminal"
+	// ErrorClassTransient 网络错误、限流、服务端错误等临时故障
+	ErrorClassTransient ErrorClass = "transient"
+	// ErrorClassConfig 项目配置错误（模板、请求头、提取规则、客户端凭证等）
+	ErrorClassConfig ErrorClass = "config"
+)
+
+// RefreshError 带分类的刷新错误
+type RefreshError struct {
+	Class      ErrorClass
+	StatusCode int
+	Err        error
+}
+
+func (e *RefreshError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RefreshError) Unwrap() error {
+	return e.Err
+}
+
+// ClassOf 返回错误的类别，未分类的错误视为临时错误
+func ClassOf(err error) ErrorClass {
+	var refreshErr *RefreshError
+	if errors.As(err, &refreshErr) {
+		return refreshErr.Class
+	}
+	return ErrorClassTransient
+}
+
+// classifyRequestError 对发送请求时的错误分类。证书校验失败和对端拒绝握手
+// （如未提供客户端证书）属于TLS配置错误，其余视为临时错误
+func classifyRequestError(err error) ErrorClass {
+	var verifyErr *tls.CertificateVerificationError
+	var hostnameErr x509.HostnameError
+	var authorityErr x509.UnknownAuthorityError
+	var invalidErr x509.CertificateInvalidError
+	if errors.As(err, &verifyErr) || errors.As(err, &hostnameErr) ||
+		errors.As(err, &authorityErr) || errors.As(err, &invalidErr) {
+		return ErrorClassConfig
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "remote error" {
+		return ErrorClassConfig
+	}
+	return ErrorClassTransient
+}
+
+// ErrorMatcher 根据HTTP状态码和响应字段对错误分类。
+// Status为0表示匹配任意状态码；Value为空表示Path存在即可
+type ErrorMatcher struct {
+	Class  ErrorClass `json:"class"`
+	Status int        `json:"status"`
+	Path   string     `json:"path"`
+	Value  string     `json:"value"`
+}
+
+// defaultErrorMatchers 标准OAuth2错误码（RFC 6749 5.2节）
+var defaultErrorMatchers = []ErrorMatcher{
+	{Class: ErrorClassTerminal, Path: "error", Value: "invalid_grant"},
+	{Class: ErrorClassConfig, Path: "error", Value: "invalid_client"},
+	{Class: ErrorClassConfig, Path: "error", Value: "unauthorized_client"},
+	{Class: ErrorClassConfig, Path: "error", Value: "unsupported_grant_type"},
+	{Class: ErrorClassConfig, Path: "error", Value: "invalid_scope"},
+	{Class: ErrorClassConfig, Path: "error", Value: "invalid_request"},
+}
+
+// ParseErrorMatchers 解析项目配置的错误匹配规则（JSON数组）
+func ParseErrorMatchers(s string) ([]ErrorMatcher, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var matchers []ErrorMatcher
+	if err := json.Unmarshal([]byte(s), &matchers); err != nil {
+		return nil, err
+	}
+	for i, m := range matchers {
+		switch m.Class {
+		case ErrorClassTerminal, ErrorClassTransient, ErrorClassConfig:
+		default:
+			return nil, fmt.Errorf("error matcher %d: unknown class %q", i, m.Class)
+		}
+		if m.Status == 0 && m.Path == "" {
+			return nil, fmt.Errorf("error matcher %d: status or path is required", i)
+		}
+	}
+	return matchers, nil
+}
+
+// classifyResponse 对非200响应分类：先匹配项目规则，再匹配默认规则，
+// 最后按状态码兜底（429和5xx为临时错误，其余为配置错误）
+func classifyResponse(matchers []ErrorMatcher, statusCode int, body string) ErrorClass {
+	for _, list := range [][]ErrorMatcher{matchers, defaultErrorMatchers} {
+		for _, m := range list {
+			if m.matches(statusCode, body) {
+				return m.Class
+			}
+		}
+	}
+
+	if statusCode == 429 || statusCode >= 500 {
+		return ErrorClassTransient
+	}
+	return ErrorClassConfig
+}
+
+func (m ErrorMatcher) matches(statusCode int, body string) bool {
+	if m.Status != 0 && m.Status != statusCode {
+		return false
+	}
+	if m.Path == "" {
+		return true
+	}
+	result := gjson.Get(body, m.Path)
+	if !result.Exists() {
+		return false
+	}
+	return m.Value == "" || result.String() == m.Value
+}
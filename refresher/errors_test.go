@@ -0,0 +1,204 @@
+package refresher
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"jwt_refresher/models"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestClassifyResponse(t *testing.T) {
+	matchers, err := ParseErrorMatchers(`[
+		{"class":"terminal","status":401,"path":"code","value":"TOKEN_REVOKED"},
+		{"class":"transient","path":"error","value":"invalid_grant","status":503},
+		{"class":"config","status":418}
+	]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		matchers []ErrorMatcher
+		status   int
+		body     string
+		want     ErrorClass
+	}{
+		{name: "invalid_grant", status: 400, body: `{"error":"invalid_grant"}`, want: ErrorClassTerminal},
+		{name: "invalid_grant with any status", status: 401, body: `{"error":"invalid_grant","error_description":"expired"}`, want: ErrorClassTerminal},
+		{name: "invalid_client", status: 401, body: `{"error":"invalid_client"}`, want: ErrorClassConfig},
+		{name: "unknown oauth error falls back to status", status: 400, body: `{"error":"slow_down"}`, want: ErrorClassConfig},
+		{name: "rate limited", status: 429, body: `{"error":"slow_down"}`, want: ErrorClassTransient},
+		{name: "server error", status: 502, body: "<html>Bad Gateway</html>", want: ErrorClassTransient},
+		{name: "not found", status: 404, body: "", want: ErrorClassConfig},
+
+		{name: "project matcher", matchers: matchers, status: 401, body: `{"code":"TOKEN_REVOKED"}`, want: ErrorClassTerminal},
+		{name: "project matcher needs the status", matchers: matchers, status: 403, body: `{"code":"TOKEN_REVOKED"}`, want: ErrorClassConfig},
+		{name: "project matcher needs the value", matchers: matchers, status: 401, body: `{"code":"EXPIRED"}`, want: ErrorClassConfig},
+		{name: "project matcher wins over defaults", matchers: matchers, status: 503, body: `{"error":"invalid_grant"}`, want: ErrorClassTransient},
+		{name: "status only matcher", matchers: matchers, status: 418, body: "", want: ErrorClassConfig},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classifyResponse(tt.matchers, tt.status, tt.body); got != tt.want {
+				t.Errorf("classifyResponse() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseErrorMatchers(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		want    int
+		wantErr bool
+	}{
+		{name: "empty", s: "", want: 0},
+		{name: "valid", s: `[{"class":"terminal","path":"error","value":"invalid_grant"},{"class":"transient","status":409}]`, want: 2},
+		{name: "unknown class", s: `[{"class":"fatal","status":400}]`, wantErr: true},
+		{name: "no status or path", s: `[{"class":"terminal","value":"x"}]`, wantErr: true},
+		{name: "not an array", s: `{"class":"terminal"}`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseErrorMatchers(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseErrorMatchers() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(got) != tt.want {
+				t.Errorf("ParseErrorMatchers() = %d matchers, want %d", len(got), tt.want)
+			}
+		})
+	}
+}
+
+func TestClassifyRequestError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want ErrorClass
+	}{
+		{name: "unknown authority", err: fmt.Errorf("Post: %w", x509.UnknownAuthorityError{}), want: ErrorClassConfig},
+		{name: "hostname mismatch", err: fmt.Errorf("Post: %w", x509.HostnameError{Host: "auth.example.com"}), want: ErrorClassConfig},
+		{name: "handshake rejected", err: &net.OpError{Op: "remote error", Err: errors.New("tls: certificate required")}, want: ErrorClassConfig},
+		{name: "connection refused", err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}, want: ErrorClassTransient},
+		{name: "other", err: errors.New("EOF"), want: ErrorClassTransient},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classifyRequestError(tt.err); got != tt.want {
+				t.Errorf("classifyRequestError() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRefreshNeedsReauth(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		body       string
+		matchers   string
+		wantClass  ErrorClass
+		wantStatus string
+		wantHits   int32
+	}{
+		{
+			name:       "invalid_grant",
+			status:     http.StatusBadRequest,
+			body:       `{"error":"invalid_grant"}`,
+			wantClass:  ErrorClassTerminal,
+			wantStatus: models.StatusNeedsReauth,
+			wantHits:   1,
+		},
+		{
+			// 终止性错误不重试，即使状态码在retry_on中
+			name:       "invalid_grant on a retryable status",
+			status:     http.StatusServiceUnavailable,
+			body:       `{"error":"invalid_grant"}`,
+			wantClass:  ErrorClassTerminal,
+			wantStatus: models.StatusNeedsReauth,
+			wantHits:   1,
+		},
+		{
+			name:       "project matcher",
+			status:     http.StatusUnauthorized,
+			body:       `{"code":"TOKEN_REVOKED"}`,
+			matchers:   `[{"class":"terminal","status":401,"path":"code"}]`,
+			wantClass:  ErrorClassTerminal,
+			wantStatus: models.StatusNeedsReauth,
+			wantHits:   1,
+		},
+		{
+			name:       "config error",
+			status:     http.StatusUnauthorized,
+			body:       `{"error":"invalid_client"}`,
+			wantClass:  ErrorClassConfig,
+			wantStatus: models.StatusFailed,
+			wantHits:   1,
+		},
+		{
+			name:       "transient error",
+			status:     http.StatusServiceUnavailable,
+			body:       `{"error":"temporarily_unavailable"}`,
+			wantClass:  ErrorClassTransient,
+			wantStatus: models.StatusFailed,
+			wantHits:   2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var hits atomic.Int32
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				hits.Add(1)
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer upstream.Close()
+
+			db, e := newTestEngine(t)
+			project := createTestProject(t, db, &models.Project{
+				RefreshURL:          upstream.URL,
+				CurrentRefreshToken: "rt-dead",
+				ErrorMatchers:       tt.matchers,
+				RetryMaxAttempts:    2,
+				RetryBaseDelayMs:    1,
+			})
+
+			err := e.Refresh(context.Background(), project)
+			var refreshErr *RefreshError
+			if !errors.As(err, &refreshErr) || refreshErr.StatusCode != tt.status {
+				t.Fatalf("Refresh() error = %v, want a RefreshError with status %d", err, tt.status)
+			}
+			if got := ClassOf(err); got != tt.wantClass {
+				t.Errorf("ClassOf() = %s, want %s", got, tt.wantClass)
+			}
+			if got := hits.Load(); got != tt.wantHits {
+				t.Errorf("upstream hits = %d, want %d", got, tt.wantHits)
+			}
+
+			got, err := db.GetProject(context.Background(), project.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.LastRefreshStatus != tt.wantStatus {
+				t.Errorf("status = %s, want %s", got.LastRefreshStatus, tt.wantStatus)
+			}
+			// needs_reauth暂停调度，其他失败等待重试间隔后再试
+			if _, ok := e.NextRefreshAt(got); ok == (tt.wantStatus == models.StatusNeedsReauth) {
+				t.Errorf("NextRefreshAt() scheduled = %v for status %s", ok, got.LastRefreshStatus)
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package refresher
+
+import (
+	"fmt"
+	"jwt_refresher/models"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// 绝对过期时间早于当前时间但在此范围内时视为时钟偏差，仍然接受（会立即再次刷新）
+	maxClockSkew = 5 * time.Minute
+	// 超过此时长的过期时间通常是格式配置错误（如毫秒被当作秒）
+	maxTokenLifetime = 10 * 365 * 24 * time.Hour
+)
+
+// ValidateExpiresFormat 校验过期时间格式配置
+func ValidateExpiresFormat(format, layout string) error {
+	switch format {
+	case "", models.ExpiresFormatSeconds, models.ExpiresFormatMilliseconds, models.ExpiresFormatMinutes,
+		models.ExpiresFormatDuration, models.ExpiresFormatEpochSeconds, models.ExpiresFormatEpochMilliseconds,
+		models.ExpiresFormatRFC3339:
+		return nil
+	case models.ExpiresFormatLayout:
+		if strings.TrimSpace(layout) == "" {
+			return fmt.Errorf("expires_layout is required for format %q", format)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown expires format %q", format)
+	}
+}
+
+// ParseExpiry 将响应中的过期时间按format换算为绝对时间并校验是否合理
+func ParseExpiry(value, format, layout string, now time.Time) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	expiresAt, err := parseExpiry(value, format, layout, now)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if relativeExpiry(format) && !expiresAt.After(now) {
+		return time.Time{}, fmt.Errorf("relative expiry %q must be positive", value)
+	}
+	if expiresAt.Before(now.Add(-maxClockSkew)) {
+		return time.Time{}, fmt.Errorf("expiry %s is in the past, check expires_format or clock skew", expiresAt.Format(time.RFC3339))
+	}
+	if expiresAt.After(now.Add(maxTokenLifetime)) {
+		return time.Time{}, fmt.Errorf("expiry %s is too far in the future, check expires_format", expiresAt.Format(time.RFC3339))
+	}
+	return expiresAt, nil
+}
+
+func parseExpiry(value, format, layout string, now time.Time) (time.Time, error) {
+	switch format {
+	case "", models.ExpiresFormatSeconds:
+		n, err := expiryNumber(value)
+		return now.Add(time.Duration(n * float64(time.Second))), err
+	case models.ExpiresFormatMilliseconds:
+		n, err := expiryNumber(value)
+		return now.Add(time.Duration(n * float64(time.Millisecond))), err
+	case models.ExpiresFormatMinutes:
+		n, err := expiryNumber(value)
+		return now.Add(time.Duration(n * float64(time.Minute))), err
+	case models.ExpiresFormatDuration:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid duration: %w", err)
+		}
+		return now.Add(d), nil
+	case models.ExpiresFormatEpochSeconds:
+		n, err := expiryNumber(value)
+		sec, frac := math.Modf(n)
+		return time.Unix(int64(sec), int64(frac*1e9)), err
+	case models.ExpiresFormatEpochMilliseconds:
+		n, err := expiryNumber(value)
+		return time.UnixMilli(int64(n)), err
+	case models.ExpiresFormatRFC3339:
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid RFC3339 time: %w", err)
+		}
+		return t, nil
+	case models.ExpiresFormatLayout:
+		t, err := time.Parse(layout, value)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid time for layout %q: %w", layout, err)
+		}
+		return t, nil
+	default:
+		return time.Time{}, fmt.Errorf("unknown expires format %q", format)
+	}
+}
+
+// relativeExpiry 判断格式是否为相对时间
+func relativeExpiry(format string) bool {
+	switch format {
+	case "", models.ExpiresFormatSeconds, models.ExpiresFormatMilliseconds, models.ExpiresFormatMinutes, models.ExpiresFormatDuration:
+		return true
+	}
+	return false
+}
+
+// expiryNumber 解析数字
+func expiryNumber(value string) (float64, error) {
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsInf(n, 0) || math.IsNaN(n) {
+		return 0, fmt.Errorf("expiry %q is not a number", value)
+	}
+	return n, nil
+}
+
+// responseExpiry 从响应中提取过期时间，没有时尝试从JWT格式的access token中读取。
+// 返回零值表示过期时间未知；过期时间字段提取或解析失败时同时返回错误
+func responseExpiry(project *models.Project, response *Response, expiresInPath, accessToken string, now time.Time) (time.Time, error) {
+	var expiresAt time.Time
+	var err error
+	if expiresInPath != "" {
+		var value string
+		value, err = ExtractValue(response, project.ResponseFormat, expiresInPath)
+		if err == nil {
+			expiresAt, err = ParseExpiry(value, project.ExpiresFormat, project.ExpiresLayout, now)
+		}
+	}
+
+	if expiresAt.IsZero() {
+		if exp, ok := jwtExpiry(accessToken, now); ok {
+			expiresAt = exp
+		}
+	}
+	return expiresAt, err
+}
@@ -0,0 +1,80 @@
+package refresher
+
+import (
+	"jwt_refresher/models"
+	"testing"
+	"time"
+)
+
+func TestParseExpiry(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		value   string
+		format  string
+		layout  string
+		want    time.Time
+		wantErr bool
+	}{
+		{name: "default is seconds", value: "3600", want: now.Add(time.Hour)},
+		{name: "seconds with whitespace", value: " 60 ", format: models.ExpiresFormatSeconds, want: now.Add(time.Minute)},
+		{name: "fractional seconds", value: "1.5", format: models.ExpiresFormatSeconds, want: now.Add(1500 * time.Millisecond)},
+		{name: "milliseconds", value: "90000", format: models.ExpiresFormatMilliseconds, want: now.Add(90 * time.Second)},
+		{name: "minutes", value: "15", format: models.ExpiresFormatMinutes, want: now.Add(15 * time.Minute)},
+		{name: "duration", value: "1h30m", format: models.ExpiresFormatDuration, want: now.Add(90 * time.Minute)},
+		{name: "epoch seconds", value: "1717246800", format: models.ExpiresFormatEpochSeconds, want: time.Unix(1717246800, 0)},
+		{name: "epoch milliseconds", value: "1717246800500", format: models.ExpiresFormatEpochMilliseconds, want: time.UnixMilli(1717246800500)},
+		{name: "rfc3339", value: "2024-06-01T13:00:00Z", format: models.ExpiresFormatRFC3339, want: now.Add(time.Hour)},
+		{name: "rfc3339 with offset", value: "2024-06-01T15:00:00+02:00", format: models.ExpiresFormatRFC3339, want: now.Add(time.Hour)},
+		{name: "layout", value: "2024-06-01 13:00:00", format: models.ExpiresFormatLayout, layout: "2006-01-02 15:04:05", want: now.Add(time.Hour)},
+		{name: "within clock skew", value: "2024-06-01T11:58:00Z", format: models.ExpiresFormatRFC3339, want: now.Add(-2 * time.Minute)},
+
+		{name: "not a number", value: "soon", format: models.ExpiresFormatSeconds, wantErr: true},
+		{name: "zero relative expiry", value: "0", wantErr: true},
+		{name: "negative relative expiry", value: "-60", wantErr: true},
+		{name: "invalid duration", value: "1 hour", format: models.ExpiresFormatDuration, wantErr: true},
+		{name: "epoch in the past", value: "1000000000", format: models.ExpiresFormatEpochSeconds, wantErr: true},
+		{name: "milliseconds as seconds", value: "1717246800500", format: models.ExpiresFormatEpochSeconds, wantErr: true},
+		{name: "too far in the future", value: "999999999999", format: models.ExpiresFormatSeconds, wantErr: true},
+		{name: "invalid rfc3339", value: "2024-06-01", format: models.ExpiresFormatRFC3339, wantErr: true},
+		{name: "layout mismatch", value: "01/06/2024", format: models.ExpiresFormatLayout, layout: "2006-01-02", wantErr: true},
+		{name: "unknown format", value: "3600", format: "hours", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseExpiry(tt.value, tt.format, tt.layout, now)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseExpiry() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !got.Equal(tt.want) {
+				t.Errorf("ParseExpiry() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateExpiresFormat(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		layout  string
+		wantErr bool
+	}{
+		{name: "empty", format: ""},
+		{name: "epoch seconds", format: models.ExpiresFormatEpochSeconds},
+		{name: "layout with layout", format: models.ExpiresFormatLayout, layout: time.RFC1123},
+		{name: "layout without layout", format: models.ExpiresFormatLayout, layout: " ", wantErr: true},
+		{name: "unknown", format: "hours", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateExpiresFormat(tt.format, tt.layout)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ValidateExpiresFormat() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -1,11 +1,134 @@
 package refresher
 
 import (
+	"bytes"
+	"encoding/xml"
 	"fmt"
+	"io"
+	"jwt_refresher/models"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/tidwall/gjson"
 )
 
+// Response 刷新请求的响应，供Extractor提取token
+type Response struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+// Extractor 按路径从响应中提取值，路径的含义由具体实现决定
+type Extractor interface {
+	Extract(resp *Response, path string) (string, error)
+}
+
+var (
+	extractorsMu sync.RWMutex
+	extractors   = map[string]Extractor{
+		models.ResponseFormatJSON: jsonExtractor{},
+		models.ResponseFormatForm: formExtractor{},
+		models.ResponseFormatXML:  xmlExtractor{},
+		"header":                  headerExtractor{},
+		"cookie":                  cookieExtractor{},
+		"regex":                   regexExtractor{},
+	}
+)
+
+// RegisterExtractor 注册提取器。路径以 "<name>:" 开头时总是使用该提取器，
+// 与项目响应格式同名的提取器用于解析响应体
+func RegisterExtractor(name string, extractor Extractor) {
+	extractorsMu.Lock()
+	defer extractorsMu.Unlock()
+	extractors[name] = extractor
+}
+
+// ExtractValue 从响应中提取值。路径可以带提取器前缀（如 header:X-Token、
+// cookie:session、regex:token=(\w+)），否则按响应格式解析响应体，
+// format为空或auto时根据Content-Type选择
+func ExtractValue(resp *Response, format, path string) (string, error) {
+	extractorsMu.RLock()
+	defer extractorsMu.RUnlock()
+
+	if name, rest, ok := strings.Cut(path, ":"); ok {
+		if extractor, ok := extractors[name]; ok {
+			return extractor.Extract(resp, rest)
+		}
+	}
+
+	if format == "" || format == models.ResponseFormatAuto {
+		format = detectResponseFormat(resp.Header.Get("Content-Type"))
+	}
+	extractor, ok := extractors[format]
+	if !ok {
+		return "", fmt.Errorf("unknown response format %q", format)
+	}
+	return extractor.Extract(resp, path)
+}
+
+// PathValidator 提取器可以实现此接口，在保存项目时校验路径的语法
+type PathValidator interface {
+	ValidatePath(path string) error
+}
+
+// ValidatePath 按ExtractValue的规则校验提取路径。format为auto时响应格式在收到响应后才能确定，
+// 只校验带前缀的路径
+func ValidatePath(format, path string) error {
+	if strings.TrimSpace(path) == "" {
+		return fmt.Errorf("path is required")
+	}
+
+	extractorsMu.RLock()
+	defer extractorsMu.RUnlock()
+
+	if name, rest, ok := strings.Cut(path, ":"); ok {
+		if extractor, ok := extractors[name]; ok {
+			if rest == "" {
+				return fmt.Errorf("%s: path is required", name)
+			}
+			if v, ok := extractor.(PathValidator); ok {
+				return v.ValidatePath(rest)
+			}
+			return nil
+		}
+	}
+
+	if format == "" || format == models.ResponseFormatAuto {
+		return nil
+	}
+	extractor, ok := extractors[format]
+	if !ok {
+		return fmt.Errorf("unknown response format %q", format)
+	}
+	if v, ok := extractor.(PathValidator); ok {
+		return v.ValidatePath(path)
+	}
+	return nil
+}
+
+// detectResponseFormat 根据Content-Type判断响应格式，无法判断时按JSON处理
+func detectResponseFormat(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return models.ResponseFormatJSON
+	}
+	switch {
+	case mediaType == "application/x-www-form-urlencoded":
+		return models.ResponseFormatForm
+	case strings.HasSuffix(mediaType, "/xml") || strings.HasSuffix(mediaType, "+xml"):
+		return models.ResponseFormatXML
+	default:
+		return models.ResponseFormatJSON
+	}
+}
+
+// ExtractToken 使用JSONPath从JSON响应体中提取值
 func ExtractToken(jsonBody, path string) (string, error) {
 	result := gjson.Get(jsonBody, path)
 	if !result.Exists() {
@@ -14,10 +137,285 @@ func ExtractToken(jsonBody, path string) (string, error) {
 	return result.String(), nil
 }
 
+// ExtractExpiresIn 使用JSONPath从JSON响应体中提取以秒为单位的有效期，按seconds格式校验
 func ExtractExpiresIn(jsonBody, path string) (int64, error) {
-	result := gjson.Get(jsonBody, path)
-	if !result.Exists() {
-		return 0, fmt.Errorf("path %s not found in response", path)
+	value, err := ExtractToken(jsonBody, path)
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	expiresAt, err := ParseExpiry(value, models.ExpiresFormatSeconds, "", now)
+	if err != nil {
+		return 0, err
+	}
+	return int64(expiresAt.Sub(now) / time.Second), nil
+}
+
+// jsonExtractor 路径为gjson语法的JSONPath
+type jsonExtractor struct{}
+
+func (jsonExtractor) Extract(resp *Response, path string) (string, error) {
+	return ExtractToken(string(resp.Body), path)
+}
+
+// ValidatePath 检查gjson路径的括号和引号是否成对，不能以 . 或 | 开头或结尾
+func (jsonExtractor) ValidatePath(path string) error {
+	if strings.HasPrefix(path, ".") || strings.HasSuffix(path, ".") ||
+		strings.HasPrefix(path, "|") || strings.HasSuffix(path, "|") {
+		return fmt.Errorf("invalid json path %q", path)
+	}
+
+	var stack []rune
+	inQuote := false
+	for i := 0; i < len(path); i++ {
+		c := rune(path[i])
+		switch {
+		case c == '\\':
+			i++
+		case inQuote:
+			if c == '"' {
+				inQuote = false
+			}
+		case c == '"':
+			inQuote = true
+		case c == '(' || c == '[' || c == '{':
+			stack = append(stack, c)
+		case c == ')' || c == ']' || c == '}':
+			open := map[rune]rune{')': '(', ']': '[', '}': '{'}[c]
+			if len(stack) == 0 || stack[len(stack)-1] != open {
+				return fmt.Errorf("invalid json path %q: unbalanced %q", path, c)
+			}
+			stack = stack[:len(stack)-1]
+		}
+	}
+	if inQuote || len(stack) > 0 {
+		return fmt.Errorf("invalid json path %q: unterminated quote or bracket", path)
+	}
+	return nil
+}
+
+// formExtractor 解析application/x-www-form-urlencoded响应体，路径为字段名
+type formExtractor struct{}
+
+func (formExtractor) Extract(resp *Response, path string) (string, error) {
+	values, err := url.ParseQuery(strings.TrimSpace(string(resp.Body)))
+	if err != nil {
+		return "", fmt.Errorf("invalid form response: %w", err)
+	}
+	if !values.Has(path) {
+		return "", fmt.Errorf("field %s not found in response", path)
+	}
+	return values.Get(path), nil
+}
+
+// headerExtractor 路径为响应头名称
+type headerExtractor struct{}
+
+func (headerExtractor) Extract(resp *Response, path string) (string, error) {
+	values := resp.Header.Values(path)
+	if len(values) == 0 {
+		return "", fmt.Errorf("header %s not found in response", path)
+	}
+	return values[0], nil
+}
+
+// cookieExtractor 路径为Set-Cookie中的cookie名称
+type cookieExtractor struct{}
+
+func (cookieExtractor) Extract(resp *Response, path string) (string, error) {
+	for _, cookie := range (&http.Response{Header: resp.Header}).Cookies() {
+		if cookie.Name == path {
+			return cookie.Value, nil
+		}
+	}
+	return "", fmt.Errorf("cookie %s not found in response", path)
+}
+
+// regexExtractor 路径为正则表达式，返回第一个捕获组（没有捕获组时返回整个匹配）
+type regexExtractor struct{}
+
+func (regexExtractor) Extract(resp *Response, path string) (string, error) {
+	re, err := regexp.Compile(path)
+	if err != nil {
+		return "", fmt.Errorf("invalid regex: %w", err)
+	}
+	match := re.FindSubmatch(resp.Body)
+	if match == nil {
+		return "", fmt.Errorf("regex %s did not match response", path)
+	}
+	if len(match) > 1 {
+		return string(match[1]), nil
+	}
+	return string(match[0]), nil
+}
+
+func (regexExtractor) ValidatePath(path string) error {
+	if _, err := regexp.Compile(path); err != nil {
+		return fmt.Errorf("invalid regex: %w", err)
+	}
+	return nil
+}
+
+// xmlExtractor 路径为简化的XPath：
+// /Envelope/Body/Token 按层级匹配，//Token 匹配任意层级，
+// 最后一级可以是 @属性名 或 text()。元素名忽略命名空间前缀
+type xmlExtractor struct{}
+
+func (xmlExtractor) Extract(resp *Response, path string) (string, error) {
+	root, err := parseXML(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("invalid xml response: %w", err)
+	}
+
+	value, ok := root.find(path)
+	if !ok {
+		return "", fmt.Errorf("path %s not found in response", path)
+	}
+	return value, nil
+}
+
+// ValidatePath 检查XPath的层级：不能以 / 结尾，超过两个连续的 / 无效，
+// @属性名 和 text() 只能出现在最后一级
+func (xmlExtractor) ValidatePath(path string) error {
+	if strings.HasSuffix(path, "/") || strings.Contains(path, "///") {
+		return fmt.Errorf("invalid xpath %q", path)
+	}
+	steps := strings.Split(strings.TrimLeft(path, "/"), "/")
+	for i, step := range steps {
+		last := i == len(steps)-1
+		if (strings.HasPrefix(step, "@") || step == "text()") && !last {
+			return fmt.Errorf("invalid xpath %q: %s must be the last step", path, step)
+		}
+		if step == "@" {
+			return fmt.Errorf("invalid xpath %q: attribute name is required", path)
+		}
+	}
+	return nil
+}
+
+// xmlNode 简单的XML元素树
+type xmlNode struct {
+	name     string
+	attrs    map[string]string
+	children []*xmlNode
+	text     strings.Builder
+}
+
+func parseXML(data []byte) (*xmlNode, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	root := &xmlNode{}
+	stack := []*xmlNode{root}
+
+	for {
+		tok, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			node := &xmlNode{name: t.Name.Local, attrs: make(map[string]string)}
+			for _, attr := range t.Attr {
+				node.attrs[attr.Name.Local] = attr.Value
+			}
+			parent := stack[len(stack)-1]
+			parent.children = append(parent.children, node)
+			stack = append(stack, node)
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			stack[len(stack)-1].text.Write(t)
+		}
+	}
+	if len(root.children) == 0 {
+		return nil, fmt.Errorf("empty document")
+	}
+	return root, nil
+}
+
+// find 在文档根节点上执行简化的XPath
+func (n *xmlNode) find(path string) (string, bool) {
+	if !strings.HasPrefix(path, "/") {
+		path = "//" + path
+	}
+
+	nodes := []*xmlNode{n}
+	steps := strings.Split(path[1:], "/")
+	descendant := false
+	for i, step := range steps {
+		if step == "" {
+			// "//" 之后的一级匹配任意层级
+			descendant = true
+			continue
+		}
+
+		last := i == len(steps)-1
+		if last && strings.HasPrefix(step, "@") {
+			for _, node := range nodes {
+				for _, candidate := range collect(node, descendant) {
+					if v, ok := candidate.attrs[step[1:]]; ok {
+						return v, true
+					}
+				}
+			}
+			return "", false
+		}
+		if last && step == "text()" {
+			break
+		}
+
+		var next []*xmlNode
+		for _, node := range nodes {
+			for _, child := range collectChildren(node, descendant) {
+				if step == "*" || child.name == localName(step) {
+					next = append(next, child)
+				}
+			}
+		}
+		if len(next) == 0 {
+			return "", false
+		}
+		nodes = next
+		descendant = false
+	}
+
+	if len(nodes) == 0 || nodes[0] == n {
+		return "", false
+	}
+	return strings.TrimSpace(nodes[0].text.String()), true
+}
+
+// collect 返回节点自身，descendant为true时包括所有后代
+func collect(n *xmlNode, descendant bool) []*xmlNode {
+	if !descendant {
+		return []*xmlNode{n}
+	}
+	nodes := []*xmlNode{n}
+	for _, child := range n.children {
+		nodes = append(nodes, collect(child, true)...)
+	}
+	return nodes
+}
+
+// collectChildren 返回子节点，descendant为true时返回所有后代
+func collectChildren(n *xmlNode, descendant bool) []*xmlNode {
+	if !descendant {
+		return n.children
+	}
+	var nodes []*xmlNode
+	for _, child := range n.children {
+		nodes = append(nodes, collect(child, true)...)
+	}
+	return nodes
+}
+
+// localName 去掉命名空间前缀（soap:Body -> Body）
+func localName(name string) string {
+	if i := strings.LastIndex(name, ":"); i >= 0 {
+		return name[i+1:]
 	}
-	return result.Int(), nil
+	return name
 }
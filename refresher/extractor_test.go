@@ -0,0 +1,160 @@
+package refresher
+
+import (
+	"jwt_refresher/models"
+	"net/http"
+	"testing"
+)
+
+func TestExtractValue(t *testing.T) {
+	jsonResp := &Response{
+		Header: http.Header{"Content-Type": {"application/json; charset=utf-8"}},
+		Body:   []byte(`{"access_token":"at-1","expires_in":3600,"data":{"tokens":[{"type":"id","value":"id-1"},{"type":"refresh","value":"rt-1"}]}}`),
+	}
+	formResp := &Response{
+		Header: http.Header{"Content-Type": {"application/x-www-form-urlencoded"}},
+		Body:   []byte("access_token=at%2B2&expires_in=60&empty=\n"),
+	}
+	xmlResp := &Response{
+		Header: http.Header{"Content-Type": {"application/soap+xml"}},
+		Body: []byte(`<?xml version="1.0"?>
+<soap:Envelope xmlns:soap="http://www.w3.org/2003/05/soap-envelope">
+  <soap:Body>
+    <Auth expires="300">
+      <Token> at-3 </Token>
+      <Nested><Token>inner</Token></Nested>
+    </Auth>
+  </soap:Body>
+</soap:Envelope>`),
+	}
+	textResp := &Response{
+		Header: http.Header{
+			"Content-Type": {"text/plain"},
+			"X-Token":      {"hdr-1"},
+			"Set-Cookie":   {"session=sess-1; Path=/; HttpOnly", "other=x"},
+		},
+		Body: []byte("token=abc123; expires=900"),
+	}
+
+	tests := []struct {
+		name    string
+		resp    *Response
+		format  string
+		path    string
+		want    string
+		wantErr bool
+	}{
+		// JSONPath
+		{name: "json field", resp: jsonResp, format: models.ResponseFormatJSON, path: "access_token", want: "at-1"},
+		{name: "json number", resp: jsonResp, format: models.ResponseFormatJSON, path: "expires_in", want: "3600"},
+		{name: "json query", resp: jsonResp, format: models.ResponseFormatJSON, path: `data.tokens.#(type=="refresh").value`, want: "rt-1"},
+		{name: "json index", resp: jsonResp, format: models.ResponseFormatJSON, path: "data.tokens.0.value", want: "id-1"},
+		{name: "json missing", resp: jsonResp, format: models.ResponseFormatJSON, path: "refresh_token", wantErr: true},
+		{name: "auto detects json", resp: jsonResp, format: models.ResponseFormatAuto, path: "access_token", want: "at-1"},
+
+		// 表单
+		{name: "form field is decoded", resp: formResp, format: models.ResponseFormatForm, path: "access_token", want: "at+2"},
+		{name: "form empty field", resp: formResp, format: models.ResponseFormatForm, path: "empty", want: ""},
+		{name: "form missing", resp: formResp, format: models.ResponseFormatForm, path: "refresh_token", wantErr: true},
+		{name: "auto detects form", resp: formResp, format: "", path: "expires_in", want: "60"},
+
+		// XPath
+		{name: "xpath absolute", resp: xmlResp, format: models.ResponseFormatXML, path: "/Envelope/Body/Auth/Token", want: "at-3"},
+		{name: "xpath with namespace prefix", resp: xmlResp, format: models.ResponseFormatXML, path: "/soap:Envelope/soap:Body/Auth/Token/text()", want: "at-3"},
+		{name: "xpath descendant", resp: xmlResp, format: models.ResponseFormatXML, path: "//Nested/Token", want: "inner"},
+		{name: "xpath bare name", resp: xmlResp, format: models.ResponseFormatXML, path: "Token", want: "at-3"},
+		{name: "xpath wildcard", resp: xmlResp, format: models.ResponseFormatXML, path: "/Envelope/*/Auth/Token", want: "at-3"},
+		{name: "xpath attribute", resp: xmlResp, format: models.ResponseFormatXML, path: "//Auth/@expires", want: "300"},
+		{name: "xpath missing", resp: xmlResp, format: models.ResponseFormatXML, path: "/Envelope/Header/Token", wantErr: true},
+		{name: "xpath missing attribute", resp: xmlResp, format: models.ResponseFormatXML, path: "//Auth/@id", wantErr: true},
+		{name: "auto detects xml", resp: xmlResp, format: models.ResponseFormatAuto, path: "//Token", want: "at-3"},
+		{name: "xml on json body", resp: jsonResp, format: models.ResponseFormatXML, path: "//Token", wantErr: true},
+
+		// 带前缀的路径不受响应格式影响
+		{name: "regex capture group", resp: textResp, format: models.ResponseFormatJSON, path: `regex:token=(\w+)`, want: "abc123"},
+		{name: "regex whole match", resp: textResp, format: models.ResponseFormatJSON, path: `regex:expires=\d+`, want: "expires=900"},
+		{name: "regex no match", resp: textResp, format: models.ResponseFormatJSON, path: `regex:refresh=(\w+)`, wantErr: true},
+		{name: "regex invalid", resp: textResp, format: models.ResponseFormatJSON, path: `regex:token=(`, wantErr: true},
+		{name: "header", resp: textResp, format: models.ResponseFormatJSON, path: "header:x-token", want: "hdr-1"},
+		{name: "header missing", resp: textResp, format: models.ResponseFormatJSON, path: "header:X-Other", wantErr: true},
+		{name: "cookie", resp: textResp, format: models.ResponseFormatJSON, path: "cookie:session", want: "sess-1"},
+		{name: "cookie missing", resp: textResp, format: models.ResponseFormatJSON, path: "cookie:csrf", wantErr: true},
+
+		{name: "unknown format", resp: jsonResp, format: "yaml", path: "access_token", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ExtractValue(tt.resp, tt.format, tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ExtractValue() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ExtractValue() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidatePath(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		path    string
+		wantErr bool
+	}{
+		{name: "json", format: models.ResponseFormatJSON, path: `data.tokens.#(type=="refresh").value`},
+		{name: "json unbalanced", format: models.ResponseFormatJSON, path: `data.tokens.#(type=="refresh".value`, wantErr: true},
+		{name: "json unterminated quote", format: models.ResponseFormatJSON, path: `data.#(type=="refresh).value`, wantErr: true},
+		{name: "json trailing dot", format: models.ResponseFormatJSON, path: "data.", wantErr: true},
+		{name: "xpath", format: models.ResponseFormatXML, path: "//Auth/@expires"},
+		{name: "xpath attribute not last", format: models.ResponseFormatXML, path: "//Auth/@expires/x", wantErr: true},
+		{name: "xpath trailing slash", format: models.ResponseFormatXML, path: "/Envelope/", wantErr: true},
+		{name: "xpath triple slash", format: models.ResponseFormatXML, path: "///Token", wantErr: true},
+		{name: "regex", format: models.ResponseFormatJSON, path: `regex:token=(\w+)`},
+		{name: "regex invalid", format: models.ResponseFormatJSON, path: `regex:token=(`, wantErr: true},
+		{name: "prefix without path", format: models.ResponseFormatJSON, path: "header:", wantErr: true},
+		{name: "auto skips body paths", format: models.ResponseFormatAuto, path: "data.("},
+		{name: "empty", format: models.ResponseFormatJSON, path: " ", wantErr: true},
+		{name: "unknown format", format: "yaml", path: "token", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidatePath(tt.format, tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ValidatePath() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestExtractExpiresIn(t *testing.T) {
+	body := `{"expires_in":3600,"fractional":"90.5","zero":0,"text":"soon","data":{"ttl":"120"}}`
+
+	tests := []struct {
+		name    string
+		path    string
+		want    int64
+		wantErr bool
+	}{
+		{name: "number", path: "expires_in", want: 3600},
+		{name: "string", path: "data.ttl", want: 120},
+		{name: "fraction is truncated", path: "fractional", want: 90},
+		{name: "zero", path: "zero", wantErr: true},
+		{name: "not a number", path: "text", wantErr: true},
+		{name: "missing", path: "ttl", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ExtractExpiresIn(body, tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ExtractExpiresIn() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ExtractExpiresIn() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
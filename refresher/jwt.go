@@ -0,0 +1,93 @@
+package refresher
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// JWT 解码后的JWT（不校验签名，仅用于读取过期时间和查看内容）
+type JWT struct {
+	Header map[string]any `json:"header"`
+	Claims map[string]any `json:"claims"`
+}
+
+// DecodeJWT 解析compact格式的JWT（header.payload.signature）
+func DecodeJWT(token string) (*JWT, error) {
+	parts := strings.Split(strings.TrimSpace(token), ".")
+	if len(parts) != 3 {
+		return nil, errors.New("token is not a JWT")
+	}
+
+	jwt := &JWT{}
+	if err := decodeJWTSegment(parts[0], &jwt.Header); err != nil {
+		return nil, fmt.Errorf("invalid JWT header: %w", err)
+	}
+	if err := decodeJWTSegment(parts[1], &jwt.Claims); err != nil {
+		return nil, fmt.Errorf("invalid JWT claims: %w", err)
+	}
+	return jwt, nil
+}
+
+func decodeJWTSegment(segment string, v any) error {
+	// JWT使用不带填充的base64url，兼容带填充的实现
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(segment, "="))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// ExpiresAt 返回exp声明
+func (j *JWT) ExpiresAt() (time.Time, bool) {
+	return j.numericDate("exp")
+}
+
+// IssuedAt 返回iat声明
+func (j *JWT) IssuedAt() (time.Time, bool) {
+	return j.numericDate("iat")
+}
+
+// NotBefore 返回nbf声明
+func (j *JWT) NotBefore() (time.Time, bool) {
+	return j.numericDate("nbf")
+}
+
+// numericDate 读取NumericDate类型的声明（RFC 7519，自1970年起的秒数）
+func (j *JWT) numericDate(name string) (time.Time, bool) {
+	v, ok := j.Claims[name].(float64)
+	if !ok || v <= 0 || math.IsInf(v, 0) || math.IsNaN(v) {
+		return time.Time{}, false
+	}
+	sec, frac := math.Modf(v)
+	return time.Unix(int64(sec), int64(frac*1e9)), true
+}
+
+// jwtExpiry 根据access token的声明计算过期时间。
+// 有iat或nbf时同时按有效期长度从收到响应的时间推算，取两者中较早的一个，
+// 避免本机与签发方的时钟偏差导致刷新过晚
+func jwtExpiry(accessToken string, receivedAt time.Time) (time.Time, bool) {
+	jwt, err := DecodeJWT(accessToken)
+	if err != nil {
+		return time.Time{}, false
+	}
+	exp, ok := jwt.ExpiresAt()
+	if !ok {
+		return time.Time{}, false
+	}
+
+	start, ok := jwt.IssuedAt()
+	if nbf, hasNbf := jwt.NotBefore(); hasNbf && (!ok || nbf.After(start)) {
+		start, ok = nbf, true
+	}
+	if ok && exp.After(start) {
+		if byLifetime := receivedAt.Add(exp.Sub(start)); byLifetime.Before(exp) {
+			return byLifetime, true
+		}
+	}
+	return exp, true
+}
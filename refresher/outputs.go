@@ -0,0 +1,73 @@
+package refresher
+
+import (
+	"encoding/json"
+	"fmt"
+	"jwt_refresher/models"
+	"log"
+	"sort"
+)
+
+// ParseOutputRules 解析项目的额外输出提取规则（JSON对象：名称 -> 提取路径）
+func ParseOutputRules(s string) (map[string]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var rules map[string]string
+	if err := json.Unmarshal([]byte(s), &rules); err != nil {
+		return nil, err
+	}
+	for name, path := range rules {
+		if name == "" || path == "" {
+			return nil, fmt.Errorf("output %q: name and path are required", name)
+		}
+	}
+	return rules, nil
+}
+
+// ParseOutputs 解析项目保存的输出值
+func ParseOutputs(s string) (map[string]string, error) {
+	outputs := make(map[string]string)
+	if s == "" {
+		return outputs, nil
+	}
+	if err := json.Unmarshal([]byte(s), &outputs); err != nil {
+		return nil, fmt.Errorf("failed to parse outputs: %w", err)
+	}
+	return outputs, nil
+}
+
+// extractOutputs 按规则从响应中提取输出值，与上一次的值合并后返回JSON。
+// 本次没有提取到的值保留上一次的结果
+func extractOutputs(project *models.Project, rules map[string]string, resp *Response) (string, error) {
+	if len(rules) == 0 {
+		return project.Outputs, nil
+	}
+
+	outputs, err := ParseOutputs(project.Outputs)
+	if err != nil {
+		// 旧值损坏时重新开始
+		outputs = make(map[string]string)
+	}
+
+	names := make([]string, 0, len(rules))
+	for name := range rules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		value, err := ExtractValue(resp, project.ResponseFormat, rules[name])
+		if err != nil {
+			log.Printf("Warning: Failed to extract output %s for project %s (ID: %d): %v", name, project.Name, project.ID, err)
+			continue
+		}
+		outputs[name] = value
+	}
+
+	data, err := json.Marshal(outputs)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
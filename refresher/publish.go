@@ -0,0 +1,75 @@
+package refresher
+
+import (
+	"jwt_refresher/models"
+	"jwt_refresher/pubsub"
+	"time"
+)
+
+// Token 项目当前的token，用于token事件和sink推送。
+// 字段与GET /api/projects/:id/token相同，另外包含项目ID和名称
+type Token struct {
+	ProjectID    int64             `json:"project_id"`
+	ProjectName  string            `json:"project_name"`
+	AccessToken  string            `json:"access_token"`
+	RefreshToken string            `json:"refresh_token,omitempty"`
+	ExpiresAt    *time.Time        `json:"expires_at"`
+	Outputs      map[string]string `json:"outputs"`
+}
+
+// TokenOf 返回项目已保存的token
+func TokenOf(project *models.Project) (*Token, error) {
+	outputs, err := ParseOutputs(project.Outputs)
+	if err != nil {
+		return nil, err
+	}
+	token := &Token{
+		ProjectID:    project.ID,
+		ProjectName:  project.Name,
+		AccessToken:  project.CurrentAccessToken,
+		RefreshToken: project.CurrentRefreshToken,
+		Outputs:      outputs,
+	}
+	if project.TokenExpiresAt.Valid {
+		expiresAt := project.TokenExpiresAt.Time
+		token.ExpiresAt = &expiresAt
+	}
+	return token, nil
+}
+
+// StatusCircuitHalfOpen 熔断冷却结束，开始试探性刷新。只用于status事件，不保存到数据库
+const StatusCircuitHalfOpen = "circuit_half_open"
+
+// StatusChange status事件的数据：刷新失败、熔断、重新授权或启用/禁用后项目的状态
+type StatusChange struct {
+	ProjectID   int64  `json:"project_id"`
+	ProjectName string `json:"project_name"`
+	Enabled     bool   `json:"enabled"`
+	// failed, needs_reauth, circuit_open, circuit_half_open, reauthorized，
+	// 启用/禁用时为项目当前的刷新状态
+	Status              string `json:"status"`
+	ConsecutiveFailures int    `json:"consecutive_failures"`
+	ErrorClass          string `json:"error_class"`
+	Error               string `json:"error"`
+}
+
+// publishToken 发布刷新后的新token
+func (e *Engine) publishToken(token *Token) {
+	e.broker.Publish(pubsub.Message{Event: pubsub.EventToken, ProjectID: token.ProjectID, Data: token})
+}
+
+// publishStatus 发布项目状态的变化
+func (e *Engine) publishStatus(project *models.Project, change StatusChange) {
+	change.ProjectID = project.ID
+	change.ProjectName = project.Name
+	change.Enabled = project.Enabled
+	e.broker.Publish(pubsub.Message{Event: pubsub.EventStatus, ProjectID: project.ID, Data: change})
+}
+
+// PublishProjectStatus 发布项目在API中被修改（重新授权、启用/禁用）后的状态
+func (e *Engine) PublishProjectStatus(project *models.Project) {
+	e.publishStatus(project, StatusChange{
+		Status:              project.LastRefreshStatus,
+		ConsecutiveFailures: project.ConsecutiveFailures,
+	})
+}
@@ -0,0 +1,215 @@
+package refresher
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"jwt_refresher/models"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// OAuth2标准响应字段（RFC 6749 5.1节）
+const (
+	oauth2AccessTokenPath  = "access_token"
+	oauth2RefreshTokenPath = "refresh_token"
+	oauth2ExpiresInPath    = "expires_in"
+)
+
+// requestSpec 一次刷新请求的内容
+type requestSpec struct {
+	Method  string
+	URL     string
+	Headers map[string]string
+	Body    string
+}
+
+// buildRequestSpec 根据项目类型构建刷新请求，steps为之前步骤提取的值
+func buildRequestSpec(project *models.Project, steps StepValues) (*requestSpec, error) {
+	switch project.ProjectType {
+	case "", models.ProjectTypeCustom:
+		return buildCustomRequest(project, steps)
+	case models.ProjectTypeOAuth2RefreshToken, models.ProjectTypeOAuth2ClientCredentials:
+		return buildOAuth2Request(project, steps)
+	default:
+		return nil, fmt.Errorf("unknown project type %q", project.ProjectType)
+	}
+}
+
+// RefreshHost 返回刷新请求的目标主机，供调度器按主机限制并发。
+// URL是模板时先渲染（没有刷新步骤提取的值），无法渲染或解析时返回空
+func RefreshHost(project *models.Project) string {
+	refreshURL, err := renderTemplate(project.RefreshURL, project, nil)
+	if err != nil {
+		return ""
+	}
+	u, err := url.Parse(refreshURL)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// buildCustomRequest 使用请求体模板和自定义请求头，URL和请求头的值也是模板
+func buildCustomRequest(project *models.Project, steps StepValues) (*requestSpec, error) {
+	refreshURL, err := renderTemplate(project.RefreshURL, project, steps)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render url: %w", err)
+	}
+
+	body, err := renderTemplate(project.RefreshBodyTemplate, project, steps)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render template: %w", err)
+	}
+
+	headers, err := parseHeaders(project.RefreshHeaders)
+	if err != nil {
+		return nil, err
+	}
+	if headers, err = renderHeaders(headers, project, steps); err != nil {
+		return nil, err
+	}
+
+	return &requestSpec{
+		Method:  strings.ToUpper(project.RefreshMethod),
+		URL:     refreshURL,
+		Headers: headers,
+		Body:    body,
+	}, nil
+}
+
+// buildOAuth2Request 按RFC 6749构建token请求，自定义请求头会覆盖默认值。
+// URL和自定义请求头的值是模板
+func buildOAuth2Request(project *models.Project, steps StepValues) (*requestSpec, error) {
+	params := map[string]string{}
+	headers := map[string]string{"Accept": "application/json"}
+
+	if project.ProjectType == models.ProjectTypeOAuth2RefreshToken {
+		if project.CurrentRefreshToken == "" {
+			return nil, fmt.Errorf("refresh token is required for %s", project.ProjectType)
+		}
+		params["grant_type"] = "refresh_token"
+		params["refresh_token"] = project.CurrentRefreshToken
+	} else {
+		params["grant_type"] = "client_credentials"
+	}
+	if project.OAuth2Scope != "" {
+		params["scope"] = project.OAuth2Scope
+	}
+	if project.OAuth2Audience != "" {
+		params["audience"] = project.OAuth2Audience
+	}
+
+	// 客户端认证（RFC 6749 2.3.1节），没有secret的公开客户端只在请求体中带client_id
+	switch project.OAuth2ClientAuth {
+	case "", models.OAuth2ClientAuthBasic:
+		if project.OAuth2ClientSecret == "" {
+			if project.OAuth2ClientID != "" {
+				params["client_id"] = project.OAuth2ClientID
+			}
+			break
+		}
+		credentials := url.QueryEscape(project.OAuth2ClientID) + ":" + url.QueryEscape(project.OAuth2ClientSecret)
+		headers["Authorization"] = "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials))
+	case models.OAuth2ClientAuthBody:
+		if project.OAuth2ClientID != "" {
+			params["client_id"] = project.OAuth2ClientID
+		}
+		if project.OAuth2ClientSecret != "" {
+			params["client_secret"] = project.OAuth2ClientSecret
+		}
+	default:
+		return nil, fmt.Errorf("unknown oauth2 client auth %q", project.OAuth2ClientAuth)
+	}
+
+	var body string
+	switch project.OAuth2BodyFormat {
+	case "", models.OAuth2BodyFormatForm:
+		values := url.Values{}
+		for k, v := range params {
+			values.Set(k, v)
+		}
+		body = values.Encode()
+		headers["Content-Type"] = "application/x-www-form-urlencoded"
+	case models.OAuth2BodyFormatJSON:
+		data, err := json.Marshal(params)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode request body: %w", err)
+		}
+		body = string(data)
+		headers["Content-Type"] = "application/json"
+	default:
+		return nil, fmt.Errorf("unknown oauth2 body format %q", project.OAuth2BodyFormat)
+	}
+
+	extra, err := parseHeaders(project.RefreshHeaders)
+	if err != nil {
+		return nil, err
+	}
+	if extra, err = renderHeaders(extra, project, steps); err != nil {
+		return nil, err
+	}
+	for k, v := range extra {
+		headers[k] = v
+	}
+
+	refreshURL, err := renderTemplate(project.RefreshURL, project, steps)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render url: %w", err)
+	}
+
+	return &requestSpec{
+		Method:  "POST",
+		URL:     refreshURL,
+		Headers: headers,
+		Body:    body,
+	}, nil
+}
+
+// newHTTPRequest 根据requestSpec创建HTTP请求
+func newHTTPRequest(ctx context.Context, spec *requestSpec) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, spec.Method, spec.URL, strings.NewReader(spec.Body))
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range spec.Headers {
+		req.Header.Set(key, value)
+	}
+	return req, nil
+}
+
+func parseHeaders(s string) (map[string]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var headers map[string]string
+	if err := json.Unmarshal([]byte(s), &headers); err != nil {
+		return nil, fmt.Errorf("failed to parse headers: %w", err)
+	}
+	return headers, nil
+}
+
+// tokenPaths 返回access token、refresh token和过期时间的提取路径。
+// oauth2_*类型未配置时使用标准字段名；client_credentials不返回refresh token
+func tokenPaths(project *models.Project) (accessPath, refreshPath, expiresInPath string) {
+	accessPath, refreshPath, expiresInPath = project.AccessTokenPath, project.RefreshTokenPath, project.ExpiresInPath
+
+	switch project.ProjectType {
+	case models.ProjectTypeOAuth2RefreshToken:
+		if refreshPath == "" {
+			refreshPath = oauth2RefreshTokenPath
+		}
+	case models.ProjectTypeOAuth2ClientCredentials:
+	default:
+		return
+	}
+	if accessPath == "" {
+		accessPath = oauth2AccessTokenPath
+	}
+	if expiresInPath == "" {
+		expiresInPath = oauth2ExpiresInPath
+	}
+	return
+}
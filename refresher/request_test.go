@@ -0,0 +1,261 @@
+package refresher
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"jwt_refresher/models"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestBuildOAuth2Request(t *testing.T) {
+	basic := func(id, secret string) string {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(id+":"+secret))
+	}
+
+	tests := []struct {
+		name        string
+		project     models.Project
+		wantParams  map[string]string
+		wantHeaders map[string]string
+		wantErr     bool
+	}{
+		{
+			name: "refresh token with basic auth",
+			project: models.Project{
+				ProjectType:         models.ProjectTypeOAuth2RefreshToken,
+				OAuth2ClientID:      "client",
+				OAuth2ClientSecret:  "secret",
+				OAuth2Scope:         "read write",
+				CurrentRefreshToken: "rt-1",
+			},
+			wantParams: map[string]string{"grant_type": "refresh_token", "refresh_token": "rt-1", "scope": "read write"},
+			wantHeaders: map[string]string{
+				"Authorization": basic("client", "secret"),
+				"Content-Type":  "application/x-www-form-urlencoded",
+				"Accept":        "application/json",
+			},
+		},
+		{
+			name: "basic auth credentials are form encoded",
+			project: models.Project{
+				ProjectType:        models.ProjectTypeOAuth2ClientCredentials,
+				OAuth2ClientID:     "my client",
+				OAuth2ClientSecret: "p@ss:word",
+			},
+			wantParams:  map[string]string{"grant_type": "client_credentials"},
+			wantHeaders: map[string]string{"Authorization": basic("my+client", "p%40ss%3Aword")},
+		},
+		{
+			name: "public client sends client_id in the body",
+			project: models.Project{
+				ProjectType:         models.ProjectTypeOAuth2RefreshToken,
+				OAuth2ClientID:      "public",
+				CurrentRefreshToken: "rt-1",
+			},
+			wantParams: map[string]string{"grant_type": "refresh_token", "refresh_token": "rt-1", "client_id": "public"},
+		},
+		{
+			name: "client credentials in a json body",
+			project: models.Project{
+				ProjectType:        models.ProjectTypeOAuth2ClientCredentials,
+				OAuth2ClientID:     "client",
+				OAuth2ClientSecret: "secret",
+				OAuth2ClientAuth:   models.OAuth2ClientAuthBody,
+				OAuth2BodyFormat:   models.OAuth2BodyFormatJSON,
+				OAuth2Audience:     "https://api.example.com",
+			},
+			wantParams: map[string]string{
+				"grant_type":    "client_credentials",
+				"client_id":     "client",
+				"client_secret": "secret",
+				"audience":      "https://api.example.com",
+			},
+			wantHeaders: map[string]string{"Content-Type": "application/json"},
+		},
+		{
+			name: "custom headers override defaults",
+			project: models.Project{
+				ProjectType:     models.ProjectTypeOAuth2ClientCredentials,
+				RefreshHeaders:  `{"Accept":"application/xml","X-Tenant":"{{.tenant}}"}`,
+				CustomVariables: `{"tenant":"acme"}`,
+			},
+			wantParams:  map[string]string{"grant_type": "client_credentials"},
+			wantHeaders: map[string]string{"Accept": "application/xml", "X-Tenant": "acme"},
+		},
+		{
+			name:    "refresh token is required",
+			project: models.Project{ProjectType: models.ProjectTypeOAuth2RefreshToken},
+			wantErr: true,
+		},
+		{
+			name:    "unknown client auth",
+			project: models.Project{ProjectType: models.ProjectTypeOAuth2ClientCredentials, OAuth2ClientAuth: "jwt"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown body format",
+			project: models.Project{ProjectType: models.ProjectTypeOAuth2ClientCredentials, OAuth2BodyFormat: "xml"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.project.RefreshURL = "https://auth.example.com/oauth/token"
+			spec, err := buildRequestSpec(&tt.project, nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("buildRequestSpec() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if spec.Method != http.MethodPost || spec.URL != tt.project.RefreshURL {
+				t.Errorf("request = %s %s", spec.Method, spec.URL)
+			}
+
+			params := map[string]string{}
+			if tt.project.OAuth2BodyFormat == models.OAuth2BodyFormatJSON {
+				if err := json.Unmarshal([]byte(spec.Body), &params); err != nil {
+					t.Fatalf("body %q: %v", spec.Body, err)
+				}
+			} else {
+				values, err := url.ParseQuery(spec.Body)
+				if err != nil {
+					t.Fatalf("body %q: %v", spec.Body, err)
+				}
+				for k := range values {
+					params[k] = values.Get(k)
+				}
+			}
+			if len(params) != len(tt.wantParams) {
+				t.Errorf("body = %v, want %v", params, tt.wantParams)
+			}
+			for k, v := range tt.wantParams {
+				if params[k] != v {
+					t.Errorf("body %s = %q, want %q", k, params[k], v)
+				}
+			}
+			for k, v := range tt.wantHeaders {
+				if spec.Headers[k] != v {
+					t.Errorf("header %s = %q, want %q", k, spec.Headers[k], v)
+				}
+			}
+			if _, ok := tt.wantHeaders["Authorization"]; !ok && spec.Headers["Authorization"] != "" {
+				t.Errorf("unexpected Authorization header %q", spec.Headers["Authorization"])
+			}
+		})
+	}
+}
+
+func TestTokenPaths(t *testing.T) {
+	tests := []struct {
+		name    string
+		project models.Project
+		want    [3]string
+	}{
+		{name: "custom uses configured paths", project: models.Project{AccessTokenPath: "data.token"}, want: [3]string{"data.token", "", ""}},
+		{name: "refresh token grant defaults", project: models.Project{ProjectType: models.ProjectTypeOAuth2RefreshToken}, want: [3]string{"access_token", "refresh_token", "expires_in"}},
+		{name: "client credentials has no refresh token", project: models.Project{ProjectType: models.ProjectTypeOAuth2ClientCredentials}, want: [3]string{"access_token", "", "expires_in"}},
+		{
+			name:    "configured paths win",
+			project: models.Project{ProjectType: models.ProjectTypeOAuth2RefreshToken, AccessTokenPath: "id_token", ExpiresInPath: "ttl"},
+			want:    [3]string{"id_token", "refresh_token", "ttl"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, r, e := tokenPaths(&tt.project)
+			if got := [3]string{a, r, e}; got != tt.want {
+				t.Errorf("tokenPaths() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOAuth2Refresh(t *testing.T) {
+	tests := []struct {
+		name        string
+		projectType string
+		response    string
+		wantRefresh string
+	}{
+		{
+			name:        "rotated refresh token is stored",
+			projectType: models.ProjectTypeOAuth2RefreshToken,
+			response:    `{"access_token":"at-new","token_type":"Bearer","expires_in":600,"refresh_token":"rt-new"}`,
+			wantRefresh: "rt-new",
+		},
+		{
+			name:        "refresh token is kept when not rotated",
+			projectType: models.ProjectTypeOAuth2RefreshToken,
+			response:    `{"access_token":"at-new","token_type":"Bearer","expires_in":600}`,
+			wantRefresh: "rt-old",
+		},
+		{
+			name:        "client credentials",
+			projectType: models.ProjectTypeOAuth2ClientCredentials,
+			response:    `{"access_token":"at-new","token_type":"Bearer","expires_in":600}`,
+			wantRefresh: "rt-old",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var grant, refreshToken string
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if id, secret, ok := r.BasicAuth(); !ok || id != "client" || secret != "secret" {
+					w.WriteHeader(http.StatusUnauthorized)
+					w.Write([]byte(`{"error":"invalid_client"}`))
+					return
+				}
+				grant, refreshToken = r.PostFormValue("grant_type"), r.PostFormValue("refresh_token")
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(tt.response))
+			}))
+			defer upstream.Close()
+
+			db, e := newTestEngine(t)
+			project := createTestProject(t, db, &models.Project{
+				ProjectType:         tt.projectType,
+				RefreshURL:          upstream.URL,
+				OAuth2ClientID:      "client",
+				OAuth2ClientSecret:  "secret",
+				CurrentRefreshToken: "rt-old",
+			})
+
+			start := time.Now()
+			if err := e.Refresh(context.Background(), project); err != nil {
+				t.Fatalf("Refresh() error = %v", err)
+			}
+
+			wantGrant := "client_credentials"
+			if tt.projectType == models.ProjectTypeOAuth2RefreshToken {
+				wantGrant = "refresh_token"
+			}
+			if grant != wantGrant {
+				t.Errorf("grant_type = %q, want %q", grant, wantGrant)
+			}
+			if wantGrant == "refresh_token" && refreshToken != "rt-old" {
+				t.Errorf("refresh_token = %q, want %q", refreshToken, "rt-old")
+			}
+
+			got, err := db.GetProject(context.Background(), project.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.CurrentAccessToken != "at-new" || got.CurrentRefreshToken != tt.wantRefresh {
+				t.Errorf("tokens = %s, %s, want at-new, %s", got.CurrentAccessToken, got.CurrentRefreshToken, tt.wantRefresh)
+			}
+			expires := got.TokenExpiresAt.Time
+			if !got.TokenExpiresAt.Valid || expires.Before(start.Add(599*time.Second)) || expires.After(time.Now().Add(601*time.Second)) {
+				t.Errorf("token expires at now + %s, want now + 10m", time.Until(expires))
+			}
+		})
+	}
+}
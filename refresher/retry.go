@@ -0,0 +1,144 @@
+package refresher
+
+import (
+	"errors"
+	"fmt"
+	"jwt_refresher/models"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRetryAttempts  = 3
+	defaultRetryBaseDelay = time.Second
+	defaultRetryOn        = "network,timeout,429,500-599"
+	maxRetryDelay         = 30 * time.Second
+
+	// 单次HTTP请求的默认超时
+	defaultRequestTimeout = 30 * time.Second
+
+	defaultCircuitCooldown = 10 * time.Minute
+
+	// 刷新失败后自动重新尝试的最小间隔
+	failureRetryDelay = time.Minute
+
+	// 刷新成功后到下一次自动刷新的最小间隔，避免token有效期过短时连续刷新
+	minRefreshInterval = 30 * time.Second
+
+	// 需要重新授权的项目重复发送提醒的间隔
+	reauthReminderInterval = time.Hour
+)
+
+// RetryPolicy 单个项目的重试策略
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	Jitter      float64
+
+	RetryOnNetwork bool
+	RetryOnTimeout bool
+	statusRanges   [][2]int
+}
+
+// retryPolicyFor 根据项目配置生成重试策略，未配置的字段使用默认值
+func retryPolicyFor(project *models.Project) (*RetryPolicy, error) {
+	policy := &RetryPolicy{
+		MaxAttempts: project.RetryMaxAttempts,
+		BaseDelay:   time.Duration(project.RetryBaseDelayMs) * time.Millisecond,
+		Jitter:      project.RetryJitter,
+	}
+	if policy.MaxAttempts <= 0 {
+		policy.MaxAttempts = defaultRetryAttempts
+	}
+	if policy.BaseDelay <= 0 {
+		policy.BaseDelay = defaultRetryBaseDelay
+	}
+	policy.Jitter = math.Min(math.Max(policy.Jitter, 0), 1)
+
+	retryOn := project.RetryOn
+	if strings.TrimSpace(retryOn) == "" {
+		retryOn = defaultRetryOn
+	}
+	if err := policy.parseRetryOn(retryOn); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// ValidateRetryOn 校验retry_on配置格式
+func ValidateRetryOn(s string) error {
+	return (&RetryPolicy{}).parseRetryOn(s)
+}
+
+func (rp *RetryPolicy) parseRetryOn(s string) error {
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(strings.ToLower(item))
+		switch {
+		case item == "":
+			continue
+		case item == "network":
+			rp.RetryOnNetwork = true
+		case item == "timeout":
+			rp.RetryOnTimeout = true
+		default:
+			lo, hi, found := strings.Cut(item, "-")
+			if !found {
+				hi = lo
+			}
+			from, err1 := strconv.Atoi(lo)
+			to, err2 := strconv.Atoi(hi)
+			if err1 != nil || err2 != nil || from < 100 || to > 599 || from > to {
+				return fmt.Errorf("invalid retry_on entry %q", item)
+			}
+			rp.statusRanges = append(rp.statusRanges, [2]int{from, to})
+		}
+	}
+	return nil
+}
+
+// RetryableStatus 判断HTTP状态码是否可以重试
+func (rp *RetryPolicy) RetryableStatus(code int) bool {
+	for _, r := range rp.statusRanges {
+		if code >= r[0] && code <= r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// RetryableError 判断请求错误是否可以重试
+func (rp *RetryPolicy) RetryableError(err error) bool {
+	if classifyRequestError(err) == ErrorClassConfig {
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return rp.RetryOnTimeout
+	}
+	return rp.RetryOnNetwork
+}
+
+// Backoff 计算第attempt次失败后的等待时间（指数退避 + 抖动）
+func (rp *RetryPolicy) Backoff(attempt int, resp *http.Response) time.Duration {
+	// 优先遵循服务端的Retry-After
+	if resp != nil {
+		if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs >= 0 {
+			return min(time.Duration(secs)*time.Second, maxRetryDelay)
+		}
+	}
+
+	delay := rp.BaseDelay << (attempt - 1)
+	if delay <= 0 || delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	if rp.Jitter > 0 {
+		spread := float64(delay) * rp.Jitter
+		delay += time.Duration((rand.Float64()*2 - 1) * spread)
+	}
+	return delay
+}
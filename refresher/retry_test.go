@@ -0,0 +1,202 @@
+package refresher
+
+import (
+	"context"
+	"errors"
+	"jwt_refresher/models"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyFor(t *testing.T) {
+	tests := []struct {
+		name      string
+		project   models.Project
+		want      RetryPolicy
+		retryable []int
+		final     []int
+		wantErr   bool
+	}{
+		{
+			name:      "defaults",
+			want:      RetryPolicy{MaxAttempts: defaultRetryAttempts, BaseDelay: defaultRetryBaseDelay, RetryOnNetwork: true, RetryOnTimeout: true},
+			retryable: []int{429, 500, 503, 599},
+			final:     []int{200, 400, 401, 404},
+		},
+		{
+			name:      "custom statuses only",
+			project:   models.Project{RetryMaxAttempts: 5, RetryBaseDelayMs: 250, RetryJitter: 0.5, RetryOn: " 408, 502-504 "},
+			want:      RetryPolicy{MaxAttempts: 5, BaseDelay: 250 * time.Millisecond, Jitter: 0.5},
+			retryable: []int{408, 502, 504},
+			final:     []int{429, 500, 501, 505},
+		},
+		{
+			name:    "jitter is clamped",
+			project: models.Project{RetryJitter: 3, RetryOn: "timeout"},
+			want:    RetryPolicy{MaxAttempts: defaultRetryAttempts, BaseDelay: defaultRetryBaseDelay, Jitter: 1, RetryOnTimeout: true},
+			final:   []int{429, 500},
+		},
+		{name: "unknown keyword", project: models.Project{RetryOn: "network,dns"}, wantErr: true},
+		{name: "reversed range", project: models.Project{RetryOn: "599-500"}, wantErr: true},
+		{name: "out of range", project: models.Project{RetryOn: "600"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := retryPolicyFor(&tt.project)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("retryPolicyFor() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got.MaxAttempts != tt.want.MaxAttempts || got.BaseDelay != tt.want.BaseDelay || got.Jitter != tt.want.Jitter ||
+				got.RetryOnNetwork != tt.want.RetryOnNetwork || got.RetryOnTimeout != tt.want.RetryOnTimeout {
+				t.Errorf("retryPolicyFor() = %+v, want %+v", got, tt.want)
+			}
+			for _, code := range tt.retryable {
+				if !got.RetryableStatus(code) {
+					t.Errorf("RetryableStatus(%d) = false, want true", code)
+				}
+			}
+			for _, code := range tt.final {
+				if got.RetryableStatus(code) {
+					t.Errorf("RetryableStatus(%d) = true, want false", code)
+				}
+			}
+		})
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+var _ net.Error = timeoutError{}
+
+func TestRetryableError(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Err: errors.New("connection refused")}
+
+	tests := []struct {
+		name    string
+		retryOn string
+		err     error
+		want    bool
+	}{
+		{name: "network error", retryOn: "network", err: refused, want: true},
+		{name: "network error not enabled", retryOn: "timeout", err: refused, want: false},
+		{name: "timeout", retryOn: "timeout", err: timeoutError{}, want: true},
+		{name: "timeout not enabled", retryOn: "network", err: timeoutError{}, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy, err := retryPolicyFor(&models.Project{RetryOn: tt.retryOn})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := policy.RetryableError(tt.err); got != tt.want {
+				t.Errorf("RetryableError() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	policy := &RetryPolicy{BaseDelay: time.Second}
+	retryAfter := func(v string) *http.Response {
+		return &http.Response{Header: http.Header{"Retry-After": {v}}}
+	}
+
+	tests := []struct {
+		name    string
+		attempt int
+		resp    *http.Response
+		want    time.Duration
+	}{
+		{name: "first retry", attempt: 1, want: time.Second},
+		{name: "doubles", attempt: 3, want: 4 * time.Second},
+		{name: "capped", attempt: 10, want: maxRetryDelay},
+		{name: "shift overflow is capped", attempt: 100, want: maxRetryDelay},
+		{name: "retry after", attempt: 1, resp: retryAfter("7"), want: 7 * time.Second},
+		{name: "retry after is capped", attempt: 1, resp: retryAfter("3600"), want: maxRetryDelay},
+		{name: "retry after date is ignored", attempt: 2, resp: retryAfter("Wed, 21 Oct 2015 07:28:00 GMT"), want: 2 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := policy.Backoff(tt.attempt, tt.resp); got != tt.want {
+				t.Errorf("Backoff(%d) = %v, want %v", tt.attempt, got, tt.want)
+			}
+		})
+	}
+
+	jittered := &RetryPolicy{BaseDelay: time.Second, Jitter: 0.5}
+	for i := 0; i < 100; i++ {
+		if got := jittered.Backoff(2, nil); got < time.Second || got > 3*time.Second {
+			t.Fatalf("Backoff() with jitter = %v, want within [1s, 3s]", got)
+		}
+	}
+}
+
+// statusSequence 依次返回statuses中的状态码，之后一直返回最后一个，200时返回token
+func statusSequence(hits *atomic.Int32, statuses ...int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		i := int(hits.Add(1)) - 1
+		status := statuses[min(i, len(statuses)-1)]
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		if status == http.StatusOK {
+			w.Write([]byte(`{"access_token":"at-new","expires_in":3600}`))
+		} else {
+			w.Write([]byte(`{"error":"temporarily_unavailable"}`))
+		}
+	}
+}
+
+func TestRefreshRetries(t *testing.T) {
+	tests := []struct {
+		name        string
+		statuses    []int
+		maxAttempts int
+		retryOn     string
+		wantHits    int32
+		wantErr     bool
+	}{
+		{name: "succeeds after retries", statuses: []int{503, 500, 200}, maxAttempts: 3, wantHits: 3},
+		{name: "gives up after max attempts", statuses: []int{503}, maxAttempts: 2, wantHits: 2, wantErr: true},
+		{name: "client error is not retried", statuses: []int{404, 200}, maxAttempts: 3, wantHits: 1, wantErr: true},
+		{name: "status outside retry_on", statuses: []int{429, 200}, maxAttempts: 3, retryOn: "500-599", wantHits: 1, wantErr: true},
+		{name: "status inside retry_on", statuses: []int{429, 200}, maxAttempts: 3, retryOn: "429", wantHits: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var hits atomic.Int32
+			upstream := httptest.NewServer(statusSequence(&hits, tt.statuses...))
+			defer upstream.Close()
+
+			db, e := newTestEngine(t)
+			project := createTestProject(t, db, &models.Project{
+				RefreshURL:       upstream.URL,
+				RetryMaxAttempts: tt.maxAttempts,
+				RetryBaseDelayMs: 1,
+				RetryOn:          tt.retryOn,
+			})
+
+			err := e.Refresh(context.Background(), project)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Refresh() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := hits.Load(); got != tt.wantHits {
+				t.Errorf("upstream hits = %d, want %d", got, tt.wantHits)
+			}
+		})
+	}
+}
@@ -0,0 +1,324 @@
+package refresher
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"jwt_refresher/models"
+	"jwt_refresher/notifier"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSinkTimeout  = 30 * time.Second
+	defaultSinkFileMode = 0o600
+
+	// maxSinkOutput 推送记录中保存的响应或命令输出长度
+	maxSinkOutput = 1024
+)
+
+// sinkPush 一次刷新成功后等待推送到sink的token
+type sinkPush struct {
+	project *models.Project
+	logID   int64
+	token   *Token
+}
+
+// pushSinks 在后台把刷新后的token推送到项目的sink，不阻塞刷新（及等待刷新结果的调用者）。
+// 同一项目同时只有一次推送；推送期间又刷新成功时只保留最新的token，推送完成后再推送它，
+// 保证sink最终写入的是最新的token。推送计入flights，程序退出时等待其完成
+func (e *Engine) pushSinks(project *models.Project, logID int64, token *Token) {
+	push := &sinkPush{project: project, logID: logID, token: token}
+
+	e.sinkMu.Lock()
+	if _, running := e.sinkPending[project.ID]; running {
+		if pending := e.sinkPending[project.ID]; pending != nil {
+			log.Printf("Skipping sinks of superseded token for project %s (ID: %d)", project.Name, project.ID)
+		}
+		e.sinkPending[project.ID] = push
+		e.sinkMu.Unlock()
+		return
+	}
+	e.sinkPending[project.ID] = nil
+	e.flights.Add(1)
+	e.sinkMu.Unlock()
+
+	go func() {
+		defer e.flights.Done()
+		for push != nil {
+			e.runSinks(e.ctx, push.project, push.logID, push.token)
+
+			e.sinkMu.Lock()
+			if push = e.sinkPending[project.ID]; push == nil {
+				delete(e.sinkPending, project.ID)
+			} else {
+				e.sinkPending[project.ID] = nil
+			}
+			e.sinkMu.Unlock()
+		}
+	}()
+}
+
+// runSinks 将刷新后的token并行推送到项目所有启用的sink，并在刷新日志中记录各自的结果。
+// 每个sink有各自的超时，sink失败不影响刷新结果。ctx取消（程序退出超时）时中止推送，结果仍会记录
+func (e *Engine) runSinks(ctx context.Context, project *models.Project, logID int64, token *Token) {
+	storeCtx := context.WithoutCancel(ctx)
+	sinks, err := e.db.GetEnabledSinks(storeCtx, project.ID)
+	if err != nil {
+		log.Printf("Warning: Failed to load sinks for project %s (ID: %d): %v", project.Name, project.ID, err)
+		return
+	}
+	if len(sinks) == 0 {
+		return
+	}
+
+	deliveries := make([]*models.SinkDelivery, len(sinks))
+	var wg sync.WaitGroup
+	for i, sink := range sinks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			deliveries[i] = e.pushSink(ctx, sink, token)
+		}()
+	}
+	wg.Wait()
+
+	for _, d := range deliveries {
+		d.RefreshLogID = logID
+		if d.Status != models.DeliverySuccess {
+			log.Printf("Warning: Sink %s (ID: %d) failed for project %s (ID: %d): %s", d.SinkName, d.SinkID, project.Name, project.ID, d.Error)
+		}
+		if err := e.db.CreateSinkDelivery(storeCtx, d); err != nil {
+			log.Printf("Warning: Failed to create sink delivery: %v", err)
+		}
+	}
+}
+
+// pushSink 推送到一个sink并返回结果
+func (e *Engine) pushSink(ctx context.Context, sink *models.Sink, token *Token) *models.SinkDelivery {
+	d := &models.SinkDelivery{SinkID: sink.ID, SinkName: sink.Name, SinkType: sink.Type}
+
+	timeout := defaultSinkTimeout
+	if sink.TimeoutSeconds > 0 {
+		timeout = time.Duration(sink.TimeoutSeconds) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	output, err := e.writeSink(ctx, sink, token)
+	d.DurationMs = time.Since(start).Milliseconds()
+	d.Output = truncateString(output, maxSinkOutput)
+	if err != nil {
+		d.Status = models.DeliveryFailed
+		d.Error = err.Error()
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			d.Error = fmt.Sprintf("timed out after %s: %v", timeout, err)
+		}
+		return d
+	}
+	d.Status = models.DeliverySuccess
+	return d
+}
+
+func (e *Engine) writeSink(ctx context.Context, sink *models.Sink, token *Token) (string, error) {
+	format := sinkFormat(sink)
+	payload, err := renderSinkPayload(format, token)
+	if err != nil {
+		return "", err
+	}
+
+	switch sink.Type {
+	case models.SinkFile:
+		mode, err := ParseSinkFileMode(sink.FileMode)
+		if err != nil {
+			return "", err
+		}
+		return "", writeFileAtomic(sink.Path, payload, mode)
+	case models.SinkWebhook:
+		return e.postSink(ctx, sink, format, payload)
+	case models.SinkCommand:
+		return runSinkCommand(ctx, sink, token, payload)
+	default:
+		return "", fmt.Errorf("unknown sink type: %s", sink.Type)
+	}
+}
+
+// sinkFormat 返回sink的写入格式，未配置时webhook使用json，其他使用raw
+func sinkFormat(sink *models.Sink) string {
+	if sink.Format != "" {
+		return sink.Format
+	}
+	if sink.Type == models.SinkWebhook {
+		return models.SinkFormatJSON
+	}
+	return models.SinkFormatRaw
+}
+
+func renderSinkPayload(format string, token *Token) ([]byte, error) {
+	switch format {
+	case models.SinkFormatRaw:
+		return []byte(token.AccessToken), nil
+	case models.SinkFormatJSON:
+		return json.Marshal(token)
+	case models.SinkFormatEnv:
+		var b strings.Builder
+		writeEnv(&b, "ACCESS_TOKEN", token.AccessToken)
+		writeEnv(&b, "REFRESH_TOKEN", token.RefreshToken)
+		if token.ExpiresAt != nil {
+			writeEnv(&b, "EXPIRES_AT", token.ExpiresAt.Format(time.RFC3339))
+		}
+		names := make([]string, 0, len(token.Outputs))
+		for name := range token.Outputs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			writeEnv(&b, "OUTPUT_"+envName(name), token.Outputs[name])
+		}
+		return []byte(b.String()), nil
+	default:
+		return nil, fmt.Errorf("unknown sink format: %s", format)
+	}
+}
+
+// writeEnv 写入一行KEY=value，值包含空白、引号等字符时加双引号
+func writeEnv(b *strings.Builder, key, value string) {
+	if strings.ContainsFunc(value, func(r rune) bool {
+		return r <= ' ' || r == '"' || r == '\'' || r == '\\' || r == '#' || r == '$' || r == '`' || r > '~'
+	}) {
+		value = strconv.Quote(value)
+	}
+	fmt.Fprintf(b, "%s=%s\n", key, value)
+}
+
+// envName 将输出名称转换为环境变量名：大写，非字母数字替换为下划线
+func envName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+}
+
+// ParseSinkFileMode 解析八进制的文件权限，为空时返回默认的0600
+func ParseSinkFileMode(s string) (os.FileMode, error) {
+	if s == "" {
+		return defaultSinkFileMode, nil
+	}
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 0o777 {
+		return 0, fmt.Errorf("invalid file mode %q: must be an octal permission such as 0600", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+// writeFileAtomic 写入同目录下的临时文件后重命名，读取者不会看到写了一半的文件
+func writeFileAtomic(path string, data []byte, mode os.FileMode) (err error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if _, err = tmp.Write(data); err != nil {
+		return fmt.Errorf("failed to write temp file: %w", err)
+	}
+	if err = tmp.Chmod(mode); err != nil {
+		return fmt.Errorf("failed to set file mode: %w", err)
+	}
+	if err = tmp.Sync(); err != nil {
+		return fmt.Errorf("failed to sync temp file: %w", err)
+	}
+	if err = tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close temp file: %w", err)
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to rename temp file: %w", err)
+	}
+	return nil
+}
+
+// postSink 将token POST到sink的URL，非2xx视为失败
+func (e *Engine) postSink(ctx context.Context, sink *models.Sink, format string, payload []byte) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sink.URL, bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+	if sink.Headers != "" {
+		var headers map[string]string
+		if err := json.Unmarshal([]byte(sink.Headers), &headers); err != nil {
+			return "", fmt.Errorf("invalid headers: %w", err)
+		}
+		for key, value := range headers {
+			req.Header.Set(key, value)
+		}
+	}
+	if format == models.SinkFormatJSON {
+		req.Header.Set("Content-Type", "application/json")
+	} else {
+		req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	req.Header.Set("User-Agent", "jwt-refresher")
+
+	// 与Webhook通知使用相同的签名方式
+	if sink.Secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("X-Webhook-Timestamp", timestamp)
+		req.Header.Set("X-Webhook-Signature", "sha256="+notifier.Sign(sink.Secret, timestamp, payload))
+	}
+
+	resp, err := e.sinkClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxSinkOutput))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return string(body), fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	return string(body), nil
+}
+
+// runSinkCommand 通过 /bin/sh -c 执行命令，token从stdin传入，
+// 项目信息通过JWT_REFRESHER_*环境变量传入
+func runSinkCommand(ctx context.Context, sink *models.Sink, token *Token, payload []byte) (string, error) {
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", sink.Command)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Env = append(os.Environ(),
+		"JWT_REFRESHER_PROJECT_ID="+strconv.FormatInt(token.ProjectID, 10),
+		"JWT_REFRESHER_PROJECT_NAME="+token.ProjectName,
+		"JWT_REFRESHER_SINK="+sink.Name,
+	)
+	if token.ExpiresAt != nil {
+		cmd.Env = append(cmd.Env, "JWT_REFRESHER_EXPIRES_AT="+token.ExpiresAt.Format(time.RFC3339))
+	}
+	// 命令启动的后台进程持有输出管道时，超时后不再等待
+	cmd.WaitDelay = time.Second
+
+	output, err := cmd.CombinedOutput()
+	return string(output), err
+}
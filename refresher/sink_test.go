@@ -0,0 +1,240 @@
+package refresher
+
+import (
+	"context"
+	"io"
+	"jwt_refresher/models"
+	"jwt_refresher/notifier"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenderSinkPayload(t *testing.T) {
+	expiresAt := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	token := &Token{
+		ProjectID:    1,
+		ProjectName:  "test",
+		AccessToken:  "at-1",
+		RefreshToken: "rt 1",
+		ExpiresAt:    &expiresAt,
+		Outputs:      map[string]string{"tenant-id": "t1", "api.key": `a"b`},
+	}
+
+	tests := []struct {
+		name    string
+		format  string
+		want    string
+		wantErr bool
+	}{
+		{name: "raw", format: models.SinkFormatRaw, want: "at-1"},
+		{
+			name:   "json",
+			format: models.SinkFormatJSON,
+			want: `{"project_id":1,"project_name":"test","access_token":"at-1","refresh_token":"rt 1",` +
+				`"expires_at":"2030-01-02T03:04:05Z","outputs":{"api.key":"a\"b","tenant-id":"t1"}}`,
+		},
+		{
+			// 输出按名称排序，需要时加引号
+			name:   "env",
+			format: models.SinkFormatEnv,
+			want: "ACCESS_TOKEN=at-1\nREFRESH_TOKEN=\"rt 1\"\nEXPIRES_AT=2030-01-02T03:04:05Z\n" +
+				"OUTPUT_API_KEY=\"a\\\"b\"\nOUTPUT_TENANT_ID=t1\n",
+		},
+		{name: "unknown", format: "yaml", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := renderSinkPayload(tt.format, token)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("renderSinkPayload() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if string(got) != tt.want {
+				t.Errorf("renderSinkPayload() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSinkFileMode(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    os.FileMode
+		wantErr bool
+	}{
+		{s: "", want: 0o600},
+		{s: "0644", want: 0o644},
+		{s: "640", want: 0o640},
+		{s: "0999", wantErr: true},
+		{s: "1777", wantErr: true},
+		{s: "rw-r--r--", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			got, err := ParseSinkFileMode(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseSinkFileMode() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseSinkFileMode() = %o, want %o", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPushSink(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		ts := r.Header.Get("X-Webhook-Timestamp")
+		switch {
+		case r.Header.Get("Authorization") != "Bearer sink-token":
+			w.WriteHeader(http.StatusUnauthorized)
+		case r.Header.Get("X-Webhook-Signature") != "sha256="+notifier.Sign("whsec", ts, body):
+			w.WriteHeader(http.StatusForbidden)
+		case r.Header.Get("Content-Type") != "application/json" || !strings.Contains(string(body), `"access_token":"at-1"`):
+			w.WriteHeader(http.StatusBadRequest)
+		default:
+			w.Write([]byte("stored"))
+		}
+	}))
+	defer receiver.Close()
+
+	dir := t.TempDir()
+	tests := []struct {
+		name       string
+		sink       models.Sink
+		wantStatus string
+		wantOutput string
+		wantErr    string
+	}{
+		{
+			name:       "file",
+			sink:       models.Sink{Type: models.SinkFile, Path: filepath.Join(dir, "token"), FileMode: "0640"},
+			wantStatus: models.DeliverySuccess,
+		},
+		{
+			name:       "file in missing directory",
+			sink:       models.Sink{Type: models.SinkFile, Path: filepath.Join(dir, "missing", "token")},
+			wantStatus: models.DeliveryFailed,
+			wantErr:    "failed to create temp file",
+		},
+		{
+			name: "webhook",
+			sink: models.Sink{
+				Type:    models.SinkWebhook,
+				URL:     receiver.URL,
+				Headers: `{"Authorization":"Bearer sink-token"}`,
+				Secret:  "whsec",
+			},
+			wantStatus: models.DeliverySuccess,
+			wantOutput: "stored",
+		},
+		{
+			name:       "webhook with wrong secret",
+			sink:       models.Sink{Type: models.SinkWebhook, URL: receiver.URL, Headers: `{"Authorization":"Bearer sink-token"}`, Secret: "other"},
+			wantStatus: models.DeliveryFailed,
+			wantErr:    "HTTP 403",
+		},
+		{
+			name:       "command",
+			sink:       models.Sink{Type: models.SinkCommand, Name: "cmd", Command: `read t; echo "$JWT_REFRESHER_SINK:$JWT_REFRESHER_PROJECT_ID:$t"`},
+			wantStatus: models.DeliverySuccess,
+			wantOutput: "cmd:1:at-1\n",
+		},
+		{
+			name:       "failing command",
+			sink:       models.Sink{Type: models.SinkCommand, Command: "echo oops; exit 3"},
+			wantStatus: models.DeliveryFailed,
+			wantOutput: "oops\n",
+			wantErr:    "exit status 3",
+		},
+		{
+			name:       "command timeout",
+			sink:       models.Sink{Type: models.SinkCommand, Command: "sleep 5", TimeoutSeconds: 1},
+			wantStatus: models.DeliveryFailed,
+			wantErr:    "timed out after 1s",
+		},
+	}
+
+	_, e := newTestEngine(t)
+	token := &Token{ProjectID: 1, ProjectName: "test", AccessToken: "at-1"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := e.pushSink(context.Background(), &tt.sink, token)
+			if d.Status != tt.wantStatus || d.Output != tt.wantOutput || !strings.Contains(d.Error, tt.wantErr) {
+				t.Errorf("delivery = %s, output %q, error %q; want %s, output %q, error %q",
+					d.Status, d.Output, d.Error, tt.wantStatus, tt.wantOutput, tt.wantErr)
+			}
+		})
+	}
+
+	// 文件整体替换，权限按配置设置，不残留临时文件
+	path := filepath.Join(dir, "token")
+	if data, err := os.ReadFile(path); err != nil || string(data) != "at-1" {
+		t.Errorf("file content = %q, %v", data, err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o640 {
+		t.Errorf("file mode = %v, %v", info.Mode().Perm(), err)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("directory has %d entries, want only the token file", len(entries))
+	}
+}
+
+func TestPushSinksCoalesce(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	received := make(chan string, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-release
+		received <- string(body)
+	}))
+	defer receiver.Close()
+
+	db, e := newTestEngine(t)
+	project := createTestProject(t, db, &models.Project{})
+	sink := &models.Sink{ProjectID: project.ID, Name: "hook", Type: models.SinkWebhook, URL: receiver.URL, Format: models.SinkFormatRaw, Enabled: true}
+	if err := db.CreateSink(context.Background(), sink); err != nil {
+		t.Fatal(err)
+	}
+
+	push := func(accessToken string) {
+		e.pushSinks(project, 0, &Token{ProjectID: project.ID, AccessToken: accessToken})
+	}
+
+	// 第一次推送进行中时到达的token只保留最新的一个
+	push("at-1")
+	<-started
+	push("at-2")
+	push("at-3")
+	push("at-4")
+	close(release)
+	e.flights.Wait()
+	close(received)
+
+	var got []string
+	for body := range received {
+		got = append(got, body)
+	}
+	if strings.Join(got, ",") != "at-1,at-4" {
+		t.Errorf("pushed %v, want [at-1 at-4]", got)
+	}
+
+	e.sinkMu.Lock()
+	defer e.sinkMu.Unlock()
+	if len(e.sinkPending) != 0 {
+		t.Errorf("sinkPending = %v, want empty after pushes finish", e.sinkPending)
+	}
+}
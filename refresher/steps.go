@@ -0,0 +1,123 @@
+package refresher
+
+import (
+	"encoding/json"
+	"fmt"
+	"jwt_refresher/models"
+	"strings"
+)
+
+// RefreshStep 在刷新请求之前执行的一次HTTP请求，如获取nonce、CSRF token或登录换取code。
+// URL、请求头和请求体都是模板，可以使用之前步骤提取的值 ({{.Steps.步骤名.名称}})
+type RefreshStep struct {
+	Name           string            `json:"name"`
+	URL            string            `json:"url"`
+	Method         string            `json:"method"` // 为空时为POST
+	Headers        map[string]string `json:"headers"`
+	Body           string            `json:"body"`
+	ResponseFormat string            `json:"response_format"` // 为空时为auto
+	Extract        map[string]string `json:"extract"`         // 名称 -> 提取路径
+}
+
+// StepValues 各步骤提取的值：步骤名 -> 名称 -> 值
+type StepValues map[string]map[string]string
+
+// ParseRefreshSteps 解析项目的刷新步骤（JSON数组）
+func ParseRefreshSteps(s string) ([]RefreshStep, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var steps []RefreshStep
+	if err := json.Unmarshal([]byte(s), &steps); err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	for i, step := range steps {
+		if step.Name == "" {
+			return nil, fmt.Errorf("step %d: name is required", i+1)
+		}
+		if seen[step.Name] {
+			return nil, fmt.Errorf("step %d: duplicate name %q", i+1, step.Name)
+		}
+		seen[step.Name] = true
+		if step.URL == "" {
+			return nil, fmt.Errorf("step %s: url is required", step.Name)
+		}
+		for name, path := range step.Extract {
+			if name == "" || path == "" {
+				return nil, fmt.Errorf("step %s: extract name and path are required", step.Name)
+			}
+		}
+	}
+	return steps, nil
+}
+
+// ValidateRefreshSteps 解析刷新步骤并校验模板和提取路径
+func ValidateRefreshSteps(s string) error {
+	steps, err := ParseRefreshSteps(s)
+	if err != nil {
+		return err
+	}
+	for _, step := range steps {
+		for _, tmpl := range []string{step.URL, step.Body} {
+			if err := ValidateTemplate(tmpl); err != nil {
+				return fmt.Errorf("step %s: %w", step.Name, err)
+			}
+		}
+		for key, value := range step.Headers {
+			if err := ValidateTemplate(value); err != nil {
+				return fmt.Errorf("step %s: header %s: %w", step.Name, key, err)
+			}
+		}
+		for name, path := range step.Extract {
+			if err := ValidatePath(step.ResponseFormat, path); err != nil {
+				return fmt.Errorf("step %s: extract %s: %w", step.Name, name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// buildSpec 渲染步骤的请求
+func (s *RefreshStep) buildSpec(project *models.Project, values StepValues) (*requestSpec, error) {
+	url, err := renderTemplate(s.URL, project, values)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render url: %w", err)
+	}
+
+	body, err := renderTemplate(s.Body, project, values)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render body: %w", err)
+	}
+
+	headers, err := renderHeaders(s.Headers, project, values)
+	if err != nil {
+		return nil, err
+	}
+
+	method := strings.ToUpper(strings.TrimSpace(s.Method))
+	if method == "" {
+		method = "POST"
+	}
+
+	return &requestSpec{
+		Method:  method,
+		URL:     url,
+		Headers: headers,
+		Body:    body,
+	}, nil
+}
+
+// extract 按步骤的规则从响应中提取值，任何一个值提取失败都会使步骤失败
+func (s *RefreshStep) extract(resp *Response) (map[string]string, error) {
+	values := make(map[string]string, len(s.Extract))
+	for name, path := range s.Extract {
+		value, err := ExtractValue(resp, s.ResponseFormat, path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to extract %s: %w", name, err)
+		}
+		values[name] = value
+	}
+	return values, nil
+}
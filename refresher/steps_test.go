@@ -0,0 +1,131 @@
+package refresher
+
+import (
+	"context"
+	"jwt_refresher/models"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestValidateRefreshSteps(t *testing.T) {
+	tests := []struct {
+		name    string
+		steps   string
+		wantErr string
+	}{
+		{name: "empty", steps: ""},
+		{name: "valid", steps: `[{"name":"csrf","url":"https://x/login","method":"GET","extract":{"token":"header:X-CSRF"}},` +
+			`{"name":"login","url":"https://x/login","body":"csrf={{.Steps.csrf.token}}","extract":{"code":"code"}}]`},
+		{name: "not an array", steps: `{"name":"a"}`, wantErr: "cannot unmarshal"},
+		{name: "missing name", steps: `[{"url":"https://x"}]`, wantErr: "step 1: name is required"},
+		{name: "duplicate name", steps: `[{"name":"a","url":"https://x"},{"name":"a","url":"https://y"}]`, wantErr: `step 2: duplicate name "a"`},
+		{name: "missing url", steps: `[{"name":"a"}]`, wantErr: "step a: url is required"},
+		{name: "empty extract path", steps: `[{"name":"a","url":"https://x","extract":{"code":""}}]`, wantErr: "extract name and path are required"},
+		{name: "invalid body template", steps: `[{"name":"a","url":"https://x","body":"{{.code"}]`, wantErr: "step a:"},
+		{name: "invalid header template", steps: `[{"name":"a","url":"https://x","headers":{"X":"{{end}}"}}]`, wantErr: "step a: header X"},
+		{name: "invalid extract path", steps: `[{"name":"a","url":"https://x","extract":{"code":"regex:("}}]`, wantErr: "step a: extract code"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateRefreshSteps(tt.steps)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("ValidateRefreshSteps() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ValidateRefreshSteps() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// stepsUpstream 模拟先获取CSRF token（设置cookie）、再登录换取code、最后用code换token的上游
+func stepsUpstream(t *testing.T, loginStatus int) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /csrf", func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "s-1", Path: "/"})
+		w.Header().Set("X-CSRF", "csrf-1")
+		w.Write([]byte("ok"))
+	})
+	mux.HandleFunc("POST /login", func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie("session")
+		if err != nil || cookie.Value != "s-1" || r.Header.Get("X-CSRF") != "csrf-1" || r.PostFormValue("user") != "alice" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(loginStatus)
+		w.Write([]byte(`{"code":"code-1"}`))
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		if r.PostFormValue("code") != "code-1" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_request"}`))
+			return
+		}
+		w.Write([]byte(`{"access_token":"at-steps","expires_in":3600}`))
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestRefreshSteps(t *testing.T) {
+	tests := []struct {
+		name        string
+		loginStatus int
+		wantErr     bool
+		wantStep    string
+	}{
+		{name: "values flow into later steps", loginStatus: http.StatusOK},
+		{name: "2xx steps succeed", loginStatus: http.StatusCreated},
+		{name: "failed step is recorded", loginStatus: http.StatusUnauthorized, wantErr: true, wantStep: "login"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := stepsUpstream(t, tt.loginStatus)
+			db, e := newTestEngine(t)
+			project := createTestProject(t, db, &models.Project{
+				RefreshURL:          upstream.URL + "/token",
+				RefreshHeaders:      `{"Content-Type":"application/x-www-form-urlencoded"}`,
+				RefreshBodyTemplate: "code={{.Steps.login.code}}",
+				RefreshSteps: `[
+					{"name":"csrf","url":"` + upstream.URL + `/csrf","method":"GET","extract":{"token":"header:X-CSRF"}},
+					{"name":"login","url":"` + upstream.URL + `/login",
+					 "headers":{"Content-Type":"application/x-www-form-urlencoded","X-CSRF":"{{.Steps.csrf.token}}"},
+					 "body":"user={{.user}}","extract":{"code":"code"}}
+				]`,
+				CustomVariables:  `{"user":"alice"}`,
+				RetryMaxAttempts: 1,
+			})
+
+			err := e.Refresh(context.Background(), project)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Refresh() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			got, err := db.GetProject(context.Background(), project.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			logs, err := db.GetProjectLogs(context.Background(), project.ID, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(logs) != 1 {
+				t.Fatalf("got %d refresh logs, want 1", len(logs))
+			}
+			if logs[0].FailedStep != tt.wantStep {
+				t.Errorf("failed step = %q, want %q", logs[0].FailedStep, tt.wantStep)
+			}
+			if !tt.wantErr && got.CurrentAccessToken != "at-steps" {
+				t.Errorf("access token = %q, want %q", got.CurrentAccessToken, "at-steps")
+			}
+		})
+	}
+}
@@ -2,35 +2,237 @@ package refresher
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"jwt_refresher/models"
+	"net/url"
+	"os"
+	"strings"
 	"text/template"
+	"time"
 )
 
+// templateEnvPrefix 模板只能读取带此前缀的环境变量，{{env "API_KEY"}} 读取 REFRESHER_VAR_API_KEY
+const templateEnvPrefix = "REFRESHER_VAR_"
+
+// templateFuncs 模板可用的函数
+var templateFuncs = template.FuncMap{
+	// 编码
+	"b64enc":     func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) },
+	"b64dec":     b64dec,
+	"b64url":     func(s string) string { return base64.RawURLEncoding.EncodeToString([]byte(s)) },
+	"urlencode":  url.QueryEscape,
+	"pathescape": url.PathEscape,
+	"json":       toJSON,
+	"jsonEscape": jsonEscape,
+	"basicAuth": func(user, password string) string {
+		return base64.StdEncoding.EncodeToString([]byte(user + ":" + password))
+	},
+
+	// 签名
+	"sha256":           sha256Hex,
+	"hmacSHA256":       func(key, msg string) string { return hex.EncodeToString(hmacSHA256(key, msg)) },
+	"hmacSHA256Base64": func(key, msg string) string { return base64.StdEncoding.EncodeToString(hmacSHA256(key, msg)) },
+
+	// 时间
+	"now":       time.Now,
+	"unix":      func() int64 { return time.Now().Unix() },
+	"unixMilli": func() int64 { return time.Now().UnixMilli() },
+
+	// 随机值
+	"uuid":  newUUID,
+	"nonce": nonce,
+
+	// 其他
+	"env":     templateEnv,
+	"default": defaultValue,
+	"upper":   strings.ToUpper,
+	"lower":   strings.ToLower,
+	"trim":    strings.TrimSpace,
+}
+
 func RenderTemplate(tmpl string, project *models.Project) (string, error) {
+	return renderTemplate(tmpl, project, nil)
+}
+
+// ValidateTemplate 检查模板能否解析（语法和函数名），不执行模板
+func ValidateTemplate(tmpl string) error {
+	_, err := template.New("body").Funcs(templateFuncs).Parse(tmpl)
+	return err
+}
+
+// renderTemplate 渲染模板，steps为本次刷新中之前步骤提取的值
+func renderTemplate(tmpl string, project *models.Project, steps StepValues) (string, error) {
+	data, err := templateData(project, steps)
+	if err != nil {
+		return "", err
+	}
+
+	t, err := template.New("body").Funcs(templateFuncs).Parse(tmpl)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+// renderHeaders 渲染请求头的值
+func renderHeaders(headers map[string]string, project *models.Project, steps StepValues) (map[string]string, error) {
+	rendered := make(map[string]string, len(headers))
+	for key, value := range headers {
+		v, err := renderTemplate(value, project, steps)
+		if err != nil {
+			return nil, fmt.Errorf("failed to render header %s: %w", key, err)
+		}
+		rendered[key] = v
+	}
+	return rendered, nil
+}
+
+// templateData 模板变量：自定义变量加上项目当前的状态，同名时以项目状态为准
+func templateData(project *models.Project, steps StepValues) (map[string]interface{}, error) {
 	// 解析自定义变量
 	var customVars map[string]interface{}
 	if project.CustomVariables != "" {
 		if err := json.Unmarshal([]byte(project.CustomVariables), &customVars); err != nil {
-			return "", fmt.Errorf("failed to parse custom variables: %w", err)
+			return nil, fmt.Errorf("failed to parse custom variables: %w", err)
 		}
 	} else {
 		customVars = make(map[string]interface{})
 	}
 
-	// 添加RefreshToken到变量中
+	// 添加项目状态到变量中
 	customVars["RefreshToken"] = project.CurrentRefreshToken
+	customVars["AccessToken"] = project.CurrentAccessToken
+	customVars["ProjectID"] = project.ID
+	customVars["ProjectName"] = project.Name
+
+	// 过期时间未知时为零值，可用 {{if not .ExpiresAt.IsZero}} 判断
+	var expiresAt time.Time
+	if project.TokenExpiresAt.Valid {
+		expiresAt = project.TokenExpiresAt.Time
+	}
+	customVars["ExpiresAt"] = expiresAt
+
+	// 上一次刷新提取的输出值，如 {{.Outputs.id_token}}
+	outputs, err := ParseOutputs(project.Outputs)
+	if err != nil {
+		return nil, err
+	}
+	customVars["Outputs"] = outputs
 
-	t, err := template.New("body").Parse(tmpl)
+	// 之前步骤提取的值，如 {{.Steps.login.code}}
+	if steps == nil {
+		steps = StepValues{}
+	}
+	customVars["Steps"] = steps
+
+	return customVars, nil
+}
+
+func b64dec(s string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(s)
 	if err != nil {
 		return "", err
 	}
+	return string(data), nil
+}
 
-	var buf bytes.Buffer
-	if err := t.Execute(&buf, customVars); err != nil {
+// toJSON 把值编码为JSON，字符串会带引号
+func toJSON(v any) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
 		return "", err
 	}
+	return string(data), nil
+}
 
-	return buf.String(), nil
+// jsonEscape 转义字符串以便放在JSON字符串的引号中，如 "{{jsonEscape .RefreshToken}}"
+func jsonEscape(s string) string {
+	data, _ := json.Marshal(s)
+	return string(data[1 : len(data)-1])
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key, msg string) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(msg))
+	return mac.Sum(nil)
+}
+
+// newUUID 生成随机的UUID (v4)
+func newUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// nonce 生成n个随机字节的十六进制字符串
+func nonce(n int) (string, error) {
+	if n <= 0 || n > 256 {
+		return "", fmt.Errorf("nonce length must be between 1 and 256")
+	}
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// templateEnv 读取REFRESHER_VAR_前缀的环境变量，未设置时报错
+func templateEnv(name string) (string, error) {
+	key := templateEnvPrefix + strings.TrimPrefix(name, templateEnvPrefix)
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", key)
+	}
+	return value, nil
+}
+
+// defaultValue value为空时返回def，如 {{default "openid" .Scope}}
+func defaultValue(def, value any) any {
+	if isEmpty(value) {
+		return def
+	}
+	return value
+}
+
+func isEmpty(v any) bool {
+	switch v := v.(type) {
+	case nil:
+		return true
+	case string:
+		return v == ""
+	case bool:
+		return !v
+	case int:
+		return v == 0
+	case int64:
+		return v == 0
+	case float64:
+		return v == 0
+	case map[string]interface{}:
+		return len(v) == 0
+	case []interface{}:
+		return len(v) == 0
+	}
+	return false
 }
@@ -0,0 +1,142 @@
+package refresher
+
+import (
+	"database/sql"
+	"jwt_refresher/models"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestRenderTemplateFuncs(t *testing.T) {
+	t.Setenv("REFRESHER_VAR_CLIENT_SECRET", "env-secret")
+	t.Setenv("CLIENT_SECRET", "not-exposed")
+
+	project := &models.Project{
+		ID:                  7,
+		Name:                "demo",
+		CurrentRefreshToken: `rt "quoted"`,
+		CurrentAccessToken:  "at-1",
+		CustomVariables:     `{"client_id":"my client","scope":"","tenant":"Acme","count":0}`,
+		Outputs:             `{"id_token":"id-1"}`,
+	}
+	steps := StepValues{"login": {"code": "c-1"}}
+
+	tests := []struct {
+		name    string
+		tmpl    string
+		want    string
+		match   string
+		wantErr bool
+	}{
+		// 变量
+		{name: "project state", tmpl: "{{.ProjectID}}:{{.ProjectName}}:{{.AccessToken}}", want: "7:demo:at-1"},
+		{name: "custom variable", tmpl: "{{.client_id}}", want: "my client"},
+		{name: "outputs and steps", tmpl: "{{.Outputs.id_token}}/{{.Steps.login.code}}", want: "id-1/c-1"},
+		{name: "unknown expiry is zero", tmpl: "{{if .ExpiresAt.IsZero}}unknown{{end}}", want: "unknown"},
+
+		// 编码
+		{name: "b64enc", tmpl: `{{b64enc "user:pass"}}`, want: "dXNlcjpwYXNz"},
+		{name: "b64dec", tmpl: `{{b64dec "dXNlcjpwYXNz"}}`, want: "user:pass"},
+		{name: "b64dec invalid", tmpl: `{{b64dec "%%%"}}`, wantErr: true},
+		{name: "b64url", tmpl: `{{b64url "??>"}}`, want: "Pz8-"},
+		{name: "urlencode", tmpl: "{{urlencode .client_id}}", want: "my+client"},
+		{name: "pathescape", tmpl: `{{pathescape "a b/c"}}`, want: "a%20b%2Fc"},
+		{name: "json string", tmpl: "{{json .RefreshToken}}", want: `"rt \"quoted\""`},
+		{name: "json object", tmpl: "{{json .Outputs}}", want: `{"id_token":"id-1"}`},
+		{name: "jsonEscape", tmpl: `"{{jsonEscape .RefreshToken}}"`, want: `"rt \"quoted\""`},
+		{name: "basicAuth", tmpl: `{{basicAuth "user" "pass"}}`, want: "dXNlcjpwYXNz"},
+
+		// 签名
+		{name: "sha256", tmpl: `{{sha256 "abc"}}`, want: "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{name: "hmacSHA256", tmpl: `{{hmacSHA256 "key" "The quick brown fox jumps over the lazy dog"}}`, want: "f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8"},
+		{name: "hmacSHA256Base64", tmpl: `{{hmacSHA256Base64 "key" "The quick brown fox jumps over the lazy dog"}}`, want: "97yD9DBThCSxMpjmqm+xQ+9NWaFJRhdZl0edvC0aPNg="},
+
+		// 时间和随机值
+		{name: "unix", tmpl: "{{unix}}", match: `^\d{10}$`},
+		{name: "unixMilli", tmpl: "{{unixMilli}}", match: `^\d{13}$`},
+		{name: "now", tmpl: `{{(now).UTC.Format "2006"}}`, match: `^\d{4}$`},
+		{name: "uuid", tmpl: "{{uuid}}", match: `^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`},
+		{name: "nonce", tmpl: "{{nonce 8}}", match: `^[0-9a-f]{16}$`},
+		{name: "nonce too long", tmpl: "{{nonce 1000}}", wantErr: true},
+		{name: "nonce zero", tmpl: "{{nonce 0}}", wantErr: true},
+
+		// 其他
+		{name: "env with prefix", tmpl: `{{env "CLIENT_SECRET"}}`, want: "env-secret"},
+		{name: "env full name", tmpl: `{{env "REFRESHER_VAR_CLIENT_SECRET"}}`, want: "env-secret"},
+		{name: "env unset", tmpl: `{{env "MISSING"}}`, wantErr: true},
+		{name: "default for empty string", tmpl: `{{default "openid" .scope}}`, want: "openid"},
+		{name: "default for missing", tmpl: `{{default "none" .missing}}`, want: "none"},
+		{name: "default for zero number", tmpl: `{{default 10 .count}}`, want: "10"},
+		{name: "default keeps value", tmpl: `{{default "x" .tenant}}`, want: "Acme"},
+		{name: "upper lower trim", tmpl: `{{upper .tenant}} {{lower .tenant}} [{{trim "  x "}}]`, want: "ACME acme [x]"},
+
+		{name: "unknown function", tmpl: "{{md5 .client_id}}", wantErr: true},
+		{name: "syntax error", tmpl: "{{.client_id", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := renderTemplate(tt.tmpl, project, steps)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("renderTemplate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if tt.match != "" {
+				if !regexp.MustCompile(tt.match).MatchString(got) {
+					t.Errorf("renderTemplate() = %q, want match %s", got, tt.match)
+				}
+				return
+			}
+			if got != tt.want {
+				t.Errorf("renderTemplate() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenderTemplateExpiresAt(t *testing.T) {
+	expires := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	project := &models.Project{TokenExpiresAt: sql.NullTime{Time: expires, Valid: true}}
+
+	got, err := renderTemplate(`{{.ExpiresAt.Unix}}`, project, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "1717243200" {
+		t.Errorf("renderTemplate() = %q, want %q", got, "1717243200")
+	}
+}
+
+func TestRenderTemplateInvalidVariables(t *testing.T) {
+	project := &models.Project{CustomVariables: `{"client_id":`}
+	if _, err := renderTemplate("{{.client_id}}", project, nil); err == nil {
+		t.Error("renderTemplate() with invalid custom variables succeeded, want an error")
+	}
+}
+
+func TestValidateTemplate(t *testing.T) {
+	tests := []struct {
+		name    string
+		tmpl    string
+		wantErr bool
+	}{
+		{name: "functions", tmpl: `grant_type=refresh_token&refresh_token={{urlencode .RefreshToken}}&nonce={{nonce 16}}`},
+		// 不执行模板，未设置的环境变量不报错
+		{name: "not executed", tmpl: `{{env "UNSET_FOR_VALIDATION"}}`},
+		{name: "unknown function", tmpl: "{{md5 .RefreshToken}}", wantErr: true},
+		{name: "unclosed action", tmpl: "{{.RefreshToken", wantErr: true},
+		{name: "unclosed if", tmpl: "{{if .RefreshToken}}x", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateTemplate(tt.tmpl)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ValidateTemplate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,235 @@
+package refresher
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"jwt_refresher/models"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// ProxyDirect 直连，不使用任何代理（包括HTTP_PROXY等环境变量）
+const ProxyDirect = "direct"
+
+var proxySchemes = map[string]bool{"http": true, "https": true, "socks5": true, "socks5h": true}
+
+// tlsVersions 可配置的TLS最低版本
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// projectTransport 项目专用的Transport，key为生成它的配置，配置变化时重建
+type projectTransport struct {
+	key       string
+	transport *http.Transport
+}
+
+// transportFor 返回项目使用的Transport，同一配置复用同一个Transport以复用连接。
+// 没有自定义TLS配置且使用环境变量代理时返回nil，使用http.DefaultTransport
+func (e *Engine) transportFor(project *models.Project) (http.RoundTripper, error) {
+	e.transportsMu.Lock()
+	defer e.transportsMu.Unlock()
+
+	proxy := e.projectProxy(project)
+	cached, ok := e.transports[project.ID]
+	if !hasTLSConfig(project) && proxy == "" {
+		if ok {
+			cached.transport.CloseIdleConnections()
+			delete(e.transports, project.ID)
+		}
+		return nil, nil
+	}
+
+	key := transportKey(project, proxy)
+	if ok {
+		if cached.key == key {
+			return cached.transport, nil
+		}
+		cached.transport.CloseIdleConnections()
+		delete(e.transports, project.ID)
+	}
+
+	tlsConfig, err := buildTLSConfig(project)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	if transport.Proxy, err = proxyFunc(proxy); err != nil {
+		return nil, err
+	}
+	e.transports[project.ID] = &projectTransport{key: key, transport: transport}
+	return transport, nil
+}
+
+// EvictTransport 丢弃项目缓存的Transport并关闭其空闲连接。项目被修改或删除后调用，
+// 避免已删除项目的Transport一直留在缓存中，或修改后复用旧配置建立的连接
+func (e *Engine) EvictTransport(projectID int64) {
+	e.transportsMu.Lock()
+	defer e.transportsMu.Unlock()
+	if cached, ok := e.transports[projectID]; ok {
+		cached.transport.CloseIdleConnections()
+		delete(e.transports, projectID)
+	}
+}
+
+func hasTLSConfig(project *models.Project) bool {
+	return project.TLSClientCert != "" || project.TLSClientKey != "" || project.TLSCABundle != "" ||
+		project.TLSServerName != "" || project.TLSMinVersion != "" || project.TLSInsecureSkipVerify
+}
+
+// transportKey 影响Transport的配置的摘要
+func transportKey(project *models.Project, proxy string) string {
+	h := sha256.New()
+	for _, v := range []string{
+		project.TLSClientCert, project.TLSClientKey, project.TLSCABundle,
+		project.TLSServerName, project.TLSMinVersion, strconv.FormatBool(project.TLSInsecureSkipVerify),
+		proxy,
+	} {
+		h.Write([]byte(v))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// ValidateTLSMinVersion 校验TLS最低版本，空值表示默认的1.2
+func ValidateTLSMinVersion(version string) error {
+	_, err := tlsMinVersion(version)
+	return err
+}
+
+// ValidateTLSClientCert 校验客户端证书和私钥，两者须同时配置
+func ValidateTLSClientCert(certPEM, keyPEM string) error {
+	_, err := loadClientCert(certPEM, keyPEM)
+	return err
+}
+
+// ValidateTLSCABundle 校验CA证书包至少包含一个PEM证书
+func ValidateTLSCABundle(bundle string) error {
+	_, err := loadCABundle(bundle)
+	return err
+}
+
+func buildTLSConfig(project *models.Project) (*tls.Config, error) {
+	minVersion, err := tlsMinVersion(project.TLSMinVersion)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		MinVersion:         minVersion,
+		ServerName:         project.TLSServerName,
+		InsecureSkipVerify: project.TLSInsecureSkipVerify,
+	}
+
+	if project.TLSClientCert != "" || project.TLSClientKey != "" {
+		cert, err := loadClientCert(project.TLSClientCert, project.TLSClientKey)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if project.TLSCABundle != "" {
+		if config.RootCAs, err = loadCABundle(project.TLSCABundle); err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
+
+func tlsMinVersion(version string) (uint16, error) {
+	if version == "" {
+		return tls.VersionTLS12, nil
+	}
+	v, ok := tlsVersions[version]
+	if !ok {
+		return 0, fmt.Errorf("unknown tls min version %q (supported: 1.0, 1.1, 1.2, 1.3)", version)
+	}
+	return v, nil
+}
+
+func loadClientCert(certPEM, keyPEM string) (tls.Certificate, error) {
+	if certPEM == "" || keyPEM == "" {
+		return tls.Certificate{}, fmt.Errorf("tls client cert and key must be set together")
+	}
+	cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("invalid tls client cert or key: %w", err)
+	}
+	return cert, nil
+}
+
+func loadCABundle(bundle string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM([]byte(bundle)) {
+		return nil, fmt.Errorf("no certificates found in tls ca bundle")
+	}
+	return pool, nil
+}
+
+// projectProxy 项目生效的代理配置，项目未配置时使用全局配置
+func (e *Engine) projectProxy(project *models.Project) string {
+	if project.Proxy != "" {
+		return project.Proxy
+	}
+	return e.proxy
+}
+
+// describeProxy 返回请求实际使用的代理（隐藏密码），用于刷新日志
+func (e *Engine) describeProxy(project *models.Project, req *http.Request) string {
+	proxy, err := proxyFunc(e.projectProxy(project))
+	if err != nil {
+		return ""
+	}
+	if proxy == nil {
+		return ProxyDirect
+	}
+	u, err := proxy(req)
+	if err != nil || u == nil {
+		return ProxyDirect
+	}
+	return u.Redacted()
+}
+
+// ValidateProxy 校验代理配置：空值、direct或http(s)/socks5代理URL
+func ValidateProxy(proxy string) error {
+	_, err := parseProxy(proxy)
+	return err
+}
+
+// proxyFunc 返回Transport的代理函数。空值使用环境变量，direct返回nil
+func proxyFunc(proxy string) (func(*http.Request) (*url.URL, error), error) {
+	if proxy == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+	u, err := parseProxy(proxy)
+	if err != nil || u == nil {
+		return nil, err
+	}
+	return http.ProxyURL(u), nil
+}
+
+// parseProxy 解析代理URL，空值和direct返回nil
+func parseProxy(proxy string) (*url.URL, error) {
+	if proxy == "" || proxy == ProxyDirect {
+		return nil, nil
+	}
+	u, err := url.Parse(proxy)
+	if err != nil {
+		// url.Error包含完整的URL，可能带有代理密码
+		if urlErr, ok := err.(*url.Error); ok {
+			err = urlErr.Err
+		}
+		return nil, fmt.Errorf("invalid proxy url: %w", err)
+	}
+	if !proxySchemes[u.Scheme] || u.Host == "" {
+		return nil, fmt.Errorf("proxy must be %q or an http, https or socks5 url", ProxyDirect)
+	}
+	return u, nil
+}
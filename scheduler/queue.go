@@ -0,0 +1,120 @@
+package scheduler
+
+import (
+	"jwt_refresher/models"
+	"jwt_refresher/refresher"
+	"sort"
+	"sync"
+	"time"
+)
+
+// job 一个等待执行的刷新任务
+type job struct {
+	project *models.Project
+	host    string
+	// 优先级：token过期时间越早越优先，没有token的项目最优先
+	priority time.Time
+}
+
+func newJob(project *models.Project) *job {
+	j := &job{project: project, host: refresher.RefreshHost(project)}
+	if project.CurrentAccessToken != "" && project.TokenExpiresAt.Valid {
+		j.priority = project.TokenExpiresAt.Time
+	}
+	return j
+}
+
+// workQueue 按优先级排序的刷新队列，同时限制每个上游主机的并发数
+type workQueue struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	jobs       []*job
+	queued     map[int64]bool
+	hostActive map[string]int
+	perHost    int
+	closed     bool
+}
+
+func newWorkQueue(perHost int) *workQueue {
+	q := &workQueue{
+		queued:     make(map[int64]bool),
+		hostActive: make(map[string]int),
+		perHost:    perHost,
+	}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// push 加入队列，项目已在队列中时返回false
+func (q *workQueue) push(j *job) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed || q.queued[j.project.ID] {
+		return false
+	}
+	i := sort.Search(len(q.jobs), func(i int) bool {
+		return q.jobs[i].priority.After(j.priority)
+	})
+	q.jobs = append(q.jobs, nil)
+	copy(q.jobs[i+1:], q.jobs[i:])
+	q.jobs[i] = j
+	q.queued[j.project.ID] = true
+
+	q.cond.Broadcast()
+	return true
+}
+
+// next 阻塞直到有主机并发未满的任务可执行，队列关闭后返回false
+func (q *workQueue) next() (*job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for {
+		if q.closed {
+			return nil, false
+		}
+		for i, j := range q.jobs {
+			if q.perHost > 0 && q.hostActive[j.host] >= q.perHost {
+				continue
+			}
+			q.jobs = append(q.jobs[:i], q.jobs[i+1:]...)
+			delete(q.queued, j.project.ID)
+			q.hostActive[j.host]++
+			return j, true
+		}
+		q.cond.Wait()
+	}
+}
+
+// done 释放任务占用的主机并发
+func (q *workQueue) done(j *job) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.hostActive[j.host]--
+	if q.hostActive[j.host] <= 0 {
+		delete(q.hostActive, j.host)
+	}
+	q.cond.Broadcast()
+}
+
+// close 停止分发任务，未执行的任务被丢弃（下次启动时重新调度）
+func (q *workQueue) close() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	dropped := len(q.jobs)
+	q.closed = true
+	q.jobs = nil
+	q.cond.Broadcast()
+	return dropped
+}
+
+// size 返回排队中的任务数
+func (q *workQueue) size() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.jobs)
+}
@@ -0,0 +1,209 @@
+package scheduler
+
+import (
+	"database/sql"
+	"jwt_refresher/models"
+	"testing"
+	"time"
+)
+
+func TestNewJob(t *testing.T) {
+	expires := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name         string
+		project      models.Project
+		wantHost     string
+		wantPriority time.Time
+	}{
+		{
+			name: "priority is token expiry",
+			project: models.Project{
+				RefreshURL:         "https://auth.example.com/oauth/token",
+				CurrentAccessToken: "tok",
+				TokenExpiresAt:     sql.NullTime{Time: expires, Valid: true},
+			},
+			wantHost:     "auth.example.com",
+			wantPriority: expires,
+		},
+		{
+			name: "project without token goes first",
+			project: models.Project{
+				RefreshURL:     "https://auth.example.com:8443/token",
+				TokenExpiresAt: sql.NullTime{Time: expires, Valid: true},
+			},
+			wantHost: "auth.example.com:8443",
+		},
+		{
+			name: "templated url",
+			project: models.Project{
+				RefreshURL:      "https://{{.tenant}}.example.com/token",
+				CustomVariables: `{"tenant":"acme"}`,
+			},
+			wantHost: "acme.example.com",
+		},
+		{
+			name:    "invalid template",
+			project: models.Project{RefreshURL: "https://{{.tenant"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			j := newJob(&tt.project)
+			if j.host != tt.wantHost {
+				t.Errorf("host = %q, want %q", j.host, tt.wantHost)
+			}
+			if !j.priority.Equal(tt.wantPriority) {
+				t.Errorf("priority = %v, want %v", j.priority, tt.wantPriority)
+			}
+		})
+	}
+}
+
+func testJob(id int64, host string, priority int) *job {
+	return &job{
+		project:  &models.Project{ID: id},
+		host:     host,
+		priority: time.Unix(int64(priority), 0),
+	}
+}
+
+func TestWorkQueueOrder(t *testing.T) {
+	tests := []struct {
+		name    string
+		perHost int
+		jobs    []*job
+		// 不调用done，依次取出的项目ID
+		want []int64
+	}{
+		{
+			name:    "earliest priority first",
+			perHost: 0,
+			jobs:    []*job{testJob(1, "a", 30), testJob(2, "a", 10), testJob(3, "b", 20)},
+			want:    []int64{2, 3, 1},
+		},
+		{
+			name:    "equal priority keeps insertion order",
+			perHost: 0,
+			jobs:    []*job{testJob(1, "a", 10), testJob(2, "b", 10), testJob(3, "c", 10)},
+			want:    []int64{1, 2, 3},
+		},
+		{
+			name:    "busy host is skipped",
+			perHost: 1,
+			jobs:    []*job{testJob(1, "a", 10), testJob(2, "a", 20), testJob(3, "b", 30)},
+			want:    []int64{1, 3},
+		},
+		{
+			name:    "per host limit of two",
+			perHost: 2,
+			jobs:    []*job{testJob(1, "a", 10), testJob(2, "a", 20), testJob(3, "a", 30), testJob(4, "b", 40)},
+			want:    []int64{1, 2, 4},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newWorkQueue(tt.perHost)
+			for _, j := range tt.jobs {
+				if !q.push(j) {
+					t.Fatalf("push(%d) = false", j.project.ID)
+				}
+			}
+
+			for _, want := range tt.want {
+				j, ok := q.next()
+				if !ok {
+					t.Fatalf("next() ok = false, want project %d", want)
+				}
+				if j.project.ID != want {
+					t.Fatalf("next() = project %d, want %d", j.project.ID, want)
+				}
+			}
+
+			if size := q.size(); size != len(tt.jobs)-len(tt.want) {
+				t.Errorf("size() = %d, want %d", size, len(tt.jobs)-len(tt.want))
+			}
+			if dropped := q.close(); dropped != len(tt.jobs)-len(tt.want) {
+				t.Errorf("close() dropped %d, want %d", dropped, len(tt.jobs)-len(tt.want))
+			}
+		})
+	}
+}
+
+func TestWorkQueuePushDuplicate(t *testing.T) {
+	q := newWorkQueue(0)
+	if !q.push(testJob(1, "a", 10)) {
+		t.Fatal("push() = false, want true")
+	}
+	if q.push(testJob(1, "a", 5)) {
+		t.Error("push() of a queued project = true, want false")
+	}
+
+	// 取出后可以再次加入
+	j, _ := q.next()
+	if !q.push(testJob(1, "a", 10)) {
+		t.Error("push() after next() = false, want true")
+	}
+	q.done(j)
+
+	q.close()
+	if q.push(testJob(2, "a", 10)) {
+		t.Error("push() after close() = true, want false")
+	}
+}
+
+func TestWorkQueueDoneReleasesHost(t *testing.T) {
+	q := newWorkQueue(1)
+	q.push(testJob(1, "a", 10))
+	q.push(testJob(2, "a", 20))
+
+	first, _ := q.next()
+
+	got := make(chan *job, 1)
+	go func() {
+		j, ok := q.next()
+		if ok {
+			got <- j
+		}
+		close(got)
+	}()
+
+	select {
+	case j := <-got:
+		t.Fatalf("next() = project %d while the host is busy", j.project.ID)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	q.done(first)
+	select {
+	case j := <-got:
+		if j == nil || j.project.ID != 2 {
+			t.Fatalf("next() after done() = %v, want project 2", j)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("next() still blocked after done()")
+	}
+}
+
+func TestWorkQueueCloseWakesNext(t *testing.T) {
+	q := newWorkQueue(0)
+
+	done := make(chan bool, 1)
+	go func() {
+		_, ok := q.next()
+		done <- ok
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	q.close()
+	select {
+	case ok := <-done:
+		if ok {
+			t.Error("next() after close() ok = true, want false")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("next() still blocked after close()")
+	}
+}
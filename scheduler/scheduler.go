@@ -1,6 +1,9 @@
 package scheduler
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	"jwt_refresher/database"
 	"jwt_refresher/models"
 	"jwt_refresher/refresher"
@@ -9,38 +12,97 @@ import (
 	"time"
 )
 
+// resyncInterval 定期从数据库重新加载所有项目，兜底直接修改数据库等未通知调度器的变更
+const resyncInterval = 10 * time.Minute
+
+// expiryCheckInterval 检查token即将过期而没有刷新成功、以及需要重新授权的项目的间隔
+const expiryCheckInterval = time.Minute
+
 type Scheduler struct {
-	db       *database.DB
-	engine   *refresher.Engine
-	ticker   *time.Ticker
+	db     *database.DB
+	engine *refresher.Engine
+
+	mu     sync.Mutex
+	timers *timerHeap
+	wakeCh chan struct{}
+
+	// 刷新任务由固定数量的worker执行
+	queue    *workQueue
+	workers  int
+	ctx      context.Context
+	cancel   context.CancelFunc
+	workerWg sync.WaitGroup
+
 	stopCh   chan struct{}
 	wg       sync.WaitGroup
 	stopOnce sync.Once
 }
 
-func NewScheduler(db *database.DB, engine *refresher.Engine) *Scheduler {
+// NewScheduler 创建调度器。maxConcurrent限制全局同时执行的刷新数，
+// maxPerHost限制同一上游主机同时执行的刷新数（<=0表示不限制）
+func NewScheduler(db *database.DB, engine *refresher.Engine, maxConcurrent, maxPerHost int) *Scheduler {
+	if maxConcurrent <= 0 {
+		maxConcurrent = 1
+	}
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Scheduler{
-		db:     db,
-		engine: engine,
-		stopCh: make(chan struct{}),
+		db:      db,
+		engine:  engine,
+		timers:  newTimerHeap(),
+		wakeCh:  make(chan struct{}, 1),
+		queue:   newWorkQueue(maxPerHost),
+		workers: maxConcurrent,
+		ctx:     ctx,
+		cancel:  cancel,
+		stopCh:  make(chan struct{}),
 	}
 }
 
 func (s *Scheduler) Start() {
 	log.Println("Starting scheduler...")
-	s.ticker = time.NewTicker(1 * time.Minute)
+
+	for i := 0; i < s.workers; i++ {
+		s.workerWg.Add(1)
+		go s.worker()
+	}
 
 	s.wg.Add(1)
 	go func() {
 		defer s.wg.Done()
 
-		// 启动时立即执行一次检查
-		s.checkAndRefresh()
+		// 启动时加载所有项目，已到期的会立即刷新
+		s.resync()
+		lastResync := time.Now()
+
+		timer := time.NewTimer(0)
+		defer timer.Stop()
 
 		for {
+			// 睡眠到最早的到期时间（最长到下一次全量同步）
+			wait := time.Until(lastResync.Add(resyncInterval))
+			s.mu.Lock()
+			if due, ok := s.timers.peek(); ok {
+				wait = min(wait, time.Until(due))
+			}
+			s.mu.Unlock()
+
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(max(wait, 0))
+
 			select {
-			case <-s.ticker.C:
-				s.checkAndRefresh()
+			case <-timer.C:
+				if time.Since(lastResync) >= resyncInterval {
+					s.resync()
+					lastResync = time.Now()
+				}
+				s.dispatchDue()
+			case <-s.wakeCh:
+				// 定时被修改，重新计算等待时间
 			case <-s.stopCh:
 				log.Println("Scheduler stopped")
 				return
@@ -48,43 +110,177 @@ func (s *Scheduler) Start() {
 		}
 	}()
 
-	log.Println("Scheduler started")
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(expiryCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.checkExpiry()
+			case <-s.stopCh:
+				return
+			}
+		}
+	}()
+
+	log.Printf("Scheduler started with %d workers", s.workers)
 }
 
-func (s *Scheduler) Stop() {
+// Stop 停止调度：不再分发新任务，等待进行中的刷新完成，
+// ctx结束后通过context取消剩余的刷新
+func (s *Scheduler) Stop(ctx context.Context) {
 	s.stopOnce.Do(func() {
 		log.Println("Stopping scheduler...")
-		if s.ticker != nil {
-			s.ticker.Stop()
-		}
 		close(s.stopCh)
 		s.wg.Wait()
+
+		if dropped := s.queue.close(); dropped > 0 {
+			log.Printf("Dropped %d queued refreshes", dropped)
+		}
+
+		drained := make(chan struct{})
+		go func() {
+			s.workerWg.Wait()
+			close(drained)
+		}()
+		select {
+		case <-drained:
+		case <-ctx.Done():
+			log.Println("Timed out waiting for in-flight refreshes, cancelling them")
+			s.cancel()
+			<-drained
+		}
+		s.cancel()
 		log.Println("Scheduler stopped successfully")
 	})
 }
 
-func (s *Scheduler) checkAndRefresh() {
-	projects, err := s.db.GetEnabledProjects()
+// Reschedule 重新计算项目的下一次刷新时间。项目被创建、修改、启用/禁用或刷新后调用
+func (s *Scheduler) Reschedule(projectID int64) {
+	project, err := s.db.GetProject(s.ctx, projectID)
+	if errors.Is(err, sql.ErrNoRows) {
+		// 项目已删除
+		s.Remove(projectID)
+		return
+	}
 	if err != nil {
-		log.Printf("Error getting enabled projects: %v", err)
+		log.Printf("Error loading project %d: %v", projectID, err)
 		return
 	}
+	s.schedule(project)
+	s.wake()
+}
+
+// Remove 取消项目的定时
+func (s *Scheduler) Remove(projectID int64) {
+	s.mu.Lock()
+	s.timers.remove(projectID)
+	s.mu.Unlock()
+	s.wake()
+}
+
+// schedule 根据项目状态设置或移除定时
+func (s *Scheduler) schedule(project *models.Project) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	if len(projects) == 0 {
+	if !project.Enabled {
+		s.timers.remove(project.ID)
 		return
 	}
+	next, ok := s.engine.NextRefreshAt(project)
+	if !ok {
+		s.timers.remove(project.ID)
+		return
+	}
+	s.timers.set(project.ID, next)
+}
+
+func (s *Scheduler) wake() {
+	select {
+	case s.wakeCh <- struct{}{}:
+	default:
+	}
+}
 
-	log.Printf("Checking %d enabled projects for refresh...", len(projects))
+// resync 从数据库重新加载所有启用的项目并重建定时
+func (s *Scheduler) resync() {
+	projects, err := s.db.GetEnabledProjects(s.ctx)
+	if err != nil {
+		log.Printf("Error getting enabled projects: %v", err)
+		return
+	}
+
+	s.mu.Lock()
+	s.timers = newTimerHeap()
+	s.mu.Unlock()
 
 	for _, project := range projects {
-		if s.engine.ShouldRefresh(project) {
-			log.Printf("Project %s (ID: %d) needs refresh", project.Name, project.ID)
-			// 在goroutine中执行刷新，避免阻塞
-			go func(p *models.Project) {
-				if err := s.engine.Refresh(p); err != nil {
-					log.Printf("Error refreshing project %s (ID: %d): %v", p.Name, p.ID, err)
-				}
-			}(project)
+		s.schedule(project)
+	}
+	log.Printf("Scheduled %d enabled projects", len(projects))
+}
+
+// dispatchDue 将所有已到期的项目加入刷新队列
+func (s *Scheduler) dispatchDue() {
+	s.mu.Lock()
+	due := s.timers.popDue(time.Now())
+	s.mu.Unlock()
+
+	for _, id := range due {
+		project, err := s.db.GetProject(s.ctx, id)
+		if err != nil {
+			log.Printf("Error loading project %d: %v", id, err)
+			continue
+		}
+
+		// 已有刷新在执行（如手动刷新）时跳过，刷新结束后会重新安排
+		if s.engine.IsRefreshing(project.ID) {
+			continue
+		}
+		if !project.Enabled || !s.engine.ShouldRefresh(project) {
+			s.schedule(project)
+			continue
+		}
+
+		if s.queue.push(newJob(project)) {
+			log.Printf("Project %s (ID: %d) needs refresh, queued (%d waiting)", project.Name, project.ID, s.queue.size())
+		}
+	}
+}
+
+// checkExpiry 让刷新引擎对即将过期而没有刷新成功、以及仍需要重新授权的项目发送通知
+func (s *Scheduler) checkExpiry() {
+	projects, err := s.db.GetEnabledProjects(s.ctx)
+	if err != nil {
+		log.Printf("Error getting enabled projects: %v", err)
+		return
+	}
+	for _, project := range projects {
+		s.engine.CheckExpiry(project)
+		s.engine.CheckReauth(project)
+	}
+}
+
+// worker 从队列中取出任务并执行刷新
+func (s *Scheduler) worker() {
+	defer s.workerWg.Done()
+
+	for {
+		j, ok := s.queue.next()
+		if !ok {
+			return
+		}
+
+		p := j.project
+		if err := s.engine.Refresh(s.ctx, p); err != nil {
+			log.Printf("Error refreshing project %s (ID: %d): %v", p.Name, p.ID, err)
+		}
+		s.queue.done(j)
+		if s.ctx.Err() == nil {
+			s.Reschedule(p.ID)
 		}
 	}
 }
@@ -0,0 +1,77 @@
+package scheduler
+
+import (
+	"context"
+	"jwt_refresher/database"
+	"jwt_refresher/models"
+	"jwt_refresher/pubsub"
+	"jwt_refresher/refresher"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDispatchSkipsRefreshing(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+		w.Write([]byte(`{"access_token":"at-1","expires_in":3600}`))
+	}))
+	defer upstream.Close()
+
+	db, err := database.InitDB(filepath.Join(t.TempDir(), "test.db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	engine := refresher.NewEngine(db, "", nil, pubsub.New())
+	defer engine.Stop(context.Background())
+	defer close(release)
+	s := NewScheduler(db, engine, 1, 0)
+
+	ctx := context.Background()
+	var projects []*models.Project
+	for _, name := range []string{"busy", "idle"} {
+		p := &models.Project{
+			Name:             name,
+			Enabled:          true,
+			RefreshURL:       upstream.URL,
+			RefreshMethod:    "POST",
+			AccessTokenPath:  "access_token",
+			RetryMaxAttempts: 1,
+		}
+		if err := db.CreateProject(ctx, p); err != nil {
+			t.Fatal(err)
+		}
+		projects = append(projects, p)
+	}
+	busy, idle := projects[0], projects[1]
+
+	// 手动刷新正在执行
+	go engine.Refresh(ctx, busy)
+	for i := 0; !engine.IsRefreshing(busy.ID); i++ {
+		if i > 400 {
+			t.Fatal("refresh did not start")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	s.mu.Lock()
+	s.timers.set(busy.ID, time.Now())
+	s.timers.set(idle.ID, time.Now())
+	s.mu.Unlock()
+	s.dispatchDue()
+
+	if got := s.queue.size(); got != 1 {
+		t.Fatalf("queue size = %d, want 1", got)
+	}
+	j, ok := s.queue.next()
+	if !ok || j.project.ID != idle.ID {
+		t.Errorf("queued %+v, want project %d", j, idle.ID)
+	}
+}
@@ -0,0 +1,86 @@
+package scheduler
+
+import (
+	"container/heap"
+	"time"
+)
+
+// timerItem 一个项目的下一次刷新时间
+type timerItem struct {
+	projectID int64
+	due       time.Time
+	index     int
+}
+
+// timerHeap 按到期时间排序的最小堆，并按项目ID索引以便更新和删除
+type timerHeap struct {
+	items []*timerItem
+	byID  map[int64]*timerItem
+}
+
+func newTimerHeap() *timerHeap {
+	return &timerHeap{byID: make(map[int64]*timerItem)}
+}
+
+func (h *timerHeap) Len() int           { return len(h.items) }
+func (h *timerHeap) Less(i, j int) bool { return h.items[i].due.Before(h.items[j].due) }
+
+func (h *timerHeap) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+	h.items[i].index = i
+	h.items[j].index = j
+}
+
+func (h *timerHeap) Push(x any) {
+	item := x.(*timerItem)
+	item.index = len(h.items)
+	h.items = append(h.items, item)
+}
+
+func (h *timerHeap) Pop() any {
+	n := len(h.items)
+	item := h.items[n-1]
+	h.items[n-1] = nil
+	h.items = h.items[:n-1]
+	item.index = -1
+	return item
+}
+
+// set 设置或更新项目的到期时间
+func (h *timerHeap) set(projectID int64, due time.Time) {
+	if item, ok := h.byID[projectID]; ok {
+		item.due = due
+		heap.Fix(h, item.index)
+		return
+	}
+	item := &timerItem{projectID: projectID, due: due}
+	h.byID[projectID] = item
+	heap.Push(h, item)
+}
+
+// remove 移除项目的定时
+func (h *timerHeap) remove(projectID int64) {
+	if item, ok := h.byID[projectID]; ok {
+		heap.Remove(h, item.index)
+		delete(h.byID, projectID)
+	}
+}
+
+// peek 返回最早的到期时间
+func (h *timerHeap) peek() (time.Time, bool) {
+	if len(h.items) == 0 {
+		return time.Time{}, false
+	}
+	return h.items[0].due, true
+}
+
+// popDue 取出所有在now之前到期的项目
+func (h *timerHeap) popDue(now time.Time) []int64 {
+	var ids []int64
+	for len(h.items) > 0 && !h.items[0].due.After(now) {
+		item := heap.Pop(h).(*timerItem)
+		delete(h.byID, item.projectID)
+		ids = append(ids, item.projectID)
+	}
+	return ids
+}
@@ -0,0 +1,100 @@
+package scheduler
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTimerHeap(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(sec int) time.Time { return base.Add(time.Duration(sec) * time.Second) }
+
+	type op struct {
+		set    map[int64]int
+		remove []int64
+	}
+
+	tests := []struct {
+		name     string
+		ops      []op
+		now      int
+		wantDue  []int64
+		wantPeek int
+		wantLeft int
+	}{
+		{
+			name:     "pops due timers in order",
+			ops:      []op{{set: map[int64]int{1: 30, 2: 10, 3: 20}}},
+			now:      20,
+			wantDue:  []int64{2, 3},
+			wantPeek: 30,
+			wantLeft: 1,
+		},
+		{
+			name:     "timer due exactly now is popped",
+			ops:      []op{{set: map[int64]int{1: 10}}},
+			now:      10,
+			wantDue:  []int64{1},
+			wantLeft: 0,
+		},
+		{
+			name: "set updates an existing timer",
+			ops: []op{
+				{set: map[int64]int{1: 10, 2: 20}},
+				{set: map[int64]int{1: 40}},
+			},
+			now:      25,
+			wantDue:  []int64{2},
+			wantPeek: 40,
+			wantLeft: 1,
+		},
+		{
+			name: "remove drops the timer",
+			ops: []op{
+				{set: map[int64]int{1: 10, 2: 20, 3: 30}},
+				{remove: []int64{2, 99}},
+			},
+			now:      30,
+			wantDue:  []int64{1, 3},
+			wantLeft: 0,
+		},
+		{
+			name:     "nothing due",
+			ops:      []op{{set: map[int64]int{1: 50}}},
+			now:      10,
+			wantPeek: 50,
+			wantLeft: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTimerHeap()
+			for _, o := range tt.ops {
+				for id, sec := range o.set {
+					h.set(id, at(sec))
+				}
+				for _, id := range o.remove {
+					h.remove(id)
+				}
+			}
+
+			got := h.popDue(at(tt.now))
+			if !reflect.DeepEqual(got, tt.wantDue) {
+				t.Errorf("popDue() = %v, want %v", got, tt.wantDue)
+			}
+			if h.Len() != tt.wantLeft || len(h.byID) != tt.wantLeft {
+				t.Errorf("after popDue() Len() = %d, byID = %d, want %d", h.Len(), len(h.byID), tt.wantLeft)
+			}
+
+			due, ok := h.peek()
+			if ok != (tt.wantLeft > 0) {
+				t.Fatalf("peek() ok = %v, want %v", ok, tt.wantLeft > 0)
+			}
+			if ok && !due.Equal(at(tt.wantPeek)) {
+				t.Errorf("peek() = %v, want %v", due, at(tt.wantPeek))
+			}
+		})
+	}
+}
@@ -1,5 +1,7 @@
 const API_BASE = '/api';
 let currentProjectId = null;
+let currentProjectETag = null; // 编辑中项目的ETag，保存时用于检测并发修改
+let loadedRefreshToken = null; // 编辑表单加载时的refresh token，未修改时不提交
 
 // 页面加载时初始化
 document.addEventListener('DOMContentLoaded', () => {
@@ -24,7 +26,10 @@ function showCreateForm() {
     document.getElementById('view-detail').classList.add('hidden');
     document.getElementById('form-title').textContent = '新建项目';
     document.getElementById('project-form').reset();
+    document.getElementById('dry-run-result').classList.add('hidden');
     document.getElementById('project-id').value = '';
+    updateProjectTypeFields();
+    updateExpiresLayoutField();
 
     // 设置AWS OIDC示例
     document.getElementById('refresh_headers').value = '{"Content-Type": "application/json"}';
@@ -37,21 +42,67 @@ function showEditForm(project) {
     document.getElementById('view-form').classList.remove('hidden');
     document.getElementById('view-detail').classList.add('hidden');
     document.getElementById('form-title').textContent = '编辑项目';
+    document.getElementById('dry_run_sample').value = '';
+    document.getElementById('dry-run-result').classList.add('hidden');
 
     // 填充表单
     document.getElementById('project-id').value = project.id;
     document.getElementById('name').value = project.name;
     document.getElementById('description').value = project.description || '';
+    document.getElementById('project_type').value = project.project_type || 'custom';
     document.getElementById('refresh_url').value = project.refresh_url;
     document.getElementById('refresh_method').value = project.refresh_method;
     document.getElementById('refresh_headers').value = project.refresh_headers || '';
     document.getElementById('refresh_body_template').value = project.refresh_body_template || '';
+    document.getElementById('refresh_steps').value = project.refresh_steps || '';
+    document.getElementById('oauth2_client_id').value = project.oauth2_client_id || '';
+    document.getElementById('oauth2_client_secret').value = project.oauth2_client_secret || '';
+    document.getElementById('oauth2_scope').value = project.oauth2_scope || '';
+    document.getElementById('oauth2_audience').value = project.oauth2_audience || '';
+    document.getElementById('oauth2_client_auth').value = project.oauth2_client_auth || 'basic';
+    document.getElementById('oauth2_body_format').value = project.oauth2_body_format || 'form';
+    document.getElementById('response_format').value = project.response_format || 'auto';
     document.getElementById('access_token_path').value = project.access_token_path;
-    document.getElementById('refresh_token_path').value = project.refresh_token_path;
+    document.getElementById('refresh_token_path').value = project.refresh_token_path || '';
     document.getElementById('expires_in_path').value = project.expires_in_path || '';
+    document.getElementById('expires_format').value = project.expires_format || 'seconds';
+    document.getElementById('expires_layout').value = project.expires_layout || '';
+    document.getElementById('output_rules').value = project.output_rules || '';
     document.getElementById('custom_variables').value = project.custom_variables || '';
     document.getElementById('current_refresh_token').value = project.current_refresh_token || '';
+    loadedRefreshToken = project.current_refresh_token || '';
     document.getElementById('refresh_before_seconds').value = project.refresh_before_seconds;
+    document.getElementById('request_timeout_seconds').value = project.request_timeout_seconds;
+    document.getElementById('retry_max_attempts').value = project.retry_max_attempts;
+    document.getElementById('retry_base_delay_ms').value = project.retry_base_delay_ms;
+    document.getElementById('retry_jitter').value = project.retry_jitter;
+    document.getElementById('retry_on').value = project.retry_on || '';
+    document.getElementById('circuit_breaker_threshold').value = project.circuit_breaker_threshold;
+    document.getElementById('circuit_breaker_cooldown_seconds').value = project.circuit_breaker_cooldown_seconds;
+    document.getElementById('error_matchers').value = project.error_matchers || '';
+    document.getElementById('tls_client_cert').value = project.tls_client_cert || '';
+    document.getElementById('tls_client_key').value = project.tls_client_key || '';
+    document.getElementById('tls_ca_bundle').value = project.tls_ca_bundle || '';
+    document.getElementById('tls_server_name').value = project.tls_server_name || '';
+    document.getElementById('tls_min_version').value = project.tls_min_version || '';
+    document.getElementById('tls_insecure_skip_verify').checked = !!project.tls_insecure_skip_verify;
+    document.getElementById('proxy').value = project.proxy || '';
+    updateProjectTypeFields();
+    updateExpiresLayoutField();
+}
+
+// 自定义时间格式时显示layout输入框
+function updateExpiresLayoutField() {
+    const isLayout = document.getElementById('expires_format').value === 'layout';
+    document.getElementById('expires-layout-field').classList.toggle('hidden', !isLayout);
+}
+
+// 根据项目类型切换表单字段：OAuth2类型自动构建请求，token路径可留空
+function updateProjectTypeFields() {
+    const isOAuth2 = document.getElementById('project_type').value !== 'custom';
+    document.getElementById('oauth2-fields').classList.toggle('hidden', !isOAuth2);
+    document.querySelectorAll('.custom-only').forEach(el => el.classList.toggle('hidden', isOAuth2));
+    document.getElementById('access_token_path').required = !isOAuth2;
 }
 
 // 显示项目详情
@@ -84,12 +135,43 @@ async function showDetail(projectId) {
 
         if (project.last_refresh_at && project.last_refresh_at.Valid) {
             const lastRefresh = new Date(project.last_refresh_at.Time);
-            document.getElementById('detail-last-refresh').textContent =
-                `${lastRefresh.toLocaleString()} - ${project.last_refresh_status}`;
+            let lastStatus = `${lastRefresh.toLocaleString()} - ${project.last_refresh_status}`;
+            if (project.consecutive_failures > 0) {
+                lastStatus += ` (连续失败 ${project.consecutive_failures} 次)`;
+            }
+            if (project.circuit_open_until && project.circuit_open_until.Valid &&
+                new Date(project.circuit_open_until.Time) > new Date()) {
+                lastStatus += `，熔断至 ${new Date(project.circuit_open_until.Time).toLocaleString()}`;
+            }
+            document.getElementById('detail-last-refresh').textContent = lastStatus;
         } else {
             document.getElementById('detail-last-refresh').textContent = '从未刷新';
         }
 
+        document.getElementById('detail-reauth').classList.toggle('hidden', project.last_refresh_status !== 'needs_reauth');
+
+        // 显示提取的额外输出
+        const hasOutputs = token.outputs && Object.keys(token.outputs).length > 0;
+        document.getElementById('detail-outputs').classList.toggle('hidden', !hasOutputs);
+        if (hasOutputs) {
+            document.getElementById('detail-outputs-content').textContent = JSON.stringify(token.outputs, null, 2);
+        }
+
+        // access token是JWT时显示解码后的header和claims
+        let jwt = null;
+        if (token.access_token) {
+            try {
+                jwt = await fetchAPI(`/projects/${projectId}/token/claims`);
+            } catch (e) {
+                jwt = null;
+            }
+        }
+        document.getElementById('detail-jwt').classList.toggle('hidden', !jwt);
+        if (jwt) {
+            document.getElementById('detail-jwt-content').textContent =
+                JSON.stringify({ header: jwt.header, claims: jwt.claims }, null, 2);
+        }
+
         // 显示日志（只显示最近10条）
         renderLogs(logs);
     } catch (error) {
@@ -111,8 +193,11 @@ function renderLogs(logs) {
                     </span>
                     <span class="text-sm text-gray-500">${new Date(log.refresh_at).toLocaleString()}</span>
                 </div>
+                ${log.failed_step ? `<p class="text-sm text-red-600 mt-1">失败步骤: ${log.failed_step}</p>` : ''}
                 ${log.error_message ? `<p class="text-sm text-red-600 mt-1">错误: ${truncate(log.error_message, 100)}</p>` : ''}
                 ${log.new_token_preview ? `<p class="text-sm text-gray-600 mt-1">新Access Token: ${log.new_token_preview}...</p>` : ''}
+                ${log.proxy ? `<p class="text-sm text-gray-500 mt-1">代理: ${log.proxy}</p>` : ''}
+                ${(log.sinks || []).map(sink => `<p class="text-sm ${sink.status === 'success' ? 'text-gray-500' : 'text-red-600'} mt-1">推送 ${sink.sink_name} (${sink.sink_type}): ${sink.status === 'success' ? '成功' : '失败 ' + truncate(sink.error, 100)}</p>`).join('')}
             </div>
         `).join('');
 
@@ -147,8 +232,11 @@ async function loadMoreLogs() {
                     </span>
                     <span class="text-sm text-gray-500">${new Date(log.refresh_at).toLocaleString()}</span>
                 </div>
+                ${log.failed_step ? `<p class="text-sm text-red-600 mt-1">失败步骤: ${log.failed_step}</p>` : ''}
                 ${log.error_message ? `<p class="text-sm text-red-600 mt-1">错误: ${truncate(log.error_message, 100)}</p>` : ''}
                 ${log.new_token_preview ? `<p class="text-sm text-gray-600 mt-1">新Access Token: ${log.new_token_preview}...</p>` : ''}
+                ${log.proxy ? `<p class="text-sm text-gray-500 mt-1">代理: ${log.proxy}</p>` : ''}
+                ${(log.sinks || []).map(sink => `<p class="text-sm ${sink.status === 'success' ? 'text-gray-500' : 'text-red-600'} mt-1">推送 ${sink.sink_name} (${sink.sink_type}): ${sink.status === 'success' ? '成功' : '失败 ' + truncate(sink.error, 100)}</p>`).join('')}
             </div>
         `).join('');
 
@@ -225,6 +313,19 @@ function getProjectStatus(project) {
         return { text: '已禁用', class: 'status-disabled' };
     }
 
+    if (project.refreshing) {
+        return { text: '刷新中', class: 'status-warning' };
+    }
+
+    if (project.last_refresh_status === 'needs_reauth') {
+        return { text: '需重新授权', class: 'status-error' };
+    }
+
+    if (project.circuit_open_until && project.circuit_open_until.Valid &&
+        new Date(project.circuit_open_until.Time) > new Date()) {
+        return { text: '熔断中', class: 'status-error' };
+    }
+
     if (!project.token_expires_at || !project.token_expires_at.Valid) {
         return { text: '未刷新', class: 'status-warning' };
     }
@@ -243,28 +344,65 @@ function getProjectStatus(project) {
 }
 
 // 表单提交处理
-async function handleFormSubmit(e) {
-    e.preventDefault();
-
-    const projectId = document.getElementById('project-id').value;
-    const data = {
+// 读取表单中的项目配置
+function getFormData() {
+    return {
         name: document.getElementById('name').value,
         description: document.getElementById('description').value,
+        project_type: document.getElementById('project_type').value,
         refresh_url: document.getElementById('refresh_url').value,
         refresh_method: document.getElementById('refresh_method').value,
         refresh_headers: document.getElementById('refresh_headers').value,
         refresh_body_template: document.getElementById('refresh_body_template').value,
+        refresh_steps: document.getElementById('refresh_steps').value,
+        oauth2_client_id: document.getElementById('oauth2_client_id').value,
+        oauth2_client_secret: document.getElementById('oauth2_client_secret').value,
+        oauth2_scope: document.getElementById('oauth2_scope').value,
+        oauth2_audience: document.getElementById('oauth2_audience').value,
+        oauth2_client_auth: document.getElementById('oauth2_client_auth').value,
+        oauth2_body_format: document.getElementById('oauth2_body_format').value,
+        response_format: document.getElementById('response_format').value,
         access_token_path: document.getElementById('access_token_path').value,
         refresh_token_path: document.getElementById('refresh_token_path').value,
         expires_in_path: document.getElementById('expires_in_path').value,
+        expires_format: document.getElementById('expires_format').value,
+        expires_layout: document.getElementById('expires_layout').value,
+        output_rules: document.getElementById('output_rules').value,
         custom_variables: document.getElementById('custom_variables').value,
         current_refresh_token: document.getElementById('current_refresh_token').value,
         refresh_before_seconds: parseInt(document.getElementById('refresh_before_seconds').value),
+        request_timeout_seconds: parseInt(document.getElementById('request_timeout_seconds').value),
+        retry_max_attempts: parseInt(document.getElementById('retry_max_attempts').value),
+        retry_base_delay_ms: parseInt(document.getElementById('retry_base_delay_ms').value),
+        retry_jitter: parseFloat(document.getElementById('retry_jitter').value),
+        retry_on: document.getElementById('retry_on').value,
+        circuit_breaker_threshold: parseInt(document.getElementById('circuit_breaker_threshold').value),
+        circuit_breaker_cooldown_seconds: parseInt(document.getElementById('circuit_breaker_cooldown_seconds').value),
+        error_matchers: document.getElementById('error_matchers').value,
+        tls_client_cert: document.getElementById('tls_client_cert').value,
+        tls_client_key: document.getElementById('tls_client_key').value,
+        tls_ca_bundle: document.getElementById('tls_ca_bundle').value,
+        tls_server_name: document.getElementById('tls_server_name').value,
+        tls_min_version: document.getElementById('tls_min_version').value,
+        tls_insecure_skip_verify: document.getElementById('tls_insecure_skip_verify').checked,
+        proxy: document.getElementById('proxy').value,
     };
+}
+
+async function handleFormSubmit(e) {
+    e.preventDefault();
+
+    const projectId = document.getElementById('project-id').value;
+    const data = getFormData();
 
     try {
         if (projectId) {
-            await fetchAPI(`/projects/${projectId}`, 'PUT', data);
+            // refresh token在编辑期间可能已被刷新轮换，未修改时不提交，避免覆盖为旧值
+            if (data.current_refresh_token === loadedRefreshToken) {
+                delete data.current_refresh_token;
+            }
+            const headers = currentProjectETag ? { 'If-Match': currentProjectETag } : {};
+            await fetchAPI(`/projects/${projectId}`, 'PATCH', data, headers);
             showToast('项目更新成功');
         } else {
             await fetchAPI('/projects', 'POST', data);
@@ -276,11 +414,34 @@ async function handleFormSubmit(e) {
     }
 }
 
+// 试运行：渲染将要发送的请求，并对示例响应执行提取规则
+async function dryRunProject() {
+    const projectId = document.getElementById('project-id').value;
+    const data = { project: getFormData() };
+    const sample = document.getElementById('dry_run_sample').value;
+    if (sample) {
+        data.sample_response = { body: sample };
+    }
+
+    const resultEl = document.getElementById('dry-run-result');
+    try {
+        const result = await fetchAPI(projectId ? `/projects/${projectId}/dry-run` : '/projects/dry-run', 'POST', data);
+        resultEl.textContent = JSON.stringify(result, null, 2);
+    } catch (error) {
+        resultEl.textContent = '试运行失败: ' + error.message;
+    }
+    resultEl.classList.remove('hidden');
+}
+
 // 编辑项目
 async function editProject(projectId) {
     try {
-        const project = await fetchAPI(`/projects/${projectId}`);
-        showEditForm(project);
+        const response = await fetch(`${API_BASE}/projects/${projectId}`);
+        if (!response.ok) {
+            throw new Error((await response.json()).error || 'Request failed');
+        }
+        currentProjectETag = response.headers.get('ETag');
+        showEditForm(await response.json());
     } catch (error) {
         showToast('加载项目失败: ' + error.message, 'error');
     }
@@ -324,6 +485,22 @@ async function refreshProject(projectId) {
     }
 }
 
+// 重新授权（提供新的Refresh Token）
+async function reauthorizeProject() {
+    if (!currentProjectId) return;
+
+    const refreshToken = prompt('请输入新的Refresh Token');
+    if (!refreshToken) return;
+
+    try {
+        await fetchAPI(`/projects/${currentProjectId}/reauthorize`, 'POST', { refresh_token: refreshToken });
+        showToast('重新授权成功');
+        showDetail(currentProjectId);
+    } catch (error) {
+        showToast('重新授权失败: ' + error.message, 'error');
+    }
+}
+
 // 复制Token
 function copyToken(type) {
     const inputId = type === 'refresh' ? 'detail-refresh-token' : 'detail-access-token';
@@ -335,11 +512,12 @@ function copyToken(type) {
 }
 
 // API请求封装
-async function fetchAPI(endpoint, method = 'GET', data = null) {
+async function fetchAPI(endpoint, method = 'GET', data = null, headers = {}) {
     const options = {
         method,
         headers: {
             'Content-Type': 'application/json',
+            ...headers,
         },
     };
 
@@ -351,6 +529,11 @@ async function fetchAPI(endpoint, method = 'GET', data = null) {
 
     if (!response.ok) {
         const error = await response.json();
+        // 校验失败时列出各字段的错误
+        if (error.fields) {
+            const details = Object.entries(error.fields).map(([field, msg]) => `${field}: ${msg}`).join('; ');
+            throw new Error(`${error.error} (${details})`);
+        }
         throw new Error(error.error || 'Request failed');
     }
 